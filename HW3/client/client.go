@@ -1,42 +1,111 @@
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"net"
-	"net/http"
-	"net/http/httputil"
-	"net/url"
+	"os"
+	"sync"
+	"time"
 )
 
 var serverHost = flag.String("host", "127.0.0.1", "Host of the server")
 var serverPort = flag.String("port", "8081", "Port of the server")
-var fileName = flag.String("file", "README.md", "Name of the file")
+var fileName = flag.String("file", "README.md", "Name of the file, more files can be given as arguments")
+var manifest = flag.String("manifest", "", "File with the names of the files to download, one per line")
+var outDir = flag.String("out", "downloads", "Directory to save the files to")
+var connections = flag.Int("conns", 4, "Number of connections used at once")
+var repeat = flag.Int("repeat", 1, "How many times to download the list (for load testing)")
+var discard = flag.Bool("discard", false, "Do not save the files, only measure the speed")
 
 func main() {
 	flag.Parse()
-	correctURL := fmt.Sprintf("%s:%s", *serverHost, *serverPort)
-	filenameURL := url.URL{Host: correctURL, Path: fmt.Sprintf("/%s", *fileName)}
-	conn, err := net.Dial("tcp", correctURL)
-	if err != nil {
-		panic(err)
-	}
-	req := http.Request{Method: "GET", URL: &filenameURL}
-	dumpRequest, err := httputil.DumpRequest(&req, false)
-	if err != nil {
-		panic(err)
-	}
-	_, err = conn.Write(dumpRequest)
-	if err != nil {
-		panic(err)
-	}
-	resp, err := http.ReadResponse(bufio.NewReader(conn), &req)
-	if err != nil {
-		panic(err)
-	}
-	body, _ := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
-	fmt.Println(string(body))
+	names := []string{*fileName}
+	if *manifest != "" {
+		var err error
+		if names, err = readManifest(*manifest); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if flag.NArg() > 0 {
+		names = flag.Args()
+	}
+	if *connections < 1 {
+		*connections = 1
+	}
+	// Two workers must not write the same file at once
+	if !*discard {
+		if *repeat > 1 {
+			fmt.Fprintln(os.Stderr, "-repeat needs -discard")
+			os.Exit(2)
+		}
+		names = unique(names)
+	}
+
+	jobs := make(chan string)
+	go func() {
+		for i := 0; i < *repeat; i++ {
+			for _, name := range names {
+				jobs <- name
+			}
+		}
+		close(jobs)
+	}()
+
+	// Every worker keeps its own connection and downloads the files one after another
+	results := make(chan result)
+	addr := net.JoinHostPort(*serverHost, *serverPort)
+	var wg sync.WaitGroup
+	for i := 0; i < *connections; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn := &connection{addr: addr}
+			defer conn.close()
+			for name := range jobs {
+				if *discard {
+					results <- conn.discard(name)
+				} else {
+					results <- conn.download(name, *outDir)
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	start := time.Now()
+	var total, failed int
+	var bytes int64
+	for res := range results {
+		fmt.Println(res)
+		total++
+		bytes += res.bytes
+		if res.err != nil {
+			failed++
+		}
+	}
+	elapsed := time.Since(start)
+
+	fmt.Printf("\n%d files, %d failed, %d bytes in %v: %.2f MB/s, %.1f files/s\n",
+		total, failed, bytes, elapsed.Round(time.Millisecond),
+		float64(bytes)/elapsed.Seconds()/(1<<20), float64(total)/elapsed.Seconds())
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func unique(names []string) []string {
+	seen := map[string]bool{}
+	var result []string
+	for _, name := range names {
+		if !seen[localName(name)] {
+			seen[localName(name)] = true
+			result = append(result, name)
+		}
+	}
+	return result
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var fileData = bytes.Repeat([]byte("0123456789"), 1000)
+
+// startServer serves fileData at every path and counts connections and Range requests
+func startServer(t *testing.T) (*connection, *atomic.Int32, *atomic.Int32) {
+	var conns, ranges atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/missing") {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Range") != "" {
+			ranges.Add(1)
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(fileData))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+	return &connection{addr: server.Listener.Addr().String()}, &conns, &ranges
+}
+
+func TestDownloadReusesConnection(t *testing.T) {
+	conn, conns, _ := startServer(t)
+	defer conn.close()
+	out := t.TempDir()
+
+	for _, name := range []string{"a.txt", "dir/b.txt", "/../c.txt"} {
+		res := conn.download(name, out)
+		if res.err != nil || res.status != http.StatusOK || res.bytes != int64(len(fileData)) {
+			t.Fatalf("%s: got %v", name, res)
+		}
+	}
+	for _, name := range []string{"a.txt", "dir/b.txt", "c.txt"} {
+		got, err := os.ReadFile(filepath.Join(out, name))
+		if err != nil || !bytes.Equal(got, fileData) {
+			t.Errorf("%s: got %d bytes, error %v", name, len(got), err)
+		}
+	}
+	if conns.Load() != 1 {
+		t.Errorf("got %d connections, want 1", conns.Load())
+	}
+}
+
+func TestDownloadResumes(t *testing.T) {
+	conn, _, ranges := startServer(t)
+	defer conn.close()
+	out := t.TempDir()
+	os.WriteFile(filepath.Join(out, "a.txt.part"), fileData[:1234], 0644)
+
+	res := conn.download("a.txt", out)
+	if res.err != nil || res.status != http.StatusPartialContent || res.resumed != 1234 || res.bytes != int64(len(fileData)-1234) {
+		t.Fatalf("got %v", res)
+	}
+	got, _ := os.ReadFile(filepath.Join(out, "a.txt"))
+	if !bytes.Equal(got, fileData) {
+		t.Errorf("got %d bytes, want the whole file", len(got))
+	}
+	if _, err := os.Stat(filepath.Join(out, "a.txt.part")); err == nil {
+		t.Errorf("part file is left")
+	}
+	if ranges.Load() != 1 {
+		t.Errorf("got %d Range requests, want 1", ranges.Load())
+	}
+
+	// A complete part that was not renamed
+	os.WriteFile(filepath.Join(out, "b.txt.part"), fileData, 0644)
+	if res := conn.download("b.txt", out); res.err != nil {
+		t.Errorf("complete part: got %v", res)
+	}
+	if got, _ := os.ReadFile(filepath.Join(out, "b.txt")); !bytes.Equal(got, fileData) {
+		t.Errorf("complete part: got %d bytes", len(got))
+	}
+}
+
+func TestDownloadErrors(t *testing.T) {
+	conn, _, _ := startServer(t)
+	defer conn.close()
+	out := t.TempDir()
+
+	if res := conn.download("missing.txt", out); res.err == nil || res.status != http.StatusNotFound {
+		t.Errorf("got %v, want 404 error", res)
+	}
+	if _, err := os.Stat(filepath.Join(out, "missing.txt")); err == nil {
+		t.Errorf("missing file was saved")
+	}
+	// The connection is still usable after an error answer
+	if res := conn.discard("a.txt"); res.err != nil || res.bytes != int64(len(fileData)) {
+		t.Errorf("got %v after an error", res)
+	}
+
+	dead := &connection{addr: "127.0.0.1:1"}
+	if res := dead.discard("a.txt"); res.err == nil {
+		t.Errorf("got no error without a server")
+	}
+}
+
+var localNames = []struct {
+	in  string
+	out string
+}{
+	{"a.txt", "a.txt"},
+	{"/dir/a.txt", filepath.Join("dir", "a.txt")},
+	{"../../etc/passwd", filepath.Join("etc", "passwd")},
+	{"dir/", filepath.Join("dir", "index.html")},
+	{"/", "index.html"},
+}
+
+func TestLocalName(t *testing.T) {
+	for _, tt := range localNames {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := localName(tt.in); got != tt.out {
+				t.Errorf("got %q, want %q", got, tt.out)
+			}
+		})
+	}
+}
+
+func TestReadManifest(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "manifest.txt")
+	os.WriteFile(name, []byte("# files\na.txt\n\n  dir/b.txt  \n"), 0644)
+	got, err := readManifest(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, ",") != "a.txt,dir/b.txt" {
+		t.Errorf("got %q", got)
+	}
+}
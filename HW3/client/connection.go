@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+// connection is a keep-alive connection to the server, it is reopened if the server closes it
+type connection struct {
+	addr   string
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// do sends the request and reads the response headers. The caller reads the body
+// and calls done, so that the connection can be used for the next request
+func (c *connection) do(req *http.Request) (*http.Response, error) {
+	reused := c.conn != nil
+	resp, err := c.try(req)
+	// The server may have closed an idle connection just before the request, try a new one
+	if err != nil && reused {
+		resp, err = c.try(req)
+	}
+	return resp, err
+}
+
+func (c *connection) try(req *http.Request) (*http.Response, error) {
+	if c.conn == nil {
+		conn, err := net.Dial("tcp", c.addr)
+		if err != nil {
+			return nil, err
+		}
+		c.conn, c.reader = conn, bufio.NewReader(conn)
+	}
+	if err := req.Write(c.conn); err != nil {
+		c.close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(c.reader, req)
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// done closes the body; if it was not read to the end or the server asked to close, the connection is dropped
+func (c *connection) done(resp *http.Response, err error) {
+	resp.Body.Close()
+	if err != nil || resp.Close {
+		c.close()
+	}
+}
+
+func (c *connection) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// result is the outcome of one download
+type result struct {
+	name    string
+	status  int
+	bytes   int64 // received in this run
+	resumed int64 // already on disk before the run
+	elapsed time.Duration
+	err     error
+}
+
+func (r result) String() string {
+	if r.err != nil {
+		return fmt.Sprintf("%-30s FAIL %v", r.name, r.err)
+	}
+	speed := float64(r.bytes) / r.elapsed.Seconds() / (1 << 20)
+	line := fmt.Sprintf("%-30s %d %10d bytes %10v %8.2f MB/s", r.name, r.status, r.bytes, r.elapsed.Round(time.Microsecond), speed)
+	if r.resumed > 0 {
+		line += fmt.Sprintf(" (resumed from %d)", r.resumed)
+	}
+	return line
+}
+
+// readManifest reads the names of the files, one per line. Empty lines and # comments are skipped
+func readManifest(name string) ([]string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var names []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		names = append(names, line)
+	}
+	return names, scanner.Err()
+}
+
+// localName is where the file is saved under the output directory, it cannot leave the directory
+func localName(name string) string {
+	clean := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if clean == "" || strings.HasSuffix(name, "/") {
+		clean = path.Join(clean, "index.html")
+	}
+	return filepath.FromSlash(clean)
+}
+
+func (c *connection) newRequest(name string) *http.Request {
+	return &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Scheme: "http", Host: c.addr, Path: "/" + strings.TrimPrefix(name, "/")},
+		Header: http.Header{},
+		Host:   c.addr,
+	}
+}
+
+// discard downloads the file without saving it (load testing)
+func (c *connection) discard(name string) result {
+	start := time.Now()
+	res := result{name: name}
+	resp, err := c.do(c.newRequest(name))
+	if err != nil {
+		res.err = err
+		return res
+	}
+	res.status = resp.StatusCode
+	res.bytes, err = io.Copy(io.Discard, resp.Body)
+	c.done(resp, err)
+	res.elapsed = time.Since(start)
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("server answered %s", resp.Status)
+	}
+	res.err = err
+	return res
+}
+
+// download saves the file to the output directory. The data goes to a .part file first,
+// if it is left from an interrupted run, only the rest of the file is requested
+func (c *connection) download(name, outDir string) result {
+	start := time.Now()
+	res := result{name: name}
+	target := filepath.Join(outDir, localName(name))
+	part := target + ".part"
+
+	if info, err := os.Stat(part); err == nil {
+		res.resumed = info.Size()
+	}
+	req := c.newRequest(name)
+	if res.resumed > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", res.resumed))
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	res.status = resp.StatusCode
+
+	flags := os.O_WRONLY | os.O_CREATE
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		// The server sent the whole file, the old part is not needed
+		flags |= os.O_TRUNC
+		res.resumed = 0
+	case resp.StatusCode == http.StatusPartialContent && res.resumed > 0:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", res.resumed)) {
+			c.done(resp, nil)
+			res.err = fmt.Errorf("unexpected Content-Range %q", resp.Header.Get("Content-Range"))
+			return res
+		}
+		flags |= os.O_APPEND
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && res.resumed > 0:
+		c.done(resp, nil)
+		// The part is as long as the file: it was downloaded, but not renamed
+		if resp.Header.Get("Content-Range") == fmt.Sprintf("bytes */%d", res.resumed) {
+			res.err = os.Rename(part, target)
+		} else {
+			os.Remove(part)
+			res.err = fmt.Errorf("partial file is longer than the file on the server, removed it")
+		}
+		res.elapsed = time.Since(start)
+		return res
+	default:
+		c.done(resp, nil)
+		res.err = fmt.Errorf("server answered %s", resp.Status)
+		return res
+	}
+
+	if err := os.MkdirAll(filepath.Dir(part), 0755); err != nil {
+		c.done(resp, err)
+		res.err = err
+		return res
+	}
+	file, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		c.done(resp, err)
+		res.err = err
+		return res
+	}
+	res.bytes, err = io.Copy(file, resp.Body)
+	c.done(resp, err)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && resp.ContentLength >= 0 && res.bytes != resp.ContentLength {
+		err = fmt.Errorf("got %d of %d bytes", res.bytes, resp.ContentLength)
+	}
+	if err == nil {
+		err = os.Rename(part, target)
+	}
+	res.elapsed = time.Since(start)
+	res.err = err
+	return res
+}
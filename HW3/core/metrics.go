@@ -0,0 +1,145 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the latency histogram in seconds
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// Metrics counts connections and requests of a Server. All methods can be called on nil
+type Metrics struct {
+	activeConns      atomic.Int64
+	acceptedConns    atomic.Int64
+	rejectedRequests atomic.Int64
+	queueLength      atomic.Int64
+
+	mu       sync.Mutex
+	requests map[requestKey]int64
+	buckets  []int64 // cumulative counts for latencyBuckets
+	count    int64
+	sum      time.Duration
+}
+
+type requestKey struct {
+	method string
+	status int
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests: map[requestKey]int64{},
+		buckets:  make([]int64, len(latencyBuckets)),
+	}
+}
+
+func (m *Metrics) connAccepted() {
+	if m != nil {
+		m.acceptedConns.Add(1)
+	}
+}
+
+func (m *Metrics) requestRejected() {
+	if m != nil {
+		m.rejectedRequests.Add(1)
+	}
+}
+
+func (m *Metrics) connOpened() {
+	if m != nil {
+		m.activeConns.Add(1)
+	}
+}
+
+func (m *Metrics) connClosed() {
+	if m != nil {
+		m.activeConns.Add(-1)
+	}
+}
+
+func (m *Metrics) queued(delta int64) {
+	if m != nil {
+		m.queueLength.Add(delta)
+	}
+}
+
+func (m *Metrics) observe(method string, status int, latency time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{method, status}]++
+	for i, bound := range latencyBuckets {
+		if latency.Seconds() <= bound {
+			m.buckets[i]++
+		}
+	}
+	m.count++
+	m.sum += latency
+}
+
+// WriteTo writes the metrics in the Prometheus text format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	gauge := func(name, help string, value int64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, value)
+	}
+	counter := func(name, help string, value int64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+	gauge("hw3_connections_active", "Connections being served.", m.activeConns.Load())
+	gauge("hw3_queue_length", "Requests waiting for a worker.", m.queueLength.Load())
+	counter("hw3_connections_accepted_total", "Accepted connections.", m.acceptedConns.Load())
+	counter("hw3_requests_rejected_total", "Requests rejected with 503 because the queue was full.", m.rejectedRequests.Load())
+
+	m.mu.Lock()
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].status < keys[j].status
+	})
+	b.WriteString("# HELP hw3_requests_total Answered requests.\n# TYPE hw3_requests_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(&b, "hw3_requests_total{method=%q,code=\"%d\"} %d\n", key.method, key.status, m.requests[key])
+	}
+
+	b.WriteString("# HELP hw3_request_duration_seconds Time from reading a request to sending the response.\n")
+	b.WriteString("# TYPE hw3_request_duration_seconds histogram\n")
+	for i, bound := range latencyBuckets {
+		fmt.Fprintf(&b, "hw3_request_duration_seconds_bucket{le=\"%g\"} %d\n", bound, m.buckets[i])
+	}
+	fmt.Fprintf(&b, "hw3_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.count)
+	fmt.Fprintf(&b, "hw3_request_duration_seconds_sum %g\n", m.sum.Seconds())
+	fmt.Fprintf(&b, "hw3_request_duration_seconds_count %d\n", m.count)
+	m.mu.Unlock()
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// Response answers a request to the metrics endpoint
+func (m *Metrics) Response(req *http.Request) *http.Response {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		resp := TextResponse(req, http.StatusMethodNotAllowed, "Method not allowed")
+		resp.Header.Set("Allow", "GET, HEAD")
+		return resp
+	}
+	var b strings.Builder
+	m.WriteTo(&b)
+	resp := TextResponse(req, http.StatusOK, b.String())
+	resp.Header.Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	return resp
+}
@@ -0,0 +1,30 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// NewResponse is an empty HTTP/1.1 response, the server decides whether to close the connection
+func NewResponse(req *http.Request, status int) *http.Response {
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Request:    req,
+	}
+}
+
+// TextResponse is a short plain text answer (errors and so on)
+func TextResponse(req *http.Request, status int, text string) *http.Response {
+	resp := NewResponse(req, status)
+	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp.Body = io.NopCloser(strings.NewReader(text))
+	resp.ContentLength = int64(len(text))
+	return resp
+}
@@ -0,0 +1,315 @@
+// Package core is the connection handling of the HW3 web server: keep-alive HTTP/1.x connections,
+// a pool of workers answering their requests, a bounded queue in front of it and graceful shutdown.
+// What is answered to the requests is decided by the Handler
+package core
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Handler builds the response to the request. A response with ContentLength -1 is sent chunked
+type Handler func(req *http.Request) *http.Response
+
+// ErrServerClosed is returned by Serve after Shutdown
+var ErrServerClosed = errors.New("core: server closed")
+
+// maxDrain is how much of an unread request body is skipped to keep the connection
+const maxDrain = 1 << 20
+
+type Server struct {
+	Handler Handler
+	// Workers is the number of requests handled at once
+	Workers int
+	// QueueDepth is the number of read requests waiting for a worker,
+	// the requests above it are answered with 503
+	QueueDepth int
+	// IdleTimeout is how long a connection waits for the next request, 0 means no limit
+	IdleTimeout time.Duration
+	// Metrics and Log are optional
+	Metrics *Metrics
+	Log     *log.Logger
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool // the value tells if the connection waits for a request
+	queue    chan *job
+	limit    int64
+	workers  sync.WaitGroup
+	readers  sync.WaitGroup // one per connection, reading its requests
+	closing  atomic.Bool
+	nextID   atomic.Int64
+	inFlight atomic.Int64 // requests queued or being handled
+}
+
+type queuedConn struct {
+	net.Conn
+	id int64
+}
+
+// job is a request waiting for a worker. The worker closes done after the response is written
+type job struct {
+	conn      *queuedConn
+	req       *http.Request
+	keepAlive bool
+	err       error
+	done      chan struct{}
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.Log != nil {
+		s.Log.Printf(format, args...)
+	}
+}
+
+// Serve accepts connections on the listener until Shutdown is called.
+// Accept errors are logged and retried with a growing delay instead of stopping the server
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closing.Load() {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	if s.Workers <= 0 {
+		s.Workers = 1
+	}
+	s.listener = ln
+	s.conns = map[net.Conn]bool{}
+	if s.QueueDepth < 0 {
+		s.QueueDepth = 0
+	}
+	// The queue never blocks the readers: the requests above the limit are rejected before it
+	s.limit = int64(s.Workers + s.QueueDepth)
+	s.queue = make(chan *job, s.limit)
+	for i := 0; i < s.Workers; i++ {
+		s.workers.Add(1)
+		go s.worker()
+	}
+	s.mu.Unlock()
+	// The workers stop once no connection can queue a request
+	defer func() {
+		go func() {
+			s.readers.Wait()
+			close(s.queue)
+		}()
+	}()
+
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.closing.Load() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay < time.Second {
+				delay *= 2
+			}
+			s.logf("Accept error: %v, retrying in %v", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+
+		c := &queuedConn{Conn: conn, id: s.nextID.Add(1)}
+		s.logf("Client №%d connected from %v", c.id, conn.RemoteAddr())
+		s.Metrics.connAccepted()
+		// Shutdown waits for the readers, none is added after it has started
+		s.mu.Lock()
+		if s.closing.Load() {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.readers.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.readers.Done()
+			if err := s.serveConn(c); err != nil {
+				s.logf("Client №%d: %v", c.id, err)
+			}
+			s.logf("Client №%d disconnected", c.id)
+		}()
+	}
+}
+
+// reject answers 503 and closes the connection, so the client does not wait for a worker
+func (s *Server) reject(conn net.Conn) {
+	defer conn.Close()
+	resp := TextResponse(nil, http.StatusServiceUnavailable, "Server is busy")
+	resp.Header.Set("Retry-After", "1")
+	resp.Close = true
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	writeResponse(conn, resp)
+}
+
+func (s *Server) worker() {
+	defer s.workers.Done()
+	for j := range s.queue {
+		s.Metrics.queued(-1)
+		s.logf("Handling %s %s of client №%d", j.req.Method, j.req.URL, j.conn.id)
+		start := time.Now()
+		resp := s.Handler(j.req)
+		j.keepAlive = prepareResponse(j.req, resp) && !s.closing.Load()
+		resp.Close = !j.keepAlive
+		j.err = writeResponse(j.conn, resp)
+		s.Metrics.observe(j.req.Method, resp.StatusCode, time.Since(start))
+		s.inFlight.Add(-1)
+		close(j.done)
+	}
+}
+
+// handle waits for a worker to answer the request. It returns false if the queue is full
+func (s *Server) handle(conn *queuedConn, req *http.Request) (*job, bool) {
+	if s.inFlight.Add(1) > s.limit {
+		s.inFlight.Add(-1)
+		return nil, false
+	}
+	s.Metrics.queued(1)
+	j := &job{conn: conn, req: req, done: make(chan struct{})}
+	s.queue <- j
+	<-j.done
+	return j, true
+}
+
+// setIdle marks the connection as waiting for a request (or not), so that Shutdown can close it.
+// It returns false if the server is shutting down and an idle connection should be closed right away
+func (s *Server) setIdle(conn net.Conn, idle bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if idle && s.closing.Load() {
+		return false
+	}
+	s.conns[conn] = idle
+	return true
+}
+
+// serveConn reads requests one after another until the client closes the connection,
+// asks to close it or stays idle for too long. A worker is taken only while a request is handled,
+// so idle keep-alive connections do not hold the workers
+func (s *Server) serveConn(conn *queuedConn) error {
+	s.Metrics.connOpened()
+	defer s.Metrics.connClosed()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		if s.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(s.IdleTimeout))
+		}
+		if !s.setIdle(conn, true) {
+			return nil
+		}
+		req, err := http.ReadRequest(reader)
+		if err == io.EOF || errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil
+		}
+		if err != nil {
+			resp := TextResponse(nil, http.StatusBadRequest, "Bad request")
+			resp.Close = true
+			writeResponse(conn, resp)
+			return err
+		}
+		s.setIdle(conn, false)
+		conn.SetReadDeadline(time.Time{})
+
+		j, ok := s.handle(conn, req)
+		if !ok {
+			s.logf("Client №%d rejected: queue is full", conn.id)
+			s.Metrics.requestRejected()
+			s.reject(conn)
+			return nil
+		}
+		if j.err != nil || !j.keepAlive {
+			return j.err
+		}
+
+		// The next request starts after the body of this one
+		n, err := io.Copy(io.Discard, io.LimitReader(req.Body, maxDrain+1))
+		if err != nil || n > maxDrain {
+			return err
+		}
+	}
+}
+
+// prepareResponse sets the connection headers and framing of the response,
+// it returns whether the connection may stay open afterwards
+func prepareResponse(req *http.Request, resp *http.Response) bool {
+	keepAlive := !req.Close
+	if resp.ContentLength < 0 {
+		if req.ProtoAtLeast(1, 1) {
+			resp.TransferEncoding = []string{"chunked"}
+		} else {
+			// HTTP/1.0 has no chunked encoding, the end of the body is the end of the connection
+			keepAlive = false
+		}
+	}
+	if keepAlive && !req.ProtoAtLeast(1, 1) {
+		resp.Header.Set("Connection", "keep-alive")
+	}
+	return keepAlive
+}
+
+func writeResponse(conn net.Conn, resp *http.Response) error {
+	if resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	resp.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	return resp.Write(conn)
+}
+
+// Shutdown stops accepting connections, closes the idle ones and waits until the requests
+// in progress are answered. When the context is done, the remaining connections are closed
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing.Store(true)
+	ln := s.listener
+	for conn, idle := range s.conns {
+		if idle {
+			conn.SetReadDeadline(time.Now())
+		}
+	}
+	s.mu.Unlock()
+	if ln == nil {
+		return nil
+	}
+	ln.Close()
+
+	done := make(chan struct{})
+	go func() {
+		s.readers.Wait()
+		s.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,349 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func hello(req *http.Request) *http.Response {
+	return TextResponse(req, http.StatusOK, "hello")
+}
+
+// startServer runs the server on a free local port and returns the address and the result of Serve
+func startServer(t *testing.T, s *Server, ln net.Listener) (string, <-chan error) {
+	if ln == nil {
+		var err error
+		if ln, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ln) }()
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return ln.Addr().String(), served
+}
+
+func dial(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return conn, bufio.NewReader(conn)
+}
+
+func send(t *testing.T, conn net.Conn, reader *bufio.Reader, raw string) (*http.Response, string) {
+	if raw != "" {
+		if _, err := io.WriteString(conn, raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+	method := "GET"
+	if raw != "" {
+		method, _, _ = strings.Cut(raw, " ")
+	}
+	resp, err := http.ReadResponse(reader, &http.Request{Method: method})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp, string(body)
+}
+
+func expectClosed(t *testing.T, reader *bufio.Reader) {
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("got %v, want closed connection", err)
+	}
+}
+
+const getRequest = "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+
+func TestKeepAlive(t *testing.T) {
+	addr, _ := startServer(t, &Server{Handler: hello}, nil)
+	conn, reader := dial(t, addr)
+
+	for i := 0; i < 3; i++ {
+		resp, body := send(t, conn, reader, getRequest)
+		if resp.StatusCode != http.StatusOK || body != "hello" || resp.Close {
+			t.Fatalf("request %d: got %d %q, close %v", i, resp.StatusCode, body, resp.Close)
+		}
+	}
+	resp, _ := send(t, conn, reader, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	if !resp.Close {
+		t.Errorf("got no Connection: close")
+	}
+	expectClosed(t, reader)
+}
+
+func TestBadRequest(t *testing.T) {
+	addr, _ := startServer(t, &Server{Handler: hello}, nil)
+	conn, reader := dial(t, addr)
+	resp, _ := send(t, conn, reader, "NOT HTTP\r\n\r\n")
+	if resp.StatusCode != http.StatusBadRequest || !resp.Close {
+		t.Errorf("got %d, close %v", resp.StatusCode, resp.Close)
+	}
+	expectClosed(t, reader)
+}
+
+func TestUnknownLength(t *testing.T) {
+	stream := func(req *http.Request) *http.Response {
+		resp := NewResponse(req, http.StatusOK)
+		resp.ContentLength = -1
+		resp.Body = io.NopCloser(strings.NewReader("streamed"))
+		return resp
+	}
+	addr, _ := startServer(t, &Server{Handler: stream, Workers: 2}, nil)
+
+	conn, reader := dial(t, addr)
+	resp, body := send(t, conn, reader, getRequest)
+	if len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" || body != "streamed" || resp.Close {
+		t.Errorf("HTTP/1.1: got %v %q, close %v", resp.TransferEncoding, body, resp.Close)
+	}
+
+	// HTTP/1.0 has no chunks, the body ends with the connection
+	conn, reader = dial(t, addr)
+	resp, body = send(t, conn, reader, "GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+	if len(resp.TransferEncoding) != 0 || body != "streamed" || !resp.Close {
+		t.Errorf("HTTP/1.0: got %v %q, close %v", resp.TransferEncoding, body, resp.Close)
+	}
+}
+
+func TestHTTP10KeepAlive(t *testing.T) {
+	addr, _ := startServer(t, &Server{Handler: hello}, nil)
+	conn, reader := dial(t, addr)
+	resp, _ := send(t, conn, reader, "GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+	if resp.Close || resp.Header.Get("Connection") != "keep-alive" {
+		t.Errorf("got close %v, Connection %q", resp.Close, resp.Header.Get("Connection"))
+	}
+	resp, _ = send(t, conn, reader, "GET / HTTP/1.0\r\n\r\n")
+	if !resp.Close {
+		t.Errorf("got keep-alive without asking for it")
+	}
+	expectClosed(t, reader)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	addr, _ := startServer(t, &Server{Handler: hello, IdleTimeout: 50 * time.Millisecond}, nil)
+	conn, reader := dial(t, addr)
+	send(t, conn, reader, getRequest)
+	expectClosed(t, reader)
+}
+
+// blockingHandler answers only when released
+type blockingHandler struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockingHandler() *blockingHandler {
+	return &blockingHandler{started: make(chan struct{}, 10), release: make(chan struct{})}
+}
+
+func (h *blockingHandler) serve(req *http.Request) *http.Response {
+	h.started <- struct{}{}
+	<-h.release
+	return hello(req)
+}
+
+func TestQueueLimit(t *testing.T) {
+	handler := newBlockingHandler()
+	metrics := NewMetrics()
+	addr, _ := startServer(t, &Server{Handler: handler.serve, Workers: 1, QueueDepth: 1, Metrics: metrics}, nil)
+
+	// The first request takes the only worker, the second one waits in the queue
+	busy, busyReader := dial(t, addr)
+	io.WriteString(busy, getRequest)
+	<-handler.started
+	queued, queuedReader := dial(t, addr)
+	io.WriteString(queued, getRequest)
+	waitFor(t, func() bool { return metrics.queueLength.Load() == 1 })
+
+	rejected, rejectedReader := dial(t, addr)
+	resp, _ := send(t, rejected, rejectedReader, getRequest)
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" || !resp.Close {
+		t.Errorf("got %d, close %v, want 503 and close", resp.StatusCode, resp.Close)
+	}
+	expectClosed(t, rejectedReader)
+	if metrics.rejectedRequests.Load() != 1 {
+		t.Errorf("got %d rejected requests, want 1", metrics.rejectedRequests.Load())
+	}
+
+	handler.release <- struct{}{}
+	if resp, _ := send(t, busy, busyReader, ""); resp.StatusCode != http.StatusOK || resp.Close {
+		t.Errorf("busy connection: got %d, close %v", resp.StatusCode, resp.Close)
+	}
+	// The worker is free as soon as the answer is sent, the keep-alive connection stays open
+	<-handler.started
+	handler.release <- struct{}{}
+	if resp, _ := send(t, queued, queuedReader, ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("queued connection: got %d", resp.StatusCode)
+	}
+	close(handler.release)
+	if resp, _ := send(t, busy, busyReader, getRequest); resp.StatusCode != http.StatusOK {
+		t.Errorf("busy connection again: got %d", resp.StatusCode)
+	}
+}
+
+func TestIdleConnectionKeepsNoWorker(t *testing.T) {
+	addr, _ := startServer(t, &Server{Handler: hello, Workers: 1, QueueDepth: 0}, nil)
+
+	// The only worker is not held by a keep-alive connection waiting for its next request
+	idle, idleReader := dial(t, addr)
+	send(t, idle, idleReader, getRequest)
+	for i := 0; i < 3; i++ {
+		conn, reader := dial(t, addr)
+		if resp, body := send(t, conn, reader, getRequest); resp.StatusCode != http.StatusOK || body != "hello" {
+			t.Errorf("client %d: got %d %q", i, resp.StatusCode, body)
+		}
+	}
+	if resp, _ := send(t, idle, idleReader, getRequest); resp.StatusCode != http.StatusOK {
+		t.Errorf("idle connection: got %d", resp.StatusCode)
+	}
+}
+
+func TestShutdownDrains(t *testing.T) {
+	handler := newBlockingHandler()
+	s := &Server{Handler: handler.serve, Workers: 2}
+	addr, served := startServer(t, s, nil)
+
+	idle, idleReader := dial(t, addr)
+	active, activeReader := dial(t, addr)
+	io.WriteString(active, getRequest)
+	<-handler.started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+
+	// The idle connection is closed at once, the active one gets its answer
+	expectClosed(t, idleReader)
+	idle.Close()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown finished before the request: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(handler.release)
+
+	resp, body := send(t, active, activeReader, "")
+	if resp.StatusCode != http.StatusOK || body != "hello" || !resp.Close {
+		t.Errorf("got %d %q, close %v", resp.StatusCode, body, resp.Close)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("got shutdown error %v", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("got Serve error %v, want ErrServerClosed", err)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Errorf("server still accepts connections")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	handler := newBlockingHandler()
+	s := &Server{Handler: handler.serve}
+	addr, _ := startServer(t, s, nil)
+
+	conn, reader := dial(t, addr)
+	io.WriteString(conn, getRequest)
+	<-handler.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	go func() {
+		// The handler is stuck, the connection is closed under it
+		time.Sleep(100 * time.Millisecond)
+		close(handler.release)
+	}()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want deadline exceeded", err)
+	}
+	if _, err := reader.ReadByte(); err == nil {
+		t.Errorf("connection is still open")
+	}
+}
+
+// flakyListener fails the first Accept calls like a process out of file descriptors
+type flakyListener struct {
+	net.Listener
+	failures atomic.Int32
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures.Add(-1) >= 0 {
+		return nil, temporaryError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestAcceptErrors(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flaky := &flakyListener{Listener: ln}
+	flaky.failures.Store(3)
+	addr, _ := startServer(t, &Server{Handler: hello}, flaky)
+
+	conn, reader := dial(t, addr)
+	if resp, _ := send(t, conn, reader, getRequest); resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d after Accept errors", resp.StatusCode)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	addr, _ := startServer(t, &Server{Handler: hello, Metrics: metrics}, nil)
+	conn, reader := dial(t, addr)
+	send(t, conn, reader, getRequest)
+	send(t, conn, reader, "HEAD / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	waitFor(t, func() bool {
+		metrics.mu.Lock()
+		defer metrics.mu.Unlock()
+		return metrics.count == 2
+	})
+
+	var b strings.Builder
+	metrics.WriteTo(&b)
+	for _, line := range []string{
+		"hw3_connections_active 1",
+		"hw3_connections_accepted_total 1",
+		`hw3_requests_total{method="GET",code="200"} 1`,
+		`hw3_requests_total{method="HEAD",code="200"} 1`,
+		`hw3_request_duration_seconds_bucket{le="+Inf"} 2`,
+		"hw3_request_duration_seconds_count 2",
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("no %q in\n%s", line, b.String())
+		}
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	for i := 0; i < 500; i++ {
+		if condition() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("condition is not met")
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"HW3/core"
+)
+
+var errUnsatisfiableRange = errors.New("range is not satisfiable")
+
+// byteRange is a part of the file: [start, start+length)
+type byteRange struct {
+	start, length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses the Range header ("bytes=0-99,200-,-500") for a file of the given size.
+// Ranges that start after the end of the file are skipped; if none is left, errUnsatisfiableRange is returned
+func parseRange(header string, size int64) ([]byteRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return nil, errors.New("invalid range unit")
+	}
+
+	var ranges []byteRange
+	for _, spec := range strings.Split(header[len(prefix):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, errors.New("invalid range")
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		var r byteRange
+		if first == "" {
+			// Suffix range: the last N bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errors.New("invalid range")
+			}
+			if n == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r = byteRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errors.New("invalid range")
+			}
+			if start >= size {
+				continue
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, errors.New("invalid range")
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+			r = byteRange{start: start, length: end - start + 1}
+		}
+		ranges = append(ranges, r)
+	}
+
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
+	}
+	return ranges, nil
+}
+
+// fileETag builds a strong validator from the modification time and the size
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", info.ModTime().UnixNano(), info.Size())
+}
+
+// etagMatches tells if the If-None-Match or If-Range list contains the ETag (weak comparison)
+func etagMatches(list, eTag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(eTag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified checks the conditional headers of the request (RFC 9110, 13.2.2)
+func notModified(req *http.Request, eTag string, modTime time.Time) bool {
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		return etagMatches(ifNoneMatch, eTag)
+	}
+	if ifModifiedSince := req.Header.Get("If-Modified-Since"); ifModifiedSince != "" {
+		since, err := http.ParseTime(ifModifiedSince)
+		// HTTP dates have a precision of one second
+		return err == nil && !modTime.Truncate(time.Second).After(since)
+	}
+	return false
+}
+
+// rangeApplies checks If-Range: ranges are served only if the client's copy is still current
+func rangeApplies(req *http.Request, eTag string, modTime time.Time) bool {
+	ifRange := req.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, "\"") {
+		return ifRange == eTag
+	}
+	date, err := http.ParseTime(ifRange)
+	return err == nil && modTime.Truncate(time.Second).Equal(date)
+}
+
+// contentType looks the type up by extension and sniffs the first bytes if the extension is unknown
+func contentType(file io.ReadSeeker, name string) (string, error) {
+	if ctype := mime.TypeByExtension(filepath.Ext(name)); ctype != "" {
+		return ctype, nil
+	}
+	var buf [512]byte
+	n, _ := io.ReadFull(file, buf[:])
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// serveFile answers GET and HEAD requests for the file. The returned body closes the file
+func serveFile(req *http.Request, name string) *http.Response {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		resp := core.TextResponse(req, http.StatusMethodNotAllowed, "Method not allowed")
+		resp.Header.Set("Allow", "GET, HEAD")
+		return resp
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return core.TextResponse(req, http.StatusNotFound, "File not found")
+	}
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		file.Close()
+		return core.TextResponse(req, http.StatusNotFound, "File not found")
+	}
+
+	size := info.Size()
+	modTime := info.ModTime()
+	eTag := fileETag(info)
+
+	header := http.Header{}
+	header.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	header.Set("ETag", eTag)
+	header.Set("Accept-Ranges", "bytes")
+
+	if notModified(req, eTag, modTime) {
+		file.Close()
+		resp := core.NewResponse(req, http.StatusNotModified)
+		resp.Header = header
+		return resp
+	}
+
+	ctype, err := contentType(file, name)
+	if err != nil {
+		file.Close()
+		return core.TextResponse(req, http.StatusInternalServerError, err.Error())
+	}
+	header.Set("Content-Type", ctype)
+
+	var ranges []byteRange
+	if rangeHeader := req.Header.Get("Range"); rangeHeader != "" && rangeApplies(req, eTag, modTime) {
+		ranges, err = parseRange(rangeHeader, size)
+		if errors.Is(err, errUnsatisfiableRange) {
+			file.Close()
+			resp := core.TextResponse(req, http.StatusRequestedRangeNotSatisfiable, "Range not satisfiable")
+			resp.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			return resp
+		}
+		// Invalid ranges are ignored and the whole file is sent
+		if err != nil || rangesSize(ranges) > size {
+			ranges = nil
+		}
+	}
+
+	switch {
+	case len(ranges) == 0:
+		resp := core.NewResponse(req, http.StatusOK)
+		resp.Header = header
+		resp.ContentLength = size
+		resp.Body = file
+		return resp
+	case len(ranges) == 1:
+		if _, err := file.Seek(ranges[0].start, io.SeekStart); err != nil {
+			file.Close()
+			return core.TextResponse(req, http.StatusInternalServerError, err.Error())
+		}
+		resp := core.NewResponse(req, http.StatusPartialContent)
+		resp.Header = header
+		resp.Header.Set("Content-Range", ranges[0].contentRange(size))
+		resp.ContentLength = ranges[0].length
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(file, ranges[0].length), file}
+		return resp
+	default:
+		return multipartResponse(req, header, file, ranges, size)
+	}
+}
+
+func rangesSize(ranges []byteRange) int64 {
+	var total int64
+	for _, r := range ranges {
+		total += r.length
+	}
+	return total
+}
+
+// multipartResponse sends several ranges as multipart/byteranges (RFC 9110, 14.6).
+// The parts are generated while the body is written, the length is computed in advance
+func multipartResponse(req *http.Request, header http.Header, file *os.File, ranges []byteRange, size int64) *http.Response {
+	ctype := header.Get("Content-Type")
+	partHeader := func(r byteRange) textproto.MIMEHeader {
+		return textproto.MIMEHeader{
+			"Content-Range": {r.contentRange(size)},
+			"Content-Type":  {ctype},
+		}
+	}
+
+	// Dry run without the data to find out the length of the body
+	counter := &countingWriter{}
+	mw := multipart.NewWriter(counter)
+	for _, r := range ranges {
+		mw.CreatePart(partHeader(r))
+		counter.n += r.length
+	}
+	mw.Close()
+
+	boundary := mw.Boundary()
+	pr, pw := io.Pipe()
+	mw = multipart.NewWriter(pw)
+	mw.SetBoundary(boundary)
+	go func() {
+		defer file.Close()
+		for _, r := range ranges {
+			part, err := mw.CreatePart(partHeader(r))
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := io.Copy(part, io.NewSectionReader(file, r.start, r.length)); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(mw.Close())
+	}()
+
+	resp := core.NewResponse(req, http.StatusPartialContent)
+	resp.Header = header
+	resp.Header.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	resp.ContentLength = counter.n
+	resp.Body = pr
+	return resp
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var rangesToParse = []struct {
+	name   string
+	header string
+	size   int64
+	out    []byteRange
+	err    bool
+}{
+	{"first bytes", "bytes=0-9", 100, []byteRange{{0, 10}}, false},
+	{"open end", "bytes=90-", 100, []byteRange{{90, 10}}, false},
+	{"suffix", "bytes=-5", 100, []byteRange{{95, 5}}, false},
+	{"suffix longer than file", "bytes=-500", 100, []byteRange{{0, 100}}, false},
+	{"end after file", "bytes=50-500", 100, []byteRange{{50, 50}}, false},
+	{"several", "bytes=0-0, 10-19", 100, []byteRange{{0, 1}, {10, 10}}, false},
+	{"unsatisfiable", "bytes=100-", 100, nil, true},
+	{"bad unit", "items=0-9", 100, nil, true},
+	{"end before start", "bytes=9-0", 100, nil, true},
+	{"garbage", "bytes=a-b", 100, nil, true},
+}
+
+func TestParseRange(t *testing.T) {
+	for _, tt := range rangesToParse {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRange(tt.header, tt.size)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want error %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(got, tt.out) {
+				t.Errorf("got %v, want %v", got, tt.out)
+			}
+		})
+	}
+}
+
+// roundTrip writes the response as the server does and reads it back as a client
+func roundTrip(t *testing.T, req *http.Request, name string) (*http.Response, []byte) {
+	resp := serveFile(req, name)
+	var buf bytes.Buffer
+	if err := resp.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Body != nil {
+		resp.Body.Close()
+	}
+
+	got, err := http.ReadResponse(bufio.NewReader(&buf), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(got.Body)
+	return got, body
+}
+
+func TestServeFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "data.bin")
+	data := []byte("0123456789abcdefghij")
+	os.WriteFile(name, data, 0644)
+
+	req, _ := http.NewRequest("GET", "/data.bin", nil)
+	resp, body := roundTrip(t, req, name)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) || resp.ContentLength != int64(len(data)) {
+		t.Fatalf("got %d %q, want the whole file", resp.StatusCode, body)
+	}
+	eTag := resp.Header.Get("ETag")
+
+	req, _ = http.NewRequest("HEAD", "/data.bin", nil)
+	resp, body = roundTrip(t, req, name)
+	if resp.StatusCode != http.StatusOK || len(body) != 0 || resp.ContentLength != int64(len(data)) {
+		t.Errorf("HEAD: got %d with %d bytes, length %d", resp.StatusCode, len(body), resp.ContentLength)
+	}
+
+	req, _ = http.NewRequest("GET", "/data.bin", nil)
+	req.Header.Set("If-None-Match", eTag)
+	if resp, _ = roundTrip(t, req, name); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("If-None-Match: got %d, want 304", resp.StatusCode)
+	}
+
+	req, _ = http.NewRequest("GET", "/data.bin", nil)
+	req.Header.Set("If-Modified-Since", resp.Header.Get("Last-Modified"))
+	if resp, _ = roundTrip(t, req, name); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("If-Modified-Since: got %d, want 304", resp.StatusCode)
+	}
+
+	req, _ = http.NewRequest("GET", "/data.bin", nil)
+	req.Header.Set("Range", "bytes=5-9")
+	resp, body = roundTrip(t, req, name)
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "56789" ||
+		resp.Header.Get("Content-Range") != "bytes 5-9/20" {
+		t.Errorf("Range: got %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+
+	req, _ = http.NewRequest("GET", "/data.bin", nil)
+	req.Header.Set("Range", "bytes=5-9")
+	req.Header.Set("If-Range", `"outdated"`)
+	if resp, _ = roundTrip(t, req, name); resp.StatusCode != http.StatusOK {
+		t.Errorf("If-Range: got %d, want 200", resp.StatusCode)
+	}
+
+	req, _ = http.NewRequest("GET", "/data.bin", nil)
+	req.Header.Set("Range", "bytes=0-1,-2")
+	resp, body = roundTrip(t, req, name)
+	mediaType, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if resp.StatusCode != http.StatusPartialContent || mediaType != "multipart/byteranges" ||
+		resp.ContentLength != int64(len(body)) {
+		t.Fatalf("multipart: got %d %s, length %d of %d", resp.StatusCode, mediaType, resp.ContentLength, len(body))
+	}
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for _, want := range []string{"01", "ij"} {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(part)
+		if string(got) != want {
+			t.Errorf("multipart: got part %q, want %q", got, want)
+		}
+	}
+
+	req, _ = http.NewRequest("GET", "/data.bin", nil)
+	req.Header.Set("Range", "bytes=20-")
+	if resp, _ = roundTrip(t, req, name); resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("unsatisfiable: got %d, want 416", resp.StatusCode)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/data.bin", nil)
+	if resp, _ = roundTrip(t, req, name); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE: got %d, want 405", resp.StatusCode)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"HW3/core"
+)
+
+// dirEntry is one line of the directory index
+type dirEntry struct {
+	Name    string    `json:"name"`
+	URL     string    `json:"url"`
+	Dir     bool      `json:"dir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modified"`
+}
+
+var listingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Index of {{.Path}}</title></head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Modified</th></tr>
+{{if ne .Path "/"}}<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.URL}}">{{.Name}}{{if .Dir}}/{{end}}</a></td><td>{{if not .Dir}}{{.Size}}{{end}}</td><td>{{.ModTime.UTC.Format "2006-01-02 15:04:05"}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// wantsJSON tells if the client asked for a JSON index by ?format=json or the Accept header
+func wantsJSON(req *http.Request) bool {
+	if format := req.URL.Query().Get("format"); format != "" {
+		return format == "json"
+	}
+	return strings.Contains(req.Header.Get("Accept"), "application/json")
+}
+
+// serveDirectory answers with the index of the directory, hidden entries are not listed.
+// The length is not known in advance, so the body is streamed (chunked on a keep-alive connection)
+func serveDirectory(req *http.Request, name string) *http.Response {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		resp := core.TextResponse(req, http.StatusMethodNotAllowed, "Method not allowed")
+		resp.Header.Set("Allow", "GET, HEAD")
+		return resp
+	}
+
+	// Relative links in the index only work if the directory URL ends with a slash
+	if !strings.HasSuffix(req.URL.Path, "/") {
+		location := (&url.URL{Path: req.URL.Path + "/", RawQuery: req.URL.RawQuery}).String()
+		resp := core.TextResponse(req, http.StatusMovedPermanently, "Moved permanently")
+		resp.Header.Set("Location", location)
+		return resp
+	}
+
+	dirEntries, err := os.ReadDir(name)
+	if err != nil {
+		return core.TextResponse(req, http.StatusInternalServerError, err.Error())
+	}
+	entries := make([]dirEntry, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		if strings.HasPrefix(dirEntry.Name(), ".") {
+			continue
+		}
+		// Stat follows symlinks, so a link to a directory is shown as a directory
+		info, err := os.Stat(filepath.Join(name, dirEntry.Name()))
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entryFromInfo(dirEntry.Name(), info))
+	}
+
+	resp := core.NewResponse(req, http.StatusOK)
+	resp.ContentLength = -1
+	pr, pw := io.Pipe()
+	resp.Body = pr
+	if wantsJSON(req) {
+		resp.Header.Set("Content-Type", "application/json")
+		go func() {
+			pw.CloseWithError(json.NewEncoder(pw).Encode(entries))
+		}()
+	} else {
+		resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+		data := struct {
+			Path    string
+			Entries []dirEntry
+		}{path.Clean(req.URL.Path), entries}
+		go func() {
+			pw.CloseWithError(listingTemplate.Execute(pw, data))
+		}()
+	}
+	return resp
+}
+
+func entryFromInfo(name string, info os.FileInfo) dirEntry {
+	entry := dirEntry{
+		Name:    name,
+		URL:     (&url.URL{Path: name}).String(),
+		Dir:     info.IsDir(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+	if entry.Dir {
+		entry.URL += "/"
+		entry.Size = 0
+	}
+	return entry
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Symlink policies
+const (
+	symlinksDeny   = "deny"   // any symlink on the path is forbidden
+	symlinksInside = "inside" // symlinks are followed if the target stays inside the root
+	symlinksFollow = "follow" // symlinks are followed anywhere
+)
+
+var (
+	errBadPath   = errors.New("bad request path")
+	errForbidden = errors.New("access is forbidden")
+)
+
+// sandbox maps request paths to files under the document root
+type sandbox struct {
+	root     string
+	symlinks string
+}
+
+func newSandbox(root, symlinks string) (*sandbox, error) {
+	switch symlinks {
+	case symlinksDeny, symlinksInside, symlinksFollow:
+	default:
+		return nil, fmt.Errorf("unknown symlink policy %q", symlinks)
+	}
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	// The root itself may be a symlink, compare the targets with its real path
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	return &sandbox{root: root, symlinks: symlinks}, nil
+}
+
+// resolve turns the decoded URL path (without the query) into a file name under the root.
+// The file itself may not exist, that is left to the caller
+func (s *sandbox) resolve(urlPath string) (string, error) {
+	if !strings.HasPrefix(urlPath, "/") || strings.ContainsAny(urlPath, "\x00\\") {
+		return "", errBadPath
+	}
+
+	// Cleaning a rooted path drops all ".." that would go above the root
+	clean := path.Clean(urlPath)
+	if hidden(clean, "/") {
+		return "", errForbidden
+	}
+
+	name := filepath.Join(s.root, filepath.FromSlash(clean))
+	if err := s.checkSymlinks(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// checkSymlinks applies the symlink policy to every component of the name below the root
+func (s *sandbox) checkSymlinks(name string) error {
+	if s.symlinks == symlinksFollow {
+		return nil
+	}
+
+	rel, err := filepath.Rel(s.root, name)
+	if err != nil || rel == "." {
+		return err
+	}
+	current := s.root
+	for _, component := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, component)
+		info, err := os.Lstat(current)
+		if err != nil {
+			// Missing files are not served anyway
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if s.symlinks == symlinksDeny {
+			return errForbidden
+		}
+		target, err := filepath.EvalSymlinks(current)
+		if err != nil {
+			return nil
+		}
+		// A link must not lead out of the root or to a hidden file
+		rel, err := filepath.Rel(s.root, target)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return errForbidden
+		}
+		if rel != "." && hidden(rel, string(filepath.Separator)) {
+			return errForbidden
+		}
+	}
+	return nil
+}
+
+// hidden tells if any segment of the path starts with a dot
+func hidden(name, separator string) bool {
+	for _, segment := range strings.Split(name, separator) {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+	return false
+}
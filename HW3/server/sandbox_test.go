@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"HW3/core"
+)
+
+// newTestRoot builds a document root next to a secret file that must never be served:
+//
+//	secret.txt
+//	outside/secret.txt
+//	root/index.html
+//	root/sub/a.txt
+//	root/.secret
+//	root/sub/.git/config
+//	root/link-in -> sub/a.txt
+//	root/link-hidden -> .secret
+//	root/link-out -> ../secret.txt
+//	root/dirlink-out -> ../outside
+func newTestRoot(t *testing.T) string {
+	dir := t.TempDir()
+	files := map[string]string{
+		"secret.txt":           "TOP SECRET",
+		"outside/secret.txt":   "TOP SECRET",
+		"root/index.html":      "<h1>index</h1>",
+		"root/sub/a.txt":       "a",
+		"root/.secret":         "TOP SECRET",
+		"root/sub/.git/config": "TOP SECRET",
+	}
+	for name, content := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root := filepath.Join(dir, "root")
+	links := map[string]string{
+		"link-in":     "sub/a.txt",
+		"link-hidden": ".secret",
+		"link-out":    "../secret.txt",
+		"dirlink-out": "../outside",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Skip("symlinks are not supported:", err)
+		}
+	}
+	return root
+}
+
+var hostilePaths = []struct {
+	name   string
+	target string
+	status int
+}{
+	{"plain file", "/index.html", http.StatusOK},
+	{"nested file", "/sub/a.txt", http.StatusOK},
+	{"query is not a part of the name", "/sub/a.txt?x=../../secret.txt", http.StatusOK},
+	{"double slash", "//sub//a.txt", http.StatusOK},
+	{"dot segments inside the root", "/sub/../sub/./a.txt", http.StatusOK},
+	{"absolute form", "http://localhost/sub/a.txt", http.StatusOK},
+	{"dot dot", "/../secret.txt", http.StatusNotFound},
+	{"many dot dots", "/../../../../../../etc/passwd", http.StatusNotFound},
+	{"dot dot after a directory", "/sub/../../secret.txt", http.StatusNotFound},
+	{"encoded dots", "/%2e%2e/secret.txt", http.StatusNotFound},
+	{"encoded slash", "/..%2fsecret.txt", http.StatusNotFound},
+	{"double encoding", "/%252e%252e/secret.txt", http.StatusNotFound},
+	{"absolute form with dot dot", "http://localhost/../secret.txt", http.StatusNotFound},
+	{"backslash", "/..%5csecret.txt", http.StatusBadRequest},
+	{"NUL byte", "/sub/a.txt%00.html", http.StatusBadRequest},
+	{"invalid escape", "/%zz", http.StatusBadRequest},
+	{"asterisk", "*", http.StatusBadRequest},
+	{"hidden file", "/.secret", http.StatusForbidden},
+	{"hidden directory", "/sub/.git/config", http.StatusForbidden},
+	{"encoded hidden directory", "/sub/%2egit/config", http.StatusForbidden},
+	{"symlink inside the root", "/link-in", http.StatusOK},
+	{"symlink to a hidden file", "/link-hidden", http.StatusForbidden},
+	{"symlink out of the root", "/link-out", http.StatusForbidden},
+	{"directory symlink out of the root", "/dirlink-out/secret.txt", http.StatusForbidden},
+}
+
+// request sends the raw request line through the same parsing as the server
+func request(files *sandbox, target string) (int, string) {
+	raw := "GET " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	var resp *http.Response
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		resp = core.TextResponse(nil, http.StatusBadRequest, "Bad request")
+	} else {
+		resp = serveRequest(req, files)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestHostilePaths(t *testing.T) {
+	files, err := newSandbox(newTestRoot(t), symlinksInside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range hostilePaths {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := request(files, tt.target)
+			if status != tt.status {
+				t.Errorf("got %d, want %d", status, tt.status)
+			}
+			if strings.Contains(body, "TOP SECRET") {
+				t.Errorf("secret was served")
+			}
+		})
+	}
+}
+
+var symlinkPolicies = []struct {
+	policy string
+	target string
+	status int
+}{
+	{symlinksDeny, "/link-in", http.StatusForbidden},
+	{symlinksDeny, "/sub/a.txt", http.StatusOK},
+	{symlinksInside, "/link-in", http.StatusOK},
+	{symlinksInside, "/link-out", http.StatusForbidden},
+	{symlinksFollow, "/link-out", http.StatusOK},
+	{symlinksFollow, "/dirlink-out/secret.txt", http.StatusOK},
+	{symlinksFollow, "/.secret", http.StatusForbidden},
+}
+
+func TestSymlinkPolicy(t *testing.T) {
+	root := newTestRoot(t)
+	for _, tt := range symlinkPolicies {
+		t.Run(tt.policy+tt.target, func(t *testing.T) {
+			files, err := newSandbox(root, tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status, _ := request(files, tt.target); status != tt.status {
+				t.Errorf("got %d, want %d", status, tt.status)
+			}
+		})
+	}
+}
+
+func TestNewSandbox(t *testing.T) {
+	if _, err := newSandbox(t.TempDir(), "sometimes"); err == nil {
+		t.Errorf("got no error for unknown policy")
+	}
+	if _, err := newSandbox(filepath.Join(t.TempDir(), "missing"), symlinksInside); err == nil {
+		t.Errorf("got no error for missing root")
+	}
+}
@@ -1,68 +1,101 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"flag"
 	"fmt"
-	"io"
+	"log"
 	"net"
 	"net/http"
 	"os"
-	"strings"
-	"sync/atomic"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"HW3/core"
 )
 
 var concurrencyLevel = flag.Int("conlvl", 1, "Concurrency level")
-
-var clientCounter int32 = 0
+var docRoot = flag.String("root", ".", "Document root")
+var symlinks = flag.String("symlinks", symlinksInside, "Symlink policy: deny, inside or follow")
+var idleTimeout = flag.Duration("idle", 30*time.Second, "How long an idle connection is kept open")
+var queueDepth = flag.Int("queue", 16, "Number of requests waiting for a free worker, the rest get 503")
+var drainTimeout = flag.Duration("drain", 10*time.Second, "How long to wait for requests in progress on SIGINT")
+var addr = flag.String("addr", ":8081", "Address to listen on")
 
 func main() {
 	flag.Parse()
 
-	guard := make(chan struct{}, *concurrencyLevel)
+	files, err := newSandbox(*docRoot, *symlinks)
+	if err != nil {
+		log.Fatal(err)
+	}
+	metrics := core.NewMetrics()
+	server := &core.Server{
+		Handler:     handler(files, metrics),
+		Workers:     *concurrencyLevel,
+		QueueDepth:  *queueDepth,
+		IdleTimeout: *idleTimeout,
+		Metrics:     metrics,
+		Log:         log.New(os.Stdout, "", log.LstdFlags),
+	}
 
 	fmt.Println("Launching server...")
 
-	ln, err := net.Listen("tcp", ":8081")
+	ln, err := net.Listen("tcp", *addr)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
 
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			panic(err)
+	// On SIGINT the server stops accepting connections and finishes the requests in progress
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		signal.Stop(sig)
+		fmt.Println("Shutting down...")
+		ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			fmt.Printf("Requests were interrupted: %v\n", err)
 		}
-		clientCounter++
-		fmt.Printf("Client №%d connected!\nHis address: %v\n", clientCounter, conn.RemoteAddr())
-		guard <- struct{}{}
-		fmt.Printf("Handling connection of client №%d\n", clientCounter)
+	}()
 
-		go func(conn net.Conn, clientID *int32, guard chan struct{}) {
-			if err := handleConnection(conn); err != nil && err != io.EOF {
-				fmt.Printf("Got error: %v\n", err)
-			}
-			fmt.Printf("Client №%d disconnected!\n", *clientID)
-			atomic.AddInt32(clientID, -1)
-			<-guard
-		}(conn, &clientCounter, guard)
+	if err := server.Serve(ln); err != core.ErrServerClosed {
+		log.Fatal(err)
 	}
+	<-stopped
 }
 
-func handleConnection(conn net.Conn) error {
-	defer conn.Close()
-	req, err := http.ReadRequest(bufio.NewReader(conn))
-	if err != nil {
-		return err
+// metricsPath is where the metrics are served. It is under a reserved prefix, so that it does
+// not hide a file of the document root
+const metricsPath = "/_server/metrics"
+
+// handler serves the metrics and the files of the sandbox
+func handler(files *sandbox, metrics *core.Metrics) core.Handler {
+	return func(req *http.Request) *http.Response {
+		if req.URL.Path == metricsPath {
+			return metrics.Response(req)
+		}
+		return serveRequest(req, files)
+	}
+}
+
+// serveRequest finds the file in the sandbox and serves it
+func serveRequest(req *http.Request, files *sandbox) *http.Response {
+	name, err := files.resolve(req.URL.Path)
+	switch err {
+	case nil:
+	case errForbidden:
+		return core.TextResponse(req, http.StatusForbidden, "Forbidden")
+	default:
+		return core.TextResponse(req, http.StatusBadRequest, "Bad request")
 	}
-	data, err := os.ReadFile("./" + req.URL.String())
-	var resp http.Response
-	if err == nil {
-		resp = http.Response{Status: "200 OK", Body: io.NopCloser(bytes.NewReader(data))}
-	} else {
-		resp = http.Response{Status: "404 Not Found", Body: io.NopCloser(strings.NewReader("File not found"))}
+
+	if info, err := os.Stat(name); err == nil && info.IsDir() {
+		return serveDirectory(req, name)
 	}
-	err = resp.Write(conn)
-	return err
+	return serveFile(req, name)
 }
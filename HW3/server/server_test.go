@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"HW3/core"
+)
+
+// startConnection serves the files with the server core and connects to it
+func startConnection(t *testing.T, files *sandbox) net.Conn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &core.Server{
+		Handler: func(req *http.Request) *http.Response { return serveRequest(req, files) },
+	}
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func send(t *testing.T, conn net.Conn, reader *bufio.Reader, raw string) (*http.Response, string) {
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatal(err)
+	}
+	method, _, _ := strings.Cut(raw, " ")
+	resp, err := http.ReadResponse(reader, &http.Request{Method: method})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp, string(body)
+}
+
+func TestKeepAlive(t *testing.T) {
+	files, err := newSandbox(newTestRoot(t), symlinksInside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := startConnection(t, files)
+	reader := bufio.NewReader(conn)
+
+	resp, body := send(t, conn, reader, "GET /sub/a.txt HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if resp.StatusCode != http.StatusOK || body != "a" || resp.Close {
+		t.Fatalf("got %d %q, close %v", resp.StatusCode, body, resp.Close)
+	}
+
+	// A request with a body that is not read by the server must not break the next one
+	resp, _ = send(t, conn, reader, "POST /sub/a.txt HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello")
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Close {
+		t.Fatalf("got %d, close %v", resp.StatusCode, resp.Close)
+	}
+
+	resp, body = send(t, conn, reader, "GET /?format=json HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" {
+		t.Errorf("got transfer encoding %v, want chunked", resp.TransferEncoding)
+	}
+	var entries []dirEntry
+	if err := json.Unmarshal([]byte(body), &entries); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	if got := strings.Join(names, " "); got != "dirlink-out index.html link-hidden link-in link-out sub" {
+		t.Errorf("got entries %q", got)
+	}
+
+	resp, _ = send(t, conn, reader, "GET /sub/a.txt HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	if !resp.Close {
+		t.Errorf("got no Connection: close")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("got %v, want closed connection", err)
+	}
+}
+
+func TestDirectoryRedirect(t *testing.T) {
+	files, err := newSandbox(newTestRoot(t), symlinksInside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "/sub?format=json", nil)
+	resp := serveRequest(req, files)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "/sub/?format=json" {
+		t.Errorf("got %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
+
+func TestMetricsPath(t *testing.T) {
+	root := newTestRoot(t)
+	if err := os.WriteFile(filepath.Join(root, "metrics"), []byte("a file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files, err := newSandbox(root, symlinksInside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := handler(files, core.NewMetrics())
+
+	// A file named metrics is not hidden by the endpoint
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	resp := serve(req)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "a file" {
+		t.Errorf("got %d %q, want the file", resp.StatusCode, body)
+	}
+
+	req, _ = http.NewRequest("GET", metricsPath, nil)
+	resp = serve(req)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "hw3_requests_rejected_total") {
+		t.Errorf("got %d %q, want the metrics", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,282 @@
+// Package accesslog writes and parses the access log of the proxy.
+//
+// Two formats are supported:
+//
+//	combined -- Apache Combined Log Format with extra fields at the end:
+//	            127.0.0.1 - - [18/Oct/2023:10:00:00 +0000] "GET http://a.ru/ HTTP/1.1" 200 512 "-" "curl/8.0" 12 0 MISS "allowed"
+//	            (latency in milliseconds, bytes sent by the client through a tunnel, cache status,
+//	            policy verdict)
+//	json     -- one JSON object per line
+package accesslog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache statuses
+const (
+	CacheHit         = "HIT"
+	CacheMiss        = "MISS"
+	CacheRevalidated = "REVALIDATED"
+	CacheNone        = "-" // the request did not go through the cache (CONNECT, POST, denied requests)
+)
+
+const (
+	FormatCombined = "combined"
+	FormatJSON     = "json"
+)
+
+const timeFormat = "02/Jan/2006:15:04:05 -0700"
+
+var ErrFormat = errors.New("line is not in a known log format")
+
+// Record is one handled request
+type Record struct {
+	Time      time.Time     `json:"time"`
+	ClientIP  string        `json:"client"`
+	Method    string        `json:"method"`
+	URL       string        `json:"url"`
+	Proto     string        `json:"proto"`
+	Status    int           `json:"status"`
+	Bytes     int64         `json:"bytes"`             // sent to the client
+	BytesIn   int64         `json:"bytesIn,omitempty"` // sent by the client through a tunnel
+	Referer   string        `json:"referer,omitempty"`
+	UserAgent string        `json:"userAgent,omitempty"`
+	Latency   time.Duration `json:"latency"`
+	Cache     string        `json:"cache"`
+	Policy    string        `json:"policy"`
+}
+
+// Host returns the host of the requested URL (CONNECT requests keep only "host:port")
+func (r *Record) Host() string {
+	if u, err := url.Parse(r.URL); err == nil && u.Host != "" {
+		return u.Hostname()
+	}
+	if host, _, ok := strings.Cut(r.URL, ":"); ok {
+		return host
+	}
+	return r.URL
+}
+
+func dash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// Format converts the record into a log line without the trailing newline
+func Format(format string, r *Record) (string, error) {
+	switch format {
+	case FormatJSON:
+		line, err := json.Marshal(r)
+		return string(line), err
+	case FormatCombined:
+		return fmt.Sprintf("%s - - [%s] %q %d %d %q %q %d %d %s %q",
+			dash(r.ClientIP),
+			r.Time.Format(timeFormat),
+			r.Method+" "+r.URL+" "+r.Proto,
+			r.Status,
+			r.Bytes,
+			dash(r.Referer),
+			dash(r.UserAgent),
+			r.Latency.Milliseconds(),
+			r.BytesIn,
+			dash(r.Cache),
+			dash(r.Policy),
+		), nil
+	}
+	return "", fmt.Errorf("unknown log format %q", format)
+}
+
+// Parse reads a log line in any of the formats
+func Parse(line string) (*Record, error) {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "{") {
+		r := &Record{}
+		if err := json.Unmarshal([]byte(line), r); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+	return parseCombined(line)
+}
+
+// splitCombined splits the line into fields: words, "quoted strings" and [bracketed time]
+func splitCombined(line string) ([]string, error) {
+	var fields []string
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimSpace(line) {
+		switch line[0] {
+		case '"':
+			prefix, err := strconv.QuotedPrefix(line)
+			if err != nil {
+				return nil, ErrFormat
+			}
+			value, _ := strconv.Unquote(prefix)
+			fields = append(fields, value)
+			line = line[len(prefix):]
+		case '[':
+			end := strings.IndexByte(line, ']')
+			if end < 0 {
+				return nil, ErrFormat
+			}
+			fields = append(fields, line[1:end])
+			line = line[end+1:]
+		default:
+			end := strings.IndexByte(line, ' ')
+			if end < 0 {
+				end = len(line)
+			}
+			fields = append(fields, line[:end])
+			line = line[end:]
+		}
+	}
+	return fields, nil
+}
+
+func undash(value string) string {
+	if value == "-" {
+		return ""
+	}
+	return value
+}
+
+func parseCombined(line string) (*Record, error) {
+	fields, err := splitCombined(line)
+	if err != nil {
+		return nil, err
+	}
+	// client, ident, user, time, request, status, bytes, referer, user agent, latency, bytes in, cache, policy.
+	// Lines written before bytes in was added have no such field
+	bytesIn := "0"
+	switch len(fields) {
+	case 13:
+		bytesIn = fields[10]
+		fields = append(fields[:10], fields[11:]...)
+	case 12:
+	default:
+		return nil, ErrFormat
+	}
+
+	r := &Record{
+		ClientIP:  undash(fields[0]),
+		Referer:   undash(fields[7]),
+		UserAgent: undash(fields[8]),
+		Cache:     fields[10],
+		Policy:    undash(fields[11]),
+	}
+	if r.Time, err = time.Parse(timeFormat, fields[3]); err != nil {
+		return nil, ErrFormat
+	}
+	request := strings.SplitN(fields[4], " ", 3)
+	if len(request) != 3 {
+		return nil, ErrFormat
+	}
+	r.Method, r.URL, r.Proto = request[0], request[1], request[2]
+	if r.Status, err = strconv.Atoi(fields[5]); err != nil {
+		return nil, ErrFormat
+	}
+	if r.Bytes, err = strconv.ParseInt(fields[6], 10, 64); err != nil {
+		return nil, ErrFormat
+	}
+	if r.BytesIn, err = strconv.ParseInt(bytesIn, 10, 64); err != nil {
+		return nil, ErrFormat
+	}
+	latency, err := strconv.ParseInt(fields[9], 10, 64)
+	if err != nil {
+		return nil, ErrFormat
+	}
+	r.Latency = time.Duration(latency) * time.Millisecond
+	return r, nil
+}
+
+// Writer appends records to the log file and rotates it by size:
+// proxy.log -> proxy.log.1 -> proxy.log.2 ... up to the given number of backups.
+// It is safe for concurrent use
+type Writer struct {
+	path    string
+	format  string
+	maxSize int64
+	backups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewWriter opens the log file. maxSize <= 0 disables rotation
+func NewWriter(path, format string, maxSize int64, backups int) (*Writer, error) {
+	if _, err := Format(format, &Record{}); err != nil {
+		return nil, err
+	}
+	w := &Writer{path: path, format: format, maxSize: maxSize, backups: backups}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	file, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.size = info.Size()
+	return nil
+}
+
+// rotate shifts the backups and starts a new file. Must hold w.mu
+func (w *Writer) rotate() error {
+	w.file.Close()
+
+	if w.backups > 0 {
+		for i := w.backups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+		}
+		os.Rename(w.path, w.path+".1")
+	} else {
+		os.Remove(w.path)
+	}
+	return w.open()
+}
+
+// Write adds the record to the log
+func (w *Writer) Write(r *Record) error {
+	line, err := Format(w.format, r)
+	if err != nil {
+		return err
+	}
+	line += "\n"
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(line)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := w.file.WriteString(line)
+	w.size += int64(n)
+	return err
+}
+
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
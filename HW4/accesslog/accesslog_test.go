@@ -0,0 +1,129 @@
+package accesslog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var record = Record{
+	Time:      time.Date(2023, 3, 21, 19, 8, 41, 0, time.FixedZone("", 3*60*60)),
+	ClientIP:  "127.0.0.1",
+	Method:    "GET",
+	URL:       "http://example.com/a?b=\"c\"",
+	Proto:     "HTTP/1.1",
+	Status:    200,
+	Bytes:     512,
+	UserAgent: "curl/8.0",
+	Latency:   12 * time.Millisecond,
+	Cache:     CacheMiss,
+	Policy:    "denied by blacklist.txt:2: deny domain=ok.ru",
+}
+
+func TestFormatCombined(t *testing.T) {
+	got, err := Format(FormatCombined, &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `127.0.0.1 - - [21/Mar/2023:19:08:41 +0300] "GET http://example.com/a?b=\"c\" HTTP/1.1" 200 512 "-" "curl/8.0" 12 0 MISS "denied by blacklist.txt:2: deny domain=ok.ru"`
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+var connectRecord = Record{
+	Time:     time.Date(2023, 3, 21, 19, 8, 41, 0, time.UTC),
+	ClientIP: "127.0.0.1",
+	Method:   "CONNECT",
+	URL:      "example.com:443",
+	Proto:    "HTTP/1.1",
+	Status:   200,
+	Bytes:    4096,
+	BytesIn:  517,
+	Latency:  1500 * time.Millisecond,
+	Cache:    CacheNone,
+	Policy:   "allowed",
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, want := range []Record{record, connectRecord} {
+		for _, format := range []string{FormatCombined, FormatJSON} {
+			t.Run(want.Method+"/"+format, func(t *testing.T) {
+				line, err := Format(format, &want)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := Parse(line)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !got.Time.Equal(want.Time) {
+					t.Errorf("got time %v, want %v", got.Time, want.Time)
+				}
+				got.Time = want.Time
+				if *got != want {
+					t.Errorf("got %+v, want %+v", *got, want)
+				}
+				if got.Host() != "example.com" {
+					t.Errorf("got host %q, want example.com", got.Host())
+				}
+			})
+		}
+	}
+}
+
+func TestParseWithoutBytesIn(t *testing.T) {
+	line := `127.0.0.1 - - [21/Mar/2023:19:08:41 +0000] "CONNECT example.com:443 HTTP/1.1" 200 4096 "-" "-" 1500 - "allowed"`
+	got, err := Parse(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Bytes != 4096 || got.BytesIn != 0 || got.Cache != CacheNone {
+		t.Errorf("got %+v", *got)
+	}
+}
+
+func TestParseOldLines(t *testing.T) {
+	for _, line := range []string{
+		"GET http://amazon.com/ 200",
+		"CONNECT example.com:443 200 sent:84 received:199 time:8ms",
+		"",
+	} {
+		if _, err := Parse(line); err == nil {
+			t.Errorf("got no error for %q", line)
+		}
+	}
+}
+
+func TestRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.log")
+	line, _ := Format(FormatCombined, &record)
+	lineSize := int64(len(line) + 1)
+
+	w, err := NewWriter(path, FormatCombined, lineSize*2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		if err := w.Write(&record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	// 7 lines by 2 per file: proxy.log has 1 line, .1 and .2 have 2 lines, the oldest file is dropped
+	for name, size := range map[string]int64{path: lineSize, path + ".1": lineSize * 2, path + ".2": lineSize * 2} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != size {
+			t.Errorf("%s: got %d bytes, want %d", name, info.Size(), size)
+		}
+	}
+	if _, err := os.Stat(fmt.Sprintf("%s.3", path)); err == nil {
+		t.Errorf("too many backups")
+	}
+}
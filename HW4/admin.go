@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+)
+
+// handleAdmin serves the admin endpoint of the proxy. It is available only from the local machine:
+//
+//	GET    /_proxy/stats           -- cache counters in JSON
+//	DELETE /_proxy/stats?url=<url> -- remove all variants of the URL from the cache
+//	DELETE /_proxy/stats           -- remove everything from the cache
+func handleAdmin(cache *cacheManager) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/_proxy/stats", func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil || !net.ParseIP(host).IsLoopback() {
+			http.Error(w, "Admin endpoint is available only from localhost", http.StatusForbidden)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(cache.stats())
+		case http.MethodDelete:
+			var purged int
+			if targetURL := r.URL.Query().Get("url"); targetURL != "" {
+				purged = cache.purge(targetURL)
+			} else {
+				purged = cache.purgeAll()
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	})
+
+	return mux
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errTooLarge = errors.New("response is larger than the cache")
+	errAborted  = errors.New("response was not received completely")
+)
+
+// cacheStats is the snapshot of the cache state returned by the admin endpoint
+type cacheStats struct {
+	Entries       int     `json:"entries"`
+	Size          int64   `json:"size"`
+	MaxEntries    int     `json:"maxEntries"`
+	MaxSize       int64   `json:"maxSize"`
+	Hits          int64   `json:"hits"`
+	Misses        int64   `json:"misses"`
+	Revalidations int64   `json:"revalidations"`
+	Stores        int64   `json:"stores"`
+	Evictions     int64   `json:"evictions"`
+	HitRatio      float64 `json:"hitRatio"`
+}
+
+// cacheManager owns the cache index and the cache folder. All methods are safe for concurrent use.
+// Entries handed out by the manager are copies, so handlers never share mutable state.
+type cacheManager struct {
+	path       string
+	maxSize    int64
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string][]*cacheEntry // variants by URL
+	lru     *list.List               // *cacheEntry, the most recently used at the front
+	size    int64
+
+	hits          int64
+	misses        int64
+	revalidations int64
+	stores        int64
+	evictions     int64
+}
+
+// newCacheManager rebuilds the index from the cache folder. Limits that are <= 0 are not checked
+func newCacheManager(path string, maxSize int64, maxEntries int) (*cacheManager, error) {
+	m := &cacheManager{
+		path:       path,
+		maxSize:    maxSize,
+		maxEntries: maxEntries,
+		lru:        list.New(),
+	}
+
+	entries, err := loadCache(path)
+	if err != nil {
+		return nil, err
+	}
+	m.entries = entries
+
+	// Without access times on disk, the oldest responses are considered the least recently used
+	var all []*cacheEntry
+	for _, variants := range entries {
+		all = append(all, variants...)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].ResponseTime.After(all[j].ResponseTime)
+	})
+	for _, entry := range all {
+		entry.element = m.lru.PushBack(entry)
+		m.size += entry.Size
+	}
+
+	m.mu.Lock()
+	m.evict()
+	m.mu.Unlock()
+
+	return m, nil
+}
+
+func copyEntry(entry *cacheEntry) *cacheEntry {
+	c := *entry
+	c.Header = entry.Header.Clone()
+	c.element = nil
+	return &c
+}
+
+// lookup returns a copy of the stored variant for the request, or nil
+func (m *cacheManager) lookup(req *http.Request) *cacheEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := findVariant(m.entries[req.URL.String()], req)
+	if entry == nil {
+		return nil
+	}
+	m.lru.MoveToFront(entry.element)
+	return copyEntry(entry)
+}
+
+// cacheWriter receives the body of a response while it is streamed to the client.
+// Write never fails: if the cache file cannot be written, the response is just not stored
+type cacheWriter struct {
+	m       *cacheManager
+	entry   *cacheEntry
+	tmp     *os.File
+	writer  *bufio.Writer
+	written int64
+	err     error
+}
+
+// newWriter starts storing the response. The entry is added to the index only after commit
+func (m *cacheManager) newWriter(entry *cacheEntry) (*cacheWriter, error) {
+	entry = copyEntry(entry)
+	entry.Path = cacheFileName(m.path, entry.URL, entry.VaryValues)
+
+	tmp, writer, err := createCacheTemp(entry)
+	if err != nil {
+		return nil, err
+	}
+	return &cacheWriter{m: m, entry: entry, tmp: tmp, writer: writer}, nil
+}
+
+func (cw *cacheWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return len(p), nil
+	}
+	cw.written += int64(len(p))
+	if cw.m.maxSize > 0 && cw.written > cw.m.maxSize {
+		cw.err = errTooLarge
+		return len(p), nil
+	}
+	_, cw.err = cw.writer.Write(p)
+	return len(p), nil
+}
+
+// commit adds the stored response to the index, evicting old entries if needed
+func (cw *cacheWriter) commit() error {
+	if err := closeCacheTemp(cw.tmp, cw.writer, cw.err); err != nil {
+		return err
+	}
+
+	m := cw.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// The file is renamed under the lock, so eviction of the previous version cannot remove it
+	if err := m.commit(cw.entry, cw.tmp.Name()); err != nil {
+		return err
+	}
+	m.stores++
+	m.evict()
+	return nil
+}
+
+// abort drops the partially stored response
+func (cw *cacheWriter) abort() {
+	closeCacheTemp(cw.tmp, cw.writer, errAborted)
+}
+
+// revalidated updates the stored entry after a 304 response and returns its fresh copy
+func (m *cacheManager) revalidated(entry *cacheEntry, header http.Header, requestTime, responseTime time.Time) *cacheEntry {
+	entry = copyEntry(entry)
+	updateHeaders(entry, header)
+	entry.RequestTime = requestTime
+	entry.ResponseTime = responseTime
+
+	atomic.AddInt64(&m.revalidations, 1)
+
+	tmpName, err := rewriteCacheTemp(entry)
+	if err != nil {
+		return entry
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.commit(copyEntry(entry), tmpName) == nil {
+		m.evict()
+	}
+	return entry
+}
+
+// commit moves the written file into place and puts the entry into the index. Must hold m.mu
+func (m *cacheManager) commit(entry *cacheEntry, tmpName string) error {
+	info, err := os.Stat(tmpName)
+	if err == nil {
+		err = os.Rename(tmpName, entry.Path)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	entry.Size = info.Size()
+	m.replace(entry)
+	return nil
+}
+
+// replace puts the entry into the index instead of the variant with the same file. Must hold m.mu
+func (m *cacheManager) replace(entry *cacheEntry) {
+	var variants []*cacheEntry
+	for _, variant := range m.entries[entry.URL] {
+		if variant.Path == entry.Path {
+			m.lru.Remove(variant.element)
+			m.size -= variant.Size
+			continue
+		}
+		variants = append(variants, variant)
+	}
+	entry.element = m.lru.PushFront(entry)
+	m.size += entry.Size
+	m.entries[entry.URL] = append(variants, entry)
+}
+
+// remove deletes the entry from the index and from disk. Must hold m.mu
+func (m *cacheManager) remove(entry *cacheEntry) {
+	m.lru.Remove(entry.element)
+	m.size -= entry.Size
+	os.Remove(entry.Path)
+
+	var variants []*cacheEntry
+	for _, variant := range m.entries[entry.URL] {
+		if variant != entry {
+			variants = append(variants, variant)
+		}
+	}
+	if len(variants) == 0 {
+		delete(m.entries, entry.URL)
+	} else {
+		m.entries[entry.URL] = variants
+	}
+}
+
+// evict removes the least recently used entries until the limits are met. Must hold m.mu
+func (m *cacheManager) evict() {
+	for m.lru.Len() > 0 &&
+		(m.maxSize > 0 && m.size > m.maxSize || m.maxEntries > 0 && m.lru.Len() > m.maxEntries) {
+		m.remove(m.lru.Back().Value.(*cacheEntry))
+		m.evictions++
+	}
+}
+
+// purge removes all variants of the URL. It returns the number of removed entries
+func (m *cacheManager) purge(targetURL string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	variants := m.entries[targetURL]
+	for _, entry := range variants {
+		m.remove(entry)
+	}
+	return len(variants)
+}
+
+// purgeAll removes every entry. It returns the number of removed entries
+func (m *cacheManager) purgeAll() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := m.lru.Len()
+	for m.lru.Len() > 0 {
+		m.remove(m.lru.Back().Value.(*cacheEntry))
+	}
+	return count
+}
+
+func (m *cacheManager) hit() {
+	atomic.AddInt64(&m.hits, 1)
+}
+
+func (m *cacheManager) miss() {
+	atomic.AddInt64(&m.misses, 1)
+}
+
+func (m *cacheManager) stats() cacheStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := cacheStats{
+		Entries:       m.lru.Len(),
+		Size:          m.size,
+		MaxEntries:    m.maxEntries,
+		MaxSize:       m.maxSize,
+		Hits:          atomic.LoadInt64(&m.hits),
+		Misses:        atomic.LoadInt64(&m.misses),
+		Revalidations: atomic.LoadInt64(&m.revalidations),
+		Stores:        m.stores,
+		Evictions:     m.evictions,
+	}
+	if total := stats.Hits + stats.Misses + stats.Revalidations; total > 0 {
+		stats.HitRatio = float64(stats.Hits+stats.Revalidations) / float64(total)
+	}
+	return stats
+}
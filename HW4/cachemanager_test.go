@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func storeURL(t *testing.T, m *cacheManager, targetURL string, body string) {
+	entry := &cacheEntry{
+		URL:          targetURL,
+		StatusCode:   http.StatusOK,
+		Header:       header("Cache-Control", "max-age=60"),
+		RequestTime:  responseTime,
+		ResponseTime: responseTime,
+	}
+	cw, err := m.newWriter(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(cw, body)
+	if err := cw.commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func lookupURL(m *cacheManager, targetURL string) *cacheEntry {
+	req, _ := http.NewRequest("GET", targetURL, nil)
+	return m.lookup(req)
+}
+
+func TestEvictByCount(t *testing.T) {
+	m, err := newCacheManager(t.TempDir(), 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storeURL(t, m, "http://example.com/a", "a")
+	storeURL(t, m, "http://example.com/b", "b")
+	// "a" becomes the most recently used one, so "b" is evicted
+	lookupURL(m, "http://example.com/a")
+	storeURL(t, m, "http://example.com/c", "c")
+
+	if lookupURL(m, "http://example.com/b") != nil {
+		t.Errorf("least recently used entry was not evicted")
+	}
+	if lookupURL(m, "http://example.com/a") == nil || lookupURL(m, "http://example.com/c") == nil {
+		t.Errorf("recently used entries were evicted")
+	}
+	if stats := m.stats(); stats.Entries != 2 || stats.Evictions != 1 {
+		t.Errorf("got %+v, want 2 entries and 1 eviction", stats)
+	}
+}
+
+func TestEvictBySize(t *testing.T) {
+	dir := t.TempDir()
+	m, err := newCacheManager(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeURL(t, m, "http://example.com/a", strings.Repeat("a", 1000))
+	size := m.stats().Size
+
+	m, err = newCacheManager(dir, size*2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeURL(t, m, "http://example.com/b", strings.Repeat("b", 1000))
+	storeURL(t, m, "http://example.com/c", strings.Repeat("c", 1000))
+
+	if stats := m.stats(); stats.Size > size*2 || stats.Entries != 2 {
+		t.Errorf("got %+v, want at most %d bytes in 2 entries", stats, size*2)
+	}
+	if lookupURL(m, "http://example.com/a") != nil {
+		t.Errorf("entry loaded from disk was not evicted first")
+	}
+}
+
+func TestPurge(t *testing.T) {
+	m, err := newCacheManager(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeURL(t, m, "http://example.com/a", "a")
+	storeURL(t, m, "http://example.com/b", "b")
+
+	if purged := m.purge("http://example.com/a"); purged != 1 {
+		t.Errorf("got %d purged, want 1", purged)
+	}
+	if purged := m.purgeAll(); purged != 1 {
+		t.Errorf("got %d purged, want 1", purged)
+	}
+	if stats := m.stats(); stats.Entries != 0 || stats.Size != 0 {
+		t.Errorf("got %+v, want empty cache", stats)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	m, err := newCacheManager(t.TempDir(), 0, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			targetURL := fmt.Sprintf("http://example.com/%d", i%7)
+			storeURL(t, m, targetURL, targetURL)
+			if entry := lookupURL(m, targetURL); entry != nil {
+				m.revalidated(entry, header("Age", "1"), responseTime, responseTime)
+			}
+			m.stats()
+		}(i)
+	}
+	wg.Wait()
+
+	if stats := m.stats(); stats.Entries > 5 {
+		t.Errorf("got %d entries, want at most 5", stats.Entries)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"example.com/proxy/accesslog"
+)
+
+var top = flag.Int("top", 20, "Number of hosts in the report, 0 for all")
+var sortBy = flag.String("sort", "requests", "Sort hosts by: requests, bytes or latency")
+
+type hostStats struct {
+	Host     string
+	Requests int
+	Bytes    int64
+	Latency  time.Duration
+	Hits     int
+	Misses   int
+	Denied   int
+	Errors   int
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: logstat [flags] <access log> [<access log> ...]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	hosts := map[string]*hostStats{}
+	statuses := map[int]int{}
+	cacheStatuses := map[string]int{}
+	total := &hostStats{Host: "total"}
+	skipped := 0
+
+	for _, path := range flag.Args() {
+		file, err := os.Open(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			record, err := accesslog.Parse(scanner.Text())
+			if err != nil {
+				skipped++
+				continue
+			}
+
+			host := hosts[record.Host()]
+			if host == nil {
+				host = &hostStats{Host: record.Host()}
+				hosts[record.Host()] = host
+			}
+			for _, stats := range []*hostStats{host, total} {
+				add(stats, record)
+			}
+			statuses[record.Status]++
+			cacheStatuses[record.Cache]++
+		}
+		if err := scanner.Err(); err != nil {
+			log.Fatal(err)
+		}
+		file.Close()
+	}
+
+	printHosts(hosts, total)
+	fmt.Println()
+	printStatuses(statuses, cacheStatuses)
+	if skipped > 0 {
+		fmt.Printf("\nSkipped %d lines in unknown format\n", skipped)
+	}
+}
+
+func add(stats *hostStats, record *accesslog.Record) {
+	stats.Requests++
+	stats.Bytes += record.Bytes + record.BytesIn
+	stats.Latency += record.Latency
+	switch record.Cache {
+	case accesslog.CacheHit, accesslog.CacheRevalidated:
+		stats.Hits++
+	case accesslog.CacheMiss:
+		stats.Misses++
+	}
+	if strings.HasPrefix(record.Policy, "denied") {
+		stats.Denied++
+	}
+	if record.Status >= 500 {
+		stats.Errors++
+	}
+}
+
+func printHosts(hosts map[string]*hostStats, total *hostStats) {
+	list := make([]*hostStats, 0, len(hosts))
+	for _, stats := range hosts {
+		list = append(list, stats)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		switch *sortBy {
+		case "bytes":
+			return list[i].Bytes > list[j].Bytes
+		case "latency":
+			return list[i].Latency/time.Duration(list[i].Requests) > list[j].Latency/time.Duration(list[j].Requests)
+		}
+		return list[i].Requests > list[j].Requests
+	})
+	if *top > 0 && len(list) > *top {
+		list = list[:*top]
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "HOST\tREQUESTS\tBYTES\tAVG LATENCY\tHIT RATE\tDENIED\t5XX\t")
+	for _, stats := range append(list, total) {
+		if stats.Requests == 0 {
+			continue
+		}
+		hitRate := "-"
+		if cached := stats.Hits + stats.Misses; cached > 0 {
+			hitRate = fmt.Sprintf("%.1f%%", float64(stats.Hits)*100/float64(cached))
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%d\t%d\t\n",
+			stats.Host,
+			stats.Requests,
+			stats.Bytes,
+			(stats.Latency / time.Duration(stats.Requests)).Round(time.Millisecond),
+			hitRate,
+			stats.Denied,
+			stats.Errors,
+		)
+	}
+	w.Flush()
+}
+
+func printStatuses(statuses map[int]int, cacheStatuses map[string]int) {
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "STATUS\tREQUESTS\t")
+	for _, code := range codes {
+		fmt.Fprintf(w, "%d\t%d\t\n", code, statuses[code])
+	}
+	w.Flush()
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "CACHE\tREQUESTS\t")
+	for _, status := range []string{accesslog.CacheHit, accesslog.CacheRevalidated, accesslog.CacheMiss, accesslog.CacheNone} {
+		if cacheStatuses[status] > 0 {
+			fmt.Fprintf(w, "%s\t%d\t\n", status, cacheStatuses[status])
+		}
+	}
+	w.Flush()
+}
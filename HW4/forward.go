@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Value of the Via header added by the proxy
+const viaName = "1.1 hw4-proxy"
+
+// Hop-by-hop headers are meaningful only for a single connection and are not forwarded (RFC 9110, 7.6.1)
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// newTransport creates the transport shared by all handlers, so upstream connections are reused.
+// Compression is left to the client and the origin, the proxy passes bodies as they are
+func newTransport() *http.Transport {
+	return &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		DisableCompression:    true,
+	}
+}
+
+// removeHopHeaders deletes hop-by-hop headers, including the ones listed in Connection
+func removeHopHeaders(header http.Header) {
+	for _, line := range header.Values("Connection") {
+		for _, name := range strings.Split(line, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// addForwardHeaders marks the request to the origin as passed through the proxy
+func addForwardHeaders(header http.Header, r *http.Request) {
+	header.Add("Via", viaName)
+
+	if ip := clientIP(r); ip != nil {
+		if prior := header.Values("X-Forwarded-For"); len(prior) > 0 {
+			header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+ip.String())
+		} else {
+			header.Set("X-Forwarded-For", ip.String())
+		}
+	}
+}
+
+func copyHeaders(dst, src http.Header) {
+	for header, values := range src {
+		for _, value := range values {
+			dst.Add(header, value)
+		}
+	}
+}
+
+// copyBody streams src to dst and flushes after every chunk, so slow and endless responses
+// (for example, server-sent events) reach the client as soon as they arrive
+func copyBody(dst io.Writer, src io.Reader) (int64, error) {
+	flusher, _ := dst.(http.Flusher)
+
+	buf := make([]byte, 32*1024)
+	var written int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			m, writeErr := dst.Write(buf[:n])
+			written += int64(m)
+			if writeErr != nil {
+				return written, writeErr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
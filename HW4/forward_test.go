@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/proxy/accesslog"
+)
+
+func TestRemoveHopHeaders(t *testing.T) {
+	h := header(
+		"Connection", "close, X-Secret",
+		"X-Secret", "1",
+		"Proxy-Connection", "keep-alive",
+		"Keep-Alive", "timeout=5",
+		"Content-Type", "text/plain",
+	)
+	removeHopHeaders(h)
+
+	for _, name := range []string{"Connection", "X-Secret", "Proxy-Connection", "Keep-Alive"} {
+		if h.Get(name) != "" {
+			t.Errorf("%s was not removed", name)
+		}
+	}
+	if h.Get("Content-Type") != "text/plain" {
+		t.Errorf("end-to-end header was removed")
+	}
+}
+
+// startProxy runs the proxy handler with an empty policy and cache
+func startProxy(t *testing.T) (*httptest.Server, *http.Client) {
+	dir := t.TempDir()
+	accessLog, err := accesslog.NewWriter(filepath.Join(dir, "proxy.log"), accesslog.FormatJSON, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { accessLog.Close() })
+
+	cache, err := newCacheManager(filepath.Join(dir, "cache"), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessPolicy, err := loadPolicyHolder(writePolicy(t, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := httptest.NewServer(handleRequest(accessLog, cache, accessPolicy, newTransport()))
+	t.Cleanup(proxy.Close)
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	return proxy, client
+}
+
+func TestForwardHeaders(t *testing.T) {
+	var got http.Header
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("X-Origin", "1")
+	}))
+	defer origin.Close()
+
+	_, client := startProxy(t)
+	req, _ := http.NewRequest("GET", origin.URL, nil)
+	req.Header.Set("Proxy-Connection", "keep-alive")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if got.Get("Proxy-Connection") != "" {
+		t.Errorf("Proxy-Connection was forwarded")
+	}
+	if got.Get("Via") != viaName {
+		t.Errorf("got Via %q, want %q", got.Get("Via"), viaName)
+	}
+	if xff := got.Get("X-Forwarded-For"); xff != "10.0.0.1, 127.0.0.1" {
+		t.Errorf("got X-Forwarded-For %q", xff)
+	}
+	if resp.Header.Get("Keep-Alive") != "" || resp.Header.Get("X-Origin") != "1" {
+		t.Errorf("got response headers %v", resp.Header)
+	}
+	if resp.Header.Get("Via") != viaName {
+		t.Errorf("got response Via %q, want %q", resp.Header.Get("Via"), viaName)
+	}
+}
+
+func TestStreamingAndCaching(t *testing.T) {
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, "first\n")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "second\n")
+	}))
+	defer origin.Close()
+	defer close(release)
+
+	_, client := startProxy(t)
+	resp, err := client.Get(origin.URL + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first line must arrive before the origin finishes the response
+	lines := make(chan string)
+	reader := bufio.NewReader(resp.Body)
+	go func() {
+		line, _ := reader.ReadString('\n')
+		lines <- line
+	}()
+	select {
+	case line := <-lines:
+		if line != "first\n" {
+			t.Errorf("got %q, want first line", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("response is not streamed")
+	}
+
+	release <- struct{}{}
+	rest, _ := io.ReadAll(reader)
+	resp.Body.Close()
+	if string(rest) != "second\n" {
+		t.Errorf("got %q, want second line", rest)
+	}
+
+	// Now the response is served from the cache
+	origin.Close()
+	resp, err = client.Get(origin.URL + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "first\nsecond\n" || resp.Header.Get("Age") == "" {
+		t.Errorf("got %q with headers %v, want cached response", body, resp.Header)
+	}
+}
+
+func TestAdminIsNotProxied(t *testing.T) {
+	proxy, _ := startProxy(t)
+	resp, err := http.Get(proxy.URL + "/_proxy/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `"entries":0`) {
+		t.Errorf("got %q, want stats", body)
+	}
+}
+
+func TestAdminThroughProxy(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, "cached")
+	}))
+	defer origin.Close()
+
+	proxy, client := startProxy(t)
+	resp, err := client.Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	// Sent through the proxy, the purge would come to the admin endpoint from 127.0.0.1
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(proxy.URL, "http://"))
+	for _, host := range []string{"127.0.0.1", "localhost"} {
+		req, _ := http.NewRequest(http.MethodDelete, "http://"+net.JoinHostPort(host, port)+"/_proxy/stats", nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusLoopDetected {
+			t.Errorf("%s: got %d, want %d", host, resp.StatusCode, http.StatusLoopDetected)
+		}
+	}
+
+	resp, err = http.Get(proxy.URL + "/_proxy/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `"entries":1`) {
+		t.Errorf("got %q, want the cached entry kept", body)
+	}
+}
+
+func TestTunnelEndsWhenOneSideIsOver(t *testing.T) {
+	defer func(idle time.Duration) { tunnelIdle = idle }(tunnelIdle)
+	tunnelIdle = 100 * time.Millisecond
+
+	// The target reads the request and then stays silent without closing the connection
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+		<-done
+	}()
+
+	proxy, _ := startProxy(t)
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "CONNECT "+target.Addr().String()+" HTTP/1.1\r\nHost: "+target.Addr().String()+"\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	// The client is done sending, the tunnel must end although the target never answers
+	io.WriteString(conn, "request")
+	conn.(*net.TCPConn).CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("got %v, want the tunnel closed", err)
+	}
+}
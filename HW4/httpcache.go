@@ -0,0 +1,282 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Heuristic freshness (RFC 9111, 4.2.2): 10% of the time since Last-Modified, but not more than a day
+const (
+	heuristicFraction = 10
+	maxHeuristicAge   = 24 * time.Hour
+)
+
+// Statuses that may be cached without explicit freshness information (RFC 9110, 15.1)
+var heuristicallyCacheable = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// cacheEntry describes one stored response (one variant of a URL)
+type cacheEntry struct {
+	URL          string
+	Path         string
+	StatusCode   int
+	Header       http.Header
+	VaryValues   string
+	RequestTime  time.Time
+	ResponseTime time.Time
+	Size         int64 // size of the cache file
+
+	element *list.Element // position in the LRU list of the cache manager
+}
+
+// parseCacheControl splits Cache-Control header into directives. Names are lowercased,
+// directives without a value are mapped to an empty string
+func parseCacheControl(header http.Header) map[string]string {
+	directives := map[string]string{}
+	for _, line := range header.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, value, _ := strings.Cut(part, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			directives[name] = strings.Trim(strings.TrimSpace(value), "\"")
+		}
+	}
+	return directives
+}
+
+// parseSeconds parses delta-seconds. ok is false if the value is missing or malformed
+func parseSeconds(value string) (time.Duration, bool) {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// understood tells if a stored response with the status can be replayed as a complete answer.
+// Partial and not modified replies only make sense for the request that asked for them
+func understood(statusCode int) bool {
+	switch statusCode {
+	case http.StatusPartialContent, http.StatusNotModified:
+		return false
+	}
+	return statusCode >= 200 && http.StatusText(statusCode) != ""
+}
+
+// isStorable decides if the response to the request may be stored by a shared cache (RFC 9111, 3)
+func isStorable(req *http.Request, resp *http.Response) bool {
+	if req.Method != http.MethodGet {
+		return false
+	}
+	// Only whole representations are stored
+	if req.Header.Get("Range") != "" || !understood(resp.StatusCode) {
+		return false
+	}
+
+	reqCC := parseCacheControl(req.Header)
+	respCC := parseCacheControl(resp.Header)
+
+	if _, ok := reqCC["no-store"]; ok {
+		return false
+	}
+	if _, ok := respCC["no-store"]; ok {
+		return false
+	}
+	// We are a shared cache, private responses are only for the user agent
+	if _, ok := respCC["private"]; ok {
+		return false
+	}
+	if strings.TrimSpace(resp.Header.Get("Vary")) == "*" {
+		return false
+	}
+
+	_, public := respCC["public"]
+	_, sMaxAge := respCC["s-maxage"]
+	_, mustRevalidate := respCC["must-revalidate"]
+	if req.Header.Get("Authorization") != "" && !public && !sMaxAge && !mustRevalidate {
+		return false
+	}
+
+	if public || sMaxAge || resp.Header.Get("Expires") != "" {
+		return true
+	}
+	if _, ok := respCC["max-age"]; ok {
+		return true
+	}
+	return heuristicallyCacheable[resp.StatusCode]
+}
+
+// freshnessLifetime computes how long the response stays fresh after it was generated (RFC 9111, 4.2.1)
+func freshnessLifetime(statusCode int, header http.Header) time.Duration {
+	cc := parseCacheControl(header)
+
+	if value, ok := cc["s-maxage"]; ok {
+		if lifetime, ok := parseSeconds(value); ok {
+			return lifetime
+		}
+	}
+	if value, ok := cc["max-age"]; ok {
+		if lifetime, ok := parseSeconds(value); ok {
+			return lifetime
+		}
+	}
+
+	if expiresValue := header.Get("Expires"); expiresValue != "" {
+		// Invalid Expires values (for example "0") mean "already expired"
+		expires, err := http.ParseTime(expiresValue)
+		if err != nil {
+			return 0
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			return 0
+		}
+		if lifetime := expires.Sub(date); lifetime > 0 {
+			return lifetime
+		}
+		return 0
+	}
+
+	if !heuristicallyCacheable[statusCode] {
+		return 0
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return 0
+	}
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		return 0
+	}
+	lifetime := date.Sub(lastModified) / heuristicFraction
+	if lifetime < 0 {
+		return 0
+	}
+	if lifetime > maxHeuristicAge {
+		return maxHeuristicAge
+	}
+	return lifetime
+}
+
+// currentAge estimates the age of the stored response at the moment now (RFC 9111, 4.2.3)
+func currentAge(entry *cacheEntry, now time.Time) time.Duration {
+	var apparentAge time.Duration
+	if date, err := http.ParseTime(entry.Header.Get("Date")); err == nil {
+		apparentAge = entry.ResponseTime.Sub(date)
+		if apparentAge < 0 {
+			apparentAge = 0
+		}
+	}
+
+	ageValue, _ := parseSeconds(entry.Header.Get("Age"))
+	responseDelay := entry.ResponseTime.Sub(entry.RequestTime)
+	correctedAgeValue := ageValue + responseDelay
+
+	correctedInitialAge := apparentAge
+	if correctedAgeValue > correctedInitialAge {
+		correctedInitialAge = correctedAgeValue
+	}
+
+	residentTime := now.Sub(entry.ResponseTime)
+	return correctedInitialAge + residentTime
+}
+
+// isFresh tells if the stored response can be served for the request without contacting the origin
+func isFresh(entry *cacheEntry, req *http.Request, now time.Time) bool {
+	respCC := parseCacheControl(entry.Header)
+	if _, ok := respCC["no-cache"]; ok {
+		return false
+	}
+
+	reqCC := parseCacheControl(req.Header)
+	if _, ok := reqCC["no-cache"]; ok {
+		return false
+	}
+	// HTTP/1.0 clients ask for a fresh copy with Pragma
+	if len(reqCC) == 0 && strings.Contains(req.Header.Get("Pragma"), "no-cache") {
+		return false
+	}
+
+	lifetime := freshnessLifetime(entry.StatusCode, entry.Header)
+	age := currentAge(entry, now)
+
+	if value, ok := reqCC["max-age"]; ok {
+		if maxAge, ok := parseSeconds(value); ok && age > maxAge {
+			return false
+		}
+	}
+	if value, ok := reqCC["min-fresh"]; ok {
+		if minFresh, ok := parseSeconds(value); ok {
+			age += minFresh
+		}
+	}
+
+	return lifetime > age
+}
+
+// hasValidators tells if the stored response can be revalidated with a conditional request
+func hasValidators(entry *cacheEntry) bool {
+	return entry.Header.Get("ETag") != "" || entry.Header.Get("Last-Modified") != ""
+}
+
+// addValidators turns the request into a conditional one using the validators of the stored response
+func addValidators(req *http.Request, entry *cacheEntry) {
+	// Client's own conditions are dropped: the answer must tell if our copy is still valid
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+
+	if eTag := entry.Header.Get("ETag"); eTag != "" {
+		req.Header.Set("If-None-Match", eTag)
+	}
+	if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+}
+
+// updateHeaders refreshes the stored headers with the ones from a 304 response (RFC 9111, 4.3.4)
+func updateHeaders(entry *cacheEntry, header http.Header) {
+	for name, values := range header {
+		switch http.CanonicalHeaderKey(name) {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding", "Content-Range":
+			continue
+		}
+		entry.Header[name] = values
+	}
+}
+
+// varyValues builds a canonical string of the request headers that are listed in Vary
+func varyValues(vary string, reqHeader http.Header) string {
+	var names []string
+	for _, name := range strings.Split(vary, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	sort.Strings(names)
+
+	var values []string
+	for _, name := range names {
+		values = append(values, name+"="+strings.Join(reqHeader.Values(name), ","))
+	}
+	return strings.Join(values, ";")
+}
+
+// findVariant returns the stored variant that matches the request
+func findVariant(variants []*cacheEntry, req *http.Request) *cacheEntry {
+	for _, entry := range variants {
+		if varyValues(entry.Header.Get("Vary"), req.Header) == entry.VaryValues {
+			return entry
+		}
+	}
+	return nil
+}
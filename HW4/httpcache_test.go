@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+var responseTime = time.Date(2023, 3, 21, 19, 0, 0, 0, time.UTC)
+
+func header(pairs ...string) http.Header {
+	h := http.Header{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		h.Add(pairs[i], pairs[i+1])
+	}
+	return h
+}
+
+var responsesToStore = []struct {
+	name   string
+	method string
+	req    http.Header
+	status int
+	resp   http.Header
+	out    bool
+}{
+	{"plain 200", "GET", header(), 200, header(), true},
+	{"post", "POST", header(), 200, header("Cache-Control", "max-age=60"), false},
+	{"no-store response", "GET", header(), 200, header("Cache-Control", "no-store"), false},
+	{"no-store request", "GET", header("Cache-Control", "no-store"), 200, header(), false},
+	{"private", "GET", header(), 200, header("Cache-Control", "private, max-age=60"), false},
+	{"vary star", "GET", header(), 200, header("Vary", "*"), false},
+	{"authorization", "GET", header("Authorization", "Basic a"), 200, header("Cache-Control", "max-age=60"), false},
+	{"authorization public", "GET", header("Authorization", "Basic a"), 200, header("Cache-Control", "public"), true},
+	{"500 without freshness", "GET", header(), 500, header(), false},
+	{"500 with max-age", "GET", header(), 500, header("Cache-Control", "max-age=60"), true},
+	{"304 to conditional request", "GET", header("If-None-Match", `"v1"`), 304, header("Cache-Control", "max-age=60", "ETag", `"v1"`), false},
+	{"206 to range request", "GET", header("Range", "bytes=0-9"), 206, header("Cache-Control", "public", "Content-Range", "bytes 0-9/100"), false},
+	{"206 without freshness", "GET", header(), 206, header("Last-Modified", "Tue, 21 Mar 2023 18:00:00 GMT"), false},
+	{"200 to range request", "GET", header("Range", "bytes=0-9"), 200, header("Cache-Control", "max-age=60"), false},
+	{"unknown status", "GET", header(), 299, header("Cache-Control", "max-age=60"), false},
+}
+
+func TestIsStorable(t *testing.T) {
+	for _, tt := range responsesToStore {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, "http://example.com/", nil)
+			req.Header = tt.req
+			resp := &http.Response{StatusCode: tt.status, Header: tt.resp}
+			got := isStorable(req, resp)
+			if got != tt.out {
+				t.Errorf("got %v, want %v", got, tt.out)
+			}
+		})
+	}
+}
+
+var lifetimes = []struct {
+	name   string
+	status int
+	header http.Header
+	out    time.Duration
+}{
+	{"max-age", 200, header("Cache-Control", "max-age=60"), time.Minute},
+	{"s-maxage wins", 200, header("Cache-Control", "max-age=60, s-maxage=120"), 2 * time.Minute},
+	{"expires", 200, header(
+		"Date", "Tue, 21 Mar 2023 19:00:00 GMT",
+		"Expires", "Tue, 21 Mar 2023 20:00:00 GMT"), time.Hour},
+	{"invalid expires", 200, header(
+		"Date", "Tue, 21 Mar 2023 19:00:00 GMT",
+		"Expires", "0"), 0},
+	{"heuristic", 200, header(
+		"Date", "Tue, 21 Mar 2023 19:00:00 GMT",
+		"Last-Modified", "Tue, 21 Mar 2023 09:00:00 GMT"), time.Hour},
+	{"heuristic limit", 200, header(
+		"Date", "Tue, 21 Mar 2023 19:00:00 GMT",
+		"Last-Modified", "Tue, 21 Mar 2020 09:00:00 GMT"), 24 * time.Hour},
+	{"no heuristic for 500", 500, header(
+		"Date", "Tue, 21 Mar 2023 19:00:00 GMT",
+		"Last-Modified", "Tue, 21 Mar 2023 09:00:00 GMT"), 0},
+	{"nothing", 200, header(), 0},
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	for _, tt := range lifetimes {
+		t.Run(tt.name, func(t *testing.T) {
+			got := freshnessLifetime(tt.status, tt.header)
+			if got != tt.out {
+				t.Errorf("got %v, want %v", got, tt.out)
+			}
+		})
+	}
+}
+
+var entriesToCheck = []struct {
+	name   string
+	header http.Header
+	req    http.Header
+	after  time.Duration
+	out    bool
+}{
+	{"fresh", header("Cache-Control", "max-age=60", "Date", "Tue, 21 Mar 2023 19:00:00 GMT"), header(), 30 * time.Second, true},
+	{"stale", header("Cache-Control", "max-age=60", "Date", "Tue, 21 Mar 2023 19:00:00 GMT"), header(), 90 * time.Second, false},
+	{"age header", header("Cache-Control", "max-age=60", "Age", "50"), header(), 20 * time.Second, false},
+	{"no-cache response", header("Cache-Control", "no-cache, max-age=60"), header(), 0, false},
+	{"no-cache request", header("Cache-Control", "max-age=60"), header("Cache-Control", "no-cache"), 0, false},
+	{"pragma", header("Cache-Control", "max-age=60"), header("Pragma", "no-cache"), 0, false},
+	{"request max-age", header("Cache-Control", "max-age=60"), header("Cache-Control", "max-age=10"), 20 * time.Second, false},
+	{"min-fresh", header("Cache-Control", "max-age=60"), header("Cache-Control", "min-fresh=30"), 40 * time.Second, false},
+}
+
+func TestIsFresh(t *testing.T) {
+	for _, tt := range entriesToCheck {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := &cacheEntry{
+				StatusCode:   200,
+				Header:       tt.header,
+				RequestTime:  responseTime,
+				ResponseTime: responseTime,
+			}
+			req, _ := http.NewRequest("GET", "http://example.com/", nil)
+			req.Header = tt.req
+			got := isFresh(entry, req, responseTime.Add(tt.after))
+			if got != tt.out {
+				t.Errorf("got %v, want %v", got, tt.out)
+			}
+		})
+	}
+}
+
+func TestFindVariant(t *testing.T) {
+	gzip := &cacheEntry{
+		Header:     header("Vary", "Accept-Encoding"),
+		VaryValues: "Accept-Encoding=gzip",
+	}
+	plain := &cacheEntry{
+		Header:     header("Vary", "Accept-Encoding"),
+		VaryValues: "Accept-Encoding=",
+	}
+	variants := []*cacheEntry{gzip, plain}
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	if got := findVariant(variants, req); got != plain {
+		t.Errorf("got %v, want plain variant", got)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	if got := findVariant(variants, req); got != gzip {
+		t.Errorf("got %v, want gzip variant", got)
+	}
+	req.Header.Set("Accept-Encoding", "br")
+	if got := findVariant(variants, req); got != nil {
+		t.Errorf("got %v, want no variant", got)
+	}
+}
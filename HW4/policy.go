@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policy file format: one rule per line, "#" starts a comment.
+//
+//	<allow|deny> <matcher>=<value> [<matcher>=<value> ...]
+//
+// A rule matches when all of its matchers match. Matchers:
+//
+//	host=ok.ru            -- exact host
+//	domain=ok.ru          -- the domain and all its subdomains (ok.ru, www.ok.ru, but not book.ru)
+//	glob=http://*.ru/ads* -- shell-like pattern for the whole URL ("*" -- any string, "?" -- any char)
+//	regex=^http://.*\.js$ -- regular expression for the whole URL
+//	cidr=10.0.0.0/8       -- IP of the target host (the host name is resolved if needed)
+//	client=127.0.0.1/32   -- IP of the client
+//	method=POST,PUT       -- HTTP methods
+//
+// A line with a single word is the old blacklist format and means "deny domain=<word>".
+// Allow rules take precedence over deny rules, requests that match nothing are allowed.
+
+// policyRequest is what the policy knows about a request
+type policyRequest struct {
+	Method   string
+	URL      string
+	Host     string // without port
+	ClientIP net.IP
+}
+
+type matcher func(req *policyRequest, targetIPs func() []net.IP) bool
+
+type policyRule struct {
+	Allow bool
+	Name  string // file:line and the rule text, written to the access log
+	// Line and Text are shown on the rejection page, which must not reveal the path of the file
+	Line     int
+	Text     string
+	matchers []matcher
+}
+
+type policy struct {
+	rules []*policyRule
+}
+
+// policyHolder keeps the current policy, so it can be replaced on reload while requests are handled
+type policyHolder struct {
+	path string
+
+	mu     sync.RWMutex
+	policy *policy
+}
+
+// verdict is the result of the policy check. Rule is nil if no rule matched
+type verdict struct {
+	Allowed bool
+	Rule    *policyRule
+}
+
+func (v verdict) String() string {
+	if v.Rule == nil {
+		return "allowed"
+	}
+	if v.Allowed {
+		return "allowed by " + v.Rule.Name
+	}
+	return "denied by " + v.Rule.Name
+}
+
+func loadPolicyHolder(path string) (*policyHolder, error) {
+	p, err := loadPolicy(path)
+	if err != nil {
+		return nil, err
+	}
+	return &policyHolder{path: path, policy: p}, nil
+}
+
+// reload reads the policy file again. The old policy is kept if the new one is invalid
+func (h *policyHolder) reload() error {
+	p, err := loadPolicy(h.path)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.policy = p
+	h.mu.Unlock()
+	return nil
+}
+
+func (h *policyHolder) check(req *policyRequest) verdict {
+	h.mu.RLock()
+	p := h.policy
+	h.mu.RUnlock()
+	return p.check(req)
+}
+
+func loadPolicy(path string) (*policy, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	p := &policy{}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		rule, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+		rule.Name = fmt.Sprintf("%s:%d: %s", path, lineNumber, line)
+		rule.Line, rule.Text = lineNumber, line
+		p.rules = append(p.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func parseRule(line string) (*policyRule, error) {
+	fields := strings.Fields(line)
+
+	// Old blacklist format: just a site
+	if len(fields) == 1 {
+		fields = []string{"deny", "domain=" + fields[0]}
+	}
+
+	rule := &policyRule{}
+	switch strings.ToLower(fields[0]) {
+	case "allow":
+		rule.Allow = true
+	case "deny":
+		rule.Allow = false
+	default:
+		return nil, fmt.Errorf("unknown action %q, expected allow or deny", fields[0])
+	}
+
+	if len(fields) == 1 {
+		return nil, fmt.Errorf("rule without matchers")
+	}
+	for _, field := range fields[1:] {
+		name, value, ok := strings.Cut(field, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("bad matcher %q, expected name=value", field)
+		}
+		m, err := parseMatcher(strings.ToLower(name), value)
+		if err != nil {
+			return nil, err
+		}
+		rule.matchers = append(rule.matchers, m)
+	}
+	return rule, nil
+}
+
+func parseMatcher(name, value string) (matcher, error) {
+	switch name {
+	case "host":
+		host := strings.ToLower(value)
+		return func(req *policyRequest, _ func() []net.IP) bool {
+			return strings.ToLower(req.Host) == host
+		}, nil
+	case "domain":
+		domain := strings.ToLower(strings.TrimPrefix(value, "."))
+		return func(req *policyRequest, _ func() []net.IP) bool {
+			host := strings.ToLower(req.Host)
+			return host == domain || strings.HasSuffix(host, "."+domain)
+		}, nil
+	case "glob":
+		re, err := regexp.Compile(globToRegexp(value))
+		if err != nil {
+			return nil, err
+		}
+		return func(req *policyRequest, _ func() []net.IP) bool {
+			return re.MatchString(req.URL)
+		}, nil
+	case "regex":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(req *policyRequest, _ func() []net.IP) bool {
+			return re.MatchString(req.URL)
+		}, nil
+	case "cidr":
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(_ *policyRequest, targetIPs func() []net.IP) bool {
+			for _, ip := range targetIPs() {
+				if network.Contains(ip) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "client":
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(req *policyRequest, _ func() []net.IP) bool {
+			return req.ClientIP != nil && network.Contains(req.ClientIP)
+		}, nil
+	case "method":
+		methods := strings.Split(strings.ToUpper(value), ",")
+		return func(req *policyRequest, _ func() []net.IP) bool {
+			for _, method := range methods {
+				if req.Method == method {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown matcher %q", name)
+}
+
+// globToRegexp converts a shell-like pattern into an anchored regular expression
+func globToRegexp(glob string) string {
+	var re strings.Builder
+	re.WriteString("^")
+	for _, c := range glob {
+		switch c {
+		case '*':
+			re.WriteString(".*")
+		case '?':
+			re.WriteString(".")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	return re.String()
+}
+
+// check finds the verdict for the request. Allow rules override deny rules
+func (p *policy) check(req *policyRequest) verdict {
+	// The target host is resolved only if some rule needs its IP
+	var targetIPs []net.IP
+	resolved := false
+	lookup := func() []net.IP {
+		if !resolved {
+			resolved = true
+			targetIPs = resolveHost(req.Host)
+		}
+		return targetIPs
+	}
+
+	var denied *policyRule
+	for _, rule := range p.rules {
+		if !rule.matches(req, lookup) {
+			continue
+		}
+		if rule.Allow {
+			return verdict{Allowed: true, Rule: rule}
+		}
+		if denied == nil {
+			denied = rule
+		}
+	}
+	if denied != nil {
+		return verdict{Allowed: false, Rule: denied}
+	}
+	return verdict{Allowed: true}
+}
+
+func (r *policyRule) matches(req *policyRequest, targetIPs func() []net.IP) bool {
+	for _, m := range r.matchers {
+		if !m(req, targetIPs) {
+			return false
+		}
+	}
+	return true
+}
+
+func resolveHost(host string) []net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips
+}
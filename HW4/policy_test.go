@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testPolicy = `# test policy
+ok.ru
+deny domain=vk.com
+allow host=dev.vk.com
+deny glob=http://*.example.com/ads/*
+deny regex=\.exe$
+deny cidr=10.0.0.0/8
+deny method=DELETE,PUT domain=api.com
+deny client=192.168.1.0/24 host=intranet.net
+`
+
+func writePolicy(t *testing.T, text string) string {
+	path := filepath.Join(t.TempDir(), "policy.txt")
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+var requestsToCheck = []struct {
+	name    string
+	method  string
+	url     string
+	host    string
+	client  string
+	allowed bool
+	line    int
+}{
+	{"old format exact", "GET", "http://ok.ru/", "ok.ru", "127.0.0.1", false, 2},
+	{"old format subdomain", "GET", "http://m.ok.ru/", "m.ok.ru", "127.0.0.1", false, 2},
+	{"not a substring", "GET", "http://book.ru/", "book.ru", "127.0.0.1", true, 0},
+	{"domain", "GET", "http://www.vk.com/feed", "www.vk.com", "127.0.0.1", false, 3},
+	{"allow overrides deny", "GET", "http://dev.vk.com/", "dev.vk.com", "127.0.0.1", true, 4},
+	{"glob", "GET", "http://cdn.example.com/ads/banner.png", "cdn.example.com", "127.0.0.1", false, 5},
+	{"glob other path", "GET", "http://cdn.example.com/img/banner.png", "cdn.example.com", "127.0.0.1", true, 0},
+	{"regex", "GET", "http://files.net/setup.exe", "files.net", "127.0.0.1", false, 6},
+	{"cidr", "GET", "http://10.1.2.3/", "10.1.2.3", "127.0.0.1", false, 7},
+	{"cidr outside", "GET", "http://11.1.2.3/", "11.1.2.3", "127.0.0.1", true, 0},
+	{"method", "DELETE", "http://api.com/users/1", "api.com", "127.0.0.1", false, 8},
+	{"other method", "GET", "http://api.com/users/1", "api.com", "127.0.0.1", true, 0},
+	{"client", "GET", "http://intranet.net/", "intranet.net", "192.168.1.15", false, 9},
+	{"other client", "GET", "http://intranet.net/", "intranet.net", "192.168.2.15", true, 0},
+}
+
+func TestPolicyCheck(t *testing.T) {
+	p, err := loadPolicy(writePolicy(t, testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range requestsToCheck {
+		t.Run(tt.name, func(t *testing.T) {
+			got := p.check(&policyRequest{
+				Method:   tt.method,
+				URL:      tt.url,
+				Host:     tt.host,
+				ClientIP: net.ParseIP(tt.client),
+			})
+			if got.Allowed != tt.allowed {
+				t.Errorf("got %v, want allowed=%v", got, tt.allowed)
+			}
+			if tt.line == 0 && got.Rule != nil && !got.Allowed {
+				t.Errorf("got %v, want no rule", got)
+			}
+			if tt.line != 0 && (got.Rule == nil || !strings.Contains(got.Rule.Name, fmt.Sprintf(":%d:", tt.line))) {
+				t.Errorf("got %v, want rule from line %d", got, tt.line)
+			}
+		})
+	}
+}
+
+var badPolicies = []struct {
+	name string
+	text string
+}{
+	{"unknown action", "block domain=ok.ru"},
+	{"unknown matcher", "deny site=ok.ru"},
+	{"no value", "deny domain="},
+	{"bad regex", "deny regex=("},
+	{"bad cidr", "deny cidr=10.0.0.0/33"},
+}
+
+func TestBadPolicy(t *testing.T) {
+	for _, tt := range badPolicies {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := loadPolicy(writePolicy(t, tt.text)); err == nil {
+				t.Errorf("got no error for %q", tt.text)
+			}
+		})
+	}
+}
+
+func TestPolicyReload(t *testing.T) {
+	path := writePolicy(t, "deny domain=ok.ru")
+	h, err := loadPolicyHolder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &policyRequest{Method: "GET", URL: "http://ok.ru/", Host: "ok.ru"}
+	if h.check(req).Allowed {
+		t.Errorf("request is allowed before reload")
+	}
+
+	os.WriteFile(path, []byte("deny domain=vk.com"), 0644)
+	if err := h.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !h.check(req).Allowed {
+		t.Errorf("request is denied after reload")
+	}
+
+	// Broken policy is not applied
+	os.WriteFile(path, []byte("deny regex=("), 0644)
+	if err := h.reload(); err == nil {
+		t.Errorf("got no error for broken policy")
+	}
+	if !h.check(req).Allowed {
+		t.Errorf("broken policy was applied")
+	}
+}
+
+func TestDenyAccessPage(t *testing.T) {
+	path := writePolicy(t, testPolicy)
+	p, err := loadPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := p.check(&policyRequest{Method: "GET", URL: "http://vk.com/", Host: "vk.com"})
+	w := httptest.NewRecorder()
+	denyAccess(w, v)
+
+	body := w.Body.String()
+	if w.Code != http.StatusForbidden || !strings.Contains(body, "line 3: <code>deny domain=vk.com</code>") {
+		t.Errorf("got %d %q, want the rule", w.Code, body)
+	}
+	// The path stays in the access log only
+	if strings.Contains(body, filepath.Base(path)) {
+		t.Errorf("got %q, want no path of the policy file", body)
+	}
+	if !strings.Contains(v.String(), path+":3:") {
+		t.Errorf("got %q, want the path in the log", v.String())
+	}
+}
@@ -2,193 +2,454 @@ package main
 
 import (
 	"bufio"
-	"crypto/sha256"
-	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"html"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"example.com/proxy/accesslog"
 )
 
-var bList = flag.String("bl", "blacklist.txt", "Black list of sites and domains")
+var bList = flag.String("bl", "blacklist.txt", "Access policy file (black list of sites and domains), reloaded on SIGHUP")
 var addr = flag.String("addr", ":8081", "Addr of the localhost server. Example: \":8081\"")
 var cachePath = flag.String("cache", "./cache", "Path to cache folder")
+var cacheSize = flag.Int64("cachesize", 100, "Max size of the cache folder (in MB), 0 for no limit")
+var cacheEntries = flag.Int("cacheentries", 1000, "Max number of cached responses, 0 for no limit")
+var logPath = flag.String("log", "proxy.log", "Path to access log")
+var logFormat = flag.String("logformat", accesslog.FormatCombined, "Access log format: combined or json")
+var logSize = flag.Int64("logsize", 10, "Max size of the access log (in MB) before rotation, 0 for no rotation")
+var logBackups = flag.Int("logbackups", 3, "Number of rotated access logs to keep")
 
 func main() {
 	flag.Parse()
 
 	// Create a log file
-	logFile, err := os.OpenFile("proxy.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	accessLog, err := accesslog.NewWriter(*logPath, *logFormat, *logSize<<20, *logBackups)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer accessLog.Close()
+
+	cache, err := newCacheManager(*cachePath, *cacheSize<<20, *cacheEntries)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer logFile.Close()
 
-	cache := map[string]string{}
-	items, _ := ioutil.ReadDir(*cachePath)
-	for _, item := range items {
-		file, _ := os.Open(*cachePath + "/" + item.Name())
-		scanner := bufio.NewScanner(file)
-		scanner.Scan()
-		isCurrURL := strings.Split(scanner.Text(), " ")
-		if len(isCurrURL) <= 1 {
-			file.Close()
-			continue
+	accessPolicy, err := loadPolicyHolder(*bList)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Reload the policy without restarting the proxy: kill -HUP <pid>
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			if err := accessPolicy.reload(); err != nil {
+				log.Println("Policy is not reloaded:", err)
+			} else {
+				log.Println("Policy reloaded from", *bList)
+			}
 		}
-		currURL := isCurrURL[1]
-		scanner.Scan()
-		isAddingTime := strings.Split(scanner.Text(), "$")
-		if len(isAddingTime) <= 1 {
-			file.Close()
-			continue
+	}()
+
+	// Start the server and listen on port.
+	// The handler is passed directly, because ServeMux does not route CONNECT requests to "/"
+	http.ListenAndServe(*addr, handleRequest(accessLog, cache, accessPolicy, newTransport()))
+}
+
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// denyAccess writes the rejection page with the rule that blocked the request
+func denyAccess(w http.ResponseWriter, v verdict) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html>\n<head><title>403 Forbidden</title></head>\n<body>\n"+
+		"<h1>Access denied!</h1>\n<p>This site is blocked by the proxy policy.</p>\n"+
+		"<p>Rule at line %d: <code>%s</code></p>\n</body>\n</html>\n", v.Rule.Line, html.EscapeString(v.Rule.Text))
+}
+
+// targetAddr is the "host:port" the request is forwarded to
+func targetAddr(r *http.Request) string {
+	if r.Method == http.MethodConnect {
+		// For CONNECT requests the target is in the authority form: "host:port"
+		if _, _, err := net.SplitHostPort(r.Host); err != nil {
+			return net.JoinHostPort(r.Host, "443")
 		}
-		cache[currURL] = *cachePath + "/" + item.Name()
-		file.Close()
+		return r.Host
 	}
+	if r.URL.Port() != "" {
+		return r.URL.Host
+	}
+	if r.URL.Scheme == "https" {
+		return net.JoinHostPort(r.URL.Hostname(), "443")
+	}
+	return net.JoinHostPort(r.URL.Hostname(), "80")
+}
 
-	file, _ := os.Open(*bList)
-	scanner := bufio.NewScanner(file)
-	var blackList []string
-	for scanner.Scan() {
-		blackList = append(blackList, scanner.Text())
+// loopsBack tells if the target is the proxy itself: the port the request came to at one of
+// the addresses of this machine. Forwarded there, the request would reach the admin endpoint
+// from 127.0.0.1
+func loopsBack(r *http.Request, target string) bool {
+	local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return false
+	}
+	localHost, localPort, err := net.SplitHostPort(local.String())
+	if err != nil {
+		return false
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil || port != localPort {
+		return false
 	}
-	file.Close()
 
-	// Start the server and listen on port
-	http.HandleFunc("/", handleRequest(logFile, cache, blackList, *cachePath))
-	http.ListenAndServe(*addr, nil)
+	addrs, err := net.DefaultResolver.LookupIPAddr(r.Context(), host)
+	if err != nil {
+		return false
+	}
+	ownAddrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if addr.IP.IsLoopback() || addr.IP.IsUnspecified() || addr.IP.Equal(net.ParseIP(localHost)) {
+			return true
+		}
+		for _, own := range ownAddrs {
+			if ipNet, ok := own.(*net.IPNet); ok && ipNet.IP.Equal(addr.IP) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-func handleRequest(logFile *os.File, cache map[string]string, blackList []string, cachePath string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Create a new request to the target server
-		targetURL := r.URL.String()
+// handleConnect opens a TCP tunnel to the requested host (used for https:// traffic)
+func handleConnect(w http.ResponseWriter, r *http.Request, record *accesslog.Record, accessPolicy *policyHolder) {
+	target := targetAddr(r)
+	record.URL = target
 
-		for _, blocked := range blackList {
-			if strings.Contains(targetURL, blocked) {
-				logMessage := fmt.Sprintf("%s %s %d\n", r.Method, targetURL, http.StatusForbidden)
-				logFile.WriteString(logMessage)
-				http.Error(w, "Access denied! This site is blacklisted", http.StatusForbidden)
-				return
-			}
+	host, _, _ := net.SplitHostPort(target)
+	v := accessPolicy.check(&policyRequest{
+		Method:   r.Method,
+		URL:      "https://" + target + "/",
+		Host:     host,
+		ClientIP: clientIP(r),
+	})
+	record.Policy = v.String()
+	if !v.Allowed {
+		denyAccess(w, v)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Tunneling is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	targetConn, err := net.DialTimeout("tcp", target, 10*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer targetConn.Close()
+
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer clientConn.Close()
+
+	// The connection is hijacked, so the status and the bytes are logged by hand
+	record.Status = http.StatusOK
+	_, err = clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	if err != nil {
+		return
+	}
+
+	// Client -> target. The client may have already sent some bytes, they are kept in clientBuf.
+	// Once one direction is over, the other one ends after tunnelIdle without data, so that
+	// a half-open or idle peer does not keep the tunnel forever
+	fromClient := &idleReader{Reader: clientBuf, conn: clientConn}
+	fromTarget := &idleReader{Reader: targetConn, conn: targetConn}
+	sentCh := make(chan int64)
+	go func() {
+		sent, _ := io.Copy(targetConn, fromClient)
+		if tcpConn, ok := targetConn.(*net.TCPConn); ok {
+			tcpConn.CloseWrite()
 		}
+		fromTarget.linger()
+		sentCh <- sent
+	}()
 
-		targetReq, err := http.NewRequest(r.Method, targetURL, r.Body)
-		if err != nil {
-			logMessage := fmt.Sprintf("%s %s %d\n", r.Method, targetURL, http.StatusInternalServerError)
-			logFile.WriteString(logMessage)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	// Target -> client
+	received, _ := io.Copy(clientConn, fromTarget)
+	if tcpConn, ok := clientConn.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+	}
+	fromClient.linger()
+	sent := <-sentCh
+
+	record.Bytes = received
+	record.BytesIn = sent
+}
+
+// tunnelIdle is how long one direction of a tunnel waits for data once the other one is over
+var tunnelIdle = 10 * time.Second
+
+// idleReader reads one direction of a tunnel. After linger, every read gives up after tunnelIdle
+type idleReader struct {
+	io.Reader
+	conn      net.Conn
+	lingering atomic.Bool
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	if r.lingering.Load() {
+		r.conn.SetReadDeadline(time.Now().Add(tunnelIdle))
+	}
+	return r.Reader.Read(p)
+}
+
+// linger sets the deadline for the read in progress too
+func (r *idleReader) linger() {
+	r.lingering.Store(true)
+	r.conn.SetReadDeadline(time.Now().Add(tunnelIdle))
+}
+
+// serveFromCache writes the stored response to the client.
+// An error is returned only if nothing was written yet, so the request can still go to the origin
+func serveFromCache(w http.ResponseWriter, r *http.Request, entry *cacheEntry, now time.Time) error {
+	body, err := openCacheBody(entry.Path)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	copyHeaders(w.Header(), entry.Header)
+	w.Header().Add("Via", viaName)
+	w.Header().Set("Age", strconv.Itoa(int(currentAge(entry, now).Seconds())))
+
+	eTag := entry.Header.Get("ETag")
+	if eTag != "" && r.Header.Get("If-None-Match") == eTag {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	w.WriteHeader(entry.StatusCode)
+	copyBody(w, body)
+	return nil
+}
+
+// statusWriter remembers the status and counts the bytes sent to the client
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking is not supported")
+	}
+	return hijacker.Hijack()
+}
+
+func handleRequest(accessLog *accesslog.Writer, cache *cacheManager, accessPolicy *policyHolder, transport http.RoundTripper) http.HandlerFunc {
+	admin := handleAdmin(cache)
+
+	return func(rw http.ResponseWriter, r *http.Request) {
+		// Requests with a relative URL are sent to the proxy itself, not through it
+		if r.Method != http.MethodConnect && !r.URL.IsAbs() {
+			admin.ServeHTTP(rw, r)
+			return
+		}
+
+		start := time.Now()
+		w := &statusWriter{ResponseWriter: rw}
+		record := &accesslog.Record{
+			Time:      start,
+			Method:    r.Method,
+			URL:       r.URL.String(),
+			Proto:     r.Proto,
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+			Cache:     accesslog.CacheNone,
+		}
+		if ip := clientIP(r); ip != nil {
+			record.ClientIP = ip.String()
+		}
+		defer func() {
+			record.Latency = time.Since(start)
+			if record.Status == 0 {
+				record.Status = w.status
+				record.Bytes = w.bytes
+			}
+			if err := accessLog.Write(record); err != nil {
+				log.Println("Access log:", err)
+			}
+		}()
+
+		// The admin endpoint is only for local clients, it is not reached through the proxy
+		if loopsBack(r, targetAddr(r)) {
+			http.Error(w, "The proxy does not forward requests to itself", http.StatusLoopDetected)
 			return
 		}
 
-		var fileName string
+		if r.Method == http.MethodConnect {
+			handleConnect(w, r, record, accessPolicy)
+			return
+		}
 
-		if path, inCache := cache[targetURL]; inCache {
+		// Create a new request to the target server
+		targetURL := r.URL.String()
 
-			var addingTime string
-			var eTag string
+		v := accessPolicy.check(&policyRequest{
+			Method:   r.Method,
+			URL:      targetURL,
+			Host:     r.URL.Hostname(),
+			ClientIP: clientIP(r),
+		})
+		record.Policy = v.String()
+		if !v.Allowed {
+			denyAccess(w, v)
+			return
+		}
 
-			file, _ := os.Open(path)
-			scanner := bufio.NewScanner(file)
-			scanner.Scan()
-			fileName = path
-			scanner.Scan()
-			addingTime = strings.Split(scanner.Text(), "$")[1]
-			scanner.Scan()
-			eTagIs := strings.Split(scanner.Text(), " ")
-			if len(eTagIs) > 1 {
-				eTag = eTagIs[1]
-			}
-			file.Close()
+		var entry *cacheEntry
+		if r.Method == http.MethodGet {
+			entry = cache.lookup(r)
+		}
 
-			targetReq.Header.Add("If-Modified-Since", addingTime)
-			if eTag != "" && eTag != "\n" {
-				targetReq.Header.Add("If-None-Match", eTag)
+		// Fresh responses are served without contacting the origin
+		if entry != nil && isFresh(entry, r, time.Now()) {
+			if serveFromCache(w, r, entry, time.Now()) == nil {
+				cache.hit()
+				record.Cache = accesslog.CacheHit
+				return
 			}
+			// The entry was evicted in the meantime
+			entry = nil
 		}
 
-		// Copy headers from the incoming request to the target request
-		for header, values := range r.Header {
-			for _, value := range values {
-				targetReq.Header.Add(header, value)
-			}
+		targetReq, err := http.NewRequestWithContext(r.Context(), r.Method, targetURL, r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
+		// The request body is streamed to the origin as it arrives
+		targetReq.ContentLength = r.ContentLength
+
+		// Copy end-to-end headers from the incoming request to the target request
+		copyHeaders(targetReq.Header, r.Header)
+		removeHopHeaders(targetReq.Header)
+		addForwardHeaders(targetReq.Header, r)
 
-		// Send the target request and read the response
-		client := &http.Client{}
+		// Stale responses are revalidated with the stored validators
+		if entry != nil && hasValidators(entry) {
+			addValidators(targetReq, entry)
+		}
 
-		targetResp, err := client.Do(targetReq)
+		// Send the target request. Redirects are not followed: they are for the client
+		requestTime := time.Now()
+		targetResp, err := transport.RoundTrip(targetReq)
 		if err != nil {
-			logMessage := fmt.Sprintf("%s %s %d\n", r.Method, targetURL, http.StatusBadGateway)
-			logFile.WriteString(logMessage)
 			http.Error(w, err.Error(), http.StatusBadGateway)
 			return
 		}
 		defer targetResp.Body.Close()
+		responseTime := time.Now()
+		removeHopHeaders(targetResp.Header)
 
-		// Copy headers from the target response to the outgoing response
-		for header, values := range targetResp.Header {
-			for _, value := range values {
-				w.Header().Add(header, value)
+		// Our copy is still valid: update its metadata and serve it
+		if entry != nil && targetResp.StatusCode == http.StatusNotModified {
+			entry = cache.revalidated(entry, targetResp.Header, requestTime, responseTime)
+			if err := serveFromCache(w, r, entry, time.Now()); err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
 			}
+			record.Cache = accesslog.CacheRevalidated
+			return
+		}
+		if r.Method == http.MethodGet {
+			cache.miss()
+			record.Cache = accesslog.CacheMiss
 		}
 
-		var body []byte
-		var statusCode int
-
-		if fileName == "" {
-			code := sha256.New()
-			var fileNameInt []byte
-			code.Write(fileNameInt)
-			sha := base64.URLEncoding.EncodeToString(code.Sum(nil))
-			fileName = cachePath + "/" + sha + ".txt"
+		// Successful unsafe methods invalidate the stored responses (RFC 9111, 4.4)
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && targetResp.StatusCode < 400 {
+			cache.purge(targetURL)
 		}
 
-		// Copy the target response body to the outgoing response
-		if targetResp.StatusCode == 304 {
-			file, _ := os.Open(fileName)
-			scanner := bufio.NewScanner(file)
-			scanner.Scan()
-			scanner.Scan()
-			scanner.Scan()
-			for scanner.Scan() {
-				body = append(body, scanner.Bytes()...)
+		// The body goes to the client and to the cache file at the same time
+		var body io.Reader = targetResp.Body
+		var cacheFile *cacheWriter
+		if isStorable(r, targetResp) {
+			cacheFile, err = cache.newWriter(&cacheEntry{
+				URL:          targetURL,
+				StatusCode:   targetResp.StatusCode,
+				Header:       targetResp.Header.Clone(),
+				VaryValues:   varyValues(targetResp.Header.Get("Vary"), r.Header),
+				RequestTime:  requestTime,
+				ResponseTime: responseTime,
+			})
+			if err == nil {
+				body = io.TeeReader(targetResp.Body, cacheFile)
 			}
-			file.Close()
-			statusCode = 304
-		} else {
-			body, err = ioutil.ReadAll(targetResp.Body)
-			if err != nil {
-				logMessage := fmt.Sprintf("%s %s %d\n", r.Method, targetURL, http.StatusInternalServerError)
-				logFile.WriteString(logMessage)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			file, _ := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0745)
-
-			file.Write([]byte(fmt.Sprintf("URL: %s\n", targetURL)))
-			file.Write([]byte(fmt.Sprintf("LastModified:$%s\n", time.Now().Format(http.TimeFormat))))
-			file.Write([]byte(fmt.Sprintf("eTag: %s\n", targetResp.Header.Get("Etag"))))
-			file.Write(body)
-
-			file.Close()
-
-			cache[targetURL] = fileName
-			statusCode = targetResp.StatusCode
 		}
 
-		w.Write(body)
+		// Copy end-to-end headers from the target response to the outgoing response
+		copyHeaders(w.Header(), targetResp.Header)
+		w.Header().Add("Via", viaName)
+		w.WriteHeader(targetResp.StatusCode)
 
-		// Log the response
-		logMessage := fmt.Sprintf("%s %s %d\n", r.Method, targetURL, statusCode)
-		if r.Method == "POST" {
-			logMessage = fmt.Sprintf("%s %s %d\n%s\n", r.Method, targetURL, statusCode, string(body))
+		_, err = copyBody(w, body)
+		if cacheFile != nil {
+			// A response that was not received completely must not be served later
+			if err != nil {
+				cacheFile.abort()
+			} else {
+				cacheFile.commit()
+			}
 		}
-		logFile.WriteString(logMessage)
 	}
 }
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every cache file starts with this line. Files with another version are ignored
+const cacheFormatVersion = "HW4CACHE/1"
+
+var errCacheFormat = errors.New("unsupported cache file format")
+
+// cacheFileName returns the file for the variant: the name is a hash of the URL and the Vary values
+func cacheFileName(cachePath, targetURL, varyValues string) string {
+	code := sha256.New()
+	code.Write([]byte(targetURL))
+	code.Write([]byte{'\n'})
+	code.Write([]byte(varyValues))
+	sha := base64.URLEncoding.EncodeToString(code.Sum(nil))
+	return filepath.Join(cachePath, sha+".cache")
+}
+
+// loadCache rebuilds the in-memory index from the files in the cache folder
+func loadCache(cachePath string) (map[string][]*cacheEntry, error) {
+	cache := map[string][]*cacheEntry{}
+
+	if err := os.MkdirAll(cachePath, 0755); err != nil {
+		return cache, err
+	}
+
+	items, err := os.ReadDir(cachePath)
+	if err != nil {
+		return cache, err
+	}
+	for _, item := range items {
+		if item.IsDir() || !strings.HasSuffix(item.Name(), ".cache") {
+			continue
+		}
+		entry, err := readCacheEntry(filepath.Join(cachePath, item.Name()))
+		if err != nil {
+			continue
+		}
+		if info, err := item.Info(); err == nil {
+			entry.Size = info.Size()
+		}
+		cache[entry.URL] = append(cache[entry.URL], entry)
+	}
+	return cache, nil
+}
+
+// readCacheHead reads the metadata and the stored response head, leaving reader at the start of the body
+func readCacheHead(path string, reader *bufio.Reader) (*cacheEntry, error) {
+	tp := textproto.NewReader(reader)
+
+	version, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	if version != cacheFormatVersion {
+		return nil, fmt.Errorf("%s: %w", path, errCacheFormat)
+	}
+
+	meta, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, fmt.Errorf("%s: bad metadata: %w", path, err)
+	}
+
+	entry := &cacheEntry{
+		URL:        meta.Get("Url"),
+		Path:       path,
+		VaryValues: meta.Get("Vary-Values"),
+	}
+	if entry.URL == "" {
+		return nil, fmt.Errorf("%s: no URL", path)
+	}
+	entry.RequestTime, err = time.Parse(time.RFC3339Nano, meta.Get("Request-Time"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: bad request time: %w", path, err)
+	}
+	entry.ResponseTime, err = time.Parse(time.RFC3339Nano, meta.Get("Response-Time"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: bad response time: %w", path, err)
+	}
+
+	// Status line: "HTTP/1.1 200 OK"
+	statusLine, err := tp.ReadLine()
+	if err != nil {
+		return nil, fmt.Errorf("%s: no status line: %w", path, err)
+	}
+	parts := strings.SplitN(statusLine, " ", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("%s: bad status line %q", path, statusLine)
+	}
+	entry.StatusCode, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%s: bad status: %w", path, err)
+	}
+
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, fmt.Errorf("%s: bad headers: %w", path, err)
+	}
+	entry.Header = http.Header(header)
+
+	return entry, nil
+}
+
+// readCacheEntry reads the metadata and the headers of the cache file
+func readCacheEntry(path string) (*cacheEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return readCacheHead(path, bufio.NewReader(file))
+}
+
+type cacheBody struct {
+	*bufio.Reader
+	file *os.File
+}
+
+func (b *cacheBody) Close() error {
+	return b.file.Close()
+}
+
+// openCacheBody returns the raw response body stored in the cache file
+func openCacheBody(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(file)
+	if _, err := readCacheHead(path, reader); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &cacheBody{Reader: reader, file: file}, nil
+}
+
+// createCacheTemp creates a temporary file in the cache folder and writes the metadata and the response head.
+// The caller writes the body and renames the file to entry.Path, so readers never see a half-written entry
+func createCacheTemp(entry *cacheEntry) (*os.File, *bufio.Writer, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(entry.Path), ".tmp-*")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	writer := bufio.NewWriter(tmp)
+	fmt.Fprintf(writer, "%s\r\n", cacheFormatVersion)
+	fmt.Fprintf(writer, "URL: %s\r\n", entry.URL)
+	fmt.Fprintf(writer, "Request-Time: %s\r\n", entry.RequestTime.Format(time.RFC3339Nano))
+	fmt.Fprintf(writer, "Response-Time: %s\r\n", entry.ResponseTime.Format(time.RFC3339Nano))
+	if entry.VaryValues != "" {
+		fmt.Fprintf(writer, "Vary-Values: %s\r\n", entry.VaryValues)
+	}
+	fmt.Fprintf(writer, "\r\n")
+
+	fmt.Fprintf(writer, "HTTP/1.1 %03d %s\r\n", entry.StatusCode, http.StatusText(entry.StatusCode))
+	entry.Header.Write(writer)
+	fmt.Fprintf(writer, "\r\n")
+
+	return tmp, writer, nil
+}
+
+// closeCacheTemp flushes and closes the temporary file. The file is removed if anything failed
+func closeCacheTemp(tmp *os.File, writer *bufio.Writer, err error) error {
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// writeCacheTemp writes the entry and the body into a temporary file and returns its name
+func writeCacheTemp(entry *cacheEntry, body io.Reader) (string, error) {
+	tmp, writer, err := createCacheTemp(entry)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(writer, body)
+	if err := closeCacheTemp(tmp, writer, err); err != nil {
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// rewriteCacheTemp writes the updated metadata of the entry together with the stored body into a temporary file
+func rewriteCacheTemp(entry *cacheEntry) (string, error) {
+	body, err := openCacheBody(entry.Path)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	return writeCacheTemp(entry, body)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheFileName(t *testing.T) {
+	a := cacheFileName("cache", "http://example.com/a", "")
+	b := cacheFileName("cache", "http://example.com/b", "")
+	gzip := cacheFileName("cache", "http://example.com/a", "Accept-Encoding=gzip")
+	if a == b || a == gzip {
+		t.Errorf("different variants share a file: %s, %s, %s", a, b, gzip)
+	}
+	if a != cacheFileName("cache", "http://example.com/a", "") {
+		t.Errorf("file name is not stable")
+	}
+}
+
+func TestCacheEntryRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	body := []byte("line1\nline2\r\n\r\n\x00\xff" + string(bytes.Repeat([]byte{'x'}, 100000)))
+
+	entry := &cacheEntry{
+		URL:          "http://example.com/image.png",
+		StatusCode:   http.StatusOK,
+		Header:       header("Content-Type", "image/png", "ETag", `"v1"`, "Set-Cookie", "a=1", "Set-Cookie", "b=2"),
+		VaryValues:   "Accept-Encoding=gzip",
+		RequestTime:  responseTime,
+		ResponseTime: responseTime.Add(time.Second),
+	}
+
+	m, err := newCacheManager(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cw, err := m.newWriter(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cw.Write(body)
+	if err := cw.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := loadCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	variants := cache[entry.URL]
+	if len(variants) != 1 {
+		t.Fatalf("got %d variants, want 1", len(variants))
+	}
+	got := variants[0]
+	if got.StatusCode != entry.StatusCode || got.VaryValues != entry.VaryValues ||
+		!got.RequestTime.Equal(entry.RequestTime) || !got.ResponseTime.Equal(entry.ResponseTime) {
+		t.Errorf("got %+v, want %+v", got, entry)
+	}
+	if len(got.Header.Values("Set-Cookie")) != 2 || got.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("got headers %v, want %v", got.Header, entry.Header)
+	}
+
+	reader, err := openCacheBody(got.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	gotBody, _ := io.ReadAll(reader)
+	if !bytes.Equal(gotBody, body) {
+		t.Errorf("body is corrupted: got %d bytes, want %d", len(gotBody), len(body))
+	}
+}
+
+func TestCacheVersion(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "old.cache")
+	os.WriteFile(path, []byte("URL: http://google.com/\nLastModified:$Tue, 21 Mar 2023 19:08:41 GMT\neTag: \nbody"), 0644)
+
+	_, err := readCacheEntry(path)
+	if !errors.Is(err, errCacheFormat) {
+		t.Errorf("got %v, want %v", err, errCacheFormat)
+	}
+}
@@ -1,15 +1,26 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"mime"
+	"net"
+	"net/mail"
 	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
-var addrTo = flag.String("addrTo", "", "Email address of receiver")
+var addrTo = flag.String("addrTo", "", "Comma separated email addresses of receivers")
+var addrCc = flag.String("cc", "", "Comma separated email addresses of carbon copy receivers")
+var addrBcc = flag.String("bcc", "", "Comma separated email addresses of blind carbon copy receivers")
 var addrFrom = flag.String("addrFrom", "", "Email address of sender")
 var pwrd = flag.String("pwrd", "", "Email password of sender")
+var subject = flag.String("subject", "Test email from Go!", "Email subject")
 var filePath = flag.String("fp", "hello.txt", "File to send (.txt or .html)")
 var smtpHost = flag.String("host", "mail.sibnet.ru", "SMTP host")
 var smtpPort = flag.String("port", "25", "SMTP port")
@@ -20,26 +31,119 @@ func main() {
 	from := *addrFrom
 	password := *pwrd
 
-	to := []string{
-		*addrTo,
+	var recipients [3][]*mail.Address
+	for i, list := range []string{*addrTo, *addrCc, *addrBcc} {
+		if strings.TrimSpace(list) == "" {
+			continue
+		}
+		addresses, err := mail.ParseAddressList(list)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		recipients[i] = addresses
+	}
+	to, cc, bcc := recipients[0], recipients[1], recipients[2]
+	if len(to)+len(cc)+len(bcc) == 0 {
+		fmt.Println("No recipients, use -addrTo, -cc or -bcc")
+		os.Exit(1)
 	}
 
-	subject := "Subject: Test email from Go!\n"
-	mime := "MIME-version: 1.0;\nContent-Type: text/html; charset=\"UTF-8\";\n\n"
 	body, err := ioutil.ReadFile(*filePath)
 	if err != nil {
 		fmt.Println(err)
-		return
+		os.Exit(1)
 	}
-	message := []byte(subject + mime)
-	message = append(message, body...)
 
-	auth := smtp.PlainAuth("", from, password, *smtpHost)
+	// Header lines end with CRLF, .txt files are sent as plain text, everything else as HTML.
+	// The Bcc recipients are not in the header
+	contentType := "text/html"
+	if strings.EqualFold(filepath.Ext(*filePath), ".txt") {
+		contentType = "text/plain"
+	}
+	header := "From: " + from + "\r\n"
+	if len(to) > 0 {
+		header += "To: " + joinAddresses(to) + "\r\n"
+	}
+	if len(cc) > 0 {
+		header += "Cc: " + joinAddresses(cc) + "\r\n"
+	}
+	header += "Subject: " + mime.BEncoding.Encode("utf-8", *subject) + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: " + contentType + "; charset=\"UTF-8\"\r\n\r\n"
+	text := strings.ReplaceAll(string(body), "\r\n", "\n")
+	message := []byte(header + strings.ReplaceAll(text, "\n", "\r\n"))
 
-	err = smtp.SendMail(*smtpHost+":"+*smtpPort, auth, from, to, message)
-	if err != nil {
+	var envelope []string
+	for _, list := range [][]*mail.Address{to, cc, bcc} {
+		for _, address := range list {
+			envelope = append(envelope, address.Address)
+		}
+	}
+	if err := send(from, password, envelope, message); err != nil {
 		fmt.Println(err)
-		return
+		os.Exit(1)
 	}
 	fmt.Println("Email Sent Successfully!")
 }
+
+func joinAddresses(addresses []*mail.Address) string {
+	var list []string
+	for _, address := range addresses {
+		list = append(list, address.String())
+	}
+	return strings.Join(list, ", ")
+}
+
+// send does what smtp.SendMail does, but a rejected recipient does not stop the others:
+// the reply to RCPT TO is printed for each of them
+func send(from, password string, to []string, message []byte) error {
+	client, err := smtp.Dial(net.JoinHostPort(*smtpHost, *smtpPort))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: *smtpHost}); err != nil {
+			return err
+		}
+	}
+	if password != "" {
+		if err := client.Auth(smtp.PlainAuth("", from, password, *smtpHost)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	accepted := 0
+	for _, recipient := range to {
+		if err := client.Rcpt(recipient); err != nil {
+			fmt.Printf("%s: rejected: %v\n", recipient, err)
+			continue
+		}
+		fmt.Printf("%s: accepted\n", recipient)
+		accepted++
+	}
+	if accepted == 0 {
+		return fmt.Errorf("all recipients were rejected")
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if accepted < len(to) {
+		fmt.Printf("Sent to %d of %d recipients\n", accepted, len(to))
+	}
+	return client.Quit()
+}
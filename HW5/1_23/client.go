@@ -1,170 +1,174 @@
 package main
 
 import (
-	"bufio"
-	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"net"
+	"net/mail"
 	"os"
+	"path/filepath"
 	"strings"
+
+	"example.com/mail/mimemsg"
+	"example.com/mail/smtpclient"
 )
 
-var addrTo = flag.String("addrTo", "", "Email address of receiver")
+var addrTo = flag.String("addrTo", "", "Comma separated email addresses of receivers")
+var addrCc = flag.String("cc", "", "Comma separated email addresses of carbon copy receivers")
+var addrBcc = flag.String("bcc", "", "Comma separated email addresses of blind carbon copy receivers")
 var addrFrom = flag.String("addrFrom", "", "Email address of sender")
 var pwrd = flag.String("pwrd", "", "Email password of sender")
+var subjectText = flag.String("subject", "", "Email subject")
 var filePath = flag.String("fp", "hello.txt", "File to send (.txt or .html)")
 var smtpHost = flag.String("host", "mail.sibnet.ru", "SMTP host")
 var smtpPort = flag.String("port", "25", "SMTP port")
 var images = flag.String("imgs", "", "Images for attachments")
+var csvPath = flag.String("csv", "", "CSV file with the recipients for the mail merge")
+var rate = flag.Int("rate", 0, "Maximum number of messages per minute in the mail merge (0 is unlimited)")
 
 func main() {
 	flag.Parse()
-
-	// Specify the mail server host and port number
-	serverAddr := *smtpHost + ":" + *smtpPort
-
-	// Connect to the mail server
-	conn, err := net.Dial("tcp", serverAddr)
-	if err != nil {
-		fmt.Println("Error connecting to the mail server:", err)
-		return
-	}
-
-	// Send the greeting message to the mail server
-	err = sendCommand(conn, "HELO "+*smtpHost)
-	if err != nil {
-		fmt.Println("Error sending HELO command:", err)
-		return
+	if err := run(); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
 	}
+}
 
-	// Send the AUTH LOGIN command to the mail server
-	err = sendCommand(conn, "AUTH LOGIN")
-	if err != nil {
-		fmt.Println("Error sending AUTH LOGIN command:", err)
-		return
-	}
-	sender := *addrFrom
-	err = sendCommand(conn, base64.StdEncoding.EncodeToString([]byte(sender)))
-	if err != nil {
-		fmt.Println("Error sending base64-encoded username:", err)
-		return
-	}
-	err = sendCommand(conn, base64.StdEncoding.EncodeToString([]byte(*pwrd)))
+func run() error {
+	body, err := ioutil.ReadFile(*filePath)
 	if err != nil {
-		fmt.Println("Error sending base64-encoded password:", err)
-		return
+		return fmt.Errorf("reading a body file: %w", err)
 	}
-
-	// Send the "MAIL FROM" command
-	err = sendCommand(conn, "MAIL FROM:<"+sender+">")
-	if err != nil {
-		fmt.Println("Error sending MAIL FROM command:", err)
-		return
+	var rows []map[string]string
+	var to, cc, bcc []*mail.Address
+	if *csvPath != "" {
+		if *addrTo != "" || *addrCc != "" || *addrBcc != "" {
+			return errors.New("-csv cannot be combined with -addrTo, -cc and -bcc")
+		}
+		if rows, err = readMergeCSV(*csvPath); err != nil {
+			return err
+		}
+	} else {
+		if to, err = parseAddresses(*addrTo); err != nil {
+			return fmt.Errorf("-addrTo: %w", err)
+		}
+		if cc, err = parseAddresses(*addrCc); err != nil {
+			return fmt.Errorf("-cc: %w", err)
+		}
+		if bcc, err = parseAddresses(*addrBcc); err != nil {
+			return fmt.Errorf("-bcc: %w", err)
+		}
+		if len(to)+len(cc)+len(bcc) == 0 {
+			return errors.New("no recipients, use -addrTo, -cc, -bcc or -csv")
+		}
 	}
 
-	// Send the "RCPT TO" command
-	recipient := *addrTo
-	err = sendCommand(conn, "RCPT TO:<"+recipient+">")
+	// Connect to the mail server, greet it and switch to TLS
+	localName, err := os.Hostname()
 	if err != nil {
-		fmt.Println("Error sending RCPT TO command:", err)
-		return
+		localName = "localhost"
 	}
-
-	// Send the email content
-	err = sendCommand(conn, "DATA")
+	client, err := connect(localName)
 	if err != nil {
-		fmt.Println("Error sending DATA command:", err)
-		return
+		return fmt.Errorf("connecting to the mail server: %w", err)
 	}
+	defer client.Close()
 
-	reader := bufio.NewReader(os.Stdin)
-
-	// Get the email header and body from the user
-	fmt.Print("Enter the email subject: ")
-	subject, _ := reader.ReadString('\n')
-	subject = strings.TrimSpace(subject)
-
-	body, err := ioutil.ReadFile(*filePath)
-	if err != nil {
-		fmt.Println("Error while reading a body file: ", err)
-		return
+	// Log in with the best mechanism the server offers
+	if *pwrd != "" {
+		if err := client.Auth("", *addrFrom, *pwrd); err != nil {
+			return fmt.Errorf("authenticating: %w", err)
+		}
 	}
 
-	var message []byte
-
-	// Construct the email message and send it to the mail server
-	if *images == "" {
-		message = []byte("Subject: " + subject + "\r\n\r\n" + string(body) + "\r\n.")
+	if rows != nil {
+		err = sendMerge(client, rows, string(body))
 	} else {
-		message = createMessageWithAttachments(sender, recipient, subject, *images, string(body))
+		err = sendOne(client, to, cc, bcc, string(body))
 	}
 
-	err = sendCommand(conn, string(message))
-	if err != nil {
-		fmt.Println("Error sending email message:", err)
-		return
+	// Send the "QUIT" command, it also closes the connection
+	if quitErr := client.Quit(); quitErr != nil && err == nil {
+		err = fmt.Errorf("sending QUIT command: %w", quitErr)
 	}
+	return err
+}
 
-	// Send the "QUIT" command
-	err = sendCommand(conn, "QUIT")
+// sendOne sends the message to all recipients at once, the Bcc recipients are not in the header
+func sendOne(client *smtpclient.Client, to, cc, bcc []*mail.Address, body string) error {
+	message, err := buildMessage(*subjectText, body, headerAddresses(to), headerAddresses(cc))
 	if err != nil {
-		fmt.Println("Error sending QUIT command:", err)
-		return
+		return fmt.Errorf("constructing email message: %w", err)
 	}
 
-	// Close the connection to the mail server
-	err = conn.Close()
-	if err != nil {
-		fmt.Println("Error closing connection to mail server:", err)
-		return
+	var envelope []string
+	for _, list := range [][]*mail.Address{to, cc, bcc} {
+		for _, address := range list {
+			envelope = append(envelope, address.Address)
+		}
+	}
+	results, err := client.Send(*addrFrom, envelope, message)
+	if report(results) && err == nil {
+		err = errors.New("some recipients were rejected")
 	}
+	return err
 }
 
-// Sends a command to the mail server and returns any error that occurs
-func sendCommand(conn net.Conn, command string) error {
-	fmt.Println(command)
-
-	_, err := conn.Write([]byte(command + "\r\n"))
-	if err != nil {
-		return err
+// report prints the reply to RCPT TO for every recipient and tells if any was rejected
+func report(results []smtpclient.RcptResult) bool {
+	rejected := false
+	for _, result := range results {
+		if result.Err != nil {
+			fmt.Printf("%s: rejected: %v\n", result.Recipient, result.Err)
+			rejected = true
+		} else {
+			fmt.Printf("%s: accepted\n", result.Recipient)
+		}
 	}
+	return rejected
+}
 
-	response := make([]byte, 512)
-	_, err = conn.Read(response)
-	if err != nil {
-		return err
+// parseAddresses parses a comma separated list, names with commas must be quoted
+func parseAddresses(list string) ([]*mail.Address, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
 	}
+	return mail.ParseAddressList(list)
+}
 
-	fmt.Println(string(response))
-	return nil
+func headerAddresses(addresses []*mail.Address) []string {
+	var list []string
+	for _, address := range addresses {
+		list = append(list, address.String())
+	}
+	return list
 }
 
-func createMessageWithAttachments(sender, recipient, subject, images, body string) []byte {
-	// Create the email message with MIME parts
-	boundary := "$$$/|\\$$$"
-	message := []byte("From: " + sender + "\r\n")
-	message = append(message, []byte("To: "+recipient+"\r\n")...)
-	message = append(message, []byte("Subject: "+subject+"\r\n")...)
-	message = append(message, []byte("MIME-Version: 1.0\r\n")...)
-	message = append(message, []byte("Content-Type: multipart/mixed; boundary="+boundary+"\r\n\r\n")...)
-	message = append(message, []byte("--"+boundary+"\r\n")...)
-	message = append(message, []byte("Content-Type: text/plain; charset=UTF-8\r\n\r\n")...)
-	message = append(message, []byte(string(body)+"\r\n")...)
-	message = append(message, []byte("--"+boundary+"\r\n")...)
-	for _, image := range strings.Split(images, ",") {
-		message = append(message, []byte("Content-Type: image/jpeg\r\n")...)
-		message = append(message, []byte("Content-Transfer-Encoding: base64\r\n")...)
-		message = append(message, []byte("Content-Disposition: attachment; filename=\""+image+"\"\r\n\r\n")...)
-		imageContent, err := ioutil.ReadFile(image)
-		if err != nil {
-			fmt.Println("Error reading image "+image+" content:", err)
-			continue
+// buildMessage makes a MIME message: the body is HTML for .html files and plain text otherwise,
+// the images from -imgs are attached with their own content types
+func buildMessage(subject, body string, to, cc []string) ([]byte, error) {
+	msg := &mimemsg.Message{
+		From:    *addrFrom,
+		To:      to,
+		Cc:      cc,
+		Subject: subject,
+	}
+	if isHTML() {
+		msg.HTML = body
+	} else {
+		msg.Text = body
+	}
+	if *images != "" {
+		for _, image := range strings.Split(*images, ",") {
+			if err := msg.AttachFile(strings.TrimSpace(image)); err != nil {
+				return nil, err
+			}
 		}
-		message = append(message, []byte(base64.StdEncoding.EncodeToString(imageContent)+"\r\n")...)
-		message = append(message, []byte("--"+boundary+"--\r\n")...)
 	}
-	message = append(message, []byte(".")...)
-	return message
+	return msg.Build()
+}
+
+func isHTML() bool {
+	return strings.EqualFold(filepath.Ext(*filePath), ".html")
 }
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"flag"
+	"mime"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"example.com/mail/smtpserver"
+)
+
+// startServer runs the local SMTP server, the client is pointed at it with the flags
+func startServer(t *testing.T) *smtpserver.Server {
+	t.Helper()
+	s := &smtpserver.Server{
+		Maildir:           smtpserver.Maildir{Root: t.TempDir()},
+		Users:             map[string]string{"me@example.com": "secret"},
+		AllowInsecureAuth: true,
+		Rules:             []smtpserver.Rule{{Pattern: "*@spam.test", Action: smtpserver.Reject}},
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	setFlags(t, map[string]string{
+		"host": "127.0.0.1", "port": port, "tls": "none", "insecure": "true",
+		"addrFrom": "me@example.com", "pwrd": "secret",
+	})
+	return s
+}
+
+// setFlags sets the flags for the test and restores them afterwards
+func setFlags(t *testing.T, values map[string]string) {
+	t.Helper()
+	for name, value := range values {
+		f := flag.Lookup(name)
+		old := f.Value.String()
+		if err := f.Value.Set(value); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Value.Set(old) })
+	}
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// messagePath returns the file of the only message of the recipient
+func messagePath(t *testing.T, s *smtpserver.Server, recipient string) string {
+	t.Helper()
+	messages, err := s.Maildir.Messages(recipient)
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("%s: got %v, %v, want one message", recipient, messages, err)
+	}
+	return messages[0]
+}
+
+func inbox(t *testing.T, s *smtpserver.Server, recipient string) *mail.Message {
+	t.Helper()
+	file, err := os.Open(messagePath(t, s, recipient))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	msg, err := mail.ReadMessage(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func decodeSubject(msg *mail.Message) string {
+	subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	return subject
+}
+
+func TestSendRecipients(t *testing.T) {
+	s := startServer(t)
+	setFlags(t, map[string]string{
+		"addrTo":  `"Анна" <anna@example.com>, nobody@spam.test`,
+		"cc":      "carl@example.com",
+		"bcc":     "hidden@example.com",
+		"subject": "Отчет",
+		"fp":      writeFile(t, "letter.txt", "Hello!\n"),
+		"imgs":    writeFile(t, "picture.png", "\x89PNG\r\n\x1a\n"),
+	})
+
+	// The rejected recipient is reported, the others get the message
+	if err := run(); err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Errorf("got %v, want an error about the rejected recipient", err)
+	}
+	if messages, _ := s.Maildir.Messages("nobody@spam.test"); len(messages) != 0 {
+		t.Errorf("got %d messages for the rejected recipient", len(messages))
+	}
+	for _, recipient := range []string{"anna@example.com", "carl@example.com", "hidden@example.com"} {
+		msg := inbox(t, s, recipient)
+		if subject := decodeSubject(msg); subject != "Отчет" {
+			t.Errorf("%s: got Subject %q", recipient, subject)
+		}
+		to, err := msg.Header.AddressList("To")
+		if err != nil || len(to) != 2 || to[0].Name != "Анна" {
+			t.Errorf("%s: got To %v, %v", recipient, to, err)
+		}
+		if cc := msg.Header.Get("Cc"); cc != "<carl@example.com>" {
+			t.Errorf("%s: got Cc %q", recipient, cc)
+		}
+		if msg.Header.Get("Bcc") != "" || strings.Contains(strings.Join(msg.Header["To"], ""), "hidden") {
+			t.Errorf("%s: the Bcc recipient is visible", recipient)
+		}
+		if ctype := msg.Header.Get("Content-Type"); !strings.HasPrefix(ctype, "multipart/mixed") {
+			t.Errorf("%s: got Content-Type %q", recipient, ctype)
+		}
+	}
+}
+
+func TestSendMerge(t *testing.T) {
+	s := startServer(t)
+	setFlags(t, map[string]string{
+		"csv": writeFile(t, "people.csv", "email,name,city\n"+
+			"anna@example.com,Анна,Москва\n"+
+			"nobody@spam.test,Nobody,Nowhere\n"+
+			"bob@example.com,Bob,<London>\n"),
+		"subject": "Привет, {{.name}}!",
+		"fp":      writeFile(t, "letter.html", "<p>{{.name}} из {{.city}}</p>"),
+		"rate":    "6000",
+	})
+
+	err := run()
+	if err == nil || !strings.Contains(err.Error(), "1 messages were not sent") {
+		t.Errorf("got %v, want one message not sent", err)
+	}
+
+	anna := inbox(t, s, "anna@example.com")
+	if subject := decodeSubject(anna); subject != "Привет, Анна!" {
+		t.Errorf("got Subject %q", subject)
+	}
+	to, err := anna.Header.AddressList("To")
+	if err != nil || len(to) != 1 || to[0].Name != "Анна" || to[0].Address != "anna@example.com" {
+		t.Errorf("got To %v, %v", to, err)
+	}
+
+	bob := inbox(t, s, "bob@example.com")
+	if subject := decodeSubject(bob); subject != "Привет, Bob!" {
+		t.Errorf("got Subject %q", subject)
+	}
+	if ctype := bob.Header.Get("Content-Type"); !strings.HasPrefix(ctype, "text/html") {
+		t.Errorf("got Content-Type %q", ctype)
+	}
+	body, _ := os.ReadFile(messagePath(t, s, "bob@example.com"))
+	if !strings.Contains(string(body), "Bob =D0=B8=D0=B7 &lt;London&gt;") {
+		t.Errorf("the HTML body is not escaped:\n%s", body)
+	}
+}
+
+func TestNoRecipients(t *testing.T) {
+	setFlags(t, map[string]string{"fp": writeFile(t, "letter.txt", "hi")})
+	if err := run(); err == nil || !strings.Contains(err.Error(), "no recipients") {
+		t.Errorf("got %v", err)
+	}
+	setFlags(t, map[string]string{"addrTo": "a@example.com", "csv": "people.csv"})
+	if err := run(); err == nil || !strings.Contains(err.Error(), "cannot be combined") {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"example.com/mail/smtpclient"
+)
+
+var tlsMode = flag.String("tls", "", "TLS mode: starttls, implicit or none (implicit for port 465, starttls otherwise)")
+var caFile = flag.String("ca", "", "PEM file with the CA certificates to trust instead of the system ones")
+var serverName = flag.String("sni", "", "Server name to verify the certificate against (by default -host)")
+var insecure = flag.Bool("insecure", false, "Allow sending the password without TLS")
+
+func tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{ServerName: *serverName}
+	if config.ServerName == "" {
+		config.ServerName = *smtpHost
+	}
+	if *caFile != "" {
+		pem, err := ioutil.ReadFile(*caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", *caFile)
+		}
+	}
+	return config, nil
+}
+
+// connect opens the session: greeting, EHLO and TLS according to -tls
+func connect(localName string) (*smtpclient.Client, error) {
+	serverAddr := net.JoinHostPort(*smtpHost, *smtpPort)
+	mode := *tlsMode
+	if mode == "" {
+		mode = "starttls"
+		if *smtpPort == "465" {
+			mode = "implicit"
+		}
+	}
+	config, err := tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// The dialogue is printed to the terminal
+	var client *smtpclient.Client
+	switch mode {
+	case "implicit":
+		client, err = smtpclient.DialTLS(serverAddr, config, os.Stdout)
+	case "starttls", "none":
+		client, err = smtpclient.Dial(serverAddr, os.Stdout)
+	default:
+		return nil, fmt.Errorf("unknown TLS mode %q", mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	client.AllowInsecureAuth = *insecure
+
+	if err := client.Hello(localName); err != nil {
+		client.Close()
+		return nil, err
+	}
+	// STARTTLS is required: a server that does not offer it may be an attacker who removed it
+	if mode == "starttls" {
+		if err := client.StartTLS(config); err != nil {
+			client.Close()
+			if errors.Is(err, smtpclient.ErrStartTLSNotSupported) {
+				err = fmt.Errorf("%w (use -tls none to send without encryption)", err)
+			}
+			return nil, err
+		}
+	}
+	return client, nil
+}
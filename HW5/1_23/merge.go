@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"net/mail"
+	"os"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"example.com/mail/smtpclient"
+)
+
+// readMergeCSV reads the recipients for the mail merge. The first row names the columns:
+// "email" is required, "name" is used in the To header, all columns can be used in the templates
+func readMergeCSV(path string) ([]map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("%s: empty file", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+	hasEmail := false
+	for _, column := range header {
+		hasEmail = hasEmail || column == "email"
+	}
+	if !hasEmail {
+		return nil, fmt.Errorf("%s: no \"email\" column", path)
+	}
+
+	var rows []map[string]string
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		row := make(map[string]string, len(header))
+		for i, column := range header {
+			row[column] = record[i]
+		}
+		if _, err := mail.ParseAddress(row["email"]); err != nil {
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("%s:%d: %q: %w", path, line, row["email"], err)
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("%s: no recipients", path)
+	}
+	return rows, nil
+}
+
+type executor interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// mergeTemplate fills the CSV columns into the subject and the body ({{.name}}),
+// values in an HTML body are escaped
+type mergeTemplate struct {
+	subject *texttemplate.Template
+	body    executor
+}
+
+func newMergeTemplate(subject, body string, html bool) (*mergeTemplate, error) {
+	t := &mergeTemplate{}
+	var err error
+	if t.subject, err = texttemplate.New("subject").Option("missingkey=error").Parse(subject); err != nil {
+		return nil, err
+	}
+	if html {
+		t.body, err = htmltemplate.New("body").Option("missingkey=error").Parse(body)
+	} else {
+		t.body, err = texttemplate.New("body").Option("missingkey=error").Parse(body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *mergeTemplate) render(row map[string]string) (subject, body string, err error) {
+	var buf bytes.Buffer
+	if err := t.subject.Execute(&buf, row); err != nil {
+		return "", "", err
+	}
+	// A header cannot contain line breaks
+	subject = strings.Join(strings.Fields(buf.String()), " ")
+	buf.Reset()
+	if err := t.body.Execute(&buf, row); err != nil {
+		return "", "", err
+	}
+	return subject, buf.String(), nil
+}
+
+// sendMerge sends a personal message to every row over the same session, no more than -rate
+// messages per minute. A rejected message does not stop the batch, a broken connection does
+func sendMerge(client *smtpclient.Client, rows []map[string]string, body string) error {
+	t, err := newMergeTemplate(*subjectText, body, isHTML())
+	if err != nil {
+		return err
+	}
+	var interval time.Duration
+	if *rate > 0 {
+		interval = time.Minute / time.Duration(*rate)
+	}
+
+	sent := 0
+	var last time.Time
+	for i, row := range rows {
+		subject, text, err := t.render(row)
+		if err != nil {
+			fmt.Printf("%s: %v\n", row["email"], err)
+			continue
+		}
+		// The address was checked by readMergeCSV
+		recipient, _ := mail.ParseAddress(row["email"])
+		if row["name"] != "" {
+			recipient.Name = row["name"]
+		}
+		message, err := buildMessage(subject, text, []string{recipient.String()}, nil)
+		if err != nil {
+			return fmt.Errorf("constructing email message: %w", err)
+		}
+
+		if wait := interval - time.Since(last); i > 0 && wait > 0 {
+			time.Sleep(wait)
+		}
+		last = time.Now()
+		results, err := client.Send(*addrFrom, []string{recipient.Address}, message)
+		var smtpErr *smtpclient.Error
+		switch {
+		case err == nil:
+			sent++
+			report(results)
+		case errors.As(err, &smtpErr):
+			if !report(results) {
+				fmt.Printf("%s: not sent: %v\n", recipient.Address, err)
+			}
+		default:
+			return fmt.Errorf("sent %d of %d messages: %w", sent, len(rows), err)
+		}
+	}
+
+	fmt.Printf("Sent %d of %d messages\n", sent, len(rows))
+	if sent < len(rows) {
+		return fmt.Errorf("%d messages were not sent", len(rows)-sent)
+	}
+	return nil
+}
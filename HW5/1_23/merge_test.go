@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeCSV(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "recipients.csv")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadMergeCSV(t *testing.T) {
+	rows, err := readMergeCSV(writeCSV(t, "email, name, city\n"+
+		"a@example.com, Анна, Москва\n"+
+		"\"Bob <b@example.com>\",\"Smith, Bob\",London\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("got %d rows, want 2", len(rows))
+	}
+	if rows[0]["name"] != "Анна" || rows[0]["city"] != "Москва" || rows[1]["name"] != "Smith, Bob" {
+		t.Errorf("got %v", rows)
+	}
+}
+
+var badCSVs = []struct {
+	name    string
+	content string
+	want    string
+}{
+	{"empty", "", "empty file"},
+	{"no email column", "name\nAnna\n", "no \"email\" column"},
+	{"no rows", "email,name\n", "no recipients"},
+	{"bad address", "email\na@example.com\nnot an address\n", "recipients.csv:3"},
+	{"wrong number of fields", "email,name\na@example.com\n", "wrong number of fields"},
+}
+
+func TestReadMergeCSVErrors(t *testing.T) {
+	for _, tt := range badCSVs {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readMergeCSV(writeCSV(t, tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+var mergeCases = []struct {
+	name        string
+	subject     string
+	body        string
+	html        bool
+	wantSubject string
+	wantBody    string
+}{
+	{
+		name:        "text",
+		subject:     "Привет, {{.name}}!",
+		body:        "{{.name}} из города {{.city}}",
+		wantSubject: "Привет, Tom & Jerry!",
+		wantBody:    "Tom & Jerry из города <Москва>",
+	},
+	{
+		name:        "html is escaped",
+		subject:     "Hi {{.name}}",
+		body:        "<p>{{.name}} from {{.city}}</p>",
+		html:        true,
+		wantSubject: "Hi Tom & Jerry",
+		wantBody:    "<p>Tom &amp; Jerry from &lt;Москва&gt;</p>",
+	},
+	{
+		name:        "line breaks in the subject",
+		subject:     "Hi\n{{.name}}\r\n",
+		body:        "hello",
+		wantSubject: "Hi Tom & Jerry",
+		wantBody:    "hello",
+	},
+}
+
+func TestMergeTemplate(t *testing.T) {
+	row := map[string]string{"email": "a@example.com", "name": "Tom & Jerry", "city": "<Москва>"}
+	for _, tt := range mergeCases {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := newMergeTemplate(tt.subject, tt.body, tt.html)
+			if err != nil {
+				t.Fatal(err)
+			}
+			subject, body, err := tmpl.render(row)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if subject != tt.wantSubject || body != tt.wantBody {
+				t.Errorf("got %q, %q, want %q, %q", subject, body, tt.wantSubject, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestMergeTemplateMissingField(t *testing.T) {
+	tmpl, err := newMergeTemplate("Hi {{.nickname}}", "hello", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tmpl.render(map[string]string{"email": "a@example.com"}); err == nil {
+		t.Error("got no error for a missing field")
+	}
+	if _, err := newMergeTemplate("{{.name", "hello", false); err == nil {
+		t.Error("got no error for a broken template")
+	}
+}
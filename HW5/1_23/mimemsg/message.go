@@ -0,0 +1,398 @@
+// Package mimemsg builds e-mail messages (RFC 5322 and MIME): text and HTML alternatives,
+// attachments, encoded non-ASCII headers, Date and Message-ID
+package mimemsg
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Attachment is a file attached to the message
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// Message is an e-mail message. Addresses may have display names ("Имя <user@example.com>")
+type Message struct {
+	From    string
+	To      []string
+	Cc      []string
+	Subject string
+	// Text and HTML are alternative versions of the body, either may be empty
+	Text string
+	HTML string
+
+	Attachments []Attachment
+	// Date and MessageID are filled in by Build if they are not set
+	Date      time.Time
+	MessageID string
+}
+
+// DetectContentType guesses the type by the extension and, if it is unknown, by the data
+func DetectContentType(filename string, data []byte) string {
+	if ctype := mime.TypeByExtension(strings.ToLower(filepath.Ext(filename))); ctype != "" {
+		return ctype
+	}
+	if len(data) == 0 {
+		return "application/octet-stream"
+	}
+	return http.DetectContentType(data)
+}
+
+// Attach adds the data as an attachment, the content type is detected
+func (m *Message) Attach(filename string, data []byte) {
+	m.Attachments = append(m.Attachments, Attachment{
+		Filename:    filepath.Base(filename),
+		ContentType: DetectContentType(filename, data),
+		Data:        data,
+	})
+}
+
+// AttachFile reads the file and attaches it
+func (m *Message) AttachFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	m.Attach(path, data)
+	return nil
+}
+
+// Build returns the message with CRLF line endings and lines no longer than 78 characters,
+// ready to be sent after DATA
+func (m *Message) Build() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteTo writes the message, see Build
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	err := m.write(cw)
+	return cw.n, err
+}
+
+func (m *Message) write(w io.Writer) error {
+	header, err := m.header()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(m.Attachments) > 0:
+		mw := multipart.NewWriter(w)
+		header.Set("Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mw.Boundary()}))
+		writeHeader(w, header)
+		if m.Text != "" || m.HTML != "" {
+			if err := m.writeBody(mw); err != nil {
+				return err
+			}
+		}
+		for _, attachment := range m.Attachments {
+			if err := writeAttachment(mw, attachment); err != nil {
+				return err
+			}
+		}
+		return mw.Close()
+	case m.Text != "" && m.HTML != "":
+		mw := multipart.NewWriter(w)
+		header.Set("Content-Type", mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": mw.Boundary()}))
+		writeHeader(w, header)
+		if err := writeAlternatives(mw, m.Text, m.HTML); err != nil {
+			return err
+		}
+		return mw.Close()
+	case m.HTML != "":
+		return writeTextPart(w, header, "text/html", m.HTML)
+	default:
+		return writeTextPart(w, header, "text/plain", m.Text)
+	}
+}
+
+// header builds the top level header, the Content-Type is set later
+func (m *Message) header() (textproto.MIMEHeader, error) {
+	if m.From == "" {
+		return nil, errors.New("mimemsg: no sender")
+	}
+	from, err := formatAddresses([]string{m.From})
+	if err != nil {
+		return nil, err
+	}
+
+	header := textproto.MIMEHeader{}
+	date := m.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	header.Set("Date", date.Format(time.RFC1123Z))
+	header.Set("From", from)
+	if len(m.To) > 0 {
+		to, err := formatAddresses(m.To)
+		if err != nil {
+			return nil, err
+		}
+		header.Set("To", to)
+	}
+	if len(m.Cc) > 0 {
+		cc, err := formatAddresses(m.Cc)
+		if err != nil {
+			return nil, err
+		}
+		header.Set("Cc", cc)
+	}
+	header.Set("Subject", mime.BEncoding.Encode("utf-8", m.Subject))
+
+	messageID := m.MessageID
+	if messageID == "" {
+		address, _ := mail.ParseAddress(m.From)
+		messageID, err = NewMessageID(address.Address)
+		if err != nil {
+			return nil, err
+		}
+	}
+	header.Set("Message-ID", messageID)
+	header.Set("MIME-Version", "1.0")
+	return header, nil
+}
+
+// NewMessageID makes a unique "<random@domain>" with the domain of the address
+func NewMessageID(address string) (string, error) {
+	var random [16]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return "", err
+	}
+	domain := "localhost"
+	if at := strings.LastIndex(address, "@"); at >= 0 && at < len(address)-1 {
+		domain = address[at+1:]
+	}
+	return "<" + hex.EncodeToString(random[:]) + "@" + domain + ">", nil
+}
+
+// formatAddresses checks the addresses and encodes non-ASCII display names (RFC 2047)
+func formatAddresses(addresses []string) (string, error) {
+	formatted := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		parsed, err := mail.ParseAddress(address)
+		if err != nil {
+			return "", fmt.Errorf("mimemsg: %q: %w", address, err)
+		}
+		formatted = append(formatted, parsed.String())
+	}
+	return strings.Join(formatted, ", "), nil
+}
+
+// headerOrder keeps the top level fields in the usual order
+var headerOrder = []string{"Date", "From", "To", "Cc", "Subject", "Message-ID", "MIME-Version",
+	"Content-Type", "Content-Transfer-Encoding", "Content-Disposition"}
+
+func writeHeader(w io.Writer, header textproto.MIMEHeader) {
+	for _, key := range headerOrder {
+		for _, value := range header.Values(key) {
+			folded := fold(key, value)
+			if strings.HasPrefix(folded, "\r\n") {
+				// The first word goes to the next line, so there is no space after the colon
+				fmt.Fprintf(w, "%s:%s\r\n", key, folded)
+			} else {
+				fmt.Fprintf(w, "%s: %s\r\n", key, folded)
+			}
+		}
+	}
+	io.WriteString(w, "\r\n")
+}
+
+// fold breaks the field at the spaces, so that the lines fit into 78 characters (RFC 5322 2.2.3).
+// Encoded words and boundaries have no spaces inside and are never split
+func fold(key, value string) string {
+	var b strings.Builder
+	lineLength := len(key) + 2
+	for i, word := range strings.Split(value, " ") {
+		space := 1
+		if i == 0 {
+			// The space after the colon is already counted
+			space = 0
+		}
+		if lineLength+space+len(word) > 78 && len(word) <= 77 {
+			b.WriteString("\r\n ")
+			lineLength = 1
+		} else if i > 0 {
+			b.WriteString(" ")
+			lineLength++
+		}
+		b.WriteString(word)
+		lineLength += len(word)
+	}
+	return b.String()
+}
+
+// partHeader folds the fields of a part, multipart.Writer writes them as is
+func partHeader(header textproto.MIMEHeader) textproto.MIMEHeader {
+	for key, values := range header {
+		for i := range values {
+			values[i] = fold(key, values[i])
+		}
+	}
+	return header
+}
+
+func (m *Message) writeBody(mw *multipart.Writer) error {
+	switch {
+	case m.Text != "" && m.HTML != "":
+		var buf bytes.Buffer
+		alternative := multipart.NewWriter(&buf)
+		if err := writeAlternatives(alternative, m.Text, m.HTML); err != nil {
+			return err
+		}
+		if err := alternative.Close(); err != nil {
+			return err
+		}
+		part, err := mw.CreatePart(partHeader(textproto.MIMEHeader{
+			"Content-Type": {mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": alternative.Boundary()})},
+		}))
+		if err != nil {
+			return err
+		}
+		_, err = part.Write(buf.Bytes())
+		return err
+	case m.HTML != "":
+		return createTextPart(mw, "text/html", m.HTML)
+	default:
+		return createTextPart(mw, "text/plain", m.Text)
+	}
+}
+
+// writeAlternatives writes the plain text first: clients show the last version they understand
+func writeAlternatives(mw *multipart.Writer, text, html string) error {
+	if err := createTextPart(mw, "text/plain", text); err != nil {
+		return err
+	}
+	return createTextPart(mw, "text/html", html)
+}
+
+func createTextPart(mw *multipart.Writer, mediaType, text string) error {
+	header := textproto.MIMEHeader{}
+	part, err := mw.CreatePart(partHeader(textHeader(header, mediaType)))
+	if err != nil {
+		return err
+	}
+	return writeQuotedPrintable(part, text)
+}
+
+func writeTextPart(w io.Writer, header textproto.MIMEHeader, mediaType, text string) error {
+	writeHeader(w, textHeader(header, mediaType))
+	return writeQuotedPrintable(w, text)
+}
+
+func textHeader(header textproto.MIMEHeader, mediaType string) textproto.MIMEHeader {
+	header.Set("Content-Type", mime.FormatMediaType(mediaType, map[string]string{"charset": "utf-8"}))
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	return header
+}
+
+// writeQuotedPrintable encodes the text, so that the lines are short and 7-bit.
+// Line breaks are normalized to CRLF
+func writeQuotedPrintable(w io.Writer, text string) error {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\n", "\r\n")
+	qp := quotedprintable.NewWriter(w)
+	if _, err := io.WriteString(qp, text); err != nil {
+		return err
+	}
+	if err := qp.Close(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+func writeAttachment(mw *multipart.Writer, attachment Attachment) error {
+	ctype := attachment.ContentType
+	if ctype == "" {
+		ctype = DetectContentType(attachment.Filename, attachment.Data)
+	}
+	part, err := mw.CreatePart(partHeader(textproto.MIMEHeader{
+		"Content-Type":              {ctype},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {disposition(attachment.Filename)},
+	}))
+	if err != nil {
+		return err
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(attachment.Data)
+	for len(encoded) > 76 {
+		if _, err := io.WriteString(part, encoded[:76]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err = io.WriteString(part, encoded+"\r\n")
+	return err
+}
+
+// disposition formats the Content-Disposition. Long and non-ASCII file names are
+// percent-encoded and split into continuations (RFC 2231), so that they can be folded
+func disposition(filename string) string {
+	value := mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+	if len("Content-Disposition: ")+len(value) <= 78 {
+		return value
+	}
+
+	const chunk = 60
+	var encoded strings.Builder
+	for i := 0; i < len(filename); i++ {
+		c := filename[i]
+		if c < 0x80 && (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0) {
+			encoded.WriteByte(c)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+	rest := "utf-8''" + encoded.String()
+
+	var b strings.Builder
+	b.WriteString("attachment")
+	for i := 0; rest != ""; i++ {
+		n := len(rest)
+		if n > chunk {
+			n = chunk
+			// A %XX escape is not split between the continuations
+			if j := strings.LastIndexByte(rest[n-2:n], '%'); j >= 0 {
+				n = n - 2 + j
+			}
+		}
+		fmt.Fprintf(&b, "; filename*%d*=%s", i, rest[:n])
+		rest = rest[n:]
+	}
+	return b.String()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
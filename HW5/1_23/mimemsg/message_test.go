@@ -0,0 +1,263 @@
+package mimemsg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parse reads the message back and checks that the lines end with CRLF and are short
+func parse(t *testing.T, m *Message) *mail.Message {
+	t.Helper()
+	data, err := m.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, line := range strings.Split(string(data), "\r\n") {
+		if strings.ContainsAny(line, "\r\n") {
+			t.Fatalf("line %d: bare line break in %q", i, line)
+		}
+		if len(line) > 78 {
+			t.Fatalf("line %d: %d characters", i, len(line))
+		}
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// readPart decodes the body of a part according to its Content-Transfer-Encoding
+func readPart(t *testing.T, encoding string, r io.Reader) string {
+	t.Helper()
+	switch encoding {
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// parts returns the media types and the decoded bodies of the leaf parts
+func parts(t *testing.T, contentType string, body io.Reader) (types, bodies []string) {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		t.Fatalf("got %s, want multipart", mediaType)
+	}
+	types = append(types, mediaType)
+	r := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := r.NextRawPart()
+		if err == io.EOF {
+			return types, bodies
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctype := part.Header.Get("Content-Type")
+		if strings.HasPrefix(ctype, "multipart/") {
+			nestedTypes, nestedBodies := parts(t, ctype, part)
+			types = append(types, nestedTypes...)
+			bodies = append(bodies, nestedBodies...)
+			continue
+		}
+		mediaType, _, _ := mime.ParseMediaType(ctype)
+		types = append(types, mediaType)
+		bodies = append(bodies, readPart(t, part.Header.Get("Content-Transfer-Encoding"), part))
+	}
+}
+
+func TestHeader(t *testing.T) {
+	date := time.Date(2023, 3, 8, 12, 0, 0, 0, time.UTC)
+	msg := parse(t, &Message{
+		From:    "Отправитель <sender@example.com>",
+		To:      []string{"a@example.com", "Получатель <b@example.com>"},
+		Cc:      []string{"c@example.com"},
+		Subject: "Привет, мир! " + strings.Repeat("очень длинная тема ", 5),
+		Text:    "hello",
+		Date:    date,
+	})
+
+	from, err := msg.Header.AddressList("From")
+	if err != nil || len(from) != 1 || from[0].Name != "Отправитель" || from[0].Address != "sender@example.com" {
+		t.Errorf("got From %v, %v", from, err)
+	}
+	to, err := msg.Header.AddressList("To")
+	if err != nil || len(to) != 2 || to[1].Name != "Получатель" {
+		t.Errorf("got To %v, %v", to, err)
+	}
+	if cc := msg.Header.Get("Cc"); cc != "<c@example.com>" {
+		t.Errorf("got Cc %q", cc)
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || !strings.HasPrefix(subject, "Привет, мир! очень") {
+		t.Errorf("got Subject %q, %v", subject, err)
+	}
+	if got, err := msg.Header.Date(); err != nil || !got.Equal(date) {
+		t.Errorf("got Date %v, %v", got, err)
+	}
+	if id := msg.Header.Get("Message-ID"); !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, "@example.com>") {
+		t.Errorf("got Message-ID %q", id)
+	}
+	if version := msg.Header.Get("MIME-Version"); version != "1.0" {
+		t.Errorf("got MIME-Version %q", version)
+	}
+}
+
+func TestASCIISubject(t *testing.T) {
+	msg := parse(t, &Message{From: "sender@example.com", Subject: "Hello", Text: "hello"})
+	if subject := msg.Header.Get("Subject"); subject != "Hello" {
+		t.Errorf("got Subject %q, want it unencoded", subject)
+	}
+}
+
+func TestBadAddress(t *testing.T) {
+	for _, m := range []*Message{
+		{Text: "no sender"},
+		{From: "not an address", Text: "hello"},
+		{From: "sender@example.com", To: []string{"a@example.com", "broken <"}, Text: "hello"},
+	} {
+		if _, err := m.Build(); err == nil {
+			t.Errorf("From %q, To %q: got no error", m.From, m.To)
+		}
+	}
+}
+
+var structureCases = []struct {
+	name   string
+	msg    Message
+	types  []string
+	bodies []string
+}{
+	{
+		name:   "alternative",
+		msg:    Message{Text: "plain", HTML: "<b>html</b>"},
+		types:  []string{"multipart/alternative", "text/plain", "text/html"},
+		bodies: []string{"plain", "<b>html</b>"},
+	},
+	{
+		name: "attachments",
+		msg: Message{Text: "see the pictures", Attachments: []Attachment{
+			{Filename: "cat.jpg", ContentType: "image/jpeg", Data: []byte("jpeg")},
+			{Filename: "dog.png", ContentType: "image/png", Data: []byte("png")},
+		}},
+		types:  []string{"multipart/mixed", "text/plain", "image/jpeg", "image/png"},
+		bodies: []string{"see the pictures", "jpeg", "png"},
+	},
+	{
+		name: "alternative with an attachment",
+		msg: Message{Text: "plain", HTML: "<p>html</p>", Attachments: []Attachment{
+			{Filename: "notes.txt", Data: []byte("notes")},
+		}},
+		types:  []string{"multipart/mixed", "multipart/alternative", "text/plain", "text/html", "text/plain"},
+		bodies: []string{"plain", "<p>html</p>", "notes"},
+	},
+	{
+		name:   "only an attachment",
+		msg:    Message{Attachments: []Attachment{{Filename: "data.bin", Data: bytes.Repeat([]byte{0, 1, 2}, 100)}}},
+		types:  []string{"multipart/mixed", "application/octet-stream"},
+		bodies: []string{string(bytes.Repeat([]byte{0, 1, 2}, 100))},
+	},
+}
+
+func TestStructure(t *testing.T) {
+	for _, tt := range structureCases {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.msg.From = "sender@example.com"
+			msg := parse(t, &tt.msg)
+			types, bodies := parts(t, msg.Header.Get("Content-Type"), msg.Body)
+			if strings.Join(types, " ") != strings.Join(tt.types, " ") {
+				t.Errorf("got types %v, want %v", types, tt.types)
+			}
+			if len(bodies) != len(tt.bodies) {
+				t.Fatalf("got %d parts, want %d", len(bodies), len(tt.bodies))
+			}
+			for i := range bodies {
+				if strings.TrimSuffix(bodies[i], "\r\n") != tt.bodies[i] {
+					t.Errorf("part %d: got %q, want %q", i, bodies[i], tt.bodies[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSinglePart(t *testing.T) {
+	text := "Строка 1\nстрока 2\r\n.\n" + strings.Repeat("long line ", 20)
+	msg := parse(t, &Message{From: "sender@example.com", Text: text})
+	if ctype := msg.Header.Get("Content-Type"); ctype != "text/plain; charset=utf-8" {
+		t.Errorf("got Content-Type %q", ctype)
+	}
+	body := readPart(t, msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	want := strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\n", "\r\n") + "\r\n"
+	if body != want {
+		t.Errorf("got %q, want %q", body, want)
+	}
+
+	msg = parse(t, &Message{From: "sender@example.com", HTML: "<h1>hi</h1>"})
+	if ctype := msg.Header.Get("Content-Type"); ctype != "text/html; charset=utf-8" {
+		t.Errorf("got Content-Type %q", ctype)
+	}
+}
+
+func TestRandomBoundary(t *testing.T) {
+	m := &Message{From: "sender@example.com", Text: "a", HTML: "b"}
+	first := parse(t, m).Header.Get("Content-Type")
+	second := parse(t, m).Header.Get("Content-Type")
+	if first == second {
+		t.Errorf("got the same boundary twice: %q", first)
+	}
+}
+
+func TestAttachmentName(t *testing.T) {
+	m := &Message{From: "sender@example.com"}
+	m.Attach("/tmp/фото отпуска.jpg", []byte("jpeg"))
+	msg := parse(t, m)
+	_, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	part, err := multipart.NewReader(msg.Body, params["boundary"]).NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if part.FileName() != "фото отпуска.jpg" {
+		t.Errorf("got filename %q", part.FileName())
+	}
+}
+
+var contentTypeCases = []struct {
+	filename string
+	data     []byte
+	want     string
+}{
+	{"photo.jpg", nil, "image/jpeg"},
+	{"PHOTO.JPG", nil, "image/jpeg"},
+	{"image.png", nil, "image/png"},
+	{"doc.pdf", nil, "application/pdf"},
+	{"unknown", []byte("\x89PNG\r\n\x1a\n"), "image/png"},
+	{"unknown", []byte("plain text"), "text/plain; charset=utf-8"},
+	{"unknown", nil, "application/octet-stream"},
+}
+
+func TestDetectContentType(t *testing.T) {
+	for _, tt := range contentTypeCases {
+		if got := DetectContentType(tt.filename, tt.data); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.filename, got, tt.want)
+		}
+	}
+}
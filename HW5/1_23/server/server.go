@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"example.com/mail/smtpserver"
+)
+
+var addr = flag.String("addr", "localhost:2525", "Address to listen on")
+var maildir = flag.String("maildir", "maildir", "Directory to store the received messages in")
+var hostname = flag.String("hostname", "localhost", "Server name in the greeting")
+var users = flag.String("users", "", "Comma separated login:password pairs, AUTH is required if set")
+var rules = flag.String("rules", "", "Comma separated recipient rules action:pattern, action is accept, reject or defer")
+var maxSize = flag.Int64("maxsize", 10<<20, "Message size limit in bytes")
+var certFile = flag.String("cert", "", "PEM certificate for STARTTLS")
+var keyFile = flag.String("key", "", "PEM private key for STARTTLS")
+var insecureAuth = flag.Bool("insecure", false, "Allow AUTH without TLS")
+
+func main() {
+	flag.Parse()
+
+	server := &smtpserver.Server{
+		Hostname:          *hostname,
+		Maildir:           smtpserver.Maildir{Root: *maildir},
+		MaxSize:           *maxSize,
+		AllowInsecureAuth: *insecureAuth,
+		Log:               log.New(os.Stderr, "", log.LstdFlags),
+	}
+	var err error
+	if server.Rules, err = smtpserver.ParseRules(*rules); err != nil {
+		log.Fatal(err)
+	}
+	if *users != "" {
+		server.Users = map[string]string{}
+		for _, pair := range strings.Split(*users, ",") {
+			login, password, ok := strings.Cut(pair, ":")
+			if !ok {
+				log.Fatalf("-users: %q is not login:password", pair)
+			}
+			server.Users[login] = password
+		}
+	}
+	if *certFile != "" || *keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		server.Close()
+	}()
+
+	fmt.Printf("Listening on %s, messages are stored in %s\n", *addr, *maildir)
+	if err := server.ListenAndServe(*addr); err != nil && !errors.Is(err, smtpserver.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,75 @@
+package smtpclient
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrAuthNotSupported is returned when the server offers none of the known mechanisms
+	ErrAuthNotSupported = errors.New("smtp: server does not support AUTH PLAIN or LOGIN")
+	// ErrInsecureAuth is returned when the credentials would be sent without TLS
+	ErrInsecureAuth = errors.New("smtp: refusing to authenticate over an unencrypted connection")
+)
+
+// Auth logs in with the mechanism ("PLAIN" or "LOGIN"), an empty mechanism picks the best one
+// the server offers. Both mechanisms send the password as is, so TLS is required unless
+// AllowInsecureAuth is set
+func (c *Client) Auth(mechanism, username, password string) error {
+	if !c.tls && !c.AllowInsecureAuth {
+		return ErrInsecureAuth
+	}
+	ok, params := c.Extension("AUTH")
+	if !ok {
+		return ErrAuthNotSupported
+	}
+	offered := strings.Fields(strings.ToUpper(params))
+	has := func(name string) bool {
+		for _, m := range offered {
+			if m == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	if mechanism == "" {
+		switch {
+		case has("PLAIN"):
+			mechanism = "PLAIN"
+		case has("LOGIN"):
+			mechanism = "LOGIN"
+		default:
+			return ErrAuthNotSupported
+		}
+	}
+
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		return c.authPlain(username, password)
+	case "LOGIN":
+		return c.authLogin(username, password)
+	}
+	return fmt.Errorf("smtp: unknown AUTH mechanism %q", mechanism)
+}
+
+// authPlain sends the credentials as the initial response (RFC 4616)
+func (c *Client) authPlain(username, password string) error {
+	credentials := base64.StdEncoding.EncodeToString([]byte("\x00" + username + "\x00" + password))
+	_, err := c.cmdHidden("AUTH PLAIN", "AUTH PLAIN "+credentials, "AUTH PLAIN <credentials>", 235)
+	return err
+}
+
+// authLogin answers the "Username:" and "Password:" challenges
+func (c *Client) authLogin(username, password string) error {
+	if _, err := c.cmd("AUTH LOGIN", "AUTH LOGIN", 334); err != nil {
+		return err
+	}
+	if _, err := c.cmdHidden("AUTH LOGIN", base64.StdEncoding.EncodeToString([]byte(username)), "<username>", 334); err != nil {
+		return err
+	}
+	_, err := c.cmdHidden("AUTH LOGIN", base64.StdEncoding.EncodeToString([]byte(password)), "<password>", 235)
+	return err
+}
@@ -0,0 +1,422 @@
+// Package smtpclient is a small SMTP client (RFC 5321) written over a plain connection:
+// EHLO with extensions, STARTTLS or implicit TLS, AUTH PLAIN/LOGIN, SIZE, 8BITMIME and PIPELINING
+package smtpclient
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrMessageTooLarge is returned when the message is larger than the SIZE the server announced
+	ErrMessageTooLarge = errors.New("smtp: message is larger than the server accepts")
+	// ErrStartTLSNotSupported is returned by StartTLS if the server did not offer STARTTLS
+	ErrStartTLSNotSupported = errors.New("smtp: server does not support STARTTLS")
+)
+
+type Client struct {
+	// Trace gets a copy of the dialogue, credentials are hidden
+	Trace io.Writer
+	// AllowInsecureAuth lets Auth send credentials over a connection without TLS
+	AllowInsecureAuth bool
+
+	conn       net.Conn
+	r          *bufio.Reader
+	w          *bufio.Writer
+	tls        bool
+	localName  string
+	extensions map[string]string // EHLO keywords in upper case and their parameters
+}
+
+// Dial connects to the server and reads its greeting, the dialogue is copied to trace if it is not nil
+func Dial(addr string, trace io.Writer) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewClient(conn, trace)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// DialTLS connects to a server with implicit TLS (port 465, RFC 8314) and reads its greeting
+func DialTLS(addr string, config *tls.Config, trace io.Writer) (*Client, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewClient(conn, trace)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewClient reads the greeting on an established connection, which may already be a TLS one
+func NewClient(conn net.Conn, trace io.Writer) (*Client, error) {
+	c := &Client{Trace: trace}
+	c.setConn(conn)
+	_, c.tls = conn.(*tls.Conn)
+	reply, err := c.readReply()
+	if err != nil {
+		return nil, err
+	}
+	if err := expect("greeting", reply, 220); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Client) setConn(conn net.Conn) {
+	c.conn = conn
+	c.r = bufio.NewReader(conn)
+	c.w = bufio.NewWriter(conn)
+}
+
+func (c *Client) tracef(format string, args ...interface{}) {
+	if c.Trace != nil {
+		fmt.Fprintf(c.Trace, format+"\n", args...)
+	}
+}
+
+// readReply reads all lines of one reply
+func (c *Client) readReply() (*Reply, error) {
+	reply := &Reply{}
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		c.tracef("S: %s", line)
+
+		code, more, text, err := parseReplyLine(line)
+		if err != nil {
+			return nil, err
+		}
+		if reply.Code != 0 && code != reply.Code {
+			return nil, fmt.Errorf("%w: reply code changed from %d to %d", ErrProtocol, reply.Code, code)
+		}
+		reply.Code = code
+		reply.Lines = append(reply.Lines, text)
+		if !more {
+			return reply, nil
+		}
+	}
+}
+
+// writeLine queues the command, it is sent with the next flush
+func (c *Client) writeLine(line string, traced string) error {
+	if strings.ContainsAny(line, "\r\n") {
+		return fmt.Errorf("smtp: line break in command %q", traced)
+	}
+	c.tracef("C: %s", traced)
+	_, err := c.w.WriteString(line + "\r\n")
+	return err
+}
+
+// cmd sends the command and checks that the reply has one of the expected codes
+func (c *Client) cmd(name string, line string, codes ...int) (*Reply, error) {
+	return c.cmdHidden(name, line, line, codes...)
+}
+
+// cmdHidden is cmd for commands that carry credentials, the trace shows a placeholder instead
+func (c *Client) cmdHidden(name string, line string, traced string, codes ...int) (*Reply, error) {
+	if err := c.writeLine(line, traced); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	reply, err := c.readReply()
+	if err != nil {
+		return nil, err
+	}
+	return reply, expect(name, reply, codes...)
+}
+
+func expect(command string, reply *Reply, codes ...int) error {
+	for _, code := range codes {
+		if reply.Code == code {
+			return nil
+		}
+	}
+	return &Error{Command: command, Reply: *reply}
+}
+
+// Hello introduces the client with EHLO and remembers the extensions.
+// Old servers that do not know EHLO get HELO
+func (c *Client) Hello(localName string) error {
+	c.localName = localName
+	reply, err := c.cmd("EHLO", "EHLO "+localName, 250)
+	if err != nil {
+		var smtpErr *Error
+		if !errors.As(err, &smtpErr) || smtpErr.Code < 500 {
+			return err
+		}
+		c.extensions = map[string]string{}
+		_, err = c.cmd("HELO", "HELO "+localName, 250)
+		return err
+	}
+
+	// The first line is the greeting, the others are "KEYWORD params"
+	c.extensions = map[string]string{}
+	for _, line := range reply.Lines[1:] {
+		keyword, params, _ := strings.Cut(line, " ")
+		c.extensions[strings.ToUpper(keyword)] = params
+	}
+	return nil
+}
+
+// StartTLS upgrades the connection to TLS (RFC 3207) and repeats EHLO,
+// because the extensions offered over TLS may differ
+func (c *Client) StartTLS(config *tls.Config) error {
+	if c.tls {
+		return errors.New("smtp: connection already uses TLS")
+	}
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		return ErrStartTLSNotSupported
+	}
+	if _, err := c.cmd("STARTTLS", "STARTTLS", 220); err != nil {
+		return err
+	}
+	// Anything sent before the handshake could be injected by an attacker, so it is not trusted
+	if c.r.Buffered() > 0 {
+		return fmt.Errorf("%w: data after the STARTTLS reply", ErrProtocol)
+	}
+
+	conn := tls.Client(c.conn, config)
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	c.setConn(conn)
+	c.tls = true
+	c.tracef("-- TLS %s, %s", tls.VersionName(conn.ConnectionState().Version),
+		tls.CipherSuiteName(conn.ConnectionState().CipherSuite))
+	return c.Hello(c.localName)
+}
+
+// TLS tells if the connection is encrypted
+func (c *Client) TLS() bool {
+	return c.tls
+}
+
+// Extension tells if the server announced the extension and returns its parameters
+func (c *Client) Extension(name string) (bool, string) {
+	params, ok := c.extensions[strings.ToUpper(name)]
+	return ok, params
+}
+
+// MaxSize is the SIZE the server announced, 0 if there is no limit
+func (c *Client) MaxSize() int64 {
+	ok, params := c.Extension("SIZE")
+	if !ok {
+		return 0
+	}
+	size, _ := strconv.ParseInt(params, 10, 64)
+	return size
+}
+
+// Mail starts a transaction. The size (0 if unknown) and the 8-bit flag are sent
+// only to servers that support SIZE and 8BITMIME
+func (c *Client) Mail(from string, size int64, body8bit bool) error {
+	if max := c.MaxSize(); max > 0 && size > max {
+		return fmt.Errorf("%w: %d > %d bytes", ErrMessageTooLarge, size, max)
+	}
+	_, err := c.cmd("MAIL FROM", c.mailLine(from, size, body8bit), 250)
+	return err
+}
+
+func (c *Client) mailLine(from string, size int64, body8bit bool) string {
+	line := "MAIL FROM:<" + from + ">"
+	if ok, _ := c.Extension("SIZE"); ok && size > 0 {
+		line += " SIZE=" + strconv.FormatInt(size, 10)
+	}
+	if ok, _ := c.Extension("8BITMIME"); ok && body8bit {
+		line += " BODY=8BITMIME"
+	}
+	return line
+}
+
+// Rcpt adds a recipient to the transaction
+func (c *Client) Rcpt(to string) error {
+	_, err := c.cmd("RCPT TO", "RCPT TO:<"+to+">", 250, 251)
+	return err
+}
+
+// Data starts the message. The message is written to the returned writer, which converts
+// line endings to CRLF and doubles leading dots; Close ends the message and waits for the reply
+func (c *Client) Data() (io.WriteCloser, error) {
+	if _, err := c.cmd("DATA", "DATA", 354); err != nil {
+		return nil, err
+	}
+	return &dataWriter{c: c, lineStart: true}, nil
+}
+
+// RcptResult is the reply to RCPT TO for one recipient, Err is nil if the recipient was accepted
+type RcptResult struct {
+	Recipient string
+	Err       error
+}
+
+// SendMail runs a whole transaction. With PIPELINING, MAIL and all RCPT commands are sent at once.
+// A rejected recipient fails the whole transaction
+func (c *Client) SendMail(from string, to []string, message []byte) error {
+	results, err := c.envelope(from, to, message)
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		if result.Err != nil {
+			c.Reset()
+			return result.Err
+		}
+	}
+	return c.data(message)
+}
+
+// Send is like SendMail, but delivers the message to the recipients the server accepts and
+// reports the reply for each of them. It fails only if no recipient is accepted
+func (c *Client) Send(from string, to []string, message []byte) ([]RcptResult, error) {
+	results, err := c.envelope(from, to, message)
+	if err != nil {
+		return results, err
+	}
+	var firstErr error
+	for _, result := range results {
+		if result.Err == nil {
+			return results, c.data(message)
+		}
+		if firstErr == nil {
+			firstErr = result.Err
+		}
+	}
+	c.Reset()
+	return results, firstErr
+}
+
+// envelope sends MAIL FROM and RCPT TO. The error is returned if MAIL FROM fails,
+// the replies to RCPT TO are returned for each recipient
+func (c *Client) envelope(from string, to []string, message []byte) ([]RcptResult, error) {
+	if len(to) == 0 {
+		return nil, errors.New("smtp: no recipients")
+	}
+	body8bit := false
+	for _, b := range message {
+		if b >= 0x80 {
+			body8bit = true
+			break
+		}
+	}
+
+	if ok, _ := c.Extension("PIPELINING"); ok {
+		results, err := c.envelopePipelined(from, to, int64(len(message)), body8bit)
+		if err != nil {
+			c.Reset()
+		}
+		return results, err
+	}
+	if err := c.Mail(from, int64(len(message)), body8bit); err != nil {
+		return nil, err
+	}
+	results := make([]RcptResult, 0, len(to))
+	for _, recipient := range to {
+		err := c.Rcpt(recipient)
+		var smtpErr *Error
+		if err != nil && !errors.As(err, &smtpErr) {
+			// The connection is broken, there is no point in trying the other recipients
+			return results, err
+		}
+		results = append(results, RcptResult{Recipient: recipient, Err: err})
+	}
+	return results, nil
+}
+
+func (c *Client) data(message []byte) error {
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// envelopePipelined sends MAIL FROM and RCPT TO in one batch (RFC 2920) and then reads all replies
+func (c *Client) envelopePipelined(from string, to []string, size int64, body8bit bool) ([]RcptResult, error) {
+	if max := c.MaxSize(); max > 0 && size > max {
+		return nil, fmt.Errorf("%w: %d > %d bytes", ErrMessageTooLarge, size, max)
+	}
+	if err := c.writeLine(c.mailLine(from, size, body8bit), c.mailLine(from, size, body8bit)); err != nil {
+		return nil, err
+	}
+	for _, recipient := range to {
+		if err := c.writeLine("RCPT TO:<"+recipient+">", "RCPT TO:<"+recipient+">"); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	// All replies must be read even after an error, otherwise they would answer the next commands
+	reply, err := c.readReply()
+	if err != nil {
+		return nil, err
+	}
+	mailErr := expect("MAIL FROM", reply, 250)
+	results := make([]RcptResult, 0, len(to))
+	for _, recipient := range to {
+		reply, err := c.readReply()
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, RcptResult{Recipient: recipient, Err: expect("RCPT TO", reply, 250, 251)})
+	}
+	if mailErr != nil {
+		return nil, mailErr
+	}
+	return results, nil
+}
+
+// Reset aborts the current transaction
+func (c *Client) Reset() error {
+	_, err := c.cmd("RSET", "RSET", 250)
+	return err
+}
+
+// Noop checks that the connection is alive
+func (c *Client) Noop() error {
+	_, err := c.cmd("NOOP", "NOOP", 250)
+	return err
+}
+
+// Quit ends the session and closes the connection
+func (c *Client) Quit() error {
+	_, err := c.cmd("QUIT", "QUIT", 221)
+	if closeErr := c.conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Close closes the connection without QUIT
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
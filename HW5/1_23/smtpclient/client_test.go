@@ -0,0 +1,415 @@
+package smtpclient
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeServer is a scripted SMTP server for the tests
+type fakeServer struct {
+	extensions []string
+	noEHLO     bool
+	username   string
+	password   string
+	// rcptReplies overrides the reply to a recipient, "<code> <text>"
+	rcptReplies map[string]string
+	// tlsConfig enables STARTTLS, or TLS from the start if implicitTLS is set
+	tlsConfig   *tls.Config
+	implicitTLS bool
+
+	mu        sync.Mutex
+	commands  []string
+	messages  []string
+	pipelined bool // RCPT arrived before the reply to MAIL was sent
+}
+
+func (f *fakeServer) start(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.implicitTLS {
+		ln = tls.NewListener(ln, f.tlsConfig)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func (f *fakeServer) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	_, secure := conn.(*tls.Conn)
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	reply := func(lines ...string) {
+		for _, line := range lines {
+			w.WriteString(line + "\r\n")
+		}
+		w.Flush()
+	}
+	readLine := func() (string, bool) {
+		line, err := r.ReadString('\n')
+		return strings.TrimSuffix(line, "\r\n"), err == nil
+	}
+
+	reply("220 fake ESMTP")
+	for {
+		line, ok := readLine()
+		if !ok {
+			return
+		}
+		f.mu.Lock()
+		f.commands = append(f.commands, line)
+		f.mu.Unlock()
+
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch {
+		case verb == "EHLO" && f.noEHLO:
+			reply("502 command not implemented")
+		case verb == "EHLO":
+			lines := []string{"250-fake greets you"}
+			extensions := f.extensions
+			if f.tlsConfig != nil && !secure {
+				extensions = append([]string{"STARTTLS"}, extensions...)
+			}
+			for i, ext := range extensions {
+				if i == len(extensions)-1 {
+					lines = append(lines, "250 "+ext)
+				} else {
+					lines = append(lines, "250-"+ext)
+				}
+			}
+			if len(extensions) == 0 {
+				lines[0] = "250 fake greets you"
+			}
+			reply(lines...)
+		case verb == "HELO":
+			reply("250 fake")
+		case verb == "STARTTLS" && f.tlsConfig != nil && !secure:
+			reply("220 ready to start TLS")
+			tlsConn := tls.Server(conn, f.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, secure = tlsConn, true
+			r, w = bufio.NewReader(conn), bufio.NewWriter(conn)
+		case line == "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00"+f.username+"\x00"+f.password)):
+			reply("235 2.7.0 accepted")
+		case line == "AUTH LOGIN":
+			reply("334 VXNlcm5hbWU6")
+			user, _ := readLine()
+			reply("334 UGFzc3dvcmQ6")
+			pass, _ := readLine()
+			if user == base64.StdEncoding.EncodeToString([]byte(f.username)) && pass == base64.StdEncoding.EncodeToString([]byte(f.password)) {
+				reply("235 2.7.0 accepted")
+			} else {
+				reply("535 5.7.8 bad credentials")
+			}
+		case verb == "AUTH":
+			reply("535 5.7.8 bad credentials")
+		case verb == "MAIL":
+			f.mu.Lock()
+			f.pipelined = r.Buffered() > 0
+			f.mu.Unlock()
+			reply("250 ok")
+		case verb == "RCPT":
+			to := strings.TrimSuffix(strings.TrimPrefix(line, "RCPT TO:<"), ">")
+			if text, ok := f.rcptReplies[to]; ok {
+				reply(text)
+			} else {
+				reply("250 ok")
+			}
+		case verb == "DATA":
+			reply("354 go ahead")
+			var lines []string
+			for {
+				line, ok := readLine()
+				if !ok {
+					return
+				}
+				if line == "." {
+					break
+				}
+				lines = append(lines, strings.TrimPrefix(line, "."))
+			}
+			f.mu.Lock()
+			f.messages = append(f.messages, strings.Join(lines, "\n"))
+			f.mu.Unlock()
+			reply("250 queued")
+		case verb == "RSET" || verb == "NOOP":
+			reply("250 ok")
+		case verb == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("500 unknown command")
+		}
+	}
+}
+
+func (f *fakeServer) lastCommand(prefix string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := len(f.commands) - 1; i >= 0; i-- {
+		if strings.HasPrefix(f.commands[i], prefix) {
+			return f.commands[i]
+		}
+	}
+	return ""
+}
+
+func (f *fakeServer) received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.messages...)
+}
+
+func dial(t *testing.T, f *fakeServer) *Client {
+	c, err := Dial(f.start(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+var replyLines = []struct {
+	line string
+	code int
+	more bool
+	text string
+	err  bool
+}{
+	{"250 ok", 250, false, "ok", false},
+	{"250-SIZE 1000", 250, true, "SIZE 1000", false},
+	{"354", 354, false, "", false},
+	{"25", 0, false, "", true},
+	{"abc hello", 0, false, "", true},
+	{"250_ok", 0, false, "", true},
+	{"999 too big", 0, false, "", true},
+}
+
+func TestParseReplyLine(t *testing.T) {
+	for _, tt := range replyLines {
+		t.Run(tt.line, func(t *testing.T) {
+			code, more, text, err := parseReplyLine(tt.line)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want error %v", err, tt.err)
+			}
+			if code != tt.code || more != tt.more || text != tt.text {
+				t.Errorf("got %d %v %q, want %d %v %q", code, more, text, tt.code, tt.more, tt.text)
+			}
+		})
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	f := &fakeServer{extensions: []string{"SIZE 1000", "8BITMIME", "PIPELINING", "AUTH LOGIN PLAIN"}}
+	c := dial(t, f)
+	if ok, params := c.Extension("auth"); !ok || params != "LOGIN PLAIN" {
+		t.Errorf("got AUTH %v %q", ok, params)
+	}
+	if c.MaxSize() != 1000 {
+		t.Errorf("got SIZE %d, want 1000", c.MaxSize())
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		t.Errorf("got STARTTLS that was not announced")
+	}
+}
+
+func TestHeloFallback(t *testing.T) {
+	f := &fakeServer{noEHLO: true}
+	dial(t, f)
+	if f.lastCommand("HELO") != "HELO localhost" {
+		t.Errorf("HELO was not sent after EHLO failed")
+	}
+}
+
+var authCases = []struct {
+	name      string
+	offered   string
+	mechanism string
+	password  string
+	want      string // the AUTH command that the server gets
+	err       error
+}{
+	{"best is PLAIN", "AUTH LOGIN PLAIN", "", "secret", "AUTH PLAIN", nil},
+	{"only LOGIN", "AUTH LOGIN", "", "secret", "AUTH LOGIN", nil},
+	{"forced LOGIN", "AUTH PLAIN LOGIN", "login", "secret", "AUTH LOGIN", nil},
+	{"wrong password", "AUTH PLAIN", "", "wrong", "AUTH PLAIN", ErrPermanent},
+	{"no AUTH", "", "", "secret", "", ErrAuthNotSupported},
+	{"unknown mechanisms", "AUTH CRAM-MD5", "", "secret", "", ErrAuthNotSupported},
+}
+
+func TestAuth(t *testing.T) {
+	for _, tt := range authCases {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeServer{username: "user@example.com", password: "secret"}
+			if tt.offered != "" {
+				f.extensions = []string{tt.offered}
+			}
+			c := dial(t, f)
+			c.AllowInsecureAuth = true
+			err := c.Auth(tt.mechanism, "user@example.com", tt.password)
+			if tt.err == nil && err != nil || tt.err != nil && !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if got := f.lastCommand("AUTH"); !strings.HasPrefix(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendMail(t *testing.T) {
+	for _, pipelining := range []bool{false, true} {
+		f := &fakeServer{extensions: []string{"SIZE 100000", "8BITMIME"}}
+		if pipelining {
+			f.extensions = append(f.extensions, "PIPELINING")
+		}
+		c := dial(t, f)
+		message := "Subject: test\n\n.hidden dot\nПривет\r\n..two dots\nbare\rCR"
+		if err := c.SendMail("from@example.com", []string{"a@example.com", "b@example.com"}, []byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Quit(); err != nil {
+			t.Errorf("QUIT: %v", err)
+		}
+
+		want := "Subject: test\n\n.hidden dot\nПривет\n..two dots\nbare\nCR"
+		if messages := f.received(); len(messages) != 1 || messages[0] != want {
+			t.Errorf("got messages %q, want %q", messages, want)
+		}
+		if got := f.lastCommand("MAIL"); got != fmt.Sprintf("MAIL FROM:<from@example.com> SIZE=%d BODY=8BITMIME", len(message)) {
+			t.Errorf("got %q", got)
+		}
+		f.mu.Lock()
+		pipelined := f.pipelined
+		f.mu.Unlock()
+		if pipelined != pipelining {
+			t.Errorf("pipelining %v: got batched commands %v", pipelining, pipelined)
+		}
+	}
+}
+
+func TestRejections(t *testing.T) {
+	for _, pipelining := range []bool{false, true} {
+		f := &fakeServer{rcptReplies: map[string]string{
+			"full@example.com":    "452 4.2.2 mailbox full",
+			"unknown@example.com": "550 5.1.1 no such user",
+		}}
+		if pipelining {
+			f.extensions = []string{"PIPELINING"}
+		}
+		c := dial(t, f)
+
+		err := c.SendMail("from@example.com", []string{"ok@example.com", "full@example.com", "unknown@example.com"}, []byte("hi"))
+		var smtpErr *Error
+		if !errors.As(err, &smtpErr) || !errors.Is(err, ErrTemporary) || errors.Is(err, ErrPermanent) || smtpErr.Code != 452 {
+			t.Errorf("got %v, want the temporary error", err)
+		}
+
+		// The session is still in sync after the failed transaction
+		err = c.SendMail("from@example.com", []string{"unknown@example.com"}, []byte("hi"))
+		if !errors.Is(err, ErrPermanent) || !strings.Contains(err.Error(), "no such user") {
+			t.Errorf("got %v, want the permanent error", err)
+		}
+		if err := c.SendMail("from@example.com", []string{"ok@example.com"}, []byte("hi")); err != nil {
+			t.Errorf("got %v", err)
+		}
+		if len(f.received()) != 1 {
+			t.Errorf("got %d messages, want 1", len(f.received()))
+		}
+	}
+}
+
+func TestMessageTooLarge(t *testing.T) {
+	f := &fakeServer{extensions: []string{"SIZE 10"}}
+	c := dial(t, f)
+	err := c.SendMail("from@example.com", []string{"a@example.com"}, []byte("this is longer than ten bytes"))
+	if !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("got %v, want ErrMessageTooLarge", err)
+	}
+	if f.lastCommand("MAIL") != "" {
+		t.Errorf("MAIL was sent for a too large message")
+	}
+}
+
+func TestTraceHidesCredentials(t *testing.T) {
+	f := &fakeServer{extensions: []string{"AUTH PLAIN"}, username: "user", password: "secret"}
+	var trace strings.Builder
+	c, err := Dial(f.start(t), &trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Hello("localhost")
+	c.AllowInsecureAuth = true
+	if err := c.Auth("", "user", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	credentials := base64.StdEncoding.EncodeToString([]byte("\x00user\x00secret"))
+	if strings.Contains(trace.String(), credentials) || !strings.Contains(trace.String(), "S: 250-fake greets you") {
+		t.Errorf("got trace\n%s", trace.String())
+	}
+}
+
+func TestSend(t *testing.T) {
+	for _, pipelining := range []bool{false, true} {
+		f := &fakeServer{rcptReplies: map[string]string{
+			"full@example.com":    "452 4.2.2 mailbox full",
+			"unknown@example.com": "550 5.1.1 no such user",
+		}}
+		if pipelining {
+			f.extensions = []string{"PIPELINING"}
+		}
+		c := dial(t, f)
+
+		to := []string{"ok@example.com", "full@example.com", "unknown@example.com", "other@example.com"}
+		results, err := c.Send("from@example.com", to, []byte("hi"))
+		if err != nil {
+			t.Fatalf("pipelining %v: %v", pipelining, err)
+		}
+		if len(results) != len(to) {
+			t.Fatalf("got %d results, want %d", len(results), len(to))
+		}
+		for i, result := range results {
+			rejected := result.Recipient == "full@example.com" || result.Recipient == "unknown@example.com"
+			if result.Recipient != to[i] || (result.Err != nil) != rejected {
+				t.Errorf("pipelining %v: got %s: %v", pipelining, result.Recipient, result.Err)
+			}
+		}
+		if !errors.Is(results[1].Err, ErrTemporary) || !errors.Is(results[2].Err, ErrPermanent) {
+			t.Errorf("got %v and %v", results[1].Err, results[2].Err)
+		}
+
+		// No recipient is accepted: nothing is sent and the session is still usable
+		if _, err := c.Send("from@example.com", []string{"unknown@example.com"}, []byte("hi")); !errors.Is(err, ErrPermanent) {
+			t.Errorf("got %v, want the permanent error", err)
+		}
+		if err := c.SendMail("from@example.com", []string{"ok@example.com"}, []byte("hi")); err != nil {
+			t.Errorf("got %v", err)
+		}
+		if len(f.received()) != 2 {
+			t.Errorf("got %d messages, want 2", len(f.received()))
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package smtpclient
+
+// dataWriter sends the message after DATA (RFC 5321, 4.5.2): every line ends with CRLF,
+// lines starting with a dot get another dot, and Close sends the final "." line
+type dataWriter struct {
+	c *Client
+	// state of the line being written
+	lineStart bool
+	afterCR   bool
+}
+
+func (d *dataWriter) Write(p []byte) (int, error) {
+	w := d.c.w
+	for _, b := range p {
+		switch {
+		case b == '\n':
+			// Both "\n" and "\r\n" become "\r\n"
+			if !d.afterCR {
+				if err := w.WriteByte('\r'); err != nil {
+					return 0, err
+				}
+			}
+			if err := w.WriteByte('\n'); err != nil {
+				return 0, err
+			}
+			d.lineStart = true
+			d.afterCR = false
+			continue
+		case d.afterCR:
+			// A bare "\r" is not a line end, make it one
+			if err := w.WriteByte('\n'); err != nil {
+				return 0, err
+			}
+			d.lineStart = true
+		}
+
+		if d.lineStart && b == '.' {
+			if err := w.WriteByte('.'); err != nil {
+				return 0, err
+			}
+		}
+		if err := w.WriteByte(b); err != nil {
+			return 0, err
+		}
+		d.lineStart = false
+		d.afterCR = b == '\r'
+	}
+	return len(p), nil
+}
+
+func (d *dataWriter) Close() error {
+	w := d.c.w
+	end := ".\r\n"
+	switch {
+	case d.afterCR:
+		end = "\n.\r\n"
+	case !d.lineStart:
+		end = "\r\n.\r\n"
+	}
+	d.c.tracef("C: <message>")
+	d.c.tracef("C: .")
+	if _, err := w.WriteString(end); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	reply, err := d.c.readReply()
+	if err != nil {
+		return err
+	}
+	return expect("DATA", reply, 250)
+}
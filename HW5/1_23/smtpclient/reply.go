@@ -0,0 +1,75 @@
+package smtpclient
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrTemporary matches the 4xx replies: the same command may succeed later
+	ErrTemporary = errors.New("smtp: temporary failure")
+	// ErrPermanent matches the 5xx replies: repeating the command will not help
+	ErrPermanent = errors.New("smtp: permanent failure")
+	// ErrProtocol is returned for replies that cannot be parsed
+	ErrProtocol = errors.New("smtp: protocol error")
+)
+
+// Reply is a server reply, possibly multi-line ("250-first", "250 last")
+type Reply struct {
+	Code  int
+	Lines []string
+}
+
+func (r *Reply) Message() string {
+	return strings.Join(r.Lines, "\n")
+}
+
+func (r *Reply) String() string {
+	return fmt.Sprintf("%d %s", r.Code, strings.Join(r.Lines, "; "))
+}
+
+// Error is an unexpected reply to a command. Use errors.Is with ErrTemporary or ErrPermanent
+// to tell 4xx from 5xx
+type Error struct {
+	Command string
+	Reply
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("smtp: %s: %s", e.Command, e.Reply.String())
+}
+
+func (e *Error) Temporary() bool {
+	return e.Code >= 400 && e.Code < 500
+}
+
+func (e *Error) Permanent() bool {
+	return e.Code >= 500 && e.Code < 600
+}
+
+func (e *Error) Is(target error) bool {
+	return target == ErrTemporary && e.Temporary() || target == ErrPermanent && e.Permanent()
+}
+
+// parseReplyLine splits "250-text" into the code, whether more lines follow and the text
+func parseReplyLine(line string) (code int, more bool, text string, err error) {
+	if len(line) < 3 {
+		return 0, false, "", fmt.Errorf("%w: short reply %q", ErrProtocol, line)
+	}
+	code, err = strconv.Atoi(line[:3])
+	if err != nil || code < 100 || code > 599 {
+		return 0, false, "", fmt.Errorf("%w: bad reply code in %q", ErrProtocol, line)
+	}
+	if len(line) == 3 {
+		return code, false, "", nil
+	}
+	switch line[3] {
+	case ' ':
+		return code, false, line[4:], nil
+	case '-':
+		return code, true, line[4:], nil
+	}
+	return 0, false, "", fmt.Errorf("%w: bad reply separator in %q", ErrProtocol, line)
+}
@@ -0,0 +1,172 @@
+package smtpclient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newCertificate makes a self-signed certificate for mail.example.test and 127.0.0.1
+// and a pool that trusts it
+func newCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mail.example.test"},
+		DNSNames:              []string{"mail.example.test"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// newTLSServer is a fake server with a self-signed certificate that remembers the SNI of the clients
+func newTLSServer(t *testing.T, implicit bool) (*fakeServer, *x509.CertPool, func() string) {
+	cert, pool := newCertificate(t)
+	var mu sync.Mutex
+	var serverName string
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			mu.Lock()
+			serverName = hello.ServerName
+			mu.Unlock()
+			return nil, nil
+		},
+	}
+	f := &fakeServer{
+		extensions:  []string{"AUTH PLAIN LOGIN"},
+		username:    "user",
+		password:    "secret",
+		tlsConfig:   config,
+		implicitTLS: implicit,
+	}
+	return f, pool, func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return serverName
+	}
+}
+
+func TestStartTLS(t *testing.T) {
+	f, pool, serverName := newTLSServer(t, false)
+	c := dial(t, f)
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		t.Fatal("STARTTLS is not offered")
+	}
+
+	// Without TLS the password is not sent
+	if err := c.Auth("", "user", "secret"); !errors.Is(err, ErrInsecureAuth) {
+		t.Fatalf("got %v, want ErrInsecureAuth", err)
+	}
+	if f.lastCommand("AUTH") != "" {
+		t.Fatal("AUTH was sent without TLS")
+	}
+
+	if err := c.StartTLS(&tls.Config{RootCAs: pool, ServerName: "mail.example.test"}); err != nil {
+		t.Fatal(err)
+	}
+	if !c.TLS() || serverName() != "mail.example.test" {
+		t.Errorf("got TLS %v, SNI %q", c.TLS(), serverName())
+	}
+	// EHLO is repeated, STARTTLS is not offered any more
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		t.Errorf("got STARTTLS after the upgrade")
+	}
+	if err := c.Auth("", "user", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendMail("user@example.com", []string{"a@example.com"}, []byte("over TLS")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Error(err)
+	}
+	if messages := f.received(); len(messages) != 1 || messages[0] != "over TLS" {
+		t.Errorf("got messages %q", messages)
+	}
+}
+
+func TestImplicitTLS(t *testing.T) {
+	f, pool, serverName := newTLSServer(t, true)
+	c, err := DialTLS(f.start(t), &tls.Config{RootCAs: pool, ServerName: "mail.example.test"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if !c.TLS() || serverName() != "mail.example.test" {
+		t.Errorf("got TLS %v, SNI %q", c.TLS(), serverName())
+	}
+	if err := c.StartTLS(&tls.Config{RootCAs: pool}); err == nil {
+		t.Errorf("got no error for STARTTLS over TLS")
+	}
+	if err := c.Auth("", "user", "secret"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var verificationCases = []struct {
+	name   string
+	config func(pool *x509.CertPool) *tls.Config
+}{
+	{"unknown CA", func(*x509.CertPool) *tls.Config {
+		return &tls.Config{ServerName: "mail.example.test"}
+	}},
+	{"wrong server name", func(pool *x509.CertPool) *tls.Config {
+		return &tls.Config{RootCAs: pool, ServerName: "other.example.test"}
+	}},
+}
+
+func TestTLSVerification(t *testing.T) {
+	for _, tt := range verificationCases {
+		t.Run(tt.name, func(t *testing.T) {
+			f, pool, _ := newTLSServer(t, false)
+			if err := dial(t, f).StartTLS(tt.config(pool)); err == nil {
+				t.Errorf("STARTTLS: got no error")
+			}
+
+			f, pool, _ = newTLSServer(t, true)
+			if c, err := DialTLS(f.start(t), tt.config(pool), nil); err == nil {
+				c.Close()
+				t.Errorf("implicit TLS: got no error")
+			}
+		})
+	}
+}
+
+func TestStartTLSNotOffered(t *testing.T) {
+	c := dial(t, &fakeServer{})
+	if err := c.StartTLS(&tls.Config{}); !errors.Is(err, ErrStartTLSNotSupported) {
+		t.Errorf("got %v, want ErrStartTLSNotSupported", err)
+	}
+}
@@ -0,0 +1,85 @@
+package smtpserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Maildir stores the messages in <Root>/<recipient>/{tmp,new,cur}. A message is written
+// to tmp and then renamed to new, so a reader never sees a half written file
+type Maildir struct {
+	Root string
+}
+
+var errBadMailbox = errors.New("bad mailbox name")
+
+// mailbox returns the directory of the recipient. The address is a single path component,
+// so that "../x" or "a/b@example.com" cannot escape the root
+func (m Maildir) mailbox(recipient string) (string, error) {
+	name := strings.ToLower(recipient)
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`+"\x00") {
+		return "", errBadMailbox
+	}
+	return filepath.Join(m.Root, name), nil
+}
+
+// Deliver stores a copy of the message for every recipient and returns the file name
+func (m Maildir) Deliver(recipients []string, message []byte) (string, error) {
+	var random [8]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return "", err
+	}
+	hostname, _ := os.Hostname()
+	hostname = strings.NewReplacer("/", "_", ":", "_").Replace(hostname)
+	name := fmt.Sprintf("%d.%s.%s.eml", time.Now().UnixNano(), hex.EncodeToString(random[:]), hostname)
+
+	for _, recipient := range recipients {
+		dir, err := m.mailbox(recipient)
+		if err != nil {
+			return "", err
+		}
+		for _, sub := range []string{"tmp", "new", "cur"} {
+			if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+				return "", err
+			}
+		}
+		tmp := filepath.Join(dir, "tmp", name)
+		if err := os.WriteFile(tmp, message, 0o644); err != nil {
+			os.Remove(tmp)
+			return "", err
+		}
+		if err := os.Rename(tmp, filepath.Join(dir, "new", name)); err != nil {
+			os.Remove(tmp)
+			return "", err
+		}
+	}
+	return name, nil
+}
+
+// Messages lists the new messages of the recipient, oldest first
+func (m Maildir) Messages(recipient string) ([]string, error) {
+	dir, err := m.mailbox(recipient)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "new"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".eml") {
+			paths = append(paths, filepath.Join(dir, "new", entry.Name()))
+		}
+	}
+	return paths, nil
+}
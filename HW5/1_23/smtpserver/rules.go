@@ -0,0 +1,68 @@
+package smtpserver
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Action is what the server answers to RCPT TO
+type Action int
+
+const (
+	Accept Action = iota
+	// Reject is a permanent failure (550)
+	Reject
+	// Defer is a temporary failure (450), the sender may try again later
+	Defer
+)
+
+// Rule applies the action to the recipients matching the pattern, e.g. "*@example.com".
+// The pattern uses the path.Match syntax and is not case sensitive
+type Rule struct {
+	Pattern string
+	Action  Action
+}
+
+// ParseRules parses a comma separated list of "action:pattern", for example
+// "reject:spam@example.com,accept:*@example.com,reject:*"
+func ParseRules(s string) ([]Rule, error) {
+	var rules []Rule
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, pattern, ok := strings.Cut(item, ":")
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("smtpserver: rule %q is not action:pattern", item)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("smtpserver: rule %q: %w", item, err)
+		}
+		rule := Rule{Pattern: strings.ToLower(pattern)}
+		switch strings.ToLower(name) {
+		case "accept":
+			rule.Action = Accept
+		case "reject":
+			rule.Action = Reject
+		case "defer":
+			rule.Action = Defer
+		default:
+			return nil, fmt.Errorf("smtpserver: unknown action %q", name)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// match returns the action of the first matching rule, a recipient that matches none is accepted
+func match(rules []Rule, recipient string) Action {
+	recipient = strings.ToLower(recipient)
+	for _, rule := range rules {
+		if ok, _ := path.Match(strings.ToLower(rule.Pattern), recipient); ok {
+			return rule.Action
+		}
+	}
+	return Accept
+}
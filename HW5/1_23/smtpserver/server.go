@@ -0,0 +1,149 @@
+// Package smtpserver is a small SMTP receiving server (RFC 5321) for testing the sender:
+// EHLO/HELO, STARTTLS, AUTH PLAIN and LOGIN, MAIL/RCPT/DATA, recipient rules and a maildir
+package smtpserver
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve after Close
+var ErrServerClosed = errors.New("smtpserver: server closed")
+
+// Server receives messages and stores them in the maildir
+type Server struct {
+	// Hostname is used in the greeting and in the Received header
+	Hostname string
+	Maildir  Maildir
+	// Users are the logins and passwords for AUTH, if there are any, MAIL requires AUTH
+	Users map[string]string
+	// Rules decide which recipients are accepted, the first matching rule wins
+	Rules []Rule
+	// MaxSize is the message size limit announced with SIZE, 0 means 10 MB
+	MaxSize int64
+	// TLSConfig enables STARTTLS
+	TLSConfig *tls.Config
+	// AllowInsecureAuth offers AUTH before STARTTLS
+	AllowInsecureAuth bool
+	// Timeout is how long a command may take, 0 means 5 minutes
+	Timeout time.Duration
+	Log     *log.Logger
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+const (
+	defaultMaxSize = 10 << 20
+	maxRecipients  = 100
+)
+
+// ListenAndServe listens on the TCP address and serves the connections
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts the connections until Close, every connection is served in its own goroutine
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.listener = ln
+	if s.conns == nil {
+		s.conns = map[net.Conn]bool{}
+	}
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			s.newSession(conn).serve()
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close stops accepting, closes all connections and waits for the sessions to end
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.Log != nil {
+		s.Log.Printf(format, args...)
+	}
+}
+
+func (s *Server) hostname() string {
+	if s.Hostname != "" {
+		return s.Hostname
+	}
+	return "localhost"
+}
+
+func (s *Server) maxSize() int64 {
+	if s.MaxSize > 0 {
+		return s.MaxSize
+	}
+	return defaultMaxSize
+}
+
+func (s *Server) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return 5 * time.Minute
+}
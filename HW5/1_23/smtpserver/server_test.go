@@ -0,0 +1,423 @@
+package smtpserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"mime"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/mail/mimemsg"
+	"example.com/mail/smtpclient"
+)
+
+// startServer serves on a random port until the end of the test
+func startServer(t *testing.T, s *Server) string {
+	t.Helper()
+	if s.Maildir.Root == "" {
+		s.Maildir.Root = t.TempDir()
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ln) }()
+	t.Cleanup(func() {
+		s.Close()
+		if err := <-done; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Serve: got %v, want ErrServerClosed", err)
+		}
+	})
+	return ln.Addr().String()
+}
+
+// dialRaw connects without a client library to send arbitrary commands
+func dialRaw(t *testing.T, addr string) *textproto.Conn {
+	t.Helper()
+	c, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// expect sends the command and checks the reply code
+func expect(t *testing.T, c *textproto.Conn, command string, code int) string {
+	t.Helper()
+	if err := c.PrintfLine("%s", command); err != nil {
+		t.Fatal(err)
+	}
+	got, message, err := c.ReadResponse(0)
+	if got != code {
+		t.Fatalf("%s: got %d %s (%v), want %d", command, got, message, err, code)
+	}
+	return message
+}
+
+func readMessage(t *testing.T, path string) *mail.Message {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	msg, err := mail.ReadMessage(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestSendAndStore(t *testing.T) {
+	s := &Server{
+		Hostname:          "mx.example.test",
+		Users:             map[string]string{"user": "secret"},
+		AllowInsecureAuth: true,
+		Rules:             []Rule{{Pattern: "*@spam.test", Action: Reject}},
+	}
+	addr := startServer(t, s)
+
+	c, err := smtpclient.Dial(addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.AllowInsecureAuth = true
+	if err := c.Hello("client.example.test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Auth("", "user", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	body := "first line\n.\n..two dots\nПривет"
+	msg := &mimemsg.Message{From: "me@example.com", To: []string{"Анна <anna@example.com>"}, Subject: "Тест", Text: body}
+	data, err := msg.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := c.Send("me@example.com", []string{"anna@example.com", "bob@spam.test", "Bob@Example.com"}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Err != nil || !errors.Is(results[1].Err, smtpclient.ErrPermanent) || results[2].Err != nil {
+		t.Errorf("got %v", results)
+	}
+	if err := c.Quit(); err != nil {
+		t.Error(err)
+	}
+
+	if messages, _ := s.Maildir.Messages("bob@spam.test"); len(messages) != 0 {
+		t.Errorf("got %d messages for the rejected recipient", len(messages))
+	}
+	// Mailboxes are not case sensitive
+	if messages, _ := s.Maildir.Messages("bob@example.com"); len(messages) != 1 {
+		t.Errorf("got %d messages for bob, want 1", len(messages))
+	}
+	messages, err := s.Maildir.Messages("anna@example.com")
+	if err != nil || len(messages) != 1 || !strings.HasSuffix(messages[0], ".eml") {
+		t.Fatalf("got %v, %v", messages, err)
+	}
+
+	stored := readMessage(t, messages[0])
+	if got := stored.Header.Get("Return-Path"); got != "<me@example.com>" {
+		t.Errorf("got Return-Path %q", got)
+	}
+	received := stored.Header.Get("Received")
+	if !strings.Contains(received, "from client.example.test") || !strings.Contains(received, "by mx.example.test with ESMTPA") {
+		t.Errorf("got Received %q", received)
+	}
+	if subject, _ := new(mime.WordDecoder).DecodeHeader(stored.Header.Get("Subject")); subject != "Тест" {
+		t.Errorf("got Subject %q", subject)
+	}
+	raw, err := os.ReadFile(messages[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The dots doubled by the client are removed again
+	if !strings.Contains(string(raw), "\r\n.\r\n..two dots\r\n") {
+		t.Errorf("dots are not restored:\n%s", raw)
+	}
+}
+
+func TestDotTransparency(t *testing.T) {
+	s := &Server{}
+	c := dialRaw(t, startServer(t, s))
+	expect(t, c, "EHLO client", 250)
+	expect(t, c, "MAIL FROM:<>", 250)
+	expect(t, c, "RCPT TO:<a@example.com>", 250)
+	expect(t, c, "DATA", 354)
+	w := c.DotWriter()
+	w.Write([]byte("Subject: dots\r\n\r\n.\r\n..\r\n.x\r\nend\r\n"))
+	w.Close()
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+
+	messages, _ := s.Maildir.Messages("a@example.com")
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages", len(messages))
+	}
+	raw, _ := os.ReadFile(messages[0])
+	if !strings.HasSuffix(string(raw), "Subject: dots\r\n\r\n.\r\n..\r\n.x\r\nend\r\n") {
+		t.Errorf("got %q", raw)
+	}
+	if !strings.HasPrefix(string(raw), "Return-Path: <>\r\nReceived: from client") {
+		t.Errorf("got %q", raw)
+	}
+}
+
+var sequenceCases = []struct {
+	name     string
+	server   func() *Server
+	commands []string
+	codes    []int
+}{
+	{
+		name:     "MAIL before EHLO",
+		commands: []string{"MAIL FROM:<a@example.com>", "EHLO client", "RCPT TO:<b@example.com>"},
+		codes:    []int{503, 250, 503},
+	},
+	{
+		name:     "DATA without recipients",
+		commands: []string{"HELO client", "DATA", "MAIL FROM:<a@example.com>", "DATA", "MAIL FROM:<a@example.com>"},
+		codes:    []int{250, 503, 250, 554, 503},
+	},
+	{
+		name:     "RSET ends the transaction",
+		commands: []string{"EHLO client", "MAIL FROM:<a@example.com>", "RSET", "RCPT TO:<b@example.com>", "NOOP", "VRFY b"},
+		codes:    []int{250, 250, 250, 503, 250, 252},
+	},
+	{
+		name:     "syntax errors",
+		commands: []string{"EHLO", "EHLO client", "MAIL a@example.com", "MAIL FROM:<a@example.com> SMTPUTF8", "MAIL FROM:<a@example.com>", "RCPT TO:<>", "RCPT TO:<../x>", "DATA now", "WHAT"},
+		codes:    []int{501, 250, 501, 555, 250, 501, 550, 501, 500},
+	},
+	{
+		name:     "size limit",
+		server:   func() *Server { return &Server{MaxSize: 100} },
+		commands: []string{"EHLO client", "MAIL FROM:<a@example.com> SIZE=101", "MAIL FROM:<a@example.com> SIZE=100 BODY=8BITMIME"},
+		codes:    []int{250, 552, 250},
+	},
+	{
+		name: "rules",
+		server: func() *Server {
+			return &Server{Rules: []Rule{{"full@example.com", Defer}, {"*@example.com", Accept}, {"*", Reject}}}
+		},
+		commands: []string{"EHLO client", "MAIL FROM:<a@example.com>", "RCPT TO:<FULL@example.com>", "RCPT TO:<b@example.com>", "RCPT TO:<b@other.test>"},
+		codes:    []int{250, 250, 450, 250, 550},
+	},
+	{
+		name:     "authentication required",
+		server:   func() *Server { return &Server{Users: map[string]string{"user": "secret"}, AllowInsecureAuth: true} },
+		commands: []string{"EHLO client", "MAIL FROM:<a@example.com>", "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00user\x00wrong")), "AUTH CRAM-MD5", "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00user\x00secret")), "AUTH PLAIN", "MAIL FROM:<a@example.com>"},
+		codes:    []int{250, 530, 535, 504, 235, 503, 250},
+	},
+	{
+		name:     "no AUTH without TLS",
+		server:   func() *Server { return &Server{Users: map[string]string{"user": "secret"}} },
+		commands: []string{"EHLO client", "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00user\x00secret")), "STARTTLS"},
+		codes:    []int{250, 538, 502},
+	},
+	{
+		name:     "long line",
+		commands: []string{"NOOP " + strings.Repeat("x", 600), "NOOP"},
+		codes:    []int{500, 250},
+	},
+}
+
+func TestSequence(t *testing.T) {
+	for _, tt := range sequenceCases {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{}
+			if tt.server != nil {
+				s = tt.server()
+			}
+			c := dialRaw(t, startServer(t, s))
+			for i, command := range tt.commands {
+				expect(t, c, command, tt.codes[i])
+			}
+			expect(t, c, "QUIT", 221)
+		})
+	}
+}
+
+func TestAuthLogin(t *testing.T) {
+	c := dialRaw(t, startServer(t, &Server{Users: map[string]string{"user": "secret"}, AllowInsecureAuth: true}))
+	expect(t, c, "EHLO client", 250)
+	if prompt := expect(t, c, "AUTH LOGIN", 334); prompt != base64.StdEncoding.EncodeToString([]byte("Username:")) {
+		t.Errorf("got prompt %q", prompt)
+	}
+	expect(t, c, "*", 501)
+	expect(t, c, "AUTH LOGIN "+base64.StdEncoding.EncodeToString([]byte("user")), 334)
+	expect(t, c, "not base64!", 501)
+	expect(t, c, "AUTH LOGIN", 334)
+	expect(t, c, base64.StdEncoding.EncodeToString([]byte("user")), 334)
+	expect(t, c, base64.StdEncoding.EncodeToString([]byte("secret")), 235)
+}
+
+func TestMessageTooBig(t *testing.T) {
+	s := &Server{MaxSize: 50}
+	c := dialRaw(t, startServer(t, s))
+	expect(t, c, "EHLO client", 250)
+	expect(t, c, "MAIL FROM:<a@example.com>", 250)
+	expect(t, c, "RCPT TO:<b@example.com>", 250)
+	expect(t, c, "DATA", 354)
+	w := c.DotWriter()
+	w.Write([]byte(strings.Repeat("0123456789\r\n", 10)))
+	w.Close()
+	if code, _, _ := c.ReadResponse(0); code != 552 {
+		t.Errorf("got %d, want 552", code)
+	}
+	// The session goes on
+	expect(t, c, "MAIL FROM:<a@example.com>", 250)
+	if messages, _ := s.Maildir.Messages("b@example.com"); len(messages) != 0 {
+		t.Errorf("got %d messages", len(messages))
+	}
+}
+
+var mailboxCases = []struct {
+	recipient string
+	ok        bool
+}{
+	{"user@example.com", true},
+	{"User@Example.COM", true},
+	{"", false},
+	{"..", false},
+	{"../user@example.com", false},
+	{"a/b@example.com", false},
+	{`a\b@example.com`, false},
+	{"a\x00b", false},
+}
+
+func TestMailbox(t *testing.T) {
+	m := Maildir{Root: "/srv/mail"}
+	for _, tt := range mailboxCases {
+		dir, err := m.mailbox(tt.recipient)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: got %q, %v", tt.recipient, dir, err)
+		}
+		if err == nil && !strings.HasPrefix(dir, "/srv/mail/") {
+			t.Errorf("%q: got %q outside the root", tt.recipient, dir)
+		}
+	}
+}
+
+var ruleCases = []struct {
+	recipient string
+	want      Action
+}{
+	{"a@example.com", Accept},
+	{"spam@example.com", Reject},
+	{"SPAM@EXAMPLE.COM", Reject},
+	{"full@example.com", Defer},
+	{"a@other.test", Reject},
+}
+
+func TestRules(t *testing.T) {
+	rules, err := ParseRules("reject:spam@example.com, defer:FULL@example.com,accept:*@example.com,reject:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range ruleCases {
+		if got := match(rules, tt.recipient); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.recipient, got, tt.want)
+		}
+	}
+	if got := match(nil, "a@example.com"); got != Accept {
+		t.Errorf("no rules: got %v, want Accept", got)
+	}
+	for _, bad := range []string{"reject", "drop:*", "accept:[", "accept:"} {
+		if _, err := ParseRules(bad); err == nil {
+			t.Errorf("%q: got no error", bad)
+		}
+	}
+}
+
+func newCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mx.example.test"},
+		DNSNames:              []string{"mx.example.test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestStartTLS(t *testing.T) {
+	cert, pool := newCertificate(t)
+	s := &Server{
+		Hostname:  "mx.example.test",
+		Users:     map[string]string{"user": "secret"},
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	c, err := smtpclient.Dial(startServer(t, s), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Hello("client"); err != nil {
+		t.Fatal(err)
+	}
+	// AUTH is offered only after STARTTLS
+	if ok, _ := c.Extension("AUTH"); ok {
+		t.Error("AUTH is offered without TLS")
+	}
+	if err := c.StartTLS(&tls.Config{RootCAs: pool, ServerName: "mx.example.test"}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		t.Error("STARTTLS is offered over TLS")
+	}
+	if err := c.Auth("", "user", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendMail("me@example.com", []string{"a@example.com"}, []byte("Subject: tls\r\n\r\nhi\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+
+	messages, _ := s.Maildir.Messages("a@example.com")
+	if len(messages) != 1 {
+		t.Fatalf("got %d messages", len(messages))
+	}
+	if received := readMessage(t, messages[0]).Header.Get("Received"); !strings.Contains(received, "with ESMTPSA") {
+		t.Errorf("got Received %q", received)
+	}
+}
@@ -0,0 +1,452 @@
+package smtpserver
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Commands are limited to 512 bytes and text lines to 1000 (RFC 5321 4.5.3.1)
+const (
+	maxCommandLine = 512
+	maxTextLine    = 1000
+)
+
+var errLineTooLong = errors.New("line too long")
+
+// session is the state of one connection
+type session struct {
+	s      *Server
+	conn   net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	remote string
+	tls    bool
+	helo   string
+	ehlo   bool
+	user   string
+
+	// The current transaction
+	inTx       bool
+	from       string
+	recipients []string
+}
+
+func (s *Server) newSession(conn net.Conn) *session {
+	ss := &session{s: s, remote: conn.RemoteAddr().String()}
+	ss.setConn(conn)
+	_, ss.tls = conn.(*tls.Conn)
+	return ss
+}
+
+func (ss *session) setConn(conn net.Conn) {
+	ss.conn = conn
+	ss.r = bufio.NewReader(conn)
+	ss.w = bufio.NewWriter(conn)
+}
+
+// reply writes a (multiline) reply. Replies to pipelined commands are sent together,
+// when the client waits for them
+func (ss *session) reply(code int, lines ...string) error {
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		fmt.Fprintf(ss.w, "%d%s%s\r\n", code, sep, line)
+	}
+	if ss.r.Buffered() > 0 {
+		return nil
+	}
+	return ss.w.Flush()
+}
+
+// readLine reads a line without the line ending. A longer line than the limit is read
+// to the end and errLineTooLong is returned
+func (ss *session) readLine(limit int) (string, error) {
+	ss.conn.SetDeadline(time.Now().Add(ss.s.timeout()))
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := ss.r.ReadSlice('\n')
+		if len(line)+len(chunk) > limit {
+			tooLong = true
+		} else {
+			line = append(line, chunk...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+	if tooLong {
+		return "", errLineTooLong
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+func (ss *session) reset() {
+	ss.inTx = false
+	ss.from = ""
+	ss.recipients = nil
+}
+
+func (ss *session) serve() {
+	defer func() { ss.conn.Close() }()
+	if err := ss.reply(220, ss.s.hostname()+" ESMTP ready"); err != nil {
+		return
+	}
+	for {
+		line, err := ss.readLine(maxCommandLine)
+		if err == errLineTooLong {
+			if ss.reply(500, "5.5.2 Line too long") != nil {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				ss.s.logf("%s: %v", ss.remote, err)
+			}
+			return
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+		verb = strings.ToUpper(verb)
+		arg = strings.TrimSpace(arg)
+		switch verb {
+		case "EHLO", "HELO":
+			err = ss.hello(verb, arg)
+		case "STARTTLS":
+			err = ss.startTLS(arg)
+		case "AUTH":
+			err = ss.auth(arg)
+		case "MAIL":
+			err = ss.mail(arg)
+		case "RCPT":
+			err = ss.rcpt(arg)
+		case "DATA":
+			err = ss.data(arg)
+		case "RSET":
+			ss.reset()
+			err = ss.reply(250, "2.0.0 OK")
+		case "NOOP":
+			err = ss.reply(250, "2.0.0 OK")
+		case "VRFY":
+			err = ss.reply(252, "2.5.0 Cannot VRFY user, but will accept the message")
+		case "QUIT":
+			ss.reply(221, "2.0.0 Bye")
+			return
+		default:
+			err = ss.reply(500, "5.5.2 Unknown command")
+		}
+		if err != nil {
+			ss.s.logf("%s: %v", ss.remote, err)
+			return
+		}
+	}
+}
+
+func (ss *session) hello(verb, name string) error {
+	if name == "" {
+		return ss.reply(501, "5.5.4 Domain name required")
+	}
+	ss.reset()
+	ss.helo = name
+	ss.ehlo = verb == "EHLO"
+	if !ss.ehlo {
+		return ss.reply(250, ss.s.hostname())
+	}
+
+	lines := []string{
+		ss.s.hostname() + " greets " + name,
+		"PIPELINING",
+		"8BITMIME",
+		"SIZE " + strconv.FormatInt(ss.s.maxSize(), 10),
+	}
+	if ss.s.TLSConfig != nil && !ss.tls {
+		lines = append(lines, "STARTTLS")
+	}
+	if len(ss.s.Users) > 0 && (ss.tls || ss.s.AllowInsecureAuth) {
+		lines = append(lines, "AUTH PLAIN LOGIN")
+	}
+	return ss.reply(250, lines...)
+}
+
+func (ss *session) startTLS(arg string) error {
+	switch {
+	case ss.s.TLSConfig == nil:
+		return ss.reply(502, "5.5.1 STARTTLS is not supported")
+	case ss.tls:
+		return ss.reply(503, "5.5.1 Already running TLS")
+	case arg != "":
+		return ss.reply(501, "5.5.4 No parameters allowed")
+	}
+	if err := ss.reply(220, "2.0.0 Ready to start TLS"); err != nil {
+		return err
+	}
+	// Commands sent before the handshake could have been injected by an attacker
+	if ss.r.Buffered() > 0 {
+		return errors.New("data after STARTTLS")
+	}
+
+	conn := tls.Server(ss.conn, ss.s.TLSConfig)
+	conn.SetDeadline(time.Now().Add(ss.s.timeout()))
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	ss.setConn(conn)
+	ss.tls = true
+	// The session starts over (RFC 3207 4.2)
+	ss.helo = ""
+	ss.user = ""
+	ss.reset()
+	return nil
+}
+
+func (ss *session) auth(arg string) error {
+	switch {
+	case ss.helo == "":
+		return ss.reply(503, "5.5.1 Send EHLO first")
+	case len(ss.s.Users) == 0:
+		return ss.reply(502, "5.5.1 AUTH is not supported")
+	case ss.user != "":
+		return ss.reply(503, "5.5.1 Already authenticated")
+	case ss.inTx:
+		return ss.reply(503, "5.5.1 AUTH is not allowed during a transaction")
+	case !ss.tls && !ss.s.AllowInsecureAuth:
+		return ss.reply(538, "5.7.11 Encryption required for requested authentication mechanism")
+	}
+
+	mechanism, initial, _ := strings.Cut(arg, " ")
+	var username, password string
+	var err error
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		var credentials string
+		if credentials, err = ss.challenge(initial, ""); err != nil {
+			break
+		}
+		// authorization identity \0 authentication identity \0 password
+		parts := strings.Split(credentials, "\x00")
+		if len(parts) != 3 {
+			return ss.reply(501, "5.5.2 Malformed credentials")
+		}
+		username, password = parts[1], parts[2]
+	case "LOGIN":
+		if username, err = ss.challenge(initial, "Username:"); err != nil {
+			break
+		}
+		password, err = ss.challenge("", "Password:")
+	default:
+		return ss.reply(504, "5.5.4 Unrecognized authentication type")
+	}
+	if err == errCancelled {
+		return ss.reply(501, "5.0.0 Authentication cancelled")
+	}
+	if err == errMalformed {
+		return ss.reply(501, "5.5.2 Malformed base64 string")
+	}
+	if err != nil {
+		return err
+	}
+
+	expected, ok := ss.s.Users[username]
+	if !ok || subtle.ConstantTimeCompare([]byte(expected), []byte(password)) != 1 {
+		ss.s.logf("%s: authentication failed for %q", ss.remote, username)
+		return ss.reply(535, "5.7.8 Authentication credentials invalid")
+	}
+	ss.user = username
+	return ss.reply(235, "2.7.0 Authentication successful")
+}
+
+var (
+	errCancelled = errors.New("authentication cancelled")
+	errMalformed = errors.New("malformed base64")
+)
+
+// challenge returns the decoded initial response or asks the client with "334 <prompt>"
+func (ss *session) challenge(initial, prompt string) (string, error) {
+	response := initial
+	if response == "" {
+		if err := ss.reply(334, base64.StdEncoding.EncodeToString([]byte(prompt))); err != nil {
+			return "", err
+		}
+		line, err := ss.readLine(maxTextLine)
+		if err != nil {
+			return "", err
+		}
+		response = line
+	}
+	if response == "*" {
+		return "", errCancelled
+	}
+	if response == "=" {
+		return "", nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		return "", errMalformed
+	}
+	return string(decoded), nil
+}
+
+// parsePath parses "FROM:<address> PARAMS" or "TO:<address>"
+func parsePath(prefix, arg string) (address string, params []string, ok bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	rest := strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(rest, "<") {
+		return "", nil, false
+	}
+	end := strings.IndexByte(rest, '>')
+	if end < 0 {
+		return "", nil, false
+	}
+	return rest[1:end], strings.Fields(rest[end+1:]), true
+}
+
+func (ss *session) mail(arg string) error {
+	switch {
+	case ss.helo == "":
+		return ss.reply(503, "5.5.1 Send EHLO first")
+	case len(ss.s.Users) > 0 && ss.user == "":
+		return ss.reply(530, "5.7.0 Authentication required")
+	case ss.inTx:
+		return ss.reply(503, "5.5.1 Nested MAIL command")
+	}
+	from, params, ok := parsePath("FROM:", arg)
+	if !ok {
+		return ss.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+	}
+	for _, param := range params {
+		key, value, _ := strings.Cut(param, "=")
+		switch strings.ToUpper(key) {
+		case "SIZE":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return ss.reply(501, "5.5.4 Bad SIZE")
+			}
+			if size > ss.s.maxSize() {
+				return ss.reply(552, "5.3.4 Message size exceeds fixed limit")
+			}
+		case "BODY":
+			if !strings.EqualFold(value, "7BIT") && !strings.EqualFold(value, "8BITMIME") {
+				return ss.reply(501, "5.5.4 Bad BODY")
+			}
+		default:
+			return ss.reply(555, "5.5.4 Unsupported parameter "+key)
+		}
+	}
+	ss.inTx = true
+	ss.from = from
+	return ss.reply(250, "2.1.0 OK")
+}
+
+func (ss *session) rcpt(arg string) error {
+	if !ss.inTx {
+		return ss.reply(503, "5.5.1 Need MAIL command first")
+	}
+	to, params, ok := parsePath("TO:", arg)
+	if !ok || to == "" || len(params) > 0 {
+		return ss.reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+	}
+	if len(ss.recipients) >= maxRecipients {
+		return ss.reply(452, "4.5.3 Too many recipients")
+	}
+	if _, err := ss.s.Maildir.mailbox(to); err != nil {
+		return ss.reply(550, "5.1.3 <"+to+">: Bad recipient address syntax")
+	}
+	switch match(ss.s.Rules, to) {
+	case Reject:
+		return ss.reply(550, "5.1.1 <"+to+">: Recipient address rejected")
+	case Defer:
+		return ss.reply(450, "4.2.1 <"+to+">: Mailbox temporarily unavailable")
+	}
+	ss.recipients = append(ss.recipients, to)
+	return ss.reply(250, "2.1.5 OK")
+}
+
+func (ss *session) data(arg string) error {
+	switch {
+	case arg != "":
+		return ss.reply(501, "5.5.4 No parameters allowed")
+	case !ss.inTx:
+		return ss.reply(503, "5.5.1 Need MAIL command first")
+	case len(ss.recipients) == 0:
+		return ss.reply(554, "5.5.1 No valid recipients")
+	}
+	if err := ss.reply(354, "End data with <CR><LF>.<CR><LF>"); err != nil {
+		return err
+	}
+
+	// The trace fields are added in front of the message (RFC 5321 4.4)
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "Return-Path: <%s>\r\n", ss.from)
+	fmt.Fprintf(&message, "Received: from %s (%s)\r\n\tby %s with %s; %s\r\n",
+		ss.helo, ss.remote, ss.s.hostname(), ss.protocol(), time.Now().Format(time.RFC1123Z))
+	size, tooBig := int64(0), false
+	for {
+		line, err := ss.readLine(maxTextLine)
+		if err == errLineTooLong {
+			tooBig = true
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if line == "." {
+			break
+		}
+		// Leading dots were doubled by the client
+		line = strings.TrimPrefix(line, ".")
+		size += int64(len(line)) + 2
+		if size > ss.s.maxSize() {
+			tooBig = true
+		}
+		if !tooBig {
+			message.WriteString(line + "\r\n")
+		}
+	}
+
+	from, recipients := ss.from, ss.recipients
+	ss.reset()
+	if tooBig {
+		return ss.reply(552, "5.3.4 Message too big")
+	}
+	name, err := ss.s.Maildir.Deliver(recipients, message.Bytes())
+	if err != nil {
+		ss.s.logf("%s: delivery failed: %v", ss.remote, err)
+		return ss.reply(451, "4.3.0 Local error in processing")
+	}
+	ss.s.logf("%s: %s -> %s: %d bytes, %s", ss.remote, from, strings.Join(recipients, ", "), size, name)
+	return ss.reply(250, "2.0.0 OK: queued as "+name)
+}
+
+// protocol is the "with" clause of the Received header (RFC 3848)
+func (ss *session) protocol() string {
+	if !ss.ehlo {
+		return "SMTP"
+	}
+	protocol := "ESMTP"
+	if ss.tls {
+		protocol += "S"
+	}
+	if ss.user != "" {
+		protocol += "A"
+	}
+	return protocol
+}
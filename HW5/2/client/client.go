@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+
+	"example.com/remote/protocol"
+	"golang.org/x/term"
+)
+
+var addr = flag.String("addr", "localhost:8081", "Address of the server")
+var secretFile = flag.String("secretFile", "", "File with the shared secret (or the REMOTE_SECRET environment variable)")
+var useTLS = flag.Bool("tls", false, "Connect over TLS, it is on when -ca or -cert are set")
+var caFile = flag.String("ca", "", "PEM file with the CA of the server certificate (the system ones by default)")
+var certFile = flag.String("cert", "", "PEM certificate of the client for TLS")
+var keyFile = flag.String("key", "", "PEM private key of the client for TLS")
+var usePTY = flag.Bool("pty", false, "Run the command in a pseudo-terminal, for interactive programs")
+var noStdin = flag.Bool("n", false, "Do not send the standard input to the command")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command [args...]]\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Without a command the commands are read line by line")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	pc, err := connect()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err.Error())
+		os.Exit(255)
+	}
+
+	if flag.NArg() == 0 {
+		err = interactive(pc)
+	} else {
+		var status protocol.ExitStatus
+		status, err = runCommand(pc, flag.Args())
+		if err == nil {
+			os.Exit(exitCode(status))
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err.Error())
+		os.Exit(255)
+	}
+}
+
+// connect dials the server and passes the handshake
+func connect() (*protocol.Conn, error) {
+	var secret []byte
+	if env := os.Getenv("REMOTE_SECRET"); env != "" {
+		secret = []byte(env)
+	}
+	if *secretFile != "" {
+		data, err := os.ReadFile(*secretFile)
+		if err != nil {
+			return nil, err
+		}
+		secret = bytes.TrimSpace(data)
+	}
+
+	var conn net.Conn
+	var err error
+	if *useTLS || *caFile != "" || *certFile != "" {
+		var tlsConfig *tls.Config
+		if tlsConfig, err = loadTLSConfig(); err != nil {
+			return nil, err
+		}
+		conn, err = tls.Dial("tcp", *addr, tlsConfig)
+	} else {
+		if len(secret) == 0 {
+			return nil, errors.New("no authentication: set -secretFile, REMOTE_SECRET or -cert")
+		}
+		conn, err = net.Dial("tcp", *addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	pc := protocol.NewConn(conn)
+	if err := pc.ClientHandshake(secret); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return pc, nil
+}
+
+func loadTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if *caFile != "" {
+		pem, err := os.ReadFile(*caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", *caFile)
+		}
+	}
+	if *certFile != "" || *keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// runCommand runs one command with the local terminal attached to it
+func runCommand(pc *protocol.Conn, args []string) (protocol.ExitStatus, error) {
+	request := protocol.ExecRequest{Args: args}
+	stdinFd := int(os.Stdin.Fd())
+	if *usePTY {
+		request.PTY = true
+		request.Term = os.Getenv("TERM")
+		if term.IsTerminal(stdinFd) {
+			if cols, rows, err := term.GetSize(stdinFd); err == nil {
+				request.Rows, request.Cols = uint16(rows), uint16(cols)
+			}
+			// Every key, Ctrl-C too, goes to the remote terminal as is
+			state, err := term.MakeRaw(stdinFd)
+			if err != nil {
+				return protocol.ExitStatus{}, err
+			}
+			defer term.Restore(stdinFd, state)
+		}
+	}
+
+	if err := pc.Start(request); err != nil {
+		return protocol.ExitStatus{}, err
+	}
+	if *noStdin {
+		if err := pc.CloseStdin(); err != nil {
+			return protocol.ExitStatus{}, err
+		}
+	} else {
+		go sendStdin(pc)
+	}
+
+	var running atomic.Bool
+	running.Store(true)
+	defer cancelOnInterrupt(pc, &running)()
+	status, err := pc.Wait(os.Stdout, os.Stderr)
+	running.Store(false)
+	return status, err
+}
+
+// sendStdin sends the local input to the command until it ends
+func sendStdin(pc *protocol.Conn) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if n > 0 && pc.SendStdin(buf[:n]) != nil {
+			return
+		}
+		if err != nil {
+			pc.CloseStdin()
+			return
+		}
+	}
+}
+
+// cancelOnInterrupt sends Cancel on Ctrl-C while running is set and exits on Ctrl-C
+// otherwise. The returned function stops it
+func cancelOnInterrupt(pc *protocol.Conn, running *atomic.Bool) func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-signals:
+				if !running.Load() {
+					fmt.Println()
+					os.Exit(130)
+				}
+				pc.Cancel()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// interactive reads commands line by line, they are split by spaces and run without input
+func interactive(pc *protocol.Conn) error {
+	var running atomic.Bool
+	defer cancelOnInterrupt(pc, &running)()
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print("> ")
+		if !scanner.Scan() {
+			fmt.Println()
+			return scanner.Err()
+		}
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "exit" || args[0] == "quit" {
+			return nil
+		}
+
+		running.Store(true)
+		status, err := pc.Run(args, os.Stdout, os.Stderr)
+		running.Store(false)
+		var remote *protocol.RemoteError
+		switch {
+		case errors.As(err, &remote):
+			fmt.Fprintln(os.Stderr, "Refused:", remote.Message)
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			return errors.New("the server closed the connection")
+		case err != nil:
+			return err
+		case status.Error != "":
+			fmt.Fprintln(os.Stderr, "Error:", status.Error)
+		case status.TimedOut:
+			fmt.Fprintln(os.Stderr, "Timed out")
+		case status.Canceled:
+			fmt.Fprintln(os.Stderr, "Canceled")
+		case status.Code != 0:
+			fmt.Fprintln(os.Stderr, "Exit code", status.Code)
+		}
+		if status.Truncated {
+			fmt.Fprintln(os.Stderr, "The output was truncated")
+		}
+	}
+}
+
+// exitCode is the code of the remote command, like the shell reports it
+func exitCode(status protocol.ExitStatus) int {
+	switch {
+	case status.TimedOut:
+		return 124
+	case status.Canceled:
+		return 130
+	case status.Error != "":
+		return 127
+	case status.Code < 0:
+		return 255
+	}
+	return status.Code
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"example.com/remote/protocol"
+)
+
+// executor runs the allowed commands with a timeout and a limit on the output
+type executor struct {
+	allow     map[string]bool
+	timeout   time.Duration
+	maxOutput int
+}
+
+func newExecutor(allow string, timeout time.Duration, maxOutput int) *executor {
+	e := &executor{allow: map[string]bool{}, timeout: timeout, maxOutput: maxOutput}
+	for _, name := range strings.Split(allow, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			e.allow[name] = true
+		}
+	}
+	return e
+}
+
+// check allows only the listed program names, paths are never allowed,
+// so "./ls" or "/tmp/ls" cannot replace a trusted program
+func (e *executor) check(args []string) error {
+	if len(args) == 0 || args[0] == "" {
+		return errors.New("empty command")
+	}
+	if strings.ContainsAny(args[0], `/\`) || !e.allow[args[0]] {
+		return fmt.Errorf("command %q is not allowed", args[0])
+	}
+	return nil
+}
+
+// cappedWriter passes the first limit bytes on and drops the rest, so the command is not blocked
+type cappedWriter struct {
+	w         io.Writer
+	limit     int
+	written   int
+	truncated bool
+}
+
+func (c *cappedWriter) Write(p []byte) (int, error) {
+	data := p
+	if room := c.limit - c.written; len(data) > room {
+		data = data[:room]
+		c.truncated = true
+	}
+	if len(data) > 0 {
+		if _, err := c.w.Write(data); err != nil {
+			return 0, err
+		}
+		c.written += len(data)
+	}
+	return len(p), nil
+}
+
+// process is a started command
+type process struct {
+	// stdin is the input of the command, eof ends it
+	stdin    io.WriteCloser
+	eof      func() error
+	cancel   context.CancelFunc
+	canceled atomic.Bool
+	// done gets the status after the command exits and all its output is written
+	done chan protocol.ExitStatus
+}
+
+// Cancel kills the command
+func (p *process) Cancel() {
+	p.canceled.Store(true)
+	p.cancel()
+}
+
+// start runs the command without a shell, the arguments are passed as is. The output
+// is written to stdout and stderr as soon as the command produces it
+func (e *executor) start(request protocol.ExecRequest, stdout, stderr io.Writer) (*process, error) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if e.timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), e.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	p := &process{cancel: cancel, done: make(chan protocol.ExitStatus, 1)}
+
+	outWriter := &cappedWriter{w: stdout, limit: e.maxOutput}
+	errWriter := &cappedWriter{w: stderr, limit: e.maxOutput}
+	cmd := exec.CommandContext(ctx, request.Args[0], request.Args[1:]...)
+	// Children that keep the pipes open must not hold up the reply
+	cmd.WaitDelay = time.Second
+
+	var wait func() error
+	var err error
+	if request.PTY {
+		if request.Term != "" {
+			cmd.Env = append(os.Environ(), "TERM="+request.Term)
+		}
+		p.stdin, wait, err = startPTY(cmd, request.Rows, request.Cols, outWriter)
+		// The terminal ends the input on Ctrl-D
+		p.eof = func() error {
+			_, err := p.stdin.Write([]byte{4})
+			return err
+		}
+	} else {
+		prepare(cmd)
+		cmd.Stdout = outWriter
+		cmd.Stderr = errWriter
+		p.stdin, err = cmd.StdinPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		p.eof = func() error { return p.stdin.Close() }
+		wait = cmd.Wait
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	go func() {
+		err := wait()
+		var status protocol.ExitStatus
+		status.Truncated = outWriter.truncated || errWriter.truncated
+		switch {
+		case ctx.Err() == context.DeadlineExceeded:
+			status.TimedOut = true
+			status.Code = -1
+		case p.canceled.Load():
+			status.Canceled = true
+			status.Code = -1
+		case cmd.ProcessState != nil:
+			// -1 if the command was killed by a signal
+			status.Code = cmd.ProcessState.ExitCode()
+		case err != nil:
+			status.Code = -1
+			status.Error = err.Error()
+		}
+		cancel()
+		p.done <- status
+	}()
+	return p, nil
+}
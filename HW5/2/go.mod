@@ -0,0 +1,10 @@
+module example.com/remote
+
+go 1.20
+
+require (
+	github.com/creack/pty v1.1.21
+	golang.org/x/term v0.13.0
+)
+
+require golang.org/x/sys v0.13.0 // indirect
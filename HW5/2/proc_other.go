@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// prepare does nothing, the timeout kills only the command itself
+func prepare(cmd *exec.Cmd) {}
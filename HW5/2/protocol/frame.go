@@ -0,0 +1,280 @@
+// Package protocol is the framed protocol of the remote command server.
+//
+// Every frame is a type byte, a big-endian uint32 payload length and the payload. After a
+// handshake with a shared secret every frame also carries an HMAC-SHA256 tag over a sequence
+// number, the type and the payload, so frames cannot be forged, replayed or reordered. Each
+// direction has its own key, so a frame cannot be sent back to its sender either.
+// The tags do not hide the data, TLS is needed for that
+package protocol
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Type is the kind of a frame
+type Type byte
+
+const (
+	// Hello is the greeting of the server: version, flags and a nonce
+	Hello Type = iota + 1
+	// Auth is the answer of the client: its nonce and the proof of the secret
+	Auth
+	// AuthOK is the proof of the server
+	AuthOK
+	// Exec asks to run a command, the payload is an ExecRequest
+	Exec
+	// Stdout and Stderr carry the output of the command
+	Stdout
+	Stderr
+	// Exit ends the command, the payload is an ExitStatus
+	Exit
+	// Error is a refusal of the server, the payload is the message
+	Error
+	// Stdin carries the input of the running command, an empty payload closes it
+	Stdin
+	// Cancel asks to kill the running command
+	Cancel
+)
+
+func (t Type) String() string {
+	names := []string{"", "Hello", "Auth", "AuthOK", "Exec", "Stdout", "Stderr", "Exit", "Error", "Stdin", "Cancel"}
+	if int(t) < len(names) && t != 0 {
+		return names[t]
+	}
+	return fmt.Sprintf("Type(%d)", byte(t))
+}
+
+const (
+	// MaxPayload limits the frame size, so a peer cannot make us allocate much memory
+	MaxPayload = 1 << 20
+	headerSize = 5
+	tagSize    = sha256.Size
+)
+
+var (
+	ErrFrameTooLarge = errors.New("protocol: frame too large")
+	ErrBadTag        = errors.New("protocol: bad frame authentication tag")
+)
+
+// Frame is one message
+type Frame struct {
+	Type    Type
+	Payload []byte
+}
+
+// ExecRequest is the payload of Exec. The command is not run by a shell
+type ExecRequest struct {
+	Args []string `json:"args"`
+	// PTY runs the command in a pseudo-terminal of Rows x Cols (24 x 80 if not set), then stdout
+	// and stderr both come as Stdout
+	PTY  bool   `json:"pty,omitempty"`
+	Rows uint16 `json:"rows,omitempty"`
+	Cols uint16 `json:"cols,omitempty"`
+	// Term is the TERM variable of the command in a pseudo-terminal
+	Term string `json:"term,omitempty"`
+}
+
+// ExitStatus is the payload of Exit
+type ExitStatus struct {
+	Code int `json:"code"`
+	// TimedOut is set when the command was killed after the timeout
+	TimedOut bool `json:"timedOut,omitempty"`
+	// Canceled is set when the command was killed because the client sent Cancel
+	Canceled bool `json:"canceled,omitempty"`
+	// Truncated is set when some output was dropped because of the size limit
+	Truncated bool `json:"truncated,omitempty"`
+	// Error is set when the command could not be started
+	Error string `json:"error,omitempty"`
+}
+
+// Conn reads and writes frames. Writes may be done from several goroutines
+type Conn struct {
+	r *bufio.Reader
+	w *bufio.Writer
+
+	// The keys are set after a handshake with a secret, then all frames are authenticated
+	sendKey []byte
+	recvKey []byte
+	wmu     sync.Mutex
+	sendSeq uint64
+	recvSeq uint64
+}
+
+// NewConn wraps the connection
+func NewConn(rw io.ReadWriter) *Conn {
+	return &Conn{r: bufio.NewReader(rw), w: bufio.NewWriter(rw)}
+}
+
+func tag(key []byte, seq uint64, header, payload []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	var seqBytes [8]byte
+	binary.BigEndian.PutUint64(seqBytes[:], seq)
+	mac.Write(seqBytes[:])
+	mac.Write(header)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// WriteFrame sends the frame at once
+func (c *Conn) WriteFrame(t Type, payload []byte) error {
+	if len(payload) > MaxPayload {
+		return ErrFrameTooLarge
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	var header [headerSize]byte
+	header[0] = byte(t)
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	c.w.Write(header[:])
+	c.w.Write(payload)
+	if c.sendKey != nil {
+		c.w.Write(tag(c.sendKey, c.sendSeq, header[:], payload))
+		c.sendSeq++
+	}
+	return c.w.Flush()
+}
+
+// WriteJSON sends the value encoded as JSON
+func (c *Conn) WriteJSON(t Type, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteFrame(t, payload)
+}
+
+// ReadFrame reads the next frame and checks its tag
+func (c *Conn) ReadFrame() (Frame, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return Frame{}, err
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > MaxPayload {
+		return Frame{}, ErrFrameTooLarge
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return Frame{}, unexpected(err)
+	}
+	if c.recvKey != nil {
+		var got [tagSize]byte
+		if _, err := io.ReadFull(c.r, got[:]); err != nil {
+			return Frame{}, unexpected(err)
+		}
+		if !hmac.Equal(got[:], tag(c.recvKey, c.recvSeq, header[:], payload)) {
+			return Frame{}, ErrBadTag
+		}
+		c.recvSeq++
+	}
+	return Frame{Type: Type(header[0]), Payload: payload}, nil
+}
+
+// ReadJSON reads a frame of the type and decodes its payload into v. An Error frame
+// is returned as *RemoteError
+func (c *Conn) ReadJSON(t Type, v interface{}) error {
+	frame, err := c.ReadFrame()
+	if err != nil {
+		return err
+	}
+	if frame.Type == Error {
+		return &RemoteError{Message: string(frame.Payload)}
+	}
+	if frame.Type != t {
+		return fmt.Errorf("protocol: got %v, want %v", frame.Type, t)
+	}
+	return json.Unmarshal(frame.Payload, v)
+}
+
+// RemoteError is a refusal sent by the server in an Error frame
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "remote: " + e.Message
+}
+
+// unexpected turns EOF in the middle of a frame into ErrUnexpectedEOF
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Start asks the server to run the command. The output is read with Wait, the input
+// may be sent with SendStdin meanwhile
+func (c *Conn) Start(request ExecRequest) error {
+	return c.WriteJSON(Exec, request)
+}
+
+// SendStdin sends the data to the input of the running command
+func (c *Conn) SendStdin(data []byte) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > MaxPayload {
+			n = MaxPayload
+		}
+		if err := c.WriteFrame(Stdin, data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// CloseStdin tells the command that there is no more input
+func (c *Conn) CloseStdin() error {
+	return c.WriteFrame(Stdin, nil)
+}
+
+// Cancel asks the server to kill the running command, Wait still returns its status
+func (c *Conn) Cancel() error {
+	return c.WriteFrame(Cancel, nil)
+}
+
+// Wait copies the output of the command to stdout and stderr as it comes until the command exits
+func (c *Conn) Wait(stdout, stderr io.Writer) (ExitStatus, error) {
+	for {
+		frame, err := c.ReadFrame()
+		if err != nil {
+			return ExitStatus{}, unexpected(err)
+		}
+		switch frame.Type {
+		case Stdout:
+			stdout.Write(frame.Payload)
+		case Stderr:
+			stderr.Write(frame.Payload)
+		case Exit:
+			var status ExitStatus
+			err := json.Unmarshal(frame.Payload, &status)
+			return status, err
+		case Error:
+			return ExitStatus{}, &RemoteError{Message: string(frame.Payload)}
+		default:
+			return ExitStatus{}, fmt.Errorf("protocol: unexpected %v", frame.Type)
+		}
+	}
+}
+
+// Run runs the command without input and copies its output to stdout and stderr
+// until the command exits
+func (c *Conn) Run(args []string, stdout, stderr io.Writer) (ExitStatus, error) {
+	if err := c.Start(ExecRequest{Args: args}); err != nil {
+		return ExitStatus{}, err
+	}
+	if err := c.CloseStdin(); err != nil {
+		return ExitStatus{}, err
+	}
+	return c.Wait(stdout, stderr)
+}
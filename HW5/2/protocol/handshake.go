@@ -0,0 +1,144 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// Version of the protocol, sent in Hello
+const Version = 1
+
+const (
+	nonceSize = 32
+	// flagSecret in Hello tells the client that the server wants the shared secret
+	flagSecret = 1
+)
+
+var (
+	// ErrAuth is returned when the peer does not know the secret
+	ErrAuth = errors.New("protocol: authentication failed")
+	// ErrNoSecret is returned to a client that has a secret, when the server does not use one
+	ErrNoSecret = errors.New("protocol: server does not use the shared secret")
+)
+
+// proof is HMAC(secret, label || server nonce || client nonce). The labels make the proofs
+// of the client and the server and the session keys all different
+func proof(secret []byte, label string, serverNonce, clientNonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(label))
+	mac.Write(serverNonce)
+	mac.Write(clientNonce)
+	return mac.Sum(nil)
+}
+
+// setKeys derives the session keys of the two directions, the server sends with the key
+// the client receives with and the other way round
+func (c *Conn) setKeys(secret, serverNonce, clientNonce []byte, server bool) {
+	serverKey := proof(secret, "remote server session", serverNonce, clientNonce)
+	clientKey := proof(secret, "remote client session", serverNonce, clientNonce)
+	if server {
+		c.sendKey, c.recvKey = serverKey, clientKey
+	} else {
+		c.sendKey, c.recvKey = clientKey, serverKey
+	}
+}
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+// ServerHandshake greets the client and, if the secret is not empty, checks that the client knows it.
+// Both sides prove the secret on fresh nonces, so a recorded handshake cannot be replayed.
+// Without a secret the client must be authenticated some other way, e.g. by a TLS certificate
+func (c *Conn) ServerHandshake(secret []byte) error {
+	serverNonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	flags := byte(0)
+	if len(secret) > 0 {
+		flags |= flagSecret
+	}
+	if err := c.WriteFrame(Hello, append([]byte{Version, flags}, serverNonce...)); err != nil {
+		return err
+	}
+
+	frame, err := c.ReadFrame()
+	if err != nil {
+		return err
+	}
+	if frame.Type != Auth || len(frame.Payload) < nonceSize {
+		return fmt.Errorf("protocol: got %v, want Auth", frame.Type)
+	}
+	clientNonce, clientProof := frame.Payload[:nonceSize], frame.Payload[nonceSize:]
+	if len(secret) == 0 {
+		return c.WriteFrame(AuthOK, nil)
+	}
+
+	if !hmac.Equal(clientProof, proof(secret, "remote client", serverNonce, clientNonce)) {
+		c.WriteFrame(Error, []byte("authentication failed"))
+		return ErrAuth
+	}
+	if err := c.WriteFrame(AuthOK, proof(secret, "remote server", serverNonce, clientNonce)); err != nil {
+		return err
+	}
+	c.setKeys(secret, serverNonce, clientNonce, true)
+	return nil
+}
+
+// ClientHandshake answers the greeting of the server. With a secret the server must prove it too
+func (c *Conn) ClientHandshake(secret []byte) error {
+	frame, err := c.ReadFrame()
+	if err != nil {
+		return err
+	}
+	if frame.Type != Hello || len(frame.Payload) != 2+nonceSize {
+		return fmt.Errorf("protocol: got %v, want Hello", frame.Type)
+	}
+	if frame.Payload[0] != Version {
+		return fmt.Errorf("protocol: server speaks version %d, want %d", frame.Payload[0], Version)
+	}
+	serverWantsSecret := frame.Payload[1]&flagSecret != 0
+	serverNonce := frame.Payload[2:]
+	if serverWantsSecret && len(secret) == 0 {
+		return errors.New("protocol: server requires the shared secret")
+	}
+	if !serverWantsSecret && len(secret) > 0 {
+		// Otherwise anyone could pretend to be the server
+		return ErrNoSecret
+	}
+
+	clientNonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	payload := clientNonce
+	if len(secret) > 0 {
+		payload = append(payload, proof(secret, "remote client", serverNonce, clientNonce)...)
+	}
+	if err := c.WriteFrame(Auth, payload); err != nil {
+		return err
+	}
+
+	frame, err = c.ReadFrame()
+	if err != nil {
+		return err
+	}
+	switch {
+	case frame.Type == Error:
+		return &RemoteError{Message: string(frame.Payload)}
+	case frame.Type != AuthOK:
+		return fmt.Errorf("protocol: got %v, want AuthOK", frame.Type)
+	case len(secret) > 0 && !hmac.Equal(frame.Payload, proof(secret, "remote server", serverNonce, clientNonce)):
+		return ErrAuth
+	}
+	if len(secret) > 0 {
+		c.setKeys(secret, serverNonce, clientNonce, false)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+var handshakeCases = []struct {
+	name         string
+	serverSecret string
+	clientSecret string
+	serverErr    bool
+	clientErr    bool
+}{
+	{"same secret", "secret", "secret", false, false},
+	{"no secrets", "", "", false, false},
+	{"wrong secret", "secret", "guess", true, true},
+	{"client without secret", "secret", "", true, true},
+	{"server without secret", "", "secret", true, true},
+}
+
+// handshake runs both sides over a pipe
+func handshake(t *testing.T, serverSecret, clientSecret string) (server, client *Conn, serverErr, clientErr error) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+	server, client = NewConn(a), NewConn(b)
+	done := make(chan error, 1)
+	go func() {
+		err := server.ServerHandshake([]byte(serverSecret))
+		if err != nil {
+			// Let the client see the end of the connection
+			a.Close()
+		}
+		done <- err
+	}()
+	clientErr = client.ClientHandshake([]byte(clientSecret))
+	if clientErr != nil {
+		b.Close()
+	}
+	return server, client, <-done, clientErr
+}
+
+func TestHandshake(t *testing.T) {
+	for _, tt := range handshakeCases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, serverErr, clientErr := handshake(t, tt.serverSecret, tt.clientSecret)
+			if (serverErr != nil) != tt.serverErr || (clientErr != nil) != tt.clientErr {
+				t.Errorf("got server %v, client %v", serverErr, clientErr)
+			}
+		})
+	}
+}
+
+func TestWrongSecretErrors(t *testing.T) {
+	_, _, serverErr, clientErr := handshake(t, "secret", "guess")
+	var remote *RemoteError
+	if !errors.Is(serverErr, ErrAuth) || !errors.As(clientErr, &remote) {
+		t.Errorf("got server %v, client %v", serverErr, clientErr)
+	}
+	_, _, _, clientErr = handshake(t, "", "secret")
+	if !errors.Is(clientErr, ErrNoSecret) {
+		t.Errorf("got %v, want ErrNoSecret", clientErr)
+	}
+}
+
+func TestAuthenticatedFrames(t *testing.T) {
+	server, client, serverErr, clientErr := handshake(t, "secret", "secret")
+	if serverErr != nil || clientErr != nil {
+		t.Fatal(serverErr, clientErr)
+	}
+	go client.WriteJSON(Exec, ExecRequest{Args: []string{"echo", "hi"}})
+	var request ExecRequest
+	if err := server.ReadJSON(Exec, &request); err != nil {
+		t.Fatal(err)
+	}
+	if len(request.Args) != 2 || request.Args[1] != "hi" {
+		t.Errorf("got %v", request.Args)
+	}
+}
+
+// keyed returns a writer and a reader with the same session key, the frames go through buf
+func keyed(buf *bytes.Buffer) (w, r *Conn) {
+	w, r = NewConn(buf), NewConn(buf)
+	w.sendKey, r.recvKey = []byte("key"), []byte("key")
+	return w, r
+}
+
+func TestTamperedFrames(t *testing.T) {
+	var buf bytes.Buffer
+	w, r := keyed(&buf)
+	w.WriteFrame(Stdout, []byte("hello"))
+	buf.Bytes()[headerSize] ^= 1
+	if _, err := r.ReadFrame(); !errors.Is(err, ErrBadTag) {
+		t.Errorf("changed payload: got %v, want ErrBadTag", err)
+	}
+
+	// A frame sent again is rejected because of the sequence number
+	buf.Reset()
+	w, r = keyed(&buf)
+	w.WriteFrame(Stdout, []byte("once"))
+	frame := append([]byte(nil), buf.Bytes()...)
+	buf.Write(frame)
+	if _, err := r.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadFrame(); !errors.Is(err, ErrBadTag) {
+		t.Errorf("replayed frame: got %v, want ErrBadTag", err)
+	}
+
+	// A frame of another type with the same payload does not pass either
+	buf.Reset()
+	w, r = keyed(&buf)
+	w.WriteFrame(Stdout, []byte("out"))
+	buf.Bytes()[0] = byte(Stderr)
+	if _, err := r.ReadFrame(); !errors.Is(err, ErrBadTag) {
+		t.Errorf("changed type: got %v, want ErrBadTag", err)
+	}
+}
+
+func TestReflectedFrames(t *testing.T) {
+	var buf bytes.Buffer
+	server, client := NewConn(&buf), NewConn(&buf)
+	nonce := make([]byte, nonceSize)
+	server.setKeys([]byte("secret"), nonce, nonce, true)
+	client.setKeys([]byte("secret"), nonce, nonce, false)
+
+	// A frame of the server sent back to it is rejected, the client takes it
+	server.WriteFrame(Stdout, []byte("hello"))
+	frame := append([]byte(nil), buf.Bytes()...)
+	if _, err := server.ReadFrame(); !errors.Is(err, ErrBadTag) {
+		t.Errorf("reflected frame: got %v, want ErrBadTag", err)
+	}
+	buf.Reset()
+	buf.Write(frame)
+	if got, err := client.ReadFrame(); err != nil || string(got.Payload) != "hello" {
+		t.Errorf("got %q, %v", got.Payload, err)
+	}
+}
+
+func TestFrameLimits(t *testing.T) {
+	var buf bytes.Buffer
+	header := make([]byte, headerSize)
+	header[0] = byte(Stdout)
+	binary.BigEndian.PutUint32(header[1:], MaxPayload+1)
+	buf.Write(header)
+	if _, err := NewConn(&buf).ReadFrame(); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("got %v, want ErrFrameTooLarge", err)
+	}
+	if err := NewConn(&buf).WriteFrame(Stdout, make([]byte, MaxPayload+1)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("got %v, want ErrFrameTooLarge", err)
+	}
+
+	buf.Reset()
+	binary.BigEndian.PutUint32(header[1:], 10)
+	buf.Write(header)
+	buf.WriteString("short")
+	if _, err := NewConn(&buf).ReadFrame(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("got %v, want ErrUnexpectedEOF", err)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+)
+
+// startPTY is not supported, pseudo-terminals are Unix only here
+func startPTY(cmd *exec.Cmd, rows, cols uint16, output io.Writer) (io.WriteCloser, func() error, error) {
+	return nil, nil, errors.New("pseudo-terminals are not supported on this system")
+}
@@ -0,0 +1,47 @@
+//go:build unix
+
+package main
+
+import (
+	"io"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+)
+
+// startPTY starts the command in a new session with a pseudo-terminal and copies what
+// the terminal shows to output. The returned wait also waits for the output
+func startPTY(cmd *exec.Cmd, rows, cols uint16, output io.Writer) (io.WriteCloser, func() error, error) {
+	if rows == 0 || cols == 0 {
+		rows, cols = 24, 80
+	}
+	// The session leader is also the leader of the process group
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	terminal, err := pty.StartWithSize(cmd, &pty.Winsize{Rows: rows, Cols: cols})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	copied := make(chan struct{})
+	go func() {
+		// Ends with an error when the last process closes the terminal
+		io.Copy(output, terminal)
+		close(copied)
+	}()
+	wait := func() error {
+		err := cmd.Wait()
+		// Background children may keep the terminal open, they do not hold up the reply
+		select {
+		case <-copied:
+		case <-time.After(time.Second):
+		}
+		terminal.Close()
+		<-copied
+		return err
+	}
+	return terminal, wait, nil
+}
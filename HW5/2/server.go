@@ -1,26 +1,58 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
-	"os/exec"
-	"strings"
+	"os"
+	"time"
+
+	"example.com/remote/protocol"
 )
 
 var port = flag.String("port", ":8081", "Port of localhost server (starts with \":\")")
+var secretFile = flag.String("secretFile", "", "File with the shared secret (or the REMOTE_SECRET environment variable)")
+var certFile = flag.String("cert", "", "PEM certificate of the server for TLS")
+var keyFile = flag.String("key", "", "PEM private key of the server for TLS")
+var clientCA = flag.String("clientCA", "", "PEM file with the CA that signs the client certificates")
+var allow = flag.String("allow", "date,echo,hostname,ls,pwd,uname,uptime,whoami", "Comma separated commands the clients may run")
+var timeout = flag.Duration("timeout", 10*time.Second, "Time limit of a command, 0 for no limit")
+var maxOutput = flag.Int("maxOutput", 1<<20, "Limit of stdout and of stderr of a command in bytes")
+
+// handshakeTimeout limits how long an unauthenticated client may hold a connection
+const handshakeTimeout = 10 * time.Second
+
+// config is what every connection needs
+type config struct {
+	secret []byte
+	exec   *executor
+}
 
 func main() {
 	flag.Parse()
 
 	fmt.Println("Starting server...")
 
+	cfg, tlsConfig, err := loadConfig()
+	if err != nil {
+		fmt.Println("Error:", err.Error())
+		os.Exit(1)
+	}
+
 	ln, err := net.Listen("tcp", *port)
 	if err != nil {
 		fmt.Println("Error:", err.Error())
 		return
 	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
 
 	defer ln.Close()
 
@@ -31,28 +63,233 @@ func main() {
 			continue
 		}
 
-		go handleConnection(conn)
+		go handleConnection(conn, cfg)
+	}
+}
+
+// loadConfig reads the secret and the certificates. At least one way of authentication is required
+func loadConfig() (*config, *tls.Config, error) {
+	cfg := &config{exec: newExecutor(*allow, *timeout, *maxOutput)}
+	if secret := os.Getenv("REMOTE_SECRET"); secret != "" {
+		cfg.secret = []byte(secret)
+	}
+	if *secretFile != "" {
+		secret, err := os.ReadFile(*secretFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		cfg.secret = bytes.TrimSpace(secret)
+	}
+
+	var tlsConfig *tls.Config
+	if *certFile != "" || *keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	if *clientCA != "" {
+		if tlsConfig == nil {
+			return nil, nil, errors.New("-clientCA needs -cert and -key")
+		}
+		pem, err := os.ReadFile(*clientCA)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificates in %s", *clientCA)
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if len(cfg.secret) == 0 && (tlsConfig == nil || tlsConfig.ClientCAs == nil) {
+		return nil, nil, errors.New("no authentication: set -secretFile, REMOTE_SECRET or -clientCA")
+	}
+	return cfg, tlsConfig, nil
+}
+
+// peerName is the address of the client and the name in its certificate, if there is one
+func peerName(conn net.Conn) string {
+	name := conn.RemoteAddr().String()
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			name += " (" + certs[0].Subject.CommonName + ")"
+		}
 	}
+	return name
 }
 
-func handleConnection(conn net.Conn) {
+func handleConnection(conn net.Conn, cfg *config) {
 	defer conn.Close()
 
-	scanner := bufio.NewScanner(conn)
-	for scanner.Scan() {
-		command := scanner.Text()
+	// The TLS handshake checks the client certificate, then the protocol handshake checks the secret
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			fmt.Println("Error:", conn.RemoteAddr(), err.Error())
+			return
+		}
+	}
+	pc := protocol.NewConn(conn)
+	if err := pc.ServerHandshake(cfg.secret); err != nil {
+		fmt.Println("Error:", conn.RemoteAddr(), err.Error())
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	peer := peerName(conn)
+
+	// Frames are read all the time, so Stdin and Cancel reach a running command
+	frames := make(chan protocol.Frame)
+	readErr := make(chan error, 1)
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		for {
+			frame, err := pc.ReadFrame()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case frames <- frame:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	for {
+		var frame protocol.Frame
+		select {
+		case frame = <-frames:
+		case err := <-readErr:
+			if err != io.EOF {
+				fmt.Println("Error:", peer, err.Error())
+				pc.WriteFrame(protocol.Error, []byte(err.Error()))
+			}
+			return
+		}
 
-		parts := strings.Fields(command)
-		if len(parts) == 0 {
+		switch frame.Type {
+		case protocol.Exec:
+		case protocol.Stdin, protocol.Cancel:
+			// Sent before the client saw the end of the previous command
 			continue
+		default:
+			fmt.Println("Error:", peer, "unexpected", frame.Type)
+			pc.WriteFrame(protocol.Error, []byte(fmt.Sprintf("unexpected %v", frame.Type)))
+			return
+		}
+		var request protocol.ExecRequest
+		if err := json.Unmarshal(frame.Payload, &request); err != nil {
+			fmt.Println("Error:", peer, err.Error())
+			pc.WriteFrame(protocol.Error, []byte(err.Error()))
+			return
 		}
 
-		cmd := exec.Command(parts[0], parts[1:]...)
-		ans, err := cmd.Output()
-		if err != nil {
-			fmt.Fprintf(conn, "Error: %s\n", err.Error())
+		if err := cfg.exec.check(request.Args); err != nil {
+			fmt.Println("Denied:", peer, request.Args)
+			if pc.WriteFrame(protocol.Error, []byte(err.Error())) != nil {
+				return
+			}
+			continue
+		}
+		if request.PTY {
+			fmt.Println("Running in a terminal:", peer, request.Args)
 		} else {
-			fmt.Fprintf(conn, string(ans))
+			fmt.Println("Running:", peer, request.Args)
+		}
+		if err := runCommand(pc, cfg.exec, request, frames, readErr); err != nil {
+			fmt.Println("Error:", peer, err.Error())
+			return
+		}
+	}
+}
+
+// maxPendingInput limits the input that the command has not read yet
+const maxPendingInput = 1 << 20
+
+// runCommand streams the output of the command to the client and passes it the input
+// and the cancellation from the client until the command exits
+func runCommand(pc *protocol.Conn, e *executor, request protocol.ExecRequest, frames <-chan protocol.Frame, readErr <-chan error) error {
+	p, err := e.start(request, frameWriter{pc, protocol.Stdout}, frameWriter{pc, protocol.Stderr})
+	if err != nil {
+		return pc.WriteJSON(protocol.Exit, protocol.ExitStatus{Code: -1, Error: err.Error()})
+	}
+
+	// The input is written by another goroutine, so a command that does not read it
+	// cannot block the cancellation
+	input := make(chan []byte)
+	defer close(input)
+	go func() {
+		for data := range input {
+			if len(data) == 0 {
+				p.eof()
+			} else if _, err := p.stdin.Write(data); err != nil {
+				// The command does not read any more, drop the rest
+				for range input {
+				}
+				return
+			}
+		}
+	}()
+	var pending [][]byte
+	pendingSize := 0
+
+	// stop kills the command when the client is gone
+	stop := func(err error) error {
+		p.Cancel()
+		<-p.done
+		return err
+	}
+	for {
+		var in chan<- []byte
+		var next []byte
+		if len(pending) > 0 {
+			in, next = input, pending[0]
+		}
+		select {
+		case status := <-p.done:
+			return pc.WriteJSON(protocol.Exit, status)
+		case in <- next:
+			pending = pending[1:]
+			pendingSize -= len(next)
+		case frame := <-frames:
+			switch frame.Type {
+			case protocol.Stdin:
+				if pendingSize += len(frame.Payload); pendingSize > maxPendingInput {
+					return stop(errors.New("too much input is not read by the command"))
+				}
+				pending = append(pending, frame.Payload)
+			case protocol.Cancel:
+				p.Cancel()
+			default:
+				return stop(fmt.Errorf("unexpected %v while a command is running", frame.Type))
+			}
+		case err := <-readErr:
+			return stop(err)
+		}
+	}
+}
+
+// frameWriter sends everything written to it in frames of the type
+type frameWriter struct {
+	pc *protocol.Conn
+	t  protocol.Type
+}
+
+func (w frameWriter) Write(p []byte) (int, error) {
+	for data := p; len(data) > 0; {
+		n := len(data)
+		if n > protocol.MaxPayload {
+			n = protocol.MaxPayload
+		}
+		if err := w.pc.WriteFrame(w.t, data[:n]); err != nil {
+			return 0, err
 		}
+		data = data[n:]
 	}
+	return len(p), nil
 }
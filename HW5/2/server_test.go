@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/remote/protocol"
+)
+
+// startServer serves the connections with handleConnection until the end of the test
+func startServer(t *testing.T, cfg *config, tlsConfig *tls.Config) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleConnection(conn, cfg)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func dial(t *testing.T, addr string, secret string) *protocol.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	pc := protocol.NewConn(conn)
+	if err := pc.ClientHandshake([]byte(secret)); err != nil {
+		t.Fatal(err)
+	}
+	return pc
+}
+
+func run(t *testing.T, pc *protocol.Conn, args ...string) (string, string, protocol.ExitStatus) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	status, err := pc.Run(args, &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+	return stdout.String(), stderr.String(), status
+}
+
+func testConfig() *config {
+	return &config{
+		secret: []byte("secret"),
+		exec:   newExecutor("cat,echo,ls,sleep,head,sh", 5*time.Second, 1<<20),
+	}
+}
+
+func TestRun(t *testing.T) {
+	pc := dial(t, startServer(t, testConfig(), nil), "secret")
+
+	stdout, stderr, status := run(t, pc, "echo", "hello", "$HOME", "; ls")
+	// There is no shell: the arguments are not expanded
+	if stdout != "hello $HOME ; ls\n" || stderr != "" || status.Code != 0 {
+		t.Errorf("got %q, %q, %+v", stdout, stderr, status)
+	}
+
+	stdout, stderr, status = run(t, pc, "sh", "-c", "echo out; echo err >&2; exit 3")
+	if stdout != "out\n" || stderr != "err\n" || status.Code != 3 {
+		t.Errorf("got %q, %q, %+v", stdout, stderr, status)
+	}
+
+	_, stderr, status = run(t, pc, "ls", "/nonexistent")
+	if stderr == "" || status.Code == 0 {
+		t.Errorf("got %q, %+v", stderr, status)
+	}
+}
+
+var deniedCommands = [][]string{
+	{"rm", "-rf", "/tmp/x"},
+	{"/bin/echo", "hi"},
+	{"./echo"},
+	{""},
+	{},
+}
+
+func TestAllowlist(t *testing.T) {
+	pc := dial(t, startServer(t, testConfig(), nil), "secret")
+	for _, args := range deniedCommands {
+		var remote *protocol.RemoteError
+		if _, err := pc.Run(args, &bytes.Buffer{}, &bytes.Buffer{}); !errors.As(err, &remote) {
+			t.Errorf("%q: got %v, want a refusal", args, err)
+		}
+	}
+	// The connection is still usable after a refusal
+	if stdout, _, _ := run(t, pc, "echo", "still here"); stdout != "still here\n" {
+		t.Errorf("got %q", stdout)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	cfg := testConfig()
+	cfg.exec.timeout = 200 * time.Millisecond
+	cfg.exec.maxOutput = 100
+	pc := dial(t, startServer(t, cfg, nil), "secret")
+
+	// The children of the command are killed too, otherwise sleep would hold the pipe
+	start := time.Now()
+	_, _, status := run(t, pc, "sh", "-c", "sleep 10 & sleep 10")
+	if !status.TimedOut || time.Since(start) > 3*time.Second {
+		t.Errorf("got %+v after %v", status, time.Since(start))
+	}
+
+	stdout, _, status := run(t, pc, "head", "-c", "5000", "/dev/zero")
+	if len(stdout) != 100 || !status.Truncated || status.Code != 0 {
+		t.Errorf("got %d bytes, %+v", len(stdout), status)
+	}
+}
+
+func TestWrongSecret(t *testing.T) {
+	addr := startServer(t, testConfig(), nil)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := protocol.NewConn(conn).ClientHandshake([]byte("guess")); err == nil {
+		t.Error("got no error for a wrong secret")
+	}
+}
+
+// newCA makes a CA and a function that issues certificates signed by it
+func newCA(t *testing.T) (*x509.CertPool, func(name string, usage x509.ExtKeyUsage) tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	serial := int64(2)
+	issue := func(name string, usage x509.ExtKeyUsage) tls.Certificate {
+		leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serial++
+		leaf := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, leaf, ca, &leafKey.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: leafKey}
+	}
+	return pool, issue
+}
+
+func TestClientCertificates(t *testing.T) {
+	pool, issue := newCA(t)
+	cfg := testConfig()
+	cfg.secret = nil
+	addr := startServer(t, cfg, &tls.Config{
+		Certificates: []tls.Certificate{issue("server", x509.ExtKeyUsageServerAuth)},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+
+	dialTLS := func(certs []tls.Certificate) (*protocol.Conn, error) {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool, Certificates: certs})
+		if err != nil {
+			return nil, err
+		}
+		t.Cleanup(func() { conn.Close() })
+		pc := protocol.NewConn(conn)
+		return pc, pc.ClientHandshake(nil)
+	}
+
+	pc, err := dialTLS([]tls.Certificate{issue("alice", x509.ExtKeyUsageClientAuth)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout, _, _ := run(t, pc, "echo", "over TLS"); stdout != "over TLS\n" {
+		t.Errorf("got %q", stdout)
+	}
+
+	if _, err := dialTLS(nil); err == nil {
+		t.Error("got no error without a client certificate")
+	}
+	_, otherIssue := newCA(t)
+	if _, err := dialTLS([]tls.Certificate{otherIssue("mallory", x509.ExtKeyUsageClientAuth)}); err == nil {
+		t.Error("got no error for a certificate of another CA")
+	}
+}
+
+// timedWriter remembers when the output came
+type timedWriter struct {
+	mu    sync.Mutex
+	times []time.Duration
+	start time.Time
+	buf   bytes.Buffer
+}
+
+func (w *timedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.times = append(w.times, time.Since(w.start))
+	return w.buf.Write(p)
+}
+
+func TestStreaming(t *testing.T) {
+	pc := dial(t, startServer(t, testConfig(), nil), "secret")
+	w := &timedWriter{start: time.Now()}
+	status, err := pc.Run([]string{"sh", "-c", "echo first; sleep 1; echo second"}, w, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.buf.String() != "first\nsecond\n" || status.Code != 0 {
+		t.Fatalf("got %q, %+v", w.buf.String(), status)
+	}
+	// The first line comes before the command exits
+	if len(w.times) != 2 || w.times[0] > 500*time.Millisecond || w.times[1] < time.Second {
+		t.Errorf("got the output after %v", w.times)
+	}
+}
+
+func TestStdin(t *testing.T) {
+	pc := dial(t, startServer(t, testConfig(), nil), "secret")
+	if err := pc.Start(protocol.ExecRequest{Args: []string{"cat"}}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		pc.SendStdin([]byte("hello\n"))
+		pc.SendStdin([]byte("world\n"))
+		pc.CloseStdin()
+	}()
+	var stdout bytes.Buffer
+	status, err := pc.Wait(&stdout, io.Discard)
+	if err != nil || stdout.String() != "hello\nworld\n" || status.Code != 0 {
+		t.Errorf("got %q, %+v, %v", stdout.String(), status, err)
+	}
+
+	// Input the command does not read is dropped
+	stdout.Reset()
+	if err := pc.Start(protocol.ExecRequest{Args: []string{"echo", "ignored"}}); err != nil {
+		t.Fatal(err)
+	}
+	pc.SendStdin(bytes.Repeat([]byte("x"), 200000))
+	pc.CloseStdin()
+	if status, err := pc.Wait(&stdout, io.Discard); err != nil || stdout.String() != "ignored\n" || status.Code != 0 {
+		t.Errorf("got %q, %+v, %v", stdout.String(), status, err)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	pc := dial(t, startServer(t, testConfig(), nil), "secret")
+	if err := pc.Start(protocol.ExecRequest{Args: []string{"sh", "-c", "echo started; sleep 10 & sleep 10"}}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	r, w := io.Pipe()
+	go func() {
+		// Cancel once the command has started
+		bufio.NewReader(r).ReadString('\n')
+		pc.Cancel()
+		io.Copy(io.Discard, r)
+	}()
+	status, err := pc.Wait(w, io.Discard)
+	w.Close()
+	if err != nil || !status.Canceled || status.TimedOut || time.Since(start) > 3*time.Second {
+		t.Errorf("got %+v, %v after %v", status, err, time.Since(start))
+	}
+
+	// A Cancel that comes after the end of the command does not break the next one
+	pc.Cancel()
+	if stdout, _, status := run(t, pc, "echo", "next"); stdout != "next\n" || status.Canceled {
+		t.Errorf("got %q, %+v", stdout, status)
+	}
+}
+
+func TestPTY(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no pseudo-terminals")
+	}
+	pc := dial(t, startServer(t, testConfig(), nil), "secret")
+
+	// Without a terminal the command sees pipes
+	stdout, _, _ := run(t, pc, "sh", "-c", "test -t 0 && echo terminal || echo pipe")
+	if stdout != "pipe\n" {
+		t.Errorf("got %q", stdout)
+	}
+
+	request := protocol.ExecRequest{
+		Args: []string{"sh", "-c", "test -t 0 && echo terminal; stty size; echo $TERM; echo err >&2; cat"},
+		PTY:  true, Rows: 30, Cols: 100, Term: "xterm",
+	}
+	if err := pc.Start(request); err != nil {
+		t.Fatal(err)
+	}
+	pc.SendStdin([]byte("typed\n"))
+	pc.CloseStdin()
+	var out, errOut bytes.Buffer
+	status, err := pc.Wait(&out, &errOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The terminal echoes the input and turns \n into \r\n, stderr goes to the same terminal
+	for _, want := range []string{"terminal\r\n", "30 100\r\n", "xterm\r\n", "err\r\n", "typed\r\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("got %q, want %q in it", out.String(), want)
+		}
+	}
+	if errOut.Len() != 0 || status.Code != 0 {
+		t.Errorf("got stderr %q, %+v", errOut.String(), status)
+	}
+}
+
+func TestCappedWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := &cappedWriter{w: &buf, limit: 5}
+	for _, chunk := range []string{"ab", "cd", "ef", "gh"} {
+		if n, err := w.Write([]byte(chunk)); n != len(chunk) || err != nil {
+			t.Fatalf("got %d, %v", n, err)
+		}
+	}
+	if got := buf.String(); got != "abcde" || !w.truncated {
+		t.Errorf("got %q, truncated %v", got, w.truncated)
+	}
+}
@@ -1,31 +1,228 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
 
+	"example.com/broadcast/timesync"
 	"github.com/libp2p/go-reuseport"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 var port = flag.String("port", ":8081", "Port of localhost server (starts with \":\")")
+var server = flag.String("server", "", "Address for the time requests (by default the sender of the broadcast)")
+var interval = flag.Duration("interval", 4*time.Second, "Interval between the time requests")
+var samples = flag.Int("samples", 8, "Number of the last requests used for the estimate")
+var secretFile = flag.String("secretFile", "", "File with the shared secret for HMAC (or the TIME_SECRET environment variable)")
+var group = flag.String("group", "", "IPv4 or IPv6 multicast group to join (by default the broadcast is received)")
+var ifaceName = flag.String("iface", "", "Interface to join the group on (by default the kernel picks one)")
+
+// responseTimeout is how long a response to a time request is waited for
+const responseTimeout = time.Second
+
+// clock is the estimate of the server clock, shared by the broadcast and the requests
+type clock struct {
+	mu       sync.Mutex
+	filter   *timesync.Filter
+	estimate timesync.Estimate
+	ready    bool
+}
+
+func (c *clock) add(sample timesync.Sample) timesync.Estimate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.estimate = c.filter.Add(sample)
+	c.ready = true
+	return c.estimate
+}
+
+func (c *clock) get() (timesync.Estimate, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.estimate, c.ready
+}
 
 func main() {
 	flag.Parse()
 
 	fmt.Println("Starting client...")
 
-	conn, _ := reuseport.ListenPacket("udp", *port)
+	key, err := loadSecret()
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	conn, err := listen()
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
 
 	defer conn.Close()
 
+	c := &clock{filter: timesync.NewFilter(*samples)}
+	syncing := false
+	if *server != "" {
+		addr, err := net.ResolveUDPAddr("udp", *server)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		go c.sync(addr, key)
+		syncing = true
+	}
+
+	// The last sequence number of every server, older packets are replays
+	lastSeq := map[string]uint64{}
+	buffer := make([]byte, 1024)
 	for {
-		buffer := make([]byte, 1024)
-		_, _, err := conn.ReadFrom(buffer)
+		n, addr, err := conn.ReadFrom(buffer)
 		if err != nil {
 			fmt.Println("Error:", err)
 			continue
 		}
+		packet, err := timesync.Unmarshal(buffer[:n], key)
+		if err != nil {
+			fmt.Println("Dropped a packet from", addr, "-", err)
+			continue
+		}
+		if packet.Type != timesync.Announce {
+			continue
+		}
+		last, seen := lastSeq[addr.String()]
+		if seen && packet.Seq <= last {
+			fmt.Println("Dropped an old packet from", addr, "with seq", packet.Seq)
+			continue
+		}
+		if seen && packet.Seq-last > 1 {
+			fmt.Println("Lost", packet.Seq-last-1, "packets")
+		}
+		lastSeq[addr.String()] = packet.Seq
+
+		// The broadcast comes from the port that answers the requests
+		if !syncing {
+			go c.sync(addr.(*net.UDPAddr), key)
+			syncing = true
+		}
+
+		line := fmt.Sprintf("Current Time:  %s (seq %d)", time.Unix(0, packet.Transmit).Format(time.RFC3339Nano), packet.Seq)
+		if estimate, ok := c.get(); ok {
+			line += ", server clock offset " + signed(estimate.Smoothed)
+		}
+		fmt.Println(line)
+	}
+}
+
+// listen opens the port, other clients on this host may open it too, and joins the group
+func listen() (net.PacketConn, error) {
+	if *group == "" {
+		return reuseport.ListenPacket("udp4", *port)
+	}
+	ip := net.ParseIP(*group)
+	if ip == nil || !ip.IsMulticast() {
+		return nil, fmt.Errorf("%q is not a multicast group", *group)
+	}
+	var iface *net.Interface
+	if *ifaceName != "" {
+		var err error
+		if iface, err = net.InterfaceByName(*ifaceName); err != nil {
+			return nil, err
+		}
+	}
+
+	network := "udp4"
+	if ip.To4() == nil {
+		network = "udp6"
+	}
+	conn, err := reuseport.ListenPacket(network, *port)
+	if err != nil {
+		return nil, err
+	}
+	groupAddr := &net.UDPAddr{IP: ip}
+	if network == "udp4" {
+		err = ipv4.NewPacketConn(conn).JoinGroup(iface, groupAddr)
+	} else {
+		err = ipv6.NewPacketConn(conn).JoinGroup(iface, groupAddr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	fmt.Println("Joined", ip.String())
+	return conn, nil
+}
+
+// loadSecret reads the secret, nil means packets without HMAC
+func loadSecret() ([]byte, error) {
+	if *secretFile != "" {
+		secret, err := os.ReadFile(*secretFile)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimSpace(secret), nil
+	}
+	if secret := os.Getenv("TIME_SECRET"); secret != "" {
+		return []byte(secret), nil
+	}
+	return nil, nil
+}
+
+// sync sends time requests to the server and updates the estimate with the responses
+func (c *clock) sync(server *net.UDPAddr, key []byte) {
+	conn, err := net.DialUDP("udp", nil, server)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	defer conn.Close()
+	fmt.Println("Requesting time from", server.String())
+
+	for seq := uint64(1); ; seq++ {
+		sample, err := exchange(conn, key, seq)
+		if err != nil {
+			fmt.Println("Error:", err)
+		} else {
+			estimate := c.add(sample)
+			fmt.Printf("Offset %s, delay %v, jitter %v, smoothed offset %s\n",
+				signed(estimate.Offset), estimate.Delay, estimate.Jitter, signed(estimate.Smoothed))
+		}
+		time.Sleep(*interval)
+	}
+}
+
+// exchange sends one request and waits for its response
+func exchange(conn *net.UDPConn, key []byte, seq uint64) (timesync.Sample, error) {
+	request := timesync.Packet{Type: timesync.Request, Seq: seq, Transmit: time.Now().UnixNano()}
+	if _, err := conn.Write(request.Marshal(key)); err != nil {
+		return timesync.Sample{}, err
+	}
+	conn.SetReadDeadline(time.Now().Add(responseTimeout))
+	buffer := make([]byte, 1024)
+	for {
+		n, err := conn.Read(buffer)
+		received := time.Now().UnixNano()
+		if err != nil {
+			return timesync.Sample{}, err
+		}
+		response, err := timesync.Unmarshal(buffer[:n], key)
+		// Late responses to the previous requests and forged ones are dropped
+		if err != nil || response.Type != timesync.Response || response.Seq != seq || response.Origin != request.Transmit {
+			continue
+		}
+		return timesync.NewSample(response, received), nil
+	}
+}
 
-		fmt.Println("Current Time: ", string(buffer))
+// signed prints the duration with its sign
+func signed(d time.Duration) string {
+	if d >= 0 {
+		return "+" + d.String()
 	}
+	return d.String()
 }
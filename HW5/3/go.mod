@@ -3,6 +3,8 @@ module example.com/broadcast
 go 1.20
 
 require (
-	github.com/libp2p/go-reuseport v0.2.0 // indirect
-	golang.org/x/sys v0.0.0-20220422013727-9388b58f7150 // indirect
+	github.com/libp2p/go-reuseport v0.2.0
+	golang.org/x/net v0.17.0
 )
+
+require golang.org/x/sys v0.13.0 // indirect
@@ -1,15 +1,26 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"net"
+	"os"
 	"strconv"
 	"strings"
 	"time"
+
+	"example.com/broadcast/timesync"
 )
 
 var port = flag.String("port", ":8081", "Port of localhost server (starts with \":\")")
+var syncPort = flag.String("syncPort", ":8082", "Port for the time requests of the clients, the broadcast is sent from it too")
+var interval = flag.Duration("interval", time.Second, "Interval between the broadcasts")
+var secretFile = flag.String("secretFile", "", "File with the shared secret for HMAC (or the TIME_SECRET environment variable)")
+var mode = flag.String("mode", "broadcast", "Where to send: broadcast (255.255.255.255), directed (the broadcast address of every subnet) or multicast")
+var group = flag.String("group", "239.255.0.1", "IPv4 or IPv6 multicast group for the multicast mode")
+var ttl = flag.Int("ttl", 1, "TTL or hop limit of the multicast packets, 1 keeps them in the local network")
+var ifaceNames = flag.String("iface", "", "Comma separated interfaces for the directed and multicast modes (by default all)")
 
 func main() {
 	flag.Parse()
@@ -24,22 +35,125 @@ func main() {
 	if err != nil {
 		panic("wrong port argument")
 	}
+	key, err := loadSecret()
+	if err != nil {
+		panic(err)
+	}
 
-	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{
-		IP:   net.IPv4(255, 255, 255, 255),
-		Port: portNum,
-	})
+	targets, v6, err := makeTargets(portNum)
+	if err != nil {
+		panic(err)
+	}
+	network := "udp4"
+	if v6 {
+		network = "udp6"
+	}
+
+	laddr, err := net.ResolveUDPAddr(network, *syncPort)
+	if err != nil {
+		panic(err)
+	}
+	conn, err := net.ListenUDP(network, laddr)
 	if err != nil {
 		panic(err)
 	}
 
 	defer conn.Close()
 
-	fmt.Println("Server is broadcasting on", conn.LocalAddr().String())
+	out, err := newSender(conn, *ttl, v6)
+	if err != nil {
+		panic(err)
+	}
+
+	go serveRequests(conn, key)
+
+	for _, t := range targets {
+		fmt.Println("Server is sending to", t.String(), "from", conn.LocalAddr().String())
+	}
+	if key != nil {
+		fmt.Println("Packets are authenticated with HMAC-SHA256")
+	}
+
+	// The sequence starts from the clock, so it keeps growing after a restart
+	seq := uint64(time.Now().UnixNano())
+	for {
+		seq++
+		packet := timesync.Packet{Type: timesync.Announce, Seq: seq, Transmit: time.Now().UnixNano()}
+		data := packet.Marshal(key)
+		for _, t := range targets {
+			if err := out.send(data, t); err != nil {
+				fmt.Println("Error:", t.String(), err)
+			}
+		}
+		time.Sleep(*interval)
+	}
+}
+
+// makeTargets returns the addresses for the mode and whether they are IPv6
+func makeTargets(port int) ([]target, bool, error) {
+	switch *mode {
+	case "broadcast":
+		return []target{{nil, &net.UDPAddr{IP: net.IPv4bcast, Port: port}}}, false, nil
+	case "directed":
+		ifaces, err := interfaces(*ifaceNames, net.FlagBroadcast)
+		if err != nil {
+			return nil, false, err
+		}
+		targets, err := directedTargets(ifaces, port)
+		return targets, false, err
+	case "multicast":
+		ip := net.ParseIP(*group)
+		if ip == nil || !ip.IsMulticast() {
+			return nil, false, fmt.Errorf("%q is not a multicast group", *group)
+		}
+		ifaces, err := interfaces(*ifaceNames, net.FlagMulticast)
+		if err != nil {
+			return nil, false, err
+		}
+		return multicastTargets(ifaces, ip, port), ip.To4() == nil, nil
+	}
+	return nil, false, fmt.Errorf("unknown mode %q", *mode)
+}
+
+// loadSecret reads the secret, nil means packets without HMAC
+func loadSecret() ([]byte, error) {
+	if *secretFile != "" {
+		secret, err := os.ReadFile(*secretFile)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimSpace(secret), nil
+	}
+	if secret := os.Getenv("TIME_SECRET"); secret != "" {
+		return []byte(secret), nil
+	}
+	return nil, nil
+}
 
+// serveRequests answers the time requests with the receive and transmit times of the server
+func serveRequests(conn *net.UDPConn, key []byte) {
+	buffer := make([]byte, 1024)
 	for {
-		currentTime := time.Now().Format(time.RFC3339)
-		conn.Write([]byte(currentTime))
-		time.Sleep(time.Second)
+		n, addr, err := conn.ReadFromUDP(buffer)
+		received := time.Now().UnixNano()
+		if err != nil {
+			fmt.Println("Error:", err)
+			continue
+		}
+		request, err := timesync.Unmarshal(buffer[:n], key)
+		if err != nil || request.Type != timesync.Request {
+			// Not a request or not authenticated
+			continue
+		}
+		response := timesync.Packet{
+			Type:    timesync.Response,
+			Seq:     request.Seq,
+			Origin:  request.Transmit,
+			Receive: received,
+		}
+		response.Transmit = time.Now().UnixNano()
+		if _, err := conn.WriteToUDP(response.Marshal(key), addr); err != nil {
+			fmt.Println("Error:", err)
+		}
 	}
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// target is an address the announces are sent to, through the interface if it is set
+type target struct {
+	iface *net.Interface
+	addr  *net.UDPAddr
+}
+
+func (t target) String() string {
+	if t.iface == nil {
+		return t.addr.String()
+	}
+	return t.addr.String() + " on " + t.iface.Name
+}
+
+// interfaces returns the named interfaces or, without names, all the up interfaces with the flag
+func interfaces(names string, flag net.Flags) ([]net.Interface, error) {
+	var result []net.Interface
+	if names != "" {
+		for _, name := range strings.Split(names, ",") {
+			iface, err := net.InterfaceByName(strings.TrimSpace(name))
+			if err != nil {
+				return nil, fmt.Errorf("interface %q: %w", name, err)
+			}
+			result = append(result, *iface)
+		}
+		return result, nil
+	}
+
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range all {
+		if iface.Flags&net.FlagUp != 0 && iface.Flags&flag != 0 {
+			result = append(result, iface)
+		}
+	}
+	return result, nil
+}
+
+// broadcastAddress is the last address of the IPv4 subnet, nil for IPv6 and for
+// subnets without a broadcast address
+func broadcastAddress(subnet *net.IPNet) net.IP {
+	ip := subnet.IP.To4()
+	mask := subnet.Mask
+	if len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
+	if ip == nil || len(mask) != net.IPv4len {
+		return nil
+	}
+	if ones, bits := mask.Size(); bits-ones < 2 {
+		return nil
+	}
+	broadcast := make(net.IP, net.IPv4len)
+	for i := range broadcast {
+		broadcast[i] = ip[i] | ^mask[i]
+	}
+	return broadcast
+}
+
+// directedTargets are the broadcast addresses of the subnets of the interfaces
+func directedTargets(ifaces []net.Interface, port int) ([]target, error) {
+	var targets []target
+	for i := range ifaces {
+		addrs, err := ifaces[i].Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if subnet, ok := addr.(*net.IPNet); ok {
+				if broadcast := broadcastAddress(subnet); broadcast != nil {
+					targets = append(targets, target{&ifaces[i], &net.UDPAddr{IP: broadcast, Port: port}})
+				}
+			}
+		}
+	}
+	if len(targets) == 0 {
+		return nil, errors.New("no interface with an IPv4 broadcast address")
+	}
+	return targets, nil
+}
+
+// multicastTargets sends to the group on every interface, or on the one the kernel picks
+// if there are no interfaces
+func multicastTargets(ifaces []net.Interface, group net.IP, port int) []target {
+	addr := &net.UDPAddr{IP: group, Port: port}
+	if len(ifaces) == 0 {
+		return []target{{nil, addr}}
+	}
+	targets := make([]target, len(ifaces))
+	for i := range ifaces {
+		targets[i] = target{&ifaces[i], addr}
+	}
+	return targets
+}
+
+// sender writes the announces through the interface of the target
+type sender struct {
+	v4 *ipv4.PacketConn
+	v6 *ipv6.PacketConn
+}
+
+// newSender sets the TTL or the hop limit of the multicast packets. They are looped
+// back too, so the clients on this host get them
+func newSender(conn *net.UDPConn, ttl int, v6 bool) (*sender, error) {
+	if v6 {
+		p := ipv6.NewPacketConn(conn)
+		if err := p.SetMulticastHopLimit(ttl); err != nil {
+			return nil, err
+		}
+		return &sender{v6: p}, p.SetMulticastLoopback(true)
+	}
+	p := ipv4.NewPacketConn(conn)
+	if err := p.SetMulticastTTL(ttl); err != nil {
+		return nil, err
+	}
+	return &sender{v4: p}, p.SetMulticastLoopback(true)
+}
+
+func (s *sender) send(data []byte, t target) error {
+	if s.v6 != nil {
+		var cm *ipv6.ControlMessage
+		if t.iface != nil {
+			cm = &ipv6.ControlMessage{IfIndex: t.iface.Index}
+		}
+		_, err := s.v6.WriteTo(data, cm, t.addr)
+		return err
+	}
+	var cm *ipv4.ControlMessage
+	if t.iface != nil {
+		cm = &ipv4.ControlMessage{IfIndex: t.iface.Index}
+	}
+	_, err := s.v4.WriteTo(data, cm, t.addr)
+	return err
+}
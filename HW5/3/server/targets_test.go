@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+var broadcastCases = []struct {
+	subnet string
+	want   string
+}{
+	{"192.168.1.17/24", "192.168.1.255"},
+	{"10.1.2.3/8", "10.255.255.255"},
+	{"172.16.5.4/20", "172.16.15.255"},
+	{"192.0.2.6/30", "192.0.2.7"},
+	// Point-to-point links and single hosts have no broadcast address
+	{"192.0.2.6/31", "<nil>"},
+	{"192.0.2.6/32", "<nil>"},
+	{"fd00::2/64", "<nil>"},
+}
+
+func TestBroadcastAddress(t *testing.T) {
+	for _, tt := range broadcastCases {
+		ip, subnet, err := net.ParseCIDR(tt.subnet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		subnet.IP = ip
+		if got := broadcastAddress(subnet).String(); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.subnet, got, tt.want)
+		}
+	}
+
+	// Interfaces may give IPv4 masks in the 16 byte form
+	subnet := &net.IPNet{IP: net.ParseIP("192.168.1.17"), Mask: net.CIDRMask(120, 128)}
+	if got := broadcastAddress(subnet).String(); got != "192.168.1.255" {
+		t.Errorf("16 byte mask: got %s", got)
+	}
+}
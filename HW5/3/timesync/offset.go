@@ -0,0 +1,91 @@
+package timesync
+
+import (
+	"math"
+	"time"
+)
+
+// Sample is one request/response exchange
+type Sample struct {
+	// Offset is how far the clock of the server is ahead of the local one
+	Offset time.Duration
+	// Delay is the round trip time without the time the server spent on the request
+	Delay time.Duration
+}
+
+// NewSample computes the sample like NTP does. received is the local time the response came,
+// the local send time of the request is in its Origin
+func NewSample(response Packet, received int64) Sample {
+	t1, t2, t3, t4 := response.Origin, response.Receive, response.Transmit, received
+	return Sample{
+		Offset: time.Duration(((t2 - t1) + (t3 - t4)) / 2),
+		Delay:  time.Duration((t4 - t1) - (t3 - t2)),
+	}
+}
+
+// Estimate is what the filter knows about the clock of the server
+type Estimate struct {
+	// Offset and Delay are of the sample with the least delay, it is the most accurate one
+	Offset time.Duration
+	Delay  time.Duration
+	// Jitter is the RMS difference of the offsets of the samples from Offset
+	Jitter time.Duration
+	// Smoothed follows Offset slowly, so single samples do not make it jump
+	Smoothed time.Duration
+}
+
+// smoothing is the weight of a new offset in Smoothed
+const smoothing = 0.125
+
+// Filter keeps the last samples like the clock filter of NTP
+type Filter struct {
+	samples  []Sample
+	size     int
+	smoothed float64
+	started  bool
+}
+
+// NewFilter makes a filter of the last size samples
+func NewFilter(size int) *Filter {
+	if size < 1 {
+		size = 1
+	}
+	return &Filter{size: size}
+}
+
+// Add adds the sample and returns the new estimate
+func (f *Filter) Add(s Sample) Estimate {
+	f.samples = append(f.samples, s)
+	if len(f.samples) > f.size {
+		f.samples = f.samples[1:]
+	}
+
+	best := f.samples[0]
+	for _, sample := range f.samples[1:] {
+		if sample.Delay < best.Delay {
+			best = sample
+		}
+	}
+	var sum float64
+	for _, sample := range f.samples {
+		d := float64(sample.Offset - best.Offset)
+		sum += d * d
+	}
+	jitter := 0.0
+	if len(f.samples) > 1 {
+		jitter = math.Sqrt(sum / float64(len(f.samples)-1))
+	}
+
+	if f.started {
+		f.smoothed += smoothing * (float64(best.Offset) - f.smoothed)
+	} else {
+		f.smoothed = float64(best.Offset)
+		f.started = true
+	}
+	return Estimate{
+		Offset:   best.Offset,
+		Delay:    best.Delay,
+		Jitter:   time.Duration(jitter),
+		Smoothed: time.Duration(f.smoothed),
+	}
+}
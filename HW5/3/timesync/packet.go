@@ -0,0 +1,122 @@
+// Package timesync is the binary time distribution protocol of the broadcaster.
+//
+// Every packet is a header (magic "TS", version, type, flags), a sequence number and three
+// nanosecond Unix timestamps, all big-endian. The server broadcasts Announce packets with its
+// time, and answers Request packets NTP-style, so a client can estimate the offset of its clock.
+// With a shared secret every packet ends with an HMAC-SHA256 tag over the rest of the packet
+package timesync
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Type is the kind of a packet
+type Type byte
+
+const (
+	// Announce is the broadcast time of the server, in Transmit
+	Announce Type = iota + 1
+	// Request asks the server for its time, Transmit is the send time of the client
+	Request
+	// Response answers a Request: Origin is the Transmit of the request, Receive and Transmit
+	// are the times the server got the request and sent the response
+	Response
+)
+
+func (t Type) String() string {
+	names := []string{"", "Announce", "Request", "Response"}
+	if int(t) < len(names) && t != 0 {
+		return names[t]
+	}
+	return fmt.Sprintf("Type(%d)", byte(t))
+}
+
+const (
+	// Version is the version of the packet format
+	Version = 1
+	// Size is the size of a packet without the tag
+	Size    = 37
+	tagSize = sha256.Size
+
+	magic         = "TS"
+	flagAuthentic = 1
+)
+
+var (
+	ErrShort   = errors.New("timesync: packet too short")
+	ErrFormat  = errors.New("timesync: not a time packet")
+	ErrVersion = errors.New("timesync: unsupported version")
+	ErrNoTag   = errors.New("timesync: packet is not authenticated")
+	ErrBadTag  = errors.New("timesync: bad packet authentication tag")
+)
+
+// Packet is one message, the times are nanoseconds since the Unix epoch
+type Packet struct {
+	Type     Type
+	Seq      uint64
+	Origin   int64
+	Receive  int64
+	Transmit int64
+	// Authenticated is set by Unmarshal when the tag was checked
+	Authenticated bool
+}
+
+// Marshal encodes the packet, with a tag if the key is not empty
+func (p Packet) Marshal(key []byte) []byte {
+	data := make([]byte, Size, Size+tagSize)
+	copy(data, magic)
+	data[2] = Version
+	data[3] = byte(p.Type)
+	binary.BigEndian.PutUint64(data[5:], p.Seq)
+	binary.BigEndian.PutUint64(data[13:], uint64(p.Origin))
+	binary.BigEndian.PutUint64(data[21:], uint64(p.Receive))
+	binary.BigEndian.PutUint64(data[29:], uint64(p.Transmit))
+	if len(key) == 0 {
+		return data
+	}
+	data[4] |= flagAuthentic
+	return append(data, tag(key, data)...)
+}
+
+// Unmarshal decodes the packet. With a key the packet must have a valid tag, without
+// one the tag is not checked
+func Unmarshal(data, key []byte) (Packet, error) {
+	if len(data) < Size {
+		return Packet{}, ErrShort
+	}
+	if string(data[:2]) != magic {
+		return Packet{}, ErrFormat
+	}
+	if data[2] != Version {
+		return Packet{}, ErrVersion
+	}
+	authentic := data[4]&flagAuthentic != 0
+	switch {
+	case authentic && len(data) != Size+tagSize:
+		return Packet{}, ErrShort
+	case !authentic && len(data) != Size:
+		return Packet{}, ErrFormat
+	case len(key) > 0 && !authentic:
+		return Packet{}, ErrNoTag
+	case len(key) > 0 && !hmac.Equal(data[Size:], tag(key, data[:Size])):
+		return Packet{}, ErrBadTag
+	}
+	return Packet{
+		Type:          Type(data[3]),
+		Seq:           binary.BigEndian.Uint64(data[5:]),
+		Origin:        int64(binary.BigEndian.Uint64(data[13:])),
+		Receive:       int64(binary.BigEndian.Uint64(data[21:])),
+		Transmit:      int64(binary.BigEndian.Uint64(data[29:])),
+		Authenticated: len(key) > 0,
+	}, nil
+}
+
+func tag(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
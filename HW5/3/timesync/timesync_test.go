@@ -0,0 +1,85 @@
+package timesync
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var packet = Packet{Type: Response, Seq: 42, Origin: 1, Receive: -2, Transmit: 1 << 62}
+
+var unmarshalCases = []struct {
+	name    string
+	sendKey string
+	readKey string
+	change  func([]byte) []byte
+	err     error
+}{
+	{"plain", "", "", nil, nil},
+	{"authenticated", "key", "key", nil, nil},
+	{"tag not checked", "key", "", nil, nil},
+	{"no tag", "", "key", nil, ErrNoTag},
+	{"wrong key", "key", "other", nil, ErrBadTag},
+	{"changed time", "key", "key", func(b []byte) []byte { b[30] ^= 1; return b }, ErrBadTag},
+	{"changed type", "key", "key", func(b []byte) []byte { b[3] = byte(Announce); return b }, ErrBadTag},
+	{"tag dropped", "key", "key", func(b []byte) []byte { b[4] = 0; return b[:Size] }, ErrNoTag},
+	{"short", "", "", func(b []byte) []byte { return b[:Size-1] }, ErrShort},
+	{"cut tag", "key", "", func(b []byte) []byte { return b[:Size+1] }, ErrShort},
+	{"extra bytes", "", "", func(b []byte) []byte { return append(b, 0) }, ErrFormat},
+	// The string of the old server in a buffer with NUL bytes
+	{"old format", "", "", func([]byte) []byte { return []byte("2023-04-01T12:00:00+03:00" + string(make([]byte, 12))) }, ErrFormat},
+	{"version", "", "", func(b []byte) []byte { b[2] = 2; return b }, ErrVersion},
+}
+
+func TestUnmarshal(t *testing.T) {
+	for _, tt := range unmarshalCases {
+		t.Run(tt.name, func(t *testing.T) {
+			data := packet.Marshal([]byte(tt.sendKey))
+			if tt.change != nil {
+				data = tt.change(data)
+			}
+			got, err := Unmarshal(data, []byte(tt.readKey))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			want := packet
+			want.Authenticated = tt.readKey != ""
+			if err == nil && got != want {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestNewSample(t *testing.T) {
+	// The server is 1s ahead, the request takes 10ms, the server 5ms and the response 20ms
+	const ms = int64(time.Millisecond)
+	t1 := int64(100_000) * ms
+	response := Packet{Type: Response, Origin: t1, Receive: t1 + 1010*ms, Transmit: t1 + 1015*ms}
+	got := NewSample(response, t1+35*ms)
+	// The paths are not symmetric, so the offset is off by half of the difference
+	want := Sample{Offset: 995 * time.Millisecond, Delay: 30 * time.Millisecond}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	f := NewFilter(3)
+	steps := []struct {
+		sample Sample
+		want   Estimate
+	}{
+		{Sample{Offset: 100, Delay: 50}, Estimate{Offset: 100, Delay: 50, Jitter: 0, Smoothed: 100}},
+		// A sample with a longer delay does not change the offset
+		{Sample{Offset: 400, Delay: 90}, Estimate{Offset: 100, Delay: 50, Jitter: 300, Smoothed: 100}},
+		{Sample{Offset: 180, Delay: 10}, Estimate{Offset: 180, Delay: 10, Jitter: 165, Smoothed: 110}},
+		// The first sample is out of the window now
+		{Sample{Offset: 900, Delay: 20}, Estimate{Offset: 180, Delay: 10, Jitter: 532, Smoothed: 118}},
+	}
+	for i, step := range steps {
+		if got := f.Add(step.sample); got != step.want {
+			t.Errorf("step %d: got %+v, want %+v", i, got, step.want)
+		}
+	}
+}
@@ -3,17 +3,23 @@ package main
 import (
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
+	"path"
+	"strings"
 	"time"
 
+	"example.com/ftpClient/transfer"
 	"github.com/jlaffaye/ftp"
 )
 
-var addr = flag.String("addr", "192.168.0.105", "FTP server host address")
+var addr = flag.String("addr", "localhost:2121", "FTP server address, host or host:port (port 21 by default)")
 var user = flag.String("user", "San", "Username")
-var pwrd = flag.String("pwrd", "123", "User password")
+var pwrd = flag.String("pwrd", "", "User password, better keep it in "+passwordEnv+" or a profile")
+var useTLS = flag.Bool("tls", false, "Use explicit FTPS (AUTH TLS)")
+var pin = flag.String("pin", "", "SHA-256 fingerprint of the server certificate to trust with -tls, even if it is self-signed")
+var profileName = flag.String("profile", "", "Connection profile from the config file, the flags given override it")
+var configPath = flag.String("config", "", "Config file with the profiles (by default profiles.json in the user config directory)")
 var pathFTP = flag.String("pF", "/catch/pep.png", "Path to file on FTP")
 var pathLocal = flag.String("pL", "samples/pep.png", "Path to local file")
 
@@ -23,15 +29,45 @@ func main() {
 	flag.BoolVar(&create, "create", false, "Create directory on FTP")
 	flag.BoolVar(&uploadFile, "upload", false, "Upload a file to FTP")
 	flag.BoolVar(&downloadFile, "download", false, "Download file from FTP")
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s [flags] [command]\n", os.Args[0])
+		fmt.Fprintln(out, "  mirror [--delete] [--dry-run] <remote dir> <local dir>  download the changed files")
+		fmt.Fprintln(out, "  sync [--delete] [--dry-run] <local dir> <remote dir>    upload the changed files")
+		fmt.Fprintln(out, "  save-profile [--password-env VAR] <name>               save the connection flags as a profile")
+		fmt.Fprintln(out, "  set-password <name>                                     store the password of the profile in the keyring")
+		fmt.Fprintln(out, "  fingerprint                                             print the certificate fingerprint of the server")
+		flag.PrintDefaults()
+	}
 
 	flag.Parse()
 
-	c, err := ftp.Dial(*addr+":21", ftp.DialWithTimeout(5*time.Second))
+	if handled, err := runProfileCommand(flag.Args()); handled {
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var command *syncCommand
+	if flag.NArg() > 0 {
+		var err error
+		if command, err = parseSyncCommand(flag.Args()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+
+	p, err := connectionProfile()
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	err = c.Login(*user, *pwrd)
+	password, err := loginPassword(p)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c, err := p.Dial(password, 5*time.Second)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -40,13 +76,22 @@ func main() {
 		createDir(c, *pathFTP)
 	}
 	if uploadFile {
-		upload(c, *pathLocal, *pathFTP)
+		if err := transfer.Upload(c, *pathLocal, *pathFTP, nil); err != nil {
+			log.Fatal("Cant store: " + err.Error())
+		}
 	}
 	if getFiles {
 		getAllFiles(c)
 	}
 	if downloadFile {
-		download(c, *pathLocal, *pathFTP)
+		if err := transfer.Download(c, *pathLocal, *pathFTP, nil); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+	if command != nil {
+		if err := command.run(c); err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	if err := c.Quit(); err != nil {
@@ -54,24 +99,6 @@ func main() {
 	}
 }
 
-func download(c *ftp.ServerConn, pathLocal, pathFTP string) {
-	file, err := os.Create(pathLocal)
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-	defer file.Close()
-
-	reader, err := c.Retr(pathFTP)
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-
-	defer reader.Close()
-
-	body, _ := ioutil.ReadAll(reader)
-	file.Write(body)
-}
-
 func createDir(c *ftp.ServerConn, pathFTP string) {
 	err := c.MakeDir(pathFTP)
 	if err != nil {
@@ -79,19 +106,6 @@ func createDir(c *ftp.ServerConn, pathFTP string) {
 	}
 }
 
-func upload(c *ftp.ServerConn, pathLocal, pathFTP string) {
-	file, err := os.Open(pathLocal)
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-	defer file.Close()
-
-	err = c.Stor(pathFTP, file)
-	if err != nil {
-		log.Fatal("Cant store: " + err.Error())
-	}
-}
-
 func getAllFiles(c *ftp.ServerConn) {
 	entries, err := c.List("/")
 	if err != nil {
@@ -104,15 +118,33 @@ func getAllFiles(c *ftp.ServerConn) {
 	}
 }
 
-func printDir(c *ftp.ServerConn, entry *ftp.Entry, padding string, path string) {
-	fmt.Println(padding + " " + entry.Name)
-	if entry.Type == ftp.EntryTypeFolder {
-		entries, err := c.List(path + entry.Name)
-		if err != nil {
-			return
-		}
-		for _, subEntry := range entries {
-			printDir(c, subEntry, "--"+padding, path+entry.Name+"/")
+func printDir(c *ftp.ServerConn, entry *ftp.Entry, padding string, dir string) {
+	walkDir(c, entry, dir, 0, func(entry *ftp.Entry, dir string, depth int) {
+		fmt.Println(strings.Repeat("--", depth) + padding + " " + entry.Name)
+	})
+}
+
+// walkDir calls fn for the entry and then, if it is a folder, for everything inside it.
+// dir is the directory of the entry, depth is how deep it is from where the walk started.
+// A folder that cannot be listed is skipped, the first such error is returned at the end
+func walkDir(c *ftp.ServerConn, entry *ftp.Entry, dir string, depth int, fn func(entry *ftp.Entry, dir string, depth int)) error {
+	// MLSD lists the folder itself and its parent too
+	if entry.Name == "." || entry.Name == ".." {
+		return nil
+	}
+	fn(entry, dir, depth)
+	if entry.Type != ftp.EntryTypeFolder {
+		return nil
+	}
+	folder := path.Join(dir, entry.Name)
+	entries, listErr := c.List(folder)
+	if listErr != nil {
+		return fmt.Errorf("list %s: %w", folder, listErr)
+	}
+	for _, subEntry := range entries {
+		if err := walkDir(c, subEntry, folder, depth+1, fn); err != nil && listErr == nil {
+			listErr = err
 		}
 	}
+	return listErr
 }
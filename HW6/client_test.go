@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"example.com/ftpClient/ftpserver"
+	"example.com/ftpClient/profile"
+	"example.com/ftpClient/transfer"
+	"github.com/jlaffaye/ftp"
+)
+
+// connect starts a local server on a temporary root and logs in to it
+func connect(t *testing.T) (*ftp.ServerConn, string) {
+	t.Helper()
+	s := &ftpserver.Server{Root: t.TempDir(), Users: map[string]string{"San": "123"}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ln) }()
+
+	c, err := profile.Profile{Addr: ln.Addr().String(), User: "San"}.Dial("123", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Quit()
+		s.Close()
+		if err := <-done; !errors.Is(err, ftpserver.ErrServerClosed) {
+			t.Errorf("Serve: got %v, want ErrServerClosed", err)
+		}
+	})
+	return c, s.Root
+}
+
+func writeFile(t *testing.T, name, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkFile(t *testing.T, name, want string) {
+	t.Helper()
+	got, err := os.ReadFile(name)
+	if err != nil || string(got) != want {
+		t.Errorf("%s: got %q (%v), want %q", name, got, err, want)
+	}
+}
+
+func TestWalkDir(t *testing.T) {
+	c, root := connect(t)
+	writeFile(t, filepath.Join(root, "a", "b", "c.txt"), "c")
+	writeFile(t, filepath.Join(root, "a", "d.txt"), "d")
+	writeFile(t, filepath.Join(root, "e.txt"), "e")
+	createDir(c, "/f")
+
+	entries, err := c.List("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, entry := range entries {
+		err := walkDir(c, entry, "/", 0, func(entry *ftp.Entry, dir string, depth int) {
+			got = append(got, filepath.ToSlash(filepath.Join(dir, entry.Name)))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort.Strings(got)
+	want := []string{"/a", "/a/b", "/a/b/c.txt", "/a/d.txt", "/e.txt", "/f"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRemoteTree(t *testing.T) {
+	c, root := connect(t)
+	modTime := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	writeFile(t, filepath.Join(root, "dir", "a", "b.txt"), "hello")
+	writeFile(t, filepath.Join(root, "dir", "c.txt"+transfer.PartSuffix), "part")
+	os.Chtimes(filepath.Join(root, "dir", "a", "b.txt"), modTime, modTime)
+
+	got, tolerance, err := remoteTree(c, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := tree{"a": dir, "a/b.txt": file(5, modTime)}
+	if !reflect.DeepEqual(got, want) || tolerance != time.Second {
+		t.Errorf("got %+v %v, want %+v", got, tolerance, want)
+	}
+	if _, _, err := remoteTree(c, "/missing"); err == nil {
+		t.Error("listed a missing directory")
+	}
+}
+
+func TestMirror(t *testing.T) {
+	c, root := connect(t)
+	modTime := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	writeFile(t, filepath.Join(root, "dir", "a", "b.txt"), "hello")
+	writeFile(t, filepath.Join(root, "dir", "c.txt"), "world")
+	os.Chtimes(filepath.Join(root, "dir", "c.txt"), modTime, modTime)
+	local := filepath.Join(t.TempDir(), "mirror")
+	writeFile(t, filepath.Join(local, "old.txt"), "old")
+
+	if err := mirror(c, "/dir", local, true, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(local, "c.txt")); !os.IsNotExist(err) {
+		t.Fatalf("dry run copied a file: %v", err)
+	}
+
+	if err := mirror(c, "/dir", local, false, false); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(local, "a", "b.txt"), "hello")
+	checkFile(t, filepath.Join(local, "c.txt"), "world")
+	checkFile(t, filepath.Join(local, "old.txt"), "old")
+	if info, err := os.Stat(filepath.Join(local, "c.txt")); err != nil || !info.ModTime().Equal(modTime) {
+		t.Errorf("the time of the source is not kept: %v", err)
+	}
+
+	// Only the changed file is copied and the extra one is deleted
+	writeFile(t, filepath.Join(root, "dir", "c.txt"), "world!")
+	if err := mirror(c, "/dir", local, true, false); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(local, "c.txt"), "world!")
+	if _, err := os.Stat(filepath.Join(local, "old.txt")); !os.IsNotExist(err) {
+		t.Errorf("the extra file is kept: %v", err)
+	}
+}
+
+func TestSyncDir(t *testing.T) {
+	c, root := connect(t)
+	modTime := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	local := t.TempDir()
+	writeFile(t, filepath.Join(local, "a", "b.txt"), "hello")
+	writeFile(t, filepath.Join(local, "c.txt"), "world")
+	os.Chtimes(filepath.Join(local, "c.txt"), modTime, modTime)
+
+	if err := syncDir(c, local, "/dir", false, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "dir")); !os.IsNotExist(err) {
+		t.Fatalf("dry run created the directory: %v", err)
+	}
+
+	// The remote directory is created
+	if err := syncDir(c, local, "/dir", false, false); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(root, "dir", "a", "b.txt"), "hello")
+	checkFile(t, filepath.Join(root, "dir", "c.txt"), "world")
+	if info, err := os.Stat(filepath.Join(root, "dir", "c.txt")); err != nil || !info.ModTime().Equal(modTime) {
+		t.Errorf("the time of the source is not kept: %v", err)
+	}
+
+	// Nothing is left to copy, the extra files and directories are deleted
+	writeFile(t, filepath.Join(root, "dir", "old", "x", "y.txt"), "old")
+	writeFile(t, filepath.Join(root, "dir", "z.txt"), "old")
+	src, _ := localTree(local)
+	dst, tolerance, err := remoteTree(c, "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actions := plan(src, dst, tolerance, false); len(actions) != 0 {
+		t.Errorf("got %+v after the sync, want nothing", actions)
+	}
+	if err := syncDir(c, local, "/dir", true, false); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(root, "dir"))
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if want := []string{"a", "c.txt"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got %q, want %q", names, want)
+	}
+
+	if err := syncDir(c, filepath.Join(local, "missing"), "/dir", false, false); err == nil {
+		t.Error("synced a missing directory")
+	}
+}
+
+// Only a missing remote directory is created, other errors stop the sync
+func TestSyncDirListError(t *testing.T) {
+	c, _ := connect(t)
+	local := t.TempDir()
+	writeFile(t, filepath.Join(local, "a.txt"), "hello")
+	c.Quit()
+	if err := syncDir(c, local, "/dir", false, true); err == nil {
+		t.Error("synced without the connection")
+	}
+}
+
+// Interrupted transfers leave part files that are not synced themselves
+func TestSyncSkipsPartFiles(t *testing.T) {
+	c, root := connect(t)
+	local := t.TempDir()
+	writeFile(t, filepath.Join(local, "a.txt"), "hello")
+	writeFile(t, filepath.Join(local, "b.txt"+transfer.PartSuffix), "part")
+
+	if err := syncDir(c, local, "/", false, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "b.txt"+transfer.PartSuffix)); !os.IsNotExist(err) {
+		t.Errorf("the part file is uploaded: %v", err)
+	}
+
+	r, err := c.Retr("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "hello" {
+		t.Errorf("got %q, want hello", data)
+	}
+}
@@ -0,0 +1,53 @@
+package ftpserver
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var errOutsideRoot = errors.New("path is outside of the root")
+
+// resolve turns the path of a client into the virtual path, absolute and clean, and the real
+// path under Root. ".." never goes above "/", and symbolic links that lead out of Root are refused
+func (s *Server) resolve(cwd, name string) (virtual, real string, err error) {
+	if strings.ContainsRune(name, 0) || (filepath.Separator != '/' && strings.ContainsRune(name, filepath.Separator)) {
+		return "", "", errOutsideRoot
+	}
+	if strings.HasPrefix(name, "/") {
+		virtual = path.Clean(name)
+	} else {
+		virtual = path.Clean(path.Join(cwd, name))
+	}
+	real = filepath.Join(s.Root, filepath.FromSlash(virtual))
+
+	root, err := filepath.EvalSymlinks(s.Root)
+	if err != nil {
+		return "", "", err
+	}
+	// The path itself may not exist yet, its nearest existing parent is checked then
+	for p := real; ; {
+		resolved, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			if !inside(root, resolved) {
+				return "", "", errOutsideRoot
+			}
+			return virtual, real, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", "", err
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return virtual, real, nil
+		}
+		p = parent
+	}
+}
+
+func inside(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
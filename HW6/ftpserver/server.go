@@ -0,0 +1,149 @@
+// Package ftpserver is a small FTP server (RFC 959, 2428, 3659) for testing the clients
+// without a real one: USER/PASS, AUTH TLS/PBSZ/PROT (RFC 4217), PASV/EPSV,
+// LIST/NLST/MLSD/MLST, RETR/STOR/APPE/REST, SIZE/MDTM/MFMT, MKD/RMD/DELE/RNFR/RNTO.
+// The clients only see a directory of the host, it is their root "/"
+package ftpserver
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve after Close
+var ErrServerClosed = errors.New("ftpserver: server closed")
+
+// Server serves the files of Root
+type Server struct {
+	// Root is the directory the clients see as "/"
+	Root string
+	// Users are the logins and passwords, without them any login is accepted
+	Users map[string]string
+	// ReadOnly refuses all the commands that change files
+	ReadOnly bool
+	// TLSConfig enables AUTH TLS
+	TLSConfig *tls.Config
+	// AllowInsecureAuth allows the login before AUTH TLS when TLSConfig is set
+	AllowInsecureAuth bool
+	// Timeout is how long the server waits for a command or a data connection, 0 means 5 minutes
+	Timeout time.Duration
+	Log     *log.Logger
+
+	mu       sync.Mutex
+	listener net.Listener
+	// conns are the control and the data connections and the passive listeners
+	conns  map[io.Closer]bool
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// ListenAndServe listens on the TCP address and serves the connections
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts the connections until Close, every connection is served in its own goroutine
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.listener = ln
+	if s.conns == nil {
+		s.conns = map[io.Closer]bool{}
+	}
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			s.newSession(conn).serve()
+			s.untrack(conn)
+		}()
+	}
+}
+
+// Close stops accepting, closes all connections and waits for the sessions to end
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// track remembers a data connection or a listener for Close, it is closed at once
+// if the server is closed
+func (s *Server) track(c io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		c.Close()
+		return false
+	}
+	s.conns[c] = true
+	return true
+}
+
+func (s *Server) untrack(c io.Closer) {
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+	c.Close()
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.Log != nil {
+		s.Log.Printf(format, args...)
+	}
+}
+
+func (s *Server) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return 5 * time.Minute
+}
@@ -0,0 +1,346 @@
+package ftpserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startServer serves on a random port until the end of the test
+func startServer(t *testing.T, s *Server) string {
+	t.Helper()
+	if s.Root == "" {
+		s.Root = t.TempDir()
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ln) }()
+	t.Cleanup(func() {
+		s.Close()
+		if err := <-done; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Serve: got %v, want ErrServerClosed", err)
+		}
+	})
+	return ln.Addr().String()
+}
+
+// dialRaw connects without a client library to send arbitrary commands
+func dialRaw(t *testing.T, addr string) *textproto.Conn {
+	t.Helper()
+	c, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// expect sends the command and checks the reply code
+func expect(t *testing.T, c *textproto.Conn, command string, code int) string {
+	t.Helper()
+	if err := c.PrintfLine("%s", command); err != nil {
+		t.Fatal(err)
+	}
+	got, message, err := c.ReadResponse(0)
+	if got != code {
+		t.Fatalf("%s: got %d %s (%v), want %d", command, got, message, err, code)
+	}
+	return message
+}
+
+func login(t *testing.T, addr string) *textproto.Conn {
+	t.Helper()
+	c := dialRaw(t, addr)
+	expect(t, c, "USER anonymous", 331)
+	expect(t, c, "PASS x", 230)
+	return c
+}
+
+// transfer opens a passive data connection, sends the command and sends or receives the data
+func transfer(t *testing.T, c *textproto.Conn, mode, command string, send []byte) string {
+	t.Helper()
+	var port int
+	message := expect(t, c, mode, map[string]int{"PASV": 227, "EPSV": 229}[mode])
+	if mode == "EPSV" {
+		fmt.Sscanf(message[strings.Index(message, "(|||"):], "(|||%d|)", &port)
+	} else {
+		var h1, h2, h3, h4, p1, p2 int
+		fmt.Sscanf(message[strings.Index(message, "("):], "(%d,%d,%d,%d,%d,%d)", &h1, &h2, &h3, &h4, &p1, &p2)
+		port = p1<<8 | p2
+	}
+	data, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+
+	expect(t, c, command, 150)
+	var received []byte
+	if send != nil {
+		data.Write(send)
+		data.Close()
+	} else if received, err = io.ReadAll(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, message, err := c.ReadResponse(226); err != nil {
+		t.Fatalf("%s: got %s (%v), want 226", command, message, err)
+	}
+	return string(received)
+}
+
+var resolveCases = []struct {
+	cwd, name string
+	want      string
+}{
+	{"/", "a.txt", "/a.txt"},
+	{"/dir", "a.txt", "/dir/a.txt"},
+	{"/dir", "/a.txt", "/a.txt"},
+	{"/dir", "..", "/"},
+	{"/dir", "../../..", "/"},
+	{"/", "/../../etc/passwd", "/etc/passwd"},
+	{"/", "", "/"},
+	{"/", "dir/./b/../c", "/dir/c"},
+	{"/", "link/x", ""},
+	{"/", "a\x00b", ""},
+}
+
+func TestResolve(t *testing.T) {
+	s := &Server{Root: t.TempDir()}
+	// A link that leads out of the root may not be followed
+	if err := os.Symlink(t.TempDir(), filepath.Join(s.Root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range resolveCases {
+		t.Run(tt.cwd+" "+tt.name, func(t *testing.T) {
+			virtual, real, err := s.resolve(tt.cwd, tt.name)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("got %s, want an error", virtual)
+				}
+				return
+			}
+			if err != nil || virtual != tt.want || real != filepath.Join(s.Root, filepath.FromSlash(tt.want)) {
+				t.Errorf("got %s %s (%v), want %s", virtual, real, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogin(t *testing.T) {
+	addr := startServer(t, &Server{Users: map[string]string{"San": "123"}})
+	c := dialRaw(t, addr)
+	expect(t, c, "PWD", 530)
+	expect(t, c, "PASS 123", 503)
+	expect(t, c, "USER San", 331)
+	expect(t, c, "PASS 1234", 530)
+	expect(t, c, "USER Bob", 331)
+	expect(t, c, "PASS 123", 530)
+	expect(t, c, "USER San", 331)
+	expect(t, c, "PASS 123", 230)
+	if got := expect(t, c, "PWD", 257); !strings.HasPrefix(got, `"/"`) {
+		t.Errorf("PWD: got %s", got)
+	}
+	expect(t, c, "FEAT", 211)
+	expect(t, c, "HELLO", 502)
+	expect(t, c, "QUIT", 221)
+}
+
+func TestFiles(t *testing.T) {
+	s := &Server{}
+	addr := startServer(t, s)
+	c := login(t, addr)
+
+	expect(t, c, "MKD dir", 257)
+	expect(t, c, "MKD dir", 550)
+	expect(t, c, "CWD dir", 250)
+	transfer(t, c, "EPSV", "STOR a.txt", []byte("hello world"))
+	if got := expect(t, c, "SIZE /dir/a.txt", 213); got != "11" {
+		t.Errorf("SIZE: got %s, want 11", got)
+	}
+	if got := transfer(t, c, "PASV", "RETR a.txt", nil); got != "hello world" {
+		t.Errorf("RETR: got %q", got)
+	}
+
+	// Both sides of a transfer may go on from an offset
+	expect(t, c, "REST 6", 350)
+	if got := transfer(t, c, "EPSV", "RETR a.txt", nil); got != "world" {
+		t.Errorf("RETR after REST: got %q", got)
+	}
+	expect(t, c, "REST 5", 350)
+	transfer(t, c, "EPSV", "STOR a.txt", []byte("!"))
+	if got, _ := os.ReadFile(filepath.Join(s.Root, "dir", "a.txt")); string(got) != "hello!" {
+		t.Errorf("STOR after REST: got %q", got)
+	}
+	// REST only applies to the next command
+	expect(t, c, "REST 5", 350)
+	expect(t, c, "NOOP", 200)
+	if got := transfer(t, c, "EPSV", "RETR a.txt", nil); got != "hello!" {
+		t.Errorf("RETR: got %q", got)
+	}
+
+	modTime := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	expect(t, c, "MFMT 20230401120000 a.txt", 213)
+	if got := expect(t, c, "MDTM a.txt", 213); got != "20230401120000" {
+		t.Errorf("MDTM: got %s", got)
+	}
+	if got := transfer(t, c, "EPSV", "MLSD", nil); got != "type=file;size=6;modify=20230401120000; a.txt\r\n" {
+		t.Errorf("MLSD: got %q", got)
+	}
+	if got := transfer(t, c, "EPSV", "LIST -la /dir", nil); !strings.HasSuffix(got, " 6 "+modTime.Format("Jan _2  2006")+" a.txt\r\n") {
+		t.Errorf("LIST: got %q", got)
+	}
+	if got := transfer(t, c, "EPSV", "NLST /", nil); got != "dir\r\n" {
+		t.Errorf("NLST: got %q", got)
+	}
+
+	expect(t, c, "RNTO b.txt", 503)
+	expect(t, c, "RNFR a.txt", 350)
+	expect(t, c, "RNTO /b.txt", 250)
+	expect(t, c, "CDUP", 250)
+	expect(t, c, "RMD dir", 250)
+	expect(t, c, "DELE dir", 550)
+	expect(t, c, "DELE b.txt", 250)
+	if entries, _ := os.ReadDir(s.Root); len(entries) != 0 {
+		t.Errorf("got %v left in the root", entries)
+	}
+}
+
+func TestRootEscape(t *testing.T) {
+	s := &Server{}
+	addr := startServer(t, s)
+	c := login(t, addr)
+
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0o644)
+	os.Symlink(outside, filepath.Join(s.Root, "link"))
+
+	expect(t, c, "CWD ../..", 250)
+	if got := expect(t, c, "PWD", 257); !strings.HasPrefix(got, `"/"`) {
+		t.Errorf("PWD: got %s", got)
+	}
+	expect(t, c, "SIZE link/secret", 550)
+	expect(t, c, "CWD link", 550)
+	expect(t, c, "RNFR /", 550)
+	expect(t, c, "RMD /", 550)
+	expect(t, c, "EPSV", 229)
+	expect(t, c, "RETR ../"+filepath.Base(outside)+"/secret", 550)
+}
+
+func TestReadOnly(t *testing.T) {
+	s := &Server{ReadOnly: true}
+	addr := startServer(t, s)
+	os.WriteFile(filepath.Join(s.Root, "a.txt"), []byte("hello"), 0o644)
+	c := login(t, addr)
+
+	expect(t, c, "MKD dir", 550)
+	expect(t, c, "DELE a.txt", 550)
+	expect(t, c, "STOR b.txt", 550)
+	if got := transfer(t, c, "EPSV", "RETR a.txt", nil); got != "hello" {
+		t.Errorf("RETR: got %q", got)
+	}
+}
+
+func TestCloseDuringSession(t *testing.T) {
+	s := &Server{}
+	addr := startServer(t, s)
+	c := login(t, addr)
+	expect(t, c, "EPSV", 229)
+	s.Close()
+	if _, _, err := c.ReadResponse(0); err == nil {
+		t.Error("the connection is still open after Close")
+	}
+}
+
+func newCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestAuthTLS(t *testing.T) {
+	s := &Server{
+		Users:     map[string]string{"San": "123"},
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{newCertificate(t)}},
+	}
+	addr := startServer(t, s)
+	os.WriteFile(filepath.Join(s.Root, "a.txt"), []byte("hello"), 0o644)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := textproto.NewConn(conn)
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	if got := expect(t, c, "FEAT", 211); !strings.Contains(got, "AUTH TLS") {
+		t.Errorf("FEAT: got %q", got)
+	}
+	// The password is not sent in the clear
+	expect(t, c, "USER San", 530)
+	expect(t, c, "PBSZ 0", 503)
+	expect(t, c, "AUTH SSL", 504)
+	expect(t, c, "AUTH TLS", 234)
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	c = textproto.NewConn(tls.Client(conn, tlsConfig))
+	expect(t, c, "USER San", 331)
+	expect(t, c, "PASS 123", 230)
+	expect(t, c, "AUTH TLS", 503)
+	expect(t, c, "PBSZ 0", 200)
+	expect(t, c, "PROT S", 504)
+	expect(t, c, "PROT P", 200)
+
+	// The data connection does the handshake before the command is sent
+	var port int
+	message := expect(t, c, "EPSV", 229)
+	fmt.Sscanf(message[strings.Index(message, "(|||"):], "(|||%d|)", &port)
+	data, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+	expect(t, c, "RETR a.txt", 150)
+	if got, err := io.ReadAll(data); err != nil || string(got) != "hello" {
+		t.Errorf("RETR: got %q (%v)", got, err)
+	}
+	if _, message, err := c.ReadResponse(226); err != nil {
+		t.Fatalf("RETR: got %s (%v), want 226", message, err)
+	}
+}
@@ -0,0 +1,841 @@
+package ftpserver
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxLine limits a command line, the longest path included
+const maxLine = 4096
+
+var (
+	errLineTooLong = errors.New("line too long")
+	errNoPassive   = errors.New("use PASV or EPSV first")
+)
+
+// timeFormat is the time of MDTM, MFMT and MLSD (RFC 3659 2.3)
+const timeFormat = "20060102150405"
+
+// session is the state of one control connection
+type session struct {
+	s      *Server
+	conn   net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	remote string
+
+	user     string
+	loggedIn bool
+	// cwd is the virtual current directory
+	cwd string
+	// restart is the offset from REST for the next transfer
+	restart int64
+	// renameFrom is the real path from RNFR for the next RNTO
+	renameFrom string
+	passive    *passive
+
+	tls bool
+	// protect is set by PROT P, the data connections use TLS then
+	protect bool
+}
+
+func (s *Server) newSession(conn net.Conn) *session {
+	ss := &session{s: s, remote: conn.RemoteAddr().String(), cwd: "/"}
+	ss.setConn(conn)
+	return ss
+}
+
+func (ss *session) reply(code int, format string, args ...interface{}) error {
+	fmt.Fprintf(ss.w, "%d %s\r\n", code, fmt.Sprintf(format, args...))
+	return ss.w.Flush()
+}
+
+// replyLines writes a multiline reply, the lines between the first and the last one
+// start with a space
+func (ss *session) replyLines(code int, first string, lines []string, last string) error {
+	fmt.Fprintf(ss.w, "%d-%s\r\n", code, first)
+	for _, line := range lines {
+		fmt.Fprintf(ss.w, " %s\r\n", line)
+	}
+	fmt.Fprintf(ss.w, "%d %s\r\n", code, last)
+	return ss.w.Flush()
+}
+
+// readLine reads a command without the line ending. A longer line than maxLine is read
+// to the end and errLineTooLong is returned
+func (ss *session) readLine() (string, error) {
+	ss.conn.SetReadDeadline(time.Now().Add(ss.s.timeout()))
+	line, err := ss.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		for err == bufio.ErrBufferFull {
+			_, err = ss.r.ReadSlice('\n')
+		}
+		if err == nil {
+			err = errLineTooLong
+		}
+		return "", err
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+type command struct {
+	handle func(ss *session, arg string) error
+	// public commands may be used before the login
+	public bool
+	// writes are refused by a read only server
+	writes bool
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"USER": {handle: (*session).handleUser, public: true},
+		"PASS": {handle: (*session).handlePass, public: true},
+		"QUIT": {handle: (*session).handleQuit, public: true},
+		"AUTH": {handle: (*session).handleAuth, public: true},
+		"PBSZ": {handle: (*session).handlePbsz, public: true},
+		"PROT": {handle: (*session).handleProt, public: true},
+		"FEAT": {handle: (*session).handleFeat, public: true},
+		"SYST": {handle: (*session).handleSyst, public: true},
+		"NOOP": {handle: (*session).handleNoop, public: true},
+		"OPTS": {handle: (*session).handleOpts, public: true},
+		"TYPE": {handle: (*session).handleType},
+		"MODE": {handle: (*session).handleMode},
+		"STRU": {handle: (*session).handleStru},
+		"PWD":  {handle: (*session).handlePwd},
+		"XPWD": {handle: (*session).handlePwd},
+		"CWD":  {handle: (*session).handleCwd},
+		"XCWD": {handle: (*session).handleCwd},
+		"CDUP": {handle: (*session).handleCdup},
+		"XCUP": {handle: (*session).handleCdup},
+		"PASV": {handle: (*session).handlePasv},
+		"EPSV": {handle: (*session).handleEpsv},
+		"PORT": {handle: (*session).handleActive},
+		"EPRT": {handle: (*session).handleActive},
+		"LIST": {handle: (*session).handleList},
+		"NLST": {handle: (*session).handleNlst},
+		"MLSD": {handle: (*session).handleMlsd},
+		"MLST": {handle: (*session).handleMlst},
+		"SIZE": {handle: (*session).handleSize},
+		"MDTM": {handle: (*session).handleMdtm},
+		"MFMT": {handle: (*session).handleMfmt, writes: true},
+		"REST": {handle: (*session).handleRest},
+		"RETR": {handle: (*session).handleRetr},
+		"STOR": {handle: (*session).handleStor, writes: true},
+		"APPE": {handle: (*session).handleAppe, writes: true},
+		"DELE": {handle: (*session).handleDele, writes: true},
+		"MKD":  {handle: (*session).handleMkd, writes: true},
+		"XMKD": {handle: (*session).handleMkd, writes: true},
+		"RMD":  {handle: (*session).handleRmd, writes: true},
+		"XRMD": {handle: (*session).handleRmd, writes: true},
+		"RNFR": {handle: (*session).handleRnfr, writes: true},
+		"RNTO": {handle: (*session).handleRnto, writes: true},
+		"ABOR": {handle: (*session).handleAbor},
+	}
+}
+
+func (ss *session) serve() {
+	ss.s.logf("%s connected", ss.remote)
+	defer ss.closePassive()
+	if ss.reply(220, "FTP server ready") != nil {
+		return
+	}
+
+	for {
+		line, err := ss.readLine()
+		if err == errLineTooLong {
+			if ss.reply(500, "Line too long") != nil {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			ss.s.logf("%s disconnected: %v", ss.remote, err)
+			return
+		}
+
+		name, arg, _ := strings.Cut(line, " ")
+		name = strings.ToUpper(name)
+		c, ok := commands[name]
+		switch {
+		case !ok:
+			err = ss.reply(502, "Command %s not implemented", name)
+		case !c.public && !ss.loggedIn:
+			err = ss.reply(530, "Please log in with USER and PASS")
+		case c.writes && ss.s.ReadOnly:
+			err = ss.reply(550, "Permission denied, the server is read only")
+		default:
+			err = c.handle(ss, arg)
+		}
+		// REST and RNFR only apply to the next command, REST may be sent before
+		// PASV or EPSV too
+		if name != "REST" && name != "PASV" && name != "EPSV" {
+			ss.restart = 0
+		}
+		if name != "RNFR" {
+			ss.renameFrom = ""
+		}
+		if err != nil || name == "QUIT" {
+			return
+		}
+	}
+}
+
+func (ss *session) handleUser(arg string) error {
+	if ss.s.TLSConfig != nil && !ss.tls && !ss.s.AllowInsecureAuth {
+		return ss.reply(530, "Use AUTH TLS before the login")
+	}
+	ss.user = arg
+	ss.loggedIn = false
+	return ss.reply(331, "Password required for %s", arg)
+}
+
+func (ss *session) handlePass(arg string) error {
+	if ss.user == "" {
+		return ss.reply(503, "Login with USER first")
+	}
+	password, known := ss.s.Users[ss.user]
+	if len(ss.s.Users) > 0 && (!known || subtle.ConstantTimeCompare([]byte(password), []byte(arg)) != 1) {
+		ss.s.logf("%s: login as %s failed", ss.remote, ss.user)
+		return ss.reply(530, "Login incorrect")
+	}
+	ss.loggedIn = true
+	ss.s.logf("%s: logged in as %s", ss.remote, ss.user)
+	return ss.reply(230, "Logged in")
+}
+
+func (ss *session) setConn(conn net.Conn) {
+	ss.conn = conn
+	ss.r = bufio.NewReaderSize(conn, maxLine)
+	ss.w = bufio.NewWriter(conn)
+}
+
+// handleAuth upgrades the control connection to TLS (RFC 4217 4)
+func (ss *session) handleAuth(arg string) error {
+	switch {
+	case ss.s.TLSConfig == nil:
+		return ss.reply(502, "AUTH is not supported")
+	case ss.tls:
+		return ss.reply(503, "Already running TLS")
+	case !strings.EqualFold(arg, "TLS") && !strings.EqualFold(arg, "TLS-C"):
+		return ss.reply(504, "Only AUTH TLS is supported")
+	}
+	if err := ss.reply(234, "Ready to start TLS"); err != nil {
+		return err
+	}
+	// Commands sent before the handshake could have been injected by an attacker
+	if ss.r.Buffered() > 0 {
+		return errors.New("data after AUTH TLS")
+	}
+
+	conn := tls.Server(ss.conn, ss.s.TLSConfig)
+	conn.SetDeadline(time.Now().Add(ss.s.timeout()))
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	ss.setConn(conn)
+	ss.tls = true
+	// The login starts over
+	ss.user = ""
+	ss.loggedIn = false
+	return nil
+}
+
+// handlePbsz only accepts 0, there are no protection buffers with TLS (RFC 4217 8)
+func (ss *session) handlePbsz(string) error {
+	if !ss.tls {
+		return ss.reply(503, "Use AUTH TLS first")
+	}
+	return ss.reply(200, "PBSZ=0")
+}
+
+// handleProt sets whether the data connections use TLS, C is clear and P is private
+func (ss *session) handleProt(arg string) error {
+	if !ss.tls {
+		return ss.reply(503, "Use AUTH TLS first")
+	}
+	switch strings.ToUpper(arg) {
+	case "C":
+		ss.protect = false
+	case "P":
+		ss.protect = true
+	default:
+		return ss.reply(504, "Protection level %s not supported", arg)
+	}
+	return ss.reply(200, "Protection level set to %s", strings.ToUpper(arg))
+}
+
+func (ss *session) handleQuit(string) error {
+	return ss.reply(221, "Goodbye")
+}
+
+func (ss *session) handleFeat(string) error {
+	features := []string{"EPSV", "PASV", "MLST type*;size*;modify*;", "SIZE", "MDTM", "MFMT", "REST STREAM", "UTF8"}
+	if ss.s.TLSConfig != nil {
+		features = append(features, "AUTH TLS", "PBSZ", "PROT")
+	}
+	return ss.replyLines(211, "Features:", features, "End")
+}
+
+func (ss *session) handleSyst(string) error {
+	return ss.reply(215, "UNIX Type: L8")
+}
+
+func (ss *session) handleNoop(string) error {
+	return ss.reply(200, "OK")
+}
+
+func (ss *session) handleOpts(arg string) error {
+	if strings.EqualFold(arg, "UTF8 ON") {
+		return ss.reply(200, "UTF8 mode is always on")
+	}
+	return ss.reply(501, "Option not understood")
+}
+
+// handleType accepts binary and ASCII, both are sent as is
+func (ss *session) handleType(arg string) error {
+	switch strings.ToUpper(arg) {
+	case "I", "L 8", "A", "A N":
+		return ss.reply(200, "Type set to %s", arg)
+	}
+	return ss.reply(504, "Type %s not supported", arg)
+}
+
+func (ss *session) handleMode(arg string) error {
+	if strings.EqualFold(arg, "S") {
+		return ss.reply(200, "Mode set to S")
+	}
+	return ss.reply(504, "Only the stream mode is supported")
+}
+
+func (ss *session) handleStru(arg string) error {
+	if strings.EqualFold(arg, "F") {
+		return ss.reply(200, "Structure set to F")
+	}
+	return ss.reply(504, "Only the file structure is supported")
+}
+
+func (ss *session) handlePwd(string) error {
+	return ss.reply(257, "%s is the current directory", quote(ss.cwd))
+}
+
+// quote puts the path in quotes, the quotes in it are doubled (RFC 959 Appendix II)
+func quote(p string) string {
+	return `"` + strings.ReplaceAll(p, `"`, `""`) + `"`
+}
+
+func (ss *session) handleCwd(arg string) error {
+	virtual, real, err := ss.s.resolve(ss.cwd, arg)
+	if err != nil {
+		return ss.replyError(err)
+	}
+	info, err := os.Stat(real)
+	if err != nil {
+		return ss.replyError(err)
+	}
+	if !info.IsDir() {
+		return ss.reply(550, "%s is not a directory", arg)
+	}
+	ss.cwd = virtual
+	return ss.reply(250, "Directory changed to %s", virtual)
+}
+
+func (ss *session) handleCdup(string) error {
+	ss.cwd = path.Dir(ss.cwd)
+	return ss.reply(250, "Directory changed to %s", ss.cwd)
+}
+
+// replyError reports a failed file operation without the real paths of the server
+func (ss *session) replyError(err error) error {
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	switch {
+	case errors.As(err, &pathErr):
+		err = pathErr.Err
+	case errors.As(err, &linkErr):
+		err = linkErr.Err
+	}
+	return ss.reply(550, "%s", err.Error())
+}
+
+// passive is the listener for the next data connection. The connection is accepted
+// at once, since a TLS client does the handshake before it sends the command
+type passive struct {
+	ln   *net.TCPListener
+	done chan dataConn
+}
+
+// dataConn is an accepted data connection, conn is raw or TLS over raw
+type dataConn struct {
+	conn, raw net.Conn
+	err       error
+}
+
+func (d dataConn) close(s *Server) {
+	if d.raw != nil {
+		d.conn.Close()
+		s.untrack(d.raw)
+	}
+}
+
+// listen opens a passive listener on the address the client reached the server at
+func (ss *session) listen() (*net.TCPListener, error) {
+	ss.closePassive()
+	local := ss.conn.LocalAddr().(*net.TCPAddr)
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: local.IP, Zone: local.Zone})
+	if err != nil {
+		return nil, err
+	}
+	if !ss.s.track(ln) {
+		return nil, ErrServerClosed
+	}
+	ss.passive = &passive{ln: ln, done: make(chan dataConn, 1)}
+	go ss.accept(ss.passive, ss.conn.RemoteAddr().(*net.TCPAddr).IP, ss.protect)
+	return ln, nil
+}
+
+// accept waits for the data connection of the client, others are refused
+func (ss *session) accept(p *passive, client net.IP, protect bool) {
+	p.ln.SetDeadline(time.Now().Add(ss.s.timeout()))
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			p.done <- dataConn{err: err}
+			return
+		}
+		if !conn.RemoteAddr().(*net.TCPAddr).IP.Equal(client) {
+			ss.s.logf("%s: data connection from %s refused", ss.remote, conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		if !ss.s.track(conn) {
+			p.done <- dataConn{err: ErrServerClosed}
+			return
+		}
+		if !protect {
+			p.done <- dataConn{conn: conn, raw: conn}
+			return
+		}
+
+		tlsConn := tls.Server(conn, ss.s.TLSConfig)
+		tlsConn.SetDeadline(time.Now().Add(ss.s.timeout()))
+		if err := tlsConn.Handshake(); err != nil {
+			ss.s.untrack(conn)
+			p.done <- dataConn{err: err}
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		p.done <- dataConn{conn: tlsConn, raw: conn}
+		return
+	}
+}
+
+func (ss *session) closePassive() {
+	if ss.passive != nil {
+		ss.s.untrack(ss.passive.ln)
+		(<-ss.passive.done).close(ss.s)
+		ss.passive = nil
+	}
+}
+
+func (ss *session) handlePasv(string) error {
+	ip := ss.conn.LocalAddr().(*net.TCPAddr).IP.To4()
+	if ip == nil {
+		return ss.reply(522, "PASV is IPv4 only, use EPSV")
+	}
+	ln, err := ss.listen()
+	if err != nil {
+		return ss.reply(425, "Cannot open passive connection")
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	return ss.reply(227, "Entering Passive Mode (%d,%d,%d,%d,%d,%d)", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff)
+}
+
+func (ss *session) handleEpsv(arg string) error {
+	if strings.EqualFold(arg, "ALL") {
+		return ss.reply(200, "EPSV ALL accepted")
+	}
+	ln, err := ss.listen()
+	if err != nil {
+		return ss.reply(425, "Cannot open passive connection")
+	}
+	return ss.reply(229, "Entering Extended Passive Mode (|||%d|)", ln.Addr().(*net.TCPAddr).Port)
+}
+
+func (ss *session) handleActive(string) error {
+	return ss.reply(502, "Active mode is not supported, use PASV or EPSV")
+}
+
+// dataConn waits for the data connection on the passive listener
+func (ss *session) dataConn() dataConn {
+	p := ss.passive
+	if p == nil {
+		return dataConn{err: errNoPassive}
+	}
+	ss.passive = nil
+	d := <-p.done
+	ss.s.untrack(p.ln)
+	return d
+}
+
+// transfer opens the data connection, calls fn with it and reports the result
+func (ss *session) transfer(fn func(conn net.Conn) error) error {
+	d := ss.dataConn()
+	if d.err != nil {
+		return ss.reply(425, "Cannot open data connection: %v", d.err)
+	}
+	if err := ss.reply(150, "Opening data connection"); err != nil {
+		d.close(ss.s)
+		return err
+	}
+	err := fn(d.conn)
+	d.close(ss.s)
+	if err != nil {
+		ss.s.logf("%s: transfer failed: %v", ss.remote, err)
+		return ss.reply(426, "Transfer aborted")
+	}
+	return ss.reply(226, "Transfer complete")
+}
+
+// listArg drops the options of ls that clients send with LIST
+func listArg(arg string) string {
+	for strings.HasPrefix(arg, "-") {
+		_, arg, _ = strings.Cut(arg, " ")
+	}
+	return arg
+}
+
+// readDir lists the directory, or the file alone. Entries that cannot be read are skipped
+func (ss *session) readDir(arg string) ([]fs.FileInfo, error) {
+	_, real, err := ss.s.resolve(ss.cwd, arg)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(real)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []fs.FileInfo{info}, nil
+	}
+	entries, err := os.ReadDir(real)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		// Links are followed, so the client sees what they point to
+		if info, err := os.Stat(path.Join(real, entry.Name())); err == nil {
+			infos = append(infos, namedInfo{info, entry.Name()})
+		}
+	}
+	return infos, nil
+}
+
+// namedInfo keeps the name of a link instead of the name of its target
+type namedInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (n namedInfo) Name() string { return n.name }
+
+// listLine is a line of "ls -l", times are in UTC
+func listLine(info fs.FileInfo, now time.Time) string {
+	mode := []byte(info.Mode().Perm().String())
+	if info.IsDir() {
+		mode[0] = 'd'
+	}
+	modTime := info.ModTime().UTC()
+	date := modTime.Format("Jan _2 15:04")
+	if modTime.Before(now.AddDate(0, -6, 0)) || modTime.After(now.AddDate(0, 0, 1)) {
+		date = modTime.Format("Jan _2  2006")
+	}
+	return fmt.Sprintf("%s 1 ftp ftp %12d %s %s", mode, info.Size(), date, info.Name())
+}
+
+// facts are the MLSD and MLST facts of the file (RFC 3659 7)
+func facts(info fs.FileInfo) string {
+	modify := info.ModTime().UTC().Format(timeFormat)
+	if info.IsDir() {
+		return fmt.Sprintf("type=dir;modify=%s;", modify)
+	}
+	return fmt.Sprintf("type=file;size=%d;modify=%s;", info.Size(), modify)
+}
+
+func (ss *session) sendList(arg string, line func(fs.FileInfo) string) error {
+	infos, err := ss.readDir(arg)
+	if err != nil {
+		return ss.replyError(err)
+	}
+	return ss.transfer(func(conn net.Conn) error {
+		w := bufio.NewWriter(conn)
+		for _, info := range infos {
+			fmt.Fprintf(w, "%s\r\n", line(info))
+		}
+		return w.Flush()
+	})
+}
+
+func (ss *session) handleList(arg string) error {
+	now := time.Now()
+	return ss.sendList(listArg(arg), func(info fs.FileInfo) string { return listLine(info, now) })
+}
+
+func (ss *session) handleNlst(arg string) error {
+	return ss.sendList(listArg(arg), fs.FileInfo.Name)
+}
+
+func (ss *session) handleMlsd(arg string) error {
+	_, real, err := ss.s.resolve(ss.cwd, arg)
+	if err != nil {
+		return ss.replyError(err)
+	}
+	if info, err := os.Stat(real); err == nil && !info.IsDir() {
+		return ss.reply(501, "%s is not a directory", arg)
+	}
+	return ss.sendList(arg, func(info fs.FileInfo) string { return facts(info) + " " + info.Name() })
+}
+
+func (ss *session) handleMlst(arg string) error {
+	virtual, real, err := ss.s.resolve(ss.cwd, arg)
+	if err != nil {
+		return ss.replyError(err)
+	}
+	info, err := os.Stat(real)
+	if err != nil {
+		return ss.replyError(err)
+	}
+	return ss.replyLines(250, "Listing "+virtual, []string{facts(info) + " " + virtual}, "End")
+}
+
+// regularFile resolves the path of an existing file that is not a directory
+func (ss *session) regularFile(arg string) (string, fs.FileInfo, error) {
+	_, real, err := ss.s.resolve(ss.cwd, arg)
+	if err != nil {
+		return "", nil, err
+	}
+	info, err := os.Stat(real)
+	if err != nil {
+		return "", nil, err
+	}
+	if info.IsDir() {
+		return "", nil, fmt.Errorf("%s is a directory", arg)
+	}
+	return real, info, nil
+}
+
+func (ss *session) handleSize(arg string) error {
+	_, info, err := ss.regularFile(arg)
+	if err != nil {
+		return ss.replyError(err)
+	}
+	return ss.reply(213, "%d", info.Size())
+}
+
+func (ss *session) handleMdtm(arg string) error {
+	_, info, err := ss.regularFile(arg)
+	if err != nil {
+		return ss.replyError(err)
+	}
+	return ss.reply(213, "%s", info.ModTime().UTC().Format(timeFormat))
+}
+
+// handleMfmt sets the modification time: MFMT YYYYMMDDHHMMSS path
+func (ss *session) handleMfmt(arg string) error {
+	value, name, _ := strings.Cut(arg, " ")
+	modTime, err := time.ParseInLocation(timeFormat, value, time.UTC)
+	if err != nil || name == "" {
+		return ss.reply(501, "Usage: MFMT YYYYMMDDHHMMSS path")
+	}
+	real, _, err := ss.regularFile(name)
+	if err != nil {
+		return ss.replyError(err)
+	}
+	if err := os.Chtimes(real, modTime, modTime); err != nil {
+		return ss.replyError(err)
+	}
+	return ss.reply(213, "Modify=%s; %s", value, name)
+}
+
+func (ss *session) handleRest(arg string) error {
+	offset, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || offset < 0 {
+		return ss.reply(501, "Bad offset %s", arg)
+	}
+	ss.restart = offset
+	return ss.reply(350, "Restarting at %d, send RETR or STOR", offset)
+}
+
+func (ss *session) handleRetr(arg string) error {
+	real, _, err := ss.regularFile(arg)
+	if err != nil {
+		return ss.closePassiveAfter(ss.replyError(err))
+	}
+	file, err := os.Open(real)
+	if err != nil {
+		return ss.closePassiveAfter(ss.replyError(err))
+	}
+	defer file.Close()
+	if _, err := file.Seek(ss.restart, io.SeekStart); err != nil {
+		return ss.closePassiveAfter(ss.replyError(err))
+	}
+	return ss.transfer(func(conn net.Conn) error {
+		_, err := io.Copy(conn, file)
+		return err
+	})
+}
+
+// closePassiveAfter drops the passive listener of a refused transfer
+func (ss *session) closePassiveAfter(err error) error {
+	ss.closePassive()
+	return err
+}
+
+func (ss *session) handleStor(arg string) error {
+	return ss.store(arg, false)
+}
+
+func (ss *session) handleAppe(arg string) error {
+	return ss.store(arg, true)
+}
+
+// store receives the file. After REST the file is cut at the offset and written from there
+func (ss *session) store(arg string, appendData bool) error {
+	_, real, err := ss.s.resolve(ss.cwd, arg)
+	if err != nil {
+		return ss.closePassiveAfter(ss.replyError(err))
+	}
+	if info, err := os.Stat(real); err == nil && info.IsDir() {
+		return ss.closePassiveAfter(ss.reply(550, "%s is a directory", arg))
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE
+	switch {
+	case appendData:
+		flags |= os.O_APPEND
+	case ss.restart == 0:
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(real, flags, 0o644)
+	if err != nil {
+		return ss.closePassiveAfter(ss.replyError(err))
+	}
+	defer file.Close()
+	if ss.restart > 0 && !appendData {
+		if err := file.Truncate(ss.restart); err != nil {
+			return ss.closePassiveAfter(ss.replyError(err))
+		}
+		if _, err := file.Seek(ss.restart, io.SeekStart); err != nil {
+			return ss.closePassiveAfter(ss.replyError(err))
+		}
+	}
+	ss.s.logf("%s: storing %s", ss.remote, arg)
+	return ss.transfer(func(conn net.Conn) error {
+		if _, err := io.Copy(file, conn); err != nil {
+			return err
+		}
+		return file.Close()
+	})
+}
+
+// changeable resolves a path that may be removed or renamed, the root may not
+func (ss *session) changeable(arg string) (string, error) {
+	virtual, real, err := ss.s.resolve(ss.cwd, arg)
+	if err != nil {
+		return "", err
+	}
+	if virtual == "/" {
+		return "", errors.New("the root cannot be changed")
+	}
+	return real, nil
+}
+
+func (ss *session) handleDele(arg string) error {
+	// The root is a directory, so it is refused as well
+	real, _, err := ss.regularFile(arg)
+	if err == nil {
+		err = os.Remove(real)
+	}
+	if err != nil {
+		return ss.replyError(err)
+	}
+	return ss.reply(250, "Deleted %s", arg)
+}
+
+func (ss *session) handleMkd(arg string) error {
+	virtual, real, err := ss.s.resolve(ss.cwd, arg)
+	if err == nil {
+		err = os.Mkdir(real, 0o755)
+	}
+	if err != nil {
+		return ss.replyError(err)
+	}
+	return ss.reply(257, "%s created", quote(virtual))
+}
+
+func (ss *session) handleRmd(arg string) error {
+	real, err := ss.changeable(arg)
+	if err != nil {
+		return ss.replyError(err)
+	}
+	info, err := os.Stat(real)
+	if err == nil && !info.IsDir() {
+		err = fmt.Errorf("%s is not a directory", arg)
+	}
+	if err == nil {
+		// Only empty directories are removed
+		err = os.Remove(real)
+	}
+	if err != nil {
+		return ss.replyError(err)
+	}
+	return ss.reply(250, "Removed %s", arg)
+}
+
+func (ss *session) handleRnfr(arg string) error {
+	real, err := ss.changeable(arg)
+	if err == nil {
+		_, err = os.Stat(real)
+	}
+	if err != nil {
+		return ss.replyError(err)
+	}
+	ss.renameFrom = real
+	return ss.reply(350, "Ready for RNTO")
+}
+
+func (ss *session) handleRnto(arg string) error {
+	if ss.renameFrom == "" {
+		return ss.reply(503, "Use RNFR first")
+	}
+	real, err := ss.changeable(arg)
+	if err == nil {
+		err = os.Rename(ss.renameFrom, real)
+	}
+	if err != nil {
+		return ss.replyError(err)
+	}
+	return ss.reply(250, "Renamed to %s", arg)
+}
+
+func (ss *session) handleAbor(string) error {
+	ss.closePassive()
+	return ss.reply(225, "No transfer to abort")
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+	"github.com/jlaffaye/ftp"
+)
+
+// entry is a file or a directory shown in a pane
+type entry struct {
+	name string
+	dir  bool
+	size int64
+}
+
+// source is what a pane browses: the local disk or the server
+type source interface {
+	list(dir string) ([]entry, error)
+	mkdir(name string) error
+	join(dir, name string) string
+	base(name string) string
+	parent(name string) string
+}
+
+type localSource struct{}
+
+func (localSource) list(dir string) ([]entry, error) {
+	files, err := os.ReadDir(dir)
+	var entries []entry
+	for _, file := range files {
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry{name: file.Name(), dir: file.IsDir(), size: info.Size()})
+	}
+	return entries, err
+}
+
+func (localSource) mkdir(name string) error      { return os.Mkdir(name, 0o755) }
+func (localSource) join(dir, name string) string { return filepath.Join(dir, name) }
+func (localSource) base(name string) string      { return filepath.Base(name) }
+func (localSource) parent(name string) string    { return filepath.Dir(name) }
+
+// remoteSource shares one connection between the listings and the editor,
+// a broken connection is dialed again the next time
+type remoteSource struct {
+	mu   sync.Mutex
+	conn *ftp.ServerConn
+	dial func() (*ftp.ServerConn, error)
+}
+
+func (r *remoteSource) do(fn func(c *ftp.ServerConn) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		conn, err := r.dial()
+		if err != nil {
+			return err
+		}
+		r.conn = conn
+	}
+	err := fn(r.conn)
+	if err != nil && r.conn.NoOp() != nil {
+		r.conn.Quit()
+		r.conn = nil
+	}
+	return err
+}
+
+func (r *remoteSource) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn != nil {
+		r.conn.Quit()
+		r.conn = nil
+	}
+}
+
+func (r *remoteSource) list(dir string) ([]entry, error) {
+	var entries []entry
+	err := r.do(func(c *ftp.ServerConn) error {
+		list, err := c.List(dir)
+		for _, e := range list {
+			if e.Name == "." || e.Name == ".." {
+				continue
+			}
+			entries = append(entries, entry{name: e.Name, dir: e.Type == ftp.EntryTypeFolder, size: int64(e.Size)})
+		}
+		return err
+	})
+	return entries, err
+}
+
+func (r *remoteSource) mkdir(name string) error {
+	return r.do(func(c *ftp.ServerConn) error { return c.MakeDir(name) })
+}
+
+func (r *remoteSource) join(dir, name string) string { return path.Join(dir, name) }
+func (r *remoteSource) base(name string) string      { return path.Base(name) }
+func (r *remoteSource) parent(name string) string    { return path.Dir(name) }
+
+// pane is a tree of a source. Directories are listed when they are opened,
+// the node IDs are the full paths
+type pane struct {
+	tree   *widget.Tree
+	path   *widget.Label
+	status func(message string)
+	// dropped is called when entries of the pane are dragged and let go at pos
+	dropped func(from *pane, names []string, pos fyne.Position)
+
+	mu         sync.Mutex
+	source     source
+	root       string
+	generation int
+	children   map[string][]string
+	entries    map[string]entry
+	errs       map[string]error
+	loading    map[string]bool
+	stale      map[string]bool
+	checked    map[string]bool
+	selected   string
+	rows       []*row
+	dragPos    fyne.Position
+}
+
+func newPane(status func(message string)) *pane {
+	p := &pane{path: widget.NewLabel("Not connected"), status: status}
+	p.reset()
+	p.tree = widget.NewTree(p.childUIDs, p.isBranch, p.createNode, p.updateNode)
+	p.tree.OnSelected = func(uid widget.TreeNodeID) {
+		p.mu.Lock()
+		p.selected = uid
+		p.mu.Unlock()
+	}
+	p.tree.OnUnselected = func(widget.TreeNodeID) {
+		p.mu.Lock()
+		p.selected = ""
+		p.mu.Unlock()
+	}
+	return p
+}
+
+func (p *pane) view() fyne.CanvasObject {
+	return container.NewBorder(p.path, nil, nil, nil, p.tree)
+}
+
+// reset forgets everything listed, p.mu is held
+func (p *pane) reset() {
+	p.generation++
+	p.children = map[string][]string{}
+	p.entries = map[string]entry{}
+	p.errs = map[string]error{}
+	p.loading = map[string]bool{}
+	p.stale = map[string]bool{}
+	p.checked = map[string]bool{}
+	p.selected = ""
+}
+
+// setSource shows root of the source, a nil source shows nothing
+func (p *pane) setSource(src source, root string) {
+	p.mu.Lock()
+	p.reset()
+	p.source = src
+	p.root = root
+	p.mu.Unlock()
+
+	p.tree.UnselectAll()
+	p.tree.CloseAllBranches()
+	p.tree.Root = root
+	if src == nil {
+		p.path.SetText("Not connected")
+	} else {
+		p.path.SetText(root)
+	}
+	p.tree.Refresh()
+}
+
+func (p *pane) childUIDs(uid widget.TreeNodeID) []widget.TreeNodeID {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.source == nil {
+		return nil
+	}
+	children, ok := p.children[uid]
+	if (!ok || p.stale[uid]) && !p.loading[uid] {
+		p.loading[uid] = true
+		go p.load(uid, p.source, p.generation)
+	}
+	return children
+}
+
+// load lists the directory, the old children are shown until it is done
+func (p *pane) load(dir string, src source, generation int) {
+	entries, err := src.list(dir)
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].dir != entries[j].dir {
+			return entries[i].dir
+		}
+		return entries[i].name < entries[j].name
+	})
+
+	p.mu.Lock()
+	if generation != p.generation {
+		// Another source or root is shown now
+		p.mu.Unlock()
+		return
+	}
+	delete(p.loading, dir)
+	delete(p.stale, dir)
+	listed := map[string]bool{}
+	var children []string
+	for _, e := range entries {
+		uid := src.join(dir, e.name)
+		p.entries[uid] = e
+		listed[uid] = true
+		children = append(children, uid)
+	}
+	for _, uid := range p.children[dir] {
+		if !listed[uid] {
+			delete(p.entries, uid)
+			delete(p.checked, uid)
+		}
+	}
+	p.children[dir] = children
+	if err != nil {
+		p.errs[dir] = err
+	} else {
+		delete(p.errs, dir)
+	}
+	p.mu.Unlock()
+
+	if err != nil {
+		p.status(fmt.Sprintf("Listing %s failed: %s", dir, err))
+	}
+	p.tree.Refresh()
+}
+
+// reload lists the directory again if it has been listed
+func (p *pane) reload(dir string) {
+	p.mu.Lock()
+	_, listed := p.children[dir]
+	if listed {
+		p.stale[dir] = true
+	}
+	p.mu.Unlock()
+	if listed {
+		p.tree.Refresh()
+	}
+}
+
+// reloadAll lists every listed directory again
+func (p *pane) reloadAll() {
+	p.mu.Lock()
+	for dir := range p.children {
+		p.stale[dir] = true
+	}
+	p.mu.Unlock()
+	p.tree.Refresh()
+}
+
+func (p *pane) isBranch(uid widget.TreeNodeID) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return uid == p.root || p.entries[uid].dir
+}
+
+func (p *pane) createNode(bool) fyne.CanvasObject {
+	r := newRow(p)
+	p.mu.Lock()
+	p.rows = append(p.rows, r)
+	p.mu.Unlock()
+	return r
+}
+
+func (p *pane) updateNode(uid widget.TreeNodeID, branch bool, node fyne.CanvasObject) {
+	p.mu.Lock()
+	e := p.entries[uid]
+	text := e.name
+	switch {
+	case p.errs[uid] != nil:
+		text = fmt.Sprintf("%s (%s)", e.name, p.errs[uid])
+	case p.loading[uid]:
+		text = e.name + " ..."
+	case !e.dir:
+		text = fmt.Sprintf("%s (%d B)", e.name, e.size)
+	}
+	checked := p.checked[uid]
+	p.mu.Unlock()
+	node.(*row).set(uid, branch, text, checked)
+}
+
+// dir is the directory the entry is in, or the entry itself if it is one
+func (p *pane) dir(uid string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if uid == "" {
+		return p.root
+	}
+	if uid == p.root || p.entries[uid].dir {
+		return uid
+	}
+	return p.source.parent(uid)
+}
+
+// targetDir is the directory of the selected entry, the root if nothing is selected
+func (p *pane) targetDir() string {
+	p.mu.Lock()
+	selected := p.selected
+	p.mu.Unlock()
+	return p.dir(selected)
+}
+
+func (p *pane) entry(uid string) entry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.entries[uid]
+}
+
+// picked are the checked entries, or the selected one if none is checked
+func (p *pane) picked() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var names []string
+	for uid, checked := range p.checked {
+		if checked {
+			names = append(names, uid)
+		}
+	}
+	sort.Strings(names)
+	if len(names) == 0 && p.selected != "" && p.selected != p.root {
+		names = []string{p.selected}
+	}
+	return names
+}
+
+func (p *pane) setChecked(uid string, checked bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if checked {
+		p.checked[uid] = true
+	} else {
+		delete(p.checked, uid)
+	}
+}
+
+func (p *pane) uncheckAll() {
+	p.mu.Lock()
+	p.checked = map[string]bool{}
+	p.mu.Unlock()
+	p.tree.Refresh()
+}
+
+// dragged are the entries that go with the dragged one: the checked ones
+// if it is checked, or just itself
+func (p *pane) dragged(uid string) []string {
+	p.mu.Lock()
+	checked := p.checked[uid]
+	p.mu.Unlock()
+	if checked {
+		return p.picked()
+	}
+	return []string{uid}
+}
+
+// target is the directory at the absolute position, ok is false if it is outside the pane
+func (p *pane) target(pos fyne.Position) (dir string, ok bool) {
+	driver := fyne.CurrentApp().Driver()
+	if !contains(driver.AbsolutePositionForObject(p.tree), p.tree.Size(), pos) {
+		return "", false
+	}
+	p.mu.Lock()
+	if p.source == nil {
+		p.mu.Unlock()
+		return "", false
+	}
+	rows := append([]*row(nil), p.rows...)
+	p.mu.Unlock()
+
+	for _, r := range rows {
+		if r.uid != "" && r.Visible() && contains(driver.AbsolutePositionForObject(r), r.Size(), pos) {
+			return p.dir(r.uid), true
+		}
+	}
+	// Below the last entry is the root
+	return p.dir(""), true
+}
+
+func contains(topLeft fyne.Position, size fyne.Size, pos fyne.Position) bool {
+	return pos.X >= topLeft.X && pos.Y >= topLeft.Y && pos.X < topLeft.X+size.Width && pos.Y < topLeft.Y+size.Height
+}
+
+// row is a tree node: a check box for choosing several entries, the icon and the name.
+// Rows are dragged to the other pane
+type row struct {
+	widget.BaseWidget
+	pane  *pane
+	uid   string
+	check *widget.Check
+	icon  *widget.Icon
+	label *widget.Label
+}
+
+func newRow(p *pane) *row {
+	r := &row{pane: p, icon: widget.NewIcon(theme.FileIcon()), label: widget.NewLabel("")}
+	r.check = widget.NewCheck("", func(checked bool) {
+		if r.uid != "" {
+			p.setChecked(r.uid, checked)
+		}
+	})
+	r.ExtendBaseWidget(r)
+	return r
+}
+
+func (r *row) set(uid string, dir bool, text string, checked bool) {
+	r.uid = uid
+	r.check.SetChecked(checked)
+	if dir {
+		r.icon.SetResource(theme.FolderIcon())
+	} else {
+		r.icon.SetResource(theme.FileIcon())
+	}
+	r.label.SetText(text)
+}
+
+func (r *row) CreateRenderer() fyne.WidgetRenderer {
+	return widget.NewSimpleRenderer(container.NewBorder(nil, nil, container.NewHBox(r.check, r.icon), nil, r.label))
+}
+
+func (r *row) Dragged(e *fyne.DragEvent) {
+	r.pane.mu.Lock()
+	r.pane.dragPos = e.AbsolutePosition
+	r.pane.mu.Unlock()
+}
+
+func (r *row) DragEnd() {
+	p := r.pane
+	p.mu.Lock()
+	pos := p.dragPos
+	p.mu.Unlock()
+	if r.uid != "" && p.dropped != nil {
+		p.dropped(p, p.dragged(r.uid), pos)
+	}
+}
@@ -1,36 +1,70 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
-	"time"
+	"sync"
 
+	"example.com/ftpClient/transfer"
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
+	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/layout"
 	"fyne.io/fyne/v2/widget"
 	"github.com/jlaffaye/ftp"
 )
 
-var c *ftp.ServerConn
+// remote is the server connection of the panes and the editor, it is replaced by the dialing goroutine
+var (
+	remoteMu sync.Mutex
+	remote   *remoteSource
+)
+
+func getRemote() *remoteSource {
+	remoteMu.Lock()
+	defer remoteMu.Unlock()
+	return remote
+}
+
+// setRemote replaces the connection and returns the old one
+func setRemote(r *remoteSource) *remoteSource {
+	remoteMu.Lock()
+	defer remoteMu.Unlock()
+	old := remote
+	remote = r
+	return old
+}
 
 func main() {
 	myApp := app.New()
 	myWindow := myApp.NewWindow("FTP Client")
-	myWindow.Resize(fyne.NewSize(1000, 900))
+	myWindow.Resize(fyne.NewSize(1200, 900))
 
-	serverEntry := widget.NewEntry()
-	usernameEntry := widget.NewEntry()
-	passwordEntry := widget.NewPasswordEntry()
+	connection := newConnectionForm(myWindow)
 	statusLabel := widget.NewLabel("Not connected")
-	outputLabel := widget.NewMultiLineEntry()
 	fileContent := widget.NewMultiLineEntry()
 	fileContent.Disable()
 	fileContent.SetMinRowsVisible(10)
+	openedLabel := widget.NewLabel("No file opened")
+	// opened is the server file in the editor, it is changed by the Open and Save goroutines
+	var openedMu sync.Mutex
+	opened := ""
+	setOpened := func(name string) {
+		openedMu.Lock()
+		opened = name
+		openedMu.Unlock()
+		openedLabel.SetText(name)
+	}
+	getOpened := func() string {
+		openedMu.Lock()
+		defer openedMu.Unlock()
+		return opened
+	}
 
 	statusChan := make(chan string)
 
@@ -43,244 +77,298 @@ func main() {
 			serverStatusLabel.SetText(message)
 		}
 	}()
-
-	getFilesButton := widget.NewButton("Get Files", func() {
-		resp := getAllFiles(c)
-		outputLabel.SetText(resp)
+	status := func(message string) { statusChan <- message }
+
+	// The local disk on the left and the server on the right
+	localPane := newPane(status)
+	remotePane := newPane(status)
+	localRoot, err := os.UserHomeDir()
+	if err != nil {
+		localRoot, _ = filepath.Abs(".")
+	}
+	localPane.setSource(localSource{}, localRoot)
+
+	// Finished jobs show up in the pane they have changed
+	queue := newQueueView(func(job transfer.Job) {
+		switch job.Kind {
+		case transfer.DownloadJob, transfer.DeleteLocalJob:
+			localPane.reload(filepath.Dir(job.Local))
+		case transfer.UploadJob, transfer.DeleteRemoteJob:
+			remotePane.reload(path.Dir(job.Remote))
+		}
 	})
-	getFilesButton.Disable()
 
-	createDirButton := widget.NewButton("Create Directory", func() {
-		locationSelect := dialog.NewEntryDialog("Location", "Input path to new directory", func(filePath string) {
-			err := c.MakeDir(filePath)
-			if err != nil {
-				// Handle error
-				statusChan <- fmt.Sprintf("Upload failed: %s", err)
-				return
-			}
-		}, myWindow)
-		locationSelect.Resize(fyne.NewSize(500, 100))
-		locationSelect.Show()
+	upload := func(names []string, dir string) {
+		for _, name := range names {
+			queue.add(transfer.Job{
+				Kind:   transfer.UploadJob,
+				Local:  name,
+				Remote: path.Join(dir, filepath.Base(name)),
+				Dir:    localPane.entry(name).dir,
+			})
+		}
+		localPane.uncheckAll()
+	}
+	download := func(names []string, dir string) {
+		for _, name := range names {
+			queue.add(transfer.Job{
+				Kind:   transfer.DownloadJob,
+				Local:  filepath.Join(dir, path.Base(name)),
+				Remote: name,
+				Dir:    remotePane.entry(name).dir,
+			})
+		}
+		remotePane.uncheckAll()
+	}
 
-		statusChan <- "Creation of folder successful"
-	})
-	createDirButton.Disable()
+	// Entries dragged from one pane are copied to the directory they are dropped on in the other
+	dropped := func(from *pane, names []string, pos fyne.Position) {
+		if getRemote() == nil {
+			return
+		}
+		if dir, ok := remotePane.target(pos); ok && from == localPane {
+			upload(names, dir)
+		} else if dir, ok := localPane.target(pos); ok && from == remotePane {
+			download(names, dir)
+		}
+	}
+	localPane.dropped = dropped
+	remotePane.dropped = dropped
 
 	uploadButton := widget.NewButton("Upload", func() {
-		fileSelect := dialog.NewFileOpen(func(file fyne.URIReadCloser, err error) {
-			if err != nil || file == nil {
-				statusChan <- fmt.Sprintln("File dialog cancelled or error:", err)
-				return
-			}
-
-			// Get the chosen file
-			fileBytes, err := ioutil.ReadAll(file)
-			if err != nil {
-				statusChan <- fmt.Sprintln("Error reading file:", err)
-				return
-			}
-
-			// Close the reader
-			file.Close()
-
-			locationSelect := dialog.NewEntryDialog("Location", "Input path for uploading file to store", func(filePath string) {
-				err = c.Stor(filePath+"/"+file.URI().Name(), bytes.NewReader(fileBytes))
-				if err != nil {
-					// Handle error
-					statusChan <- fmt.Sprintf("Upload failed: %s", err)
-					return
-				}
-			}, myWindow)
-			locationSelect.Resize(fyne.NewSize(500, 100))
-			locationSelect.Show()
-
-			// Display success message
-			statusChan <- "Upload successful"
-		}, myWindow)
-		fileSelect.Resize(fyne.NewSize(700, 700))
-		fileSelect.Show()
+		names := localPane.picked()
+		if len(names) == 0 {
+			status("Choose the local files to upload")
+			return
+		}
+		upload(names, remotePane.targetDir())
 	})
 	uploadButton.Disable()
 
 	downloadButton := widget.NewButton("Download", func() {
-		locationSelect := dialog.NewEntryDialog("Location", "Input path for downloading file to", func(filePath string) {
-			splitted := strings.Split(filePath, "/")
-			fileName := splitted[len(splitted)-1]
+		names := remotePane.picked()
+		if len(names) == 0 {
+			status("Choose the server files to download")
+			return
+		}
+		download(names, localPane.targetDir())
+	})
+	downloadButton.Disable()
 
-			reader, err := c.Retr(filePath)
-			if err != nil {
-				statusChan <- fmt.Sprintf("Download failed: %s", err)
+	deleteButton := func(p *pane, kind transfer.Kind) *widget.Button {
+		return widget.NewButton("Delete", func() {
+			names := p.picked()
+			if len(names) == 0 {
+				status("Choose the files to delete")
 				return
 			}
-			body, _ := ioutil.ReadAll(reader)
-
-			reader.Close()
-
-			fileContent.SetText(string(body))
-
-			dirSelect := dialog.NewFolderOpen(func(dir fyne.ListableURI, err error) {
-
-				file, err := os.Create(dir.Path() + "/" + fileName)
-				if err != nil {
-					statusChan <- fmt.Sprintf("Download failed: %s", err)
+			message := fmt.Sprintf("Delete %d entries with everything in them?\n%s", len(names), strings.Join(names, "\n"))
+			dialog.ShowConfirm("Delete", message, func(ok bool) {
+				if !ok {
 					return
 				}
-				defer file.Close()
-				_, err = file.Write(body)
-				if err != nil {
-					// Handle error
-					statusChan <- fmt.Sprintf("Download failed: %s", err)
+				for _, name := range names {
+					job := transfer.Job{Kind: kind, Dir: p.entry(name).dir}
+					if kind == transfer.DeleteLocalJob {
+						job.Local = name
+					} else {
+						job.Remote = name
+					}
+					queue.add(job)
+				}
+				p.uncheckAll()
+			}, myWindow)
+		})
+	}
+	deleteLocalButton := deleteButton(localPane, transfer.DeleteLocalJob)
+	deleteRemoteButton := deleteButton(remotePane, transfer.DeleteRemoteJob)
+	deleteRemoteButton.Disable()
+
+	newFolderButton := func(p *pane) *widget.Button {
+		return widget.NewButton("New Folder", func() {
+			dir := p.targetDir()
+			nameSelect := dialog.NewEntryDialog("New folder", "Name of the folder in "+dir, func(name string) {
+				if name == "" {
 					return
 				}
+				go func() {
+					p.mu.Lock()
+					src := p.source
+					p.mu.Unlock()
+					if err := src.mkdir(src.join(dir, name)); err != nil {
+						status(fmt.Sprintf("Creation of folder failed: %s", err))
+						return
+					}
+					status("Creation of folder successful")
+					p.reload(dir)
+				}()
 			}, myWindow)
-			dirSelect.Resize(fyne.NewSize(700, 700))
-			dirSelect.Show()
-		}, myWindow)
-		locationSelect.Resize(fyne.NewSize(500, 100))
-		locationSelect.Show()
+			nameSelect.Resize(fyne.NewSize(500, 100))
+			nameSelect.Show()
+		})
+	}
+	newLocalFolderButton := newFolderButton(localPane)
+	newRemoteFolderButton := newFolderButton(remotePane)
+	newRemoteFolderButton.Disable()
 
-		statusChan <- "Download successful"
-	})
-	downloadButton.Disable()
+	refreshRemoteButton := widget.NewButton("Refresh", remotePane.reloadAll)
+	refreshRemoteButton.Disable()
 
-	createFileButton := widget.NewButton("Create File", func() {
-		locationSelect := dialog.NewEntryDialog("Location", "Input path for creating file to", func(filePath string) {
-			err := c.Stor(filePath, strings.NewReader(fileContent.Text))
-			if err != nil {
-				statusChan <- fmt.Sprintf("Creation failed: %s", err)
+	localFolderButton := widget.NewButton("Folder...", func() {
+		dirSelect := dialog.NewFolderOpen(func(dir fyne.ListableURI, err error) {
+			if err != nil || dir == nil {
 				return
 			}
-			statusChan <- "Creation of file successful"
+			localPane.setSource(localSource{}, dir.Path())
 		}, myWindow)
-		locationSelect.Resize(fyne.NewSize(500, 100))
-		locationSelect.Show()
+		dirSelect.Resize(fyne.NewSize(700, 700))
+		dirSelect.Show()
 	})
-	createFileButton.Disable()
 
-	readFileButton := widget.NewButton("Read File", func() {
-		locationSelect := dialog.NewEntryDialog("Location", "Input path for reading file", func(filePath string) {
-			f, err := c.Retr(filePath)
-			if err != nil {
-				statusChan <- fmt.Sprintf("Reading failed: %s", err)
-				return
-			}
-			defer f.Close()
-
-			content, err := ioutil.ReadAll(f)
+	// The editor reads a server file and writes it back or to a new one
+	openButton := widget.NewButton("Open", func() {
+		names := remotePane.picked()
+		if len(names) != 1 || remotePane.entry(names[0]).dir {
+			status("Choose one server file to open")
+			return
+		}
+		name := names[0]
+		// The connection may be replaced meanwhile, the goroutine keeps the one it started with
+		server := getRemote()
+		go func() {
+			var content []byte
+			err := server.do(func(c *ftp.ServerConn) error {
+				f, err := c.Retr(name)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				content, err = io.ReadAll(f)
+				return err
+			})
 			if err != nil {
-				statusChan <- fmt.Sprintf("Reading failed: %s", err)
+				status(fmt.Sprintf("Reading failed: %s", err))
 				return
 			}
+			setOpened(name)
 			fileContent.SetText(string(content))
-			statusChan <- "Reading of file successful"
-		}, myWindow)
-		locationSelect.Resize(fyne.NewSize(500, 100))
-		locationSelect.Show()
+			status("Reading of file successful")
+		}()
 	})
-	readFileButton.Disable()
-
-	updateFileButton := widget.NewButton("Update File", func() {
-		locationSelect := dialog.NewEntryDialog("Location", "Input path for updating file", func(filePath string) {
-			err := c.Stor(filePath, strings.NewReader(fileContent.Text))
+	openButton.Disable()
+
+	save := func(name string) {
+		text := fileContent.Text
+		server := getRemote()
+		go func() {
+			err := server.do(func(c *ftp.ServerConn) error {
+				return c.Stor(name, strings.NewReader(text))
+			})
 			if err != nil {
-				statusChan <- fmt.Sprintf("Updating failed: %s", err)
+				status(fmt.Sprintf("Saving failed: %s", err))
 				return
 			}
-			statusChan <- "Updating of file successful"
-		}, myWindow)
-		locationSelect.Resize(fyne.NewSize(500, 100))
-		locationSelect.Show()
-	})
-	updateFileButton.Disable()
+			setOpened(name)
+			status("Saving of file successful")
+			remotePane.reload(path.Dir(name))
+		}()
+	}
 
-	deleteFileButton := widget.NewButton("Delete File", func() {
-		locationSelect := dialog.NewEntryDialog("Location", "Input path for deleting file", func(filePath string) {
-			err := c.Delete(filePath)
-			if err != nil {
-				statusChan <- fmt.Sprintf("Deleting failed: %s", err)
-				return
+	saveButton := widget.NewButton("Save", func() {
+		name := getOpened()
+		if name == "" {
+			status("Open a file or save it as a new one")
+			return
+		}
+		save(name)
+	})
+	saveButton.Disable()
+
+	saveAsButton := widget.NewButton("Save As", func() {
+		name := widget.NewEntry()
+		name.SetText(path.Join(remotePane.targetDir(), "new.txt"))
+		items := []*widget.FormItem{{Text: "Path", Widget: name}}
+		form := dialog.NewForm("Save as", "Save", "Cancel", items, func(ok bool) {
+			if ok && name.Text != "" {
+				save(name.Text)
 			}
-			statusChan <- "Deleting of file successful"
 		}, myWindow)
-		locationSelect.Resize(fyne.NewSize(500, 100))
-		locationSelect.Show()
+		form.Resize(fyne.NewSize(500, 150))
+		form.Show()
 	})
-	deleteFileButton.Disable()
+	saveAsButton.Disable()
 
 	form := &widget.Form{
-		Items: []*widget.FormItem{
-			{Text: "Server", Widget: serverEntry},
-			{Text: "Username", Widget: usernameEntry},
-			{Text: "Password", Widget: passwordEntry},
-		},
+		Items: connection.items(),
 		OnSubmit: func() {
-			server := serverEntry.Text + ":21"
-			username := usernameEntry.Text
-			password := passwordEntry.Text
+			statusLabel.SetText("Connecting...")
+			// Called from the dialing goroutine, so that the window does not freeze meanwhile
+			connection.connect(func(conn *ftp.ServerConn, dial func() (*ftp.ServerConn, error), err error) {
+				if err != nil {
+					statusLabel.SetText(fmt.Sprintf("Connection failed: %s", err))
+					return
+				}
+				server := &remoteSource{conn: conn, dial: dial}
+				if old := setRemote(server); old != nil {
+					go old.close()
+				}
 
-			// Connect to the server
-			var err error
-			c, err = ftp.Dial(server, ftp.DialWithTimeout(5*time.Second))
-			if err != nil {
-				statusLabel.SetText(fmt.Sprintf("Connection failed: %s", err))
-				return
-			}
+				// Display success message
+				statusLabel.SetText("Connected")
 
-			err = c.Login(username, password)
-			if err != nil {
-				statusLabel.SetText(fmt.Sprintf("Authorisation failed: %s", err))
-				return
-			}
+				// Show the server files and start the transfers on a connection of their own
+				remotePane.setSource(server, "/")
+				queue.connect(dial)
 
-			// Display success message
-			statusLabel.SetText("Connected")
-
-			// Print all server files
-			resp := getAllFiles(c)
-			outputLabel.SetText(resp)
-
-			// Enable the action buttons
-			getFilesButton.Enable()
-			createDirButton.Enable()
-			uploadButton.Enable()
-			downloadButton.Enable()
-			createFileButton.Enable()
-			readFileButton.Enable()
-			updateFileButton.Enable()
-			deleteFileButton.Enable()
-			fileContent.Enable()
+				// Enable the action buttons
+				for _, button := range []*widget.Button{uploadButton, downloadButton, deleteRemoteButton,
+					newRemoteFolderButton, refreshRemoteButton, openButton, saveButton, saveAsButton} {
+					button.Enable()
+				}
+				fileContent.Enable()
+			})
 		},
 		SubmitText: "Connect",
 	}
 
-	container := fyne.NewContainerWithLayout(layout.NewGridLayout(1),
-		form,
-	)
+	saveProfileButton := widget.NewButton("Save Profile", func() {
+		connection.showSave(status)
+	})
 
-	// Create a container to hold the action buttons
-	buttonContainer := fyne.NewContainerWithLayout(layout.NewHBoxLayout(),
-		getFilesButton, createDirButton, uploadButton, downloadButton, createFileButton, readFileButton, updateFileButton, deleteFileButton,
+	top := fyne.NewContainerWithLayout(layout.NewVBoxLayout(),
+		form, saveProfileButton,
 	)
 
-	// Create a container to hold the status label
-	statusContainer := fyne.NewContainerWithLayout(layout.NewVBoxLayout(),
-		widget.NewLabel("Connection Status:"),
-		statusLabel,
+	// Create the two panes with the buttons above them
+	localButtons := fyne.NewContainerWithLayout(layout.NewHBoxLayout(),
+		widget.NewLabel("Local"), localFolderButton, newLocalFolderButton, deleteLocalButton,
+		widget.NewButton("Refresh", localPane.reloadAll), uploadButton,
+	)
+	remoteButtons := fyne.NewContainerWithLayout(layout.NewHBoxLayout(),
+		widget.NewLabel("Server"), downloadButton, newRemoteFolderButton, deleteRemoteButton,
+		refreshRemoteButton, openButton,
+	)
+	panes := container.NewHSplit(
+		fyne.NewContainerWithLayout(layout.NewBorderLayout(localButtons, nil, nil, nil), localButtons, localPane.view()),
+		fyne.NewContainerWithLayout(layout.NewBorderLayout(remoteButtons, nil, nil, nil), remoteButtons, remotePane.view()),
 	)
 
-	outputContainer := fyne.NewContainerWithLayout(layout.NewGridLayout(2),
-		widget.NewLabel("Directory Output:"), widget.NewLabel("Server Messages:"),
-		outputLabel, serverStatusLabel,
+	// Create a container to hold the status labels
+	statusContainer := fyne.NewContainerWithLayout(layout.NewGridLayout(2),
+		widget.NewLabel("Connection Status:"), widget.NewLabel("Server Messages:"),
+		statusLabel, serverStatusLabel,
 	)
 
-	fileContainer := fyne.NewContainerWithLayout(layout.NewVBoxLayout(),
-		widget.NewLabel("File Content:"),
-		fileContent,
+	editorButtons := fyne.NewContainerWithLayout(layout.NewHBoxLayout(), openedLabel, saveButton, saveAsButton)
+	fileContainer := fyne.NewContainerWithLayout(layout.NewBorderLayout(editorButtons, nil, nil, nil),
+		editorButtons, fileContent,
 	)
 
+	bottom := container.NewHSplit(queue.view(), fileContainer)
+
 	// Create a container to hold all the widgets
-	content := fyne.NewContainerWithLayout(layout.NewVBoxLayout(),
-		container, buttonContainer, statusContainer, outputContainer, fileContainer,
+	content := fyne.NewContainerWithLayout(layout.NewBorderLayout(top, statusContainer, nil, nil),
+		top, statusContainer, container.NewVSplit(panes, bottom),
 	)
 
 	// Set the window content
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"example.com/ftpClient/profile"
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	"github.com/jlaffaye/ftp"
+)
+
+// connectionForm is the part of the window that picks the server: a saved profile or
+// the server, the login, the password and the FTPS settings typed in
+type connectionForm struct {
+	window     fyne.Window
+	configPath string
+	config     *profile.Config
+
+	profiles    *widget.Select
+	server      *widget.Entry
+	user        *widget.Entry
+	password    *widget.Entry
+	tls         *widget.Check
+	fingerprint *widget.Entry
+}
+
+func newConnectionForm(window fyne.Window) *connectionForm {
+	f := &connectionForm{
+		window:      window,
+		config:      &profile.Config{},
+		server:      widget.NewEntry(),
+		user:        widget.NewEntry(),
+		password:    widget.NewPasswordEntry(),
+		tls:         widget.NewCheck("Explicit FTPS (AUTH TLS)", nil),
+		fingerprint: widget.NewEntry(),
+	}
+	f.server.SetPlaceHolder("localhost:2121")
+	f.password.SetPlaceHolder("From the profile if empty")
+	f.fingerprint.SetPlaceHolder("sha256:... to trust a self-signed certificate")
+	f.profiles = widget.NewSelect(nil, f.fill)
+	f.profiles.PlaceHolder = "No profile"
+
+	path, err := profile.DefaultPath()
+	if err == nil {
+		f.configPath = path
+		f.config, err = profile.Load(path)
+	}
+	if err != nil {
+		f.config = &profile.Config{}
+		dialog.ShowError(fmt.Errorf("profiles are not loaded: %w", err), window)
+	}
+	f.profiles.Options = f.config.Names()
+	return f
+}
+
+func (f *connectionForm) items() []*widget.FormItem {
+	return []*widget.FormItem{
+		{Text: "Profile", Widget: f.profiles},
+		{Text: "Server", Widget: f.server},
+		{Text: "Username", Widget: f.user},
+		{Text: "Password", Widget: f.password},
+		{Text: "TLS", Widget: f.tls},
+		{Text: "Fingerprint", Widget: f.fingerprint},
+	}
+}
+
+// fill shows the chosen profile, the password is taken from it on connect
+func (f *connectionForm) fill(name string) {
+	p, ok := f.config.Get(name)
+	if !ok {
+		return
+	}
+	f.server.SetText(p.Addr)
+	f.user.SetText(p.User)
+	f.password.SetText("")
+	f.tls.SetChecked(p.TLS)
+	f.fingerprint.SetText(p.Fingerprint)
+}
+
+// current is the chosen profile with what is typed over it
+func (f *connectionForm) current() profile.Profile {
+	p, _ := f.config.Get(f.profiles.Selected)
+	p.Addr = f.server.Text
+	p.User = f.user.Text
+	p.TLS = f.tls.Checked
+	p.Fingerprint = f.fingerprint.Text
+	return p
+}
+
+// connect dials the server and calls done with the connection and the way to open more of
+// them, or the error to show. A certificate that is not trusted may be pinned, then the
+// connection is tried again. The dial runs in its own goroutine, done may be called from it
+func (f *connectionForm) connect(done func(c *ftp.ServerConn, dial func() (*ftp.ServerConn, error), err error)) {
+	p := f.current()
+	f.loginPassword(p, func(password string, err error) {
+		if err != nil {
+			done(nil, nil, err)
+			return
+		}
+		dial := func() (*ftp.ServerConn, error) { return p.Dial(password, 5*time.Second) }
+		go func() {
+			c, err := dial()
+			var untrusted *profile.UntrustedError
+			if errors.As(err, &untrusted) {
+				f.askTrust(untrusted, done)
+				return
+			}
+			done(c, dial, err)
+		}()
+	})
+}
+
+func (f *connectionForm) askTrust(untrusted *profile.UntrustedError, done func(c *ftp.ServerConn, dial func() (*ftp.ServerConn, error), err error)) {
+	message := fmt.Sprintf("The server certificate is not trusted:\n%v\n\nIts fingerprint is\n%s\n\nTrust this server and pin the certificate?",
+		untrusted.Err, untrusted.Fingerprint)
+	dialog.ShowConfirm("Untrusted certificate", message, func(trust bool) {
+		if !trust {
+			done(nil, nil, untrusted)
+			return
+		}
+		f.fingerprint.SetText(untrusted.Fingerprint)
+		f.connect(done)
+	}, f.window)
+}
+
+// loginPassword is the typed password, or the one of the profile from its environment
+// variable or the keyring
+func (f *connectionForm) loginPassword(p profile.Profile, done func(password string, err error)) {
+	if f.password.Text != "" {
+		done(f.password.Text, nil)
+		return
+	}
+	password, err := p.Password(nil)
+	if !errors.Is(err, profile.ErrNoPassword) || p.Name == "" || f.configPath == "" {
+		done(password, err)
+		return
+	}
+	if _, err := os.Stat(profile.KeyringPath(f.configPath)); err != nil {
+		done("", errors.New("no password, type it or save it in the profile"))
+		return
+	}
+	f.openKeyring(func(keyring *profile.Keyring, err error) {
+		if err != nil {
+			done("", err)
+			return
+		}
+		done(p.Password(func() (*profile.Keyring, error) { return keyring, nil }))
+	})
+}
+
+// openKeyring asks the passphrase unless it is in the environment
+func (f *connectionForm) openKeyring(done func(keyring *profile.Keyring, err error)) {
+	path := profile.KeyringPath(f.configPath)
+	if passphrase, ok := os.LookupEnv(profile.PassphraseEnv); ok {
+		done(profile.OpenKeyring(path, passphrase))
+		return
+	}
+	passphrase := widget.NewPasswordEntry()
+	items := []*widget.FormItem{{Text: "Passphrase", Widget: passphrase}}
+	form := dialog.NewForm("Keyring", "Open", "Cancel", items, func(ok bool) {
+		if !ok {
+			done(nil, errors.New("the keyring is not opened"))
+			return
+		}
+		done(profile.OpenKeyring(path, passphrase.Text))
+	}, f.window)
+	form.Resize(fyne.NewSize(400, 150))
+	form.Show()
+}
+
+// showSave saves the typed settings as a profile. The typed password is put
+// in the keyring if asked
+func (f *connectionForm) showSave(status func(message string)) {
+	if f.configPath == "" {
+		status("Profiles cannot be saved: no config directory")
+		return
+	}
+	name := widget.NewEntry()
+	name.SetText(f.profiles.Selected)
+	passwordEnv := widget.NewEntry()
+	passwordEnv.SetPlaceHolder("Environment variable with the password")
+	if p, ok := f.config.Get(f.profiles.Selected); ok {
+		passwordEnv.SetText(p.PasswordEnv)
+	}
+	remember := widget.NewCheck("Remember the typed password in the keyring", nil)
+	items := []*widget.FormItem{
+		{Text: "Name", Widget: name},
+		{Text: "Password from", Widget: passwordEnv},
+		{Text: "", Widget: remember},
+	}
+
+	form := dialog.NewForm("Save profile", "Save", "Cancel", items, func(ok bool) {
+		if !ok || name.Text == "" {
+			return
+		}
+		p := f.current()
+		p.Name = name.Text
+		p.PasswordEnv = passwordEnv.Text
+		// Choosing the saved profile below clears the password entry
+		password := f.password.Text
+		f.config.Set(p)
+		if err := f.config.Save(f.configPath); err != nil {
+			status(fmt.Sprintf("Saving the profile failed: %s", err))
+			return
+		}
+		f.profiles.Options = f.config.Names()
+		f.profiles.SetSelected(p.Name)
+		status(fmt.Sprintf("Profile %s saved", p.Name))
+
+		if !remember.Checked || password == "" {
+			return
+		}
+		f.openKeyring(func(keyring *profile.Keyring, err error) {
+			if err == nil {
+				keyring.Set(p.Name, password)
+				err = keyring.Save()
+			}
+			if err != nil {
+				status(fmt.Sprintf("Saving the password failed: %s", err))
+				return
+			}
+			status(fmt.Sprintf("Password of %s saved in the keyring", p.Name))
+		})
+	}, f.window)
+	form.Resize(fyne.NewSize(500, 250))
+	form.Show()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"example.com/ftpClient/transfer"
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+	"github.com/jlaffaye/ftp"
+)
+
+// queueView shows the transfer queue with the progress and the error of every job
+type queueView struct {
+	list *widget.List
+	// finished is called when a job is over, to show what it has changed
+	finished func(job transfer.Job)
+
+	mu       sync.Mutex
+	queue    *transfer.Queue
+	jobs     []transfer.Job
+	selected int
+}
+
+func newQueueView(finished func(job transfer.Job)) *queueView {
+	v := &queueView{finished: finished}
+	v.list = widget.NewList(
+		func() int {
+			v.mu.Lock()
+			defer v.mu.Unlock()
+			return len(v.jobs)
+		},
+		func() fyne.CanvasObject {
+			return container.NewGridWithColumns(2, widget.NewLabel(""), widget.NewProgressBar())
+		},
+		func(id widget.ListItemID, item fyne.CanvasObject) {
+			v.mu.Lock()
+			if id >= len(v.jobs) {
+				v.mu.Unlock()
+				return
+			}
+			job := v.jobs[id]
+			v.mu.Unlock()
+			objects := item.(*fyne.Container).Objects
+			objects[0].(*widget.Label).SetText(describe(job))
+			objects[1].(*widget.ProgressBar).SetValue(fraction(job))
+		},
+	)
+	v.list.OnSelected = func(id widget.ListItemID) {
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		if id < len(v.jobs) {
+			v.selected = v.jobs[id].ID
+		}
+	}
+	return v
+}
+
+func describe(job transfer.Job) string {
+	var what string
+	switch job.Kind {
+	case transfer.DownloadJob:
+		what = fmt.Sprintf("%s -> %s", job.Remote, job.Local)
+	case transfer.UploadJob:
+		what = fmt.Sprintf("%s -> %s", job.Local, job.Remote)
+	case transfer.DeleteRemoteJob:
+		what = job.Remote
+	case transfer.DeleteLocalJob:
+		what = job.Local
+	}
+	if job.Err != nil {
+		return fmt.Sprintf("%s %s: %s", job.Kind, what, job.Err)
+	}
+	return fmt.Sprintf("%s %s: %s", job.Kind, what, job.State)
+}
+
+func fraction(job transfer.Job) float64 {
+	switch {
+	case job.State == transfer.Done:
+		return 1
+	case job.Total > 0:
+		return float64(job.Done) / float64(job.Total)
+	}
+	return 0
+}
+
+// connect starts a queue on its own connection, the jobs of the old one are stopped
+func (v *queueView) connect(dial func() (*ftp.ServerConn, error)) {
+	var q *transfer.Queue
+	q = transfer.NewQueue(dial, func(job transfer.Job) {
+		v.changed(q, job)
+	})
+
+	v.mu.Lock()
+	old := v.queue
+	v.queue = q
+	v.jobs = nil
+	v.mu.Unlock()
+	v.list.UnselectAll()
+	v.list.Refresh()
+	if old != nil {
+		go old.Close()
+	}
+}
+
+func (v *queueView) changed(q *transfer.Queue, job transfer.Job) {
+	jobs := q.Jobs()
+	v.mu.Lock()
+	if v.queue != q {
+		v.mu.Unlock()
+		return
+	}
+	v.jobs = jobs
+	v.mu.Unlock()
+	v.list.Refresh()
+	if job.State == transfer.Done && v.finished != nil {
+		v.finished(job)
+	}
+}
+
+func (v *queueView) add(job transfer.Job) {
+	v.mu.Lock()
+	q := v.queue
+	v.mu.Unlock()
+	if q != nil {
+		q.Add(job)
+	}
+}
+
+// do calls fn with the queue, if there is one, and shows the jobs after it
+func (v *queueView) do(fn func(q *transfer.Queue)) {
+	v.mu.Lock()
+	q := v.queue
+	v.mu.Unlock()
+	if q == nil {
+		return
+	}
+	fn(q)
+	jobs := q.Jobs()
+	v.mu.Lock()
+	v.jobs = jobs
+	v.mu.Unlock()
+	v.list.UnselectAll()
+	v.list.Refresh()
+}
+
+func (v *queueView) cancelSelected() {
+	v.mu.Lock()
+	id := v.selected
+	v.mu.Unlock()
+	v.do(func(q *transfer.Queue) { q.Cancel(id) })
+}
+
+func (v *queueView) retryFailed() {
+	v.do(func(q *transfer.Queue) {
+		for _, job := range q.Jobs() {
+			if job.State == transfer.Failed {
+				q.Retry(job.ID)
+			}
+		}
+	})
+}
+
+func (v *queueView) clearFinished() {
+	v.do(func(q *transfer.Queue) { q.ClearFinished() })
+}
+
+func (v *queueView) view() fyne.CanvasObject {
+	buttons := container.NewHBox(
+		widget.NewButton("Cancel", v.cancelSelected),
+		widget.NewButton("Retry Failed", v.retryFailed),
+		widget.NewButton("Clear Finished", v.clearFinished),
+	)
+	return container.NewBorder(widget.NewLabel("Transfers:"), buttons, nil, nil, v.list)
+}
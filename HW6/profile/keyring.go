@@ -0,0 +1,135 @@
+package profile
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// PassphraseEnv is the environment variable the clients take the keyring passphrase from
+// instead of asking it
+const PassphraseEnv = "FTP_KEYRING_PASSPHRASE"
+
+// ErrWrongPassphrase is returned by OpenKeyring when the keyring cannot be decrypted
+var ErrWrongPassphrase = errors.New("profile: wrong keyring passphrase")
+
+// keyringFile is the keyring on disk. Data is the JSON of the passwords sealed with
+// AES-256-GCM, the key is derived from the passphrase with scrypt
+type keyringFile struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+const (
+	keyringVersion = 1
+	saltSize       = 16
+	// scrypt parameters recommended for interactive logins
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// Keyring is a file of passwords by profile name, encrypted with a passphrase
+type Keyring struct {
+	path       string
+	passphrase string
+	passwords  map[string]string
+}
+
+// OpenKeyring decrypts the keyring file, a missing one is empty
+func OpenKeyring(path, passphrase string) (*Keyring, error) {
+	k := &Keyring{path: path, passphrase: passphrase, passwords: map[string]string{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file keyringFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if file.Version != keyringVersion {
+		return nil, fmt.Errorf("%s: unknown keyring version %d", path, file.Version)
+	}
+	aead, err := newAEAD(passphrase, file.Salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(file.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("%s: bad nonce", path)
+	}
+	plain, err := aead.Open(nil, file.Nonce, file.Data, nil)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	if err := json.Unmarshal(plain, &k.passwords); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return k, nil
+}
+
+func newAEAD(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Get returns the password of the profile
+func (k *Keyring) Get(name string) (string, bool) {
+	password, ok := k.passwords[name]
+	return password, ok
+}
+
+// Set changes the password of the profile, Save writes it
+func (k *Keyring) Set(name, password string) {
+	k.passwords[name] = password
+}
+
+// Delete forgets the password of the profile, Save writes it
+func (k *Keyring) Delete(name string) {
+	delete(k.passwords, name)
+}
+
+// Save encrypts the keyring with a new salt and nonce and writes the file
+func (k *Keyring) Save() error {
+	plain, err := json.Marshal(k.passwords)
+	if err != nil {
+		return err
+	}
+	file := keyringFile{Version: keyringVersion, Salt: make([]byte, saltSize)}
+	if _, err := rand.Read(file.Salt); err != nil {
+		return err
+	}
+	aead, err := newAEAD(k.passphrase, file.Salt)
+	if err != nil {
+		return err
+	}
+	file.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(file.Nonce); err != nil {
+		return err
+	}
+	file.Data = aead.Seal(nil, file.Nonce, plain, nil)
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(k.path, append(data, '\n'))
+}
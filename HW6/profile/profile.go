@@ -0,0 +1,175 @@
+// Package profile keeps the FTP connection profiles of the clients: the server, the login,
+// explicit FTPS (AUTH TLS) with a pinned certificate, and where the password comes from,
+// an environment variable or an encrypted keyring file
+package profile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// ErrNoPassword is returned by Password when neither source has the password
+var ErrNoPassword = errors.New("profile: no password")
+
+// Profile is a saved connection. The password is never stored in it
+type Profile struct {
+	Name string `json:"name"`
+	// Addr is host or host:port, the port is 21 by default
+	Addr string `json:"addr"`
+	User string `json:"user"`
+	// TLS turns on explicit FTPS, the connection is upgraded with AUTH TLS
+	TLS bool `json:"tls,omitempty"`
+	// Fingerprint pins the certificate of the server, see Fingerprint.
+	// A pinned certificate is trusted even if it is self-signed
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// PasswordEnv is the environment variable with the password
+	PasswordEnv string `json:"passwordEnv,omitempty"`
+}
+
+// Config is the file with the profiles
+type Config struct {
+	Profiles []Profile `json:"profiles"`
+}
+
+// DefaultPath is profiles.json in the user config directory
+func DefaultPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "ftpClient", "profiles.json"), nil
+}
+
+// KeyringPath is the keyring file next to the config file
+func KeyringPath(configPath string) string {
+	return filepath.Join(filepath.Dir(configPath), "keyring")
+}
+
+// Load reads the config file, a missing one is empty
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &config, nil
+}
+
+// Save writes the config file, readable by the user only
+func (c *Config) Save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(path, append(data, '\n'))
+}
+
+// writeFile replaces the file at once, so it is never left half written
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Get finds the profile by its name
+func (c *Config) Get(name string) (Profile, bool) {
+	for _, p := range c.Profiles {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Profile{}, false
+}
+
+// Set adds the profile or replaces the one with the same name
+func (c *Config) Set(p Profile) {
+	for i := range c.Profiles {
+		if c.Profiles[i].Name == p.Name {
+			c.Profiles[i] = p
+			return
+		}
+	}
+	c.Profiles = append(c.Profiles, p)
+}
+
+// Names are the names of the profiles in the file order
+func (c *Config) Names() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for _, p := range c.Profiles {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// Address adds the default FTP port to the host if it has no port
+func Address(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), "21")
+}
+
+// Password takes the password from the environment variable of the profile, then from
+// the keyring by the profile name. openKeyring is only called when it is needed, since
+// it may ask for the passphrase
+func (p Profile) Password(openKeyring func() (*Keyring, error)) (string, error) {
+	if p.PasswordEnv != "" {
+		if password, ok := os.LookupEnv(p.PasswordEnv); ok {
+			return password, nil
+		}
+	}
+	if openKeyring == nil || p.Name == "" {
+		return "", ErrNoPassword
+	}
+	keyring, err := openKeyring()
+	if err != nil {
+		return "", err
+	}
+	if password, ok := keyring.Get(p.Name); ok {
+		return password, nil
+	}
+	return "", ErrNoPassword
+}
+
+// Dial connects to the server of the profile and logs in
+func (p Profile) Dial(password string, timeout time.Duration) (*ftp.ServerConn, error) {
+	addr := Address(p.Addr)
+	options := []ftp.DialOption{ftp.DialWithTimeout(timeout)}
+	if p.TLS {
+		host, _, _ := net.SplitHostPort(addr)
+		config, err := TLSConfig(host, p.Fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, ftp.DialWithExplicitTLS(config))
+	}
+
+	c, err := ftp.Dial(addr, options...)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Login(p.User, password); err != nil {
+		c.Quit()
+		return nil, err
+	}
+	return c, nil
+}
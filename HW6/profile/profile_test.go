@@ -0,0 +1,234 @@
+package profile
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/ftpClient/ftpserver"
+)
+
+var addressCases = []struct {
+	addr, want string
+}{
+	{"192.168.0.105", "192.168.0.105:21"},
+	{"localhost:2121", "localhost:2121"},
+	{"::1", "[::1]:21"},
+	{"[::1]", "[::1]:21"},
+	{"[::1]:2121", "[::1]:2121"},
+}
+
+func TestAddress(t *testing.T) {
+	for _, tt := range addressCases {
+		if got := Address(tt.addr); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ftpClient", "profiles.json")
+	config, err := Load(path)
+	if err != nil || len(config.Profiles) != 0 {
+		t.Fatalf("missing file: got %+v, %v", config, err)
+	}
+
+	config.Set(Profile{Name: "home", Addr: "192.168.0.105", User: "San"})
+	config.Set(Profile{Name: "local", Addr: "localhost:2121", User: "San"})
+	config.Set(Profile{Name: "home", Addr: "192.168.0.105", User: "San", TLS: true, PasswordEnv: "HOME_PASSWORD"})
+	if err := config.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, config) {
+		t.Errorf("got %+v, want %+v", loaded, config)
+	}
+	if got := loaded.Names(); !reflect.DeepEqual(got, []string{"home", "local"}) {
+		t.Errorf("names: got %q", got)
+	}
+	if p, ok := loaded.Get("home"); !ok || !p.TLS {
+		t.Errorf("home: got %+v, %v", p, ok)
+	}
+	if _, ok := loaded.Get("work"); ok {
+		t.Error("got a missing profile")
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring")
+	k, err := OpenKeyring(path, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.Set("home", "123")
+	k.Set("work", "456")
+	k.Delete("work")
+	if err := k.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	k, err = OpenKeyring(path, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password, ok := k.Get("home"); !ok || password != "123" {
+		t.Errorf("home: got %q, %v", password, ok)
+	}
+	if _, ok := k.Get("work"); ok {
+		t.Error("work is not deleted")
+	}
+	if _, err := OpenKeyring(path, "wrong"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("wrong passphrase: got %v", err)
+	}
+}
+
+func TestPassword(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring")
+	k, _ := OpenKeyring(path, "passphrase")
+	k.Set("home", "from keyring")
+	opened := 0
+	open := func() (*Keyring, error) {
+		opened++
+		return k, nil
+	}
+
+	t.Setenv("HOME_PASSWORD", "from env")
+	p := Profile{Name: "home", PasswordEnv: "HOME_PASSWORD"}
+	if got, err := p.Password(open); got != "from env" || err != nil || opened != 0 {
+		t.Errorf("env: got %q, %v, the keyring is opened %d times", got, err, opened)
+	}
+	p.PasswordEnv = "MISSING_PASSWORD"
+	if got, err := p.Password(open); got != "from keyring" || err != nil {
+		t.Errorf("keyring: got %q, %v", got, err)
+	}
+	p.Name = "work"
+	if _, err := p.Password(open); !errors.Is(err, ErrNoPassword) {
+		t.Errorf("no password: got %v", err)
+	}
+}
+
+var fingerprintCases = []struct {
+	fingerprint string
+	valid       bool
+}{
+	{"sha256:" + strings.Repeat("ab", 32), true},
+	{strings.Repeat("AB", 32), true},
+	{strings.TrimSuffix(strings.Repeat("ab:", 32), ":"), true},
+	{"sha256:abcd", false},
+	{"sha256:" + strings.Repeat("zz", 32), false},
+}
+
+func TestParseFingerprint(t *testing.T) {
+	for _, tt := range fingerprintCases {
+		if _, err := parseFingerprint(tt.fingerprint); (err == nil) != tt.valid {
+			t.Errorf("%s: got %v", tt.fingerprint, err)
+		}
+	}
+}
+
+func newCertificate(t *testing.T) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, Fingerprint(cert)
+}
+
+// startServer serves a temporary root over FTPS until the end of the test
+func startServer(t *testing.T, cert tls.Certificate) string {
+	t.Helper()
+	s := &ftpserver.Server{
+		Root:      t.TempDir(),
+		Users:     map[string]string{"San": "123"},
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+	return ln.Addr().String()
+}
+
+func TestDialTLS(t *testing.T) {
+	cert, fingerprint := newCertificate(t)
+	addr := startServer(t, cert)
+
+	if got, err := ServerFingerprint(addr, 5*time.Second); got != fingerprint || err != nil {
+		t.Errorf("ServerFingerprint: got %s, %v, want %s", got, err, fingerprint)
+	}
+
+	// A self-signed certificate is only trusted when it is pinned
+	p := Profile{Addr: addr, User: "San", TLS: true}
+	var untrusted *UntrustedError
+	if _, err := p.Dial("123", 5*time.Second); !errors.As(err, &untrusted) || untrusted.Fingerprint != fingerprint {
+		t.Errorf("not pinned: got %v", err)
+	}
+	_, other := newCertificate(t)
+	p.Fingerprint = other
+	if _, err := p.Dial("123", 5*time.Second); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("other pin: got %v", err)
+	}
+	// The server does not let the login go in the clear
+	if _, err := (Profile{Addr: addr, User: "San"}).Dial("123", 5*time.Second); err == nil {
+		t.Error("logged in without TLS")
+	}
+
+	p.Fingerprint = strings.ToUpper(strings.TrimPrefix(fingerprint, "sha256:"))
+	c, err := p.Dial("123", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Quit()
+	// The data connections are protected too
+	if err := c.Stor("a.txt", bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.Retr("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if string(got) != "hello" || err != nil {
+		t.Errorf("Retr: got %q, %v", got, err)
+	}
+	if _, err := p.Dial("1234", 5*time.Second); err == nil {
+		t.Error("logged in with a wrong password")
+	}
+}
@@ -0,0 +1,120 @@
+package profile
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Fingerprint is "sha256:" and the hex SHA-256 of the DER certificate
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// parseFingerprint accepts the hex with or without the "sha256:" prefix and the colons
+// that openssl puts between the bytes
+func parseFingerprint(fingerprint string) ([]byte, error) {
+	value := strings.TrimPrefix(strings.ToLower(fingerprint), "sha256:")
+	sum, err := hex.DecodeString(strings.ReplaceAll(value, ":", ""))
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("profile: %q is not a SHA-256 fingerprint", fingerprint)
+	}
+	return sum, nil
+}
+
+// UntrustedError is returned by the handshake when the certificate cannot be verified
+// and is not pinned. Fingerprint is what to pin to trust it
+type UntrustedError struct {
+	Fingerprint string
+	Err         error
+}
+
+func (e *UntrustedError) Error() string {
+	return fmt.Sprintf("%v (the certificate fingerprint is %s, pin it if you trust the server)", e.Err, e.Fingerprint)
+}
+
+func (e *UntrustedError) Unwrap() error { return e.Err }
+
+// TLSConfig is the client config for the server host. Without a fingerprint the certificate
+// is verified with the system roots. With one only the pinned certificate is accepted,
+// self-signed or not. The data connections resume the TLS session of the control one,
+// some servers require it
+func TLSConfig(host, fingerprint string) (*tls.Config, error) {
+	var pin []byte
+	if fingerprint != "" {
+		var err error
+		if pin, err = parseFingerprint(fingerprint); err != nil {
+			return nil, err
+		}
+	}
+
+	verify := func(cs tls.ConnectionState) error {
+		leaf := cs.PeerCertificates[0]
+		if pin != nil {
+			sum := sha256.Sum256(leaf.Raw)
+			if subtle.ConstantTimeCompare(sum[:], pin) != 1 {
+				return fmt.Errorf("profile: certificate fingerprint %s does not match the pinned one", Fingerprint(leaf))
+			}
+			return nil
+		}
+		options := x509.VerifyOptions{DNSName: host, Intermediates: x509.NewCertPool()}
+		for _, cert := range cs.PeerCertificates[1:] {
+			options.Intermediates.AddCert(cert)
+		}
+		if _, err := leaf.Verify(options); err != nil {
+			return &UntrustedError{Fingerprint: Fingerprint(leaf), Err: err}
+		}
+		return nil
+	}
+
+	return &tls.Config{
+		ServerName: host,
+		// The usual verification is replaced by verify, which knows about the pin
+		InsecureSkipVerify: true,
+		VerifyConnection:   verify,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}, nil
+}
+
+// ServerFingerprint connects with AUTH TLS and returns the fingerprint of the server
+// certificate without verifying it, so that the user can compare and pin it
+func ServerFingerprint(addr string, timeout time.Duration) (string, error) {
+	addr = Address(addr)
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	text := textproto.NewConn(conn)
+	if _, _, err := text.ReadResponse(220); err != nil {
+		return "", err
+	}
+	if err := text.PrintfLine("AUTH TLS"); err != nil {
+		return "", err
+	}
+	if _, _, err := text.ReadResponse(234); err != nil {
+		return "", err
+	}
+
+	host, _, _ := net.SplitHostPort(addr)
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		return "", err
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", errors.New("profile: the server sent no certificate")
+	}
+	return Fingerprint(certs[0]), nil
+}
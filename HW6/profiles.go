@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"example.com/ftpClient/profile"
+	"golang.org/x/term"
+)
+
+// passwordEnv has the password when neither -pwrd nor the profile gives one
+const passwordEnv = "FTP_PASSWORD"
+
+// stdin is shared, so that the passphrase and the password can be piped one line after another
+var stdin = bufio.NewReader(os.Stdin)
+
+func configFile() (string, error) {
+	if *configPath != "" {
+		return *configPath, nil
+	}
+	return profile.DefaultPath()
+}
+
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// connectionProfile is the profile named by -profile with the flags given explicitly over it,
+// or the flags alone without -profile
+func connectionProfile() (profile.Profile, error) {
+	p := profile.Profile{Addr: *addr, User: *user, TLS: *useTLS, Fingerprint: *pin}
+	if *profileName == "" {
+		return p, nil
+	}
+
+	path, err := configFile()
+	if err != nil {
+		return p, err
+	}
+	config, err := profile.Load(path)
+	if err != nil {
+		return p, err
+	}
+	saved, ok := config.Get(*profileName)
+	if !ok {
+		return p, fmt.Errorf("no profile %q in %s", *profileName, path)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			saved.Addr = p.Addr
+		case "user":
+			saved.User = p.User
+		case "tls":
+			saved.TLS = p.TLS
+		case "pin":
+			saved.Fingerprint = p.Fingerprint
+		}
+	})
+	return saved, nil
+}
+
+// loginPassword is -pwrd, the password of the profile, FTP_PASSWORD or the one typed on the terminal
+func loginPassword(p profile.Profile) (string, error) {
+	if isFlagSet("pwrd") {
+		return *pwrd, nil
+	}
+	password, err := p.Password(func() (*profile.Keyring, error) { return openKeyring(false) })
+	if !errors.Is(err, profile.ErrNoPassword) {
+		return password, err
+	}
+	if password, ok := os.LookupEnv(passwordEnv); ok {
+		return password, nil
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", fmt.Errorf("no password, use %s, -pwrd or a profile", passwordEnv)
+	}
+	return readPassword(fmt.Sprintf("Password of %s at %s: ", p.User, p.Addr))
+}
+
+// openKeyring opens the keyring next to the config file. A missing keyring has no passwords,
+// it is only created if create is set
+func openKeyring(create bool) (*profile.Keyring, error) {
+	path, err := configFile()
+	if err != nil {
+		return nil, err
+	}
+	path = profile.KeyringPath(path)
+	if _, err := os.Stat(path); err != nil && !create {
+		return nil, profile.ErrNoPassword
+	}
+
+	passphrase, ok := os.LookupEnv(profile.PassphraseEnv)
+	if !ok {
+		if passphrase, err = readPassword("Keyring passphrase: "); err != nil {
+			return nil, err
+		}
+	}
+	return profile.OpenKeyring(path, passphrase)
+}
+
+// readPassword reads a line without echo from the terminal, or just a line if the input
+// is not a terminal
+func readPassword(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := stdin.ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return string(password), err
+}
+
+// runProfileCommand runs save-profile, set-password and fingerprint, the other
+// commands are not handled
+func runProfileCommand(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	switch args[0] {
+	case "save-profile":
+		return true, saveProfile(args[1:])
+	case "set-password":
+		return true, setPassword(args[1:])
+	case "fingerprint":
+		p, err := connectionProfile()
+		if err != nil {
+			return true, err
+		}
+		fingerprint, err := profile.ServerFingerprint(p.Addr, 5*time.Second)
+		if err == nil {
+			fmt.Println(fingerprint)
+		}
+		return true, err
+	}
+	return false, nil
+}
+
+// saveProfile saves the connection flags as a profile, never the password
+func saveProfile(args []string) error {
+	set := flag.NewFlagSet("save-profile", flag.ContinueOnError)
+	env := set.String("password-env", "", "Environment variable with the password")
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+	if set.NArg() != 1 {
+		return errors.New("save-profile needs the profile name")
+	}
+
+	p, err := connectionProfile()
+	if err != nil {
+		return err
+	}
+	p.Name = set.Arg(0)
+	if *env != "" {
+		p.PasswordEnv = *env
+	}
+	path, err := configFile()
+	if err != nil {
+		return err
+	}
+	config, err := profile.Load(path)
+	if err != nil {
+		return err
+	}
+	config.Set(p)
+	if err := config.Save(path); err != nil {
+		return err
+	}
+	fmt.Printf("Profile %s saved to %s\n", p.Name, path)
+	return nil
+}
+
+// setPassword stores the password of a saved profile in the keyring
+func setPassword(args []string) error {
+	if len(args) != 1 {
+		return errors.New("set-password needs the profile name")
+	}
+	name := args[0]
+	path, err := configFile()
+	if err != nil {
+		return err
+	}
+	config, err := profile.Load(path)
+	if err != nil {
+		return err
+	}
+	if _, ok := config.Get(name); !ok {
+		return fmt.Errorf("no profile %q in %s", name, path)
+	}
+
+	keyring, err := openKeyring(true)
+	if err != nil {
+		return err
+	}
+	password, err := readPassword(fmt.Sprintf("Password of %s: ", name))
+	if err != nil {
+		return err
+	}
+	keyring.Set(name, password)
+	if err := keyring.Save(); err != nil {
+		return err
+	}
+	fmt.Printf("Password of %s saved to %s\n", name, profile.KeyringPath(path))
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"example.com/ftpClient/ftpserver"
+)
+
+var addr = flag.String("addr", "localhost:2121", "Address to listen on")
+var root = flag.String("root", ".", "Directory the clients see as /")
+var users = flag.String("users", "San:123", "Comma separated login:password pairs, any login is accepted if empty")
+var readOnly = flag.Bool("readonly", false, "Refuse all the commands that change files")
+var useTLS = flag.Bool("tls", false, "Enable AUTH TLS with a new self-signed certificate, unless -cert is given")
+var certFile = flag.String("cert", "", "PEM certificate for AUTH TLS")
+var keyFile = flag.String("key", "", "PEM private key for AUTH TLS")
+var insecureAuth = flag.Bool("insecure", false, "Allow the login without AUTH TLS when TLS is enabled")
+
+func main() {
+	flag.Parse()
+
+	if info, err := os.Stat(*root); err != nil || !info.IsDir() {
+		log.Fatalf("-root: %s is not a directory", *root)
+	}
+	server := &ftpserver.Server{
+		Root:              *root,
+		ReadOnly:          *readOnly,
+		AllowInsecureAuth: *insecureAuth,
+		Log:               log.New(os.Stderr, "", log.LstdFlags),
+	}
+	if *users != "" {
+		server.Users = map[string]string{}
+		for _, pair := range strings.Split(*users, ",") {
+			login, password, ok := strings.Cut(pair, ":")
+			if !ok {
+				log.Fatalf("-users: %q is not login:password", pair)
+			}
+			server.Users[login] = password
+		}
+	}
+	if *useTLS || *certFile != "" || *keyFile != "" {
+		cert, err := loadCertificate()
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		server.Close()
+	}()
+
+	fmt.Printf("Listening on %s, serving %s\n", *addr, *root)
+	if err := server.ListenAndServe(*addr); err != nil && !errors.Is(err, ftpserver.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
+
+// loadCertificate loads -cert and -key or makes a self-signed certificate for the host of -addr.
+// Its fingerprint is printed for the clients to pin
+func loadCertificate() (tls.Certificate, error) {
+	var cert tls.Certificate
+	var err error
+	if *certFile != "" || *keyFile != "" {
+		cert, err = tls.LoadX509KeyPair(*certFile, *keyFile)
+	} else {
+		host, _, _ := net.SplitHostPort(*addr)
+		cert, err = selfSigned(host)
+	}
+	if err != nil {
+		return cert, err
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	fmt.Printf("Certificate fingerprint: sha256:%s\n", hex.EncodeToString(sum[:]))
+	return cert, nil
+}
+
+func selfSigned(host string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else if host != "" {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
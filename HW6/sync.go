@@ -0,0 +1,302 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/textproto"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"example.com/ftpClient/transfer"
+	"github.com/jlaffaye/ftp"
+)
+
+// fileInfo is what the comparison needs to know about a file
+type fileInfo struct {
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+// tree holds the files under a directory by their paths relative to it, with "/" separators
+type tree map[string]fileInfo
+
+type actionKind int
+
+const (
+	mkdirAction actionKind = iota
+	copyAction
+	deleteAction
+	conflictAction
+)
+
+// action is one step that makes the destination like the source
+type action struct {
+	kind actionKind
+	path string
+	// info is of the source file for copyAction
+	info fileInfo
+}
+
+// changed tells whether the source file has to be copied over the destination one.
+// The destination gets the time of the source after a copy, or a later one if the server
+// cannot set times, so only a newer source counts
+func changed(src, dst fileInfo, tolerance time.Duration) bool {
+	return src.size != dst.size || src.modTime.Sub(dst.modTime) > tolerance
+}
+
+// plan compares the trees. Directories go before the files in them, and deletions go
+// after everything else, the deepest first
+func plan(src, dst tree, tolerance time.Duration, deleteExtra bool) []action {
+	var actions []action
+	for _, p := range sortedPaths(src) {
+		s := src[p]
+		d, exists := dst[p]
+		switch {
+		case exists && s.dir != d.dir:
+			actions = append(actions, action{kind: conflictAction, path: p})
+		case s.dir && !exists:
+			actions = append(actions, action{kind: mkdirAction, path: p})
+		case !s.dir && (!exists || changed(s, d, tolerance)):
+			actions = append(actions, action{kind: copyAction, path: p, info: s})
+		}
+	}
+	if deleteExtra {
+		paths := sortedPaths(dst)
+		for i := len(paths) - 1; i >= 0; i-- {
+			if _, exists := src[paths[i]]; !exists {
+				actions = append(actions, action{kind: deleteAction, path: paths[i]})
+			}
+		}
+	}
+	return actions
+}
+
+func sortedPaths(t tree) []string {
+	paths := make([]string, 0, len(t))
+	for p := range t {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// localTree walks the local directory, a missing one is empty
+func localTree(root string) (tree, error) {
+	t := tree{}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if p == root || (!d.IsDir() && (!d.Type().IsRegular() || strings.HasSuffix(p, transfer.PartSuffix))) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		t[filepath.ToSlash(rel)] = fileInfo{size: info.Size(), modTime: info.ModTime(), dir: d.IsDir()}
+		return nil
+	})
+	return t, err
+}
+
+// remoteTree walks the remote directory with walkDir. LIST gives times to a minute or worse,
+// so without MLSD the times are asked with MDTM. The tolerance of the time comparison is returned too
+func remoteTree(c *ftp.ServerConn, root string) (tree, time.Duration, error) {
+	entries, err := c.List(root)
+	if err != nil {
+		return nil, 0, err
+	}
+	precise := c.IsTimePreciseInList() || c.IsGetTimeSupported()
+	tolerance := time.Second
+	if !precise {
+		tolerance = time.Minute
+	}
+
+	t := tree{}
+	var walkErr error
+	for _, entry := range entries {
+		err := walkDir(c, entry, root, 0, func(entry *ftp.Entry, dir string, depth int) {
+			full := path.Join(dir, entry.Name)
+			rel := strings.TrimPrefix(strings.TrimPrefix(full, path.Clean(root)), "/")
+			switch {
+			case entry.Type == ftp.EntryTypeFolder:
+				t[rel] = fileInfo{dir: true}
+			case entry.Type == ftp.EntryTypeFile && !strings.HasSuffix(entry.Name, transfer.PartSuffix):
+				info := fileInfo{size: int64(entry.Size), modTime: entry.Time}
+				if !c.IsTimePreciseInList() && c.IsGetTimeSupported() {
+					if modTime, err := c.GetTime(full); err == nil {
+						info.modTime = modTime
+					}
+				}
+				t[rel] = info
+			}
+		})
+		if err != nil && walkErr == nil {
+			walkErr = err
+		}
+	}
+	return t, tolerance, walkErr
+}
+
+// syncCommand is the mirror or the sync subcommand
+type syncCommand struct {
+	name        string
+	from, to    string
+	deleteExtra bool
+	dryRun      bool
+}
+
+func parseSyncCommand(args []string) (*syncCommand, error) {
+	command := &syncCommand{name: args[0]}
+	if command.name != "mirror" && command.name != "sync" {
+		return nil, fmt.Errorf("unknown command %q", command.name)
+	}
+	set := flag.NewFlagSet(command.name, flag.ContinueOnError)
+	set.BoolVar(&command.deleteExtra, "delete", false, "Delete the files that are not in the source")
+	set.BoolVar(&command.dryRun, "dry-run", false, "Only print what would be done")
+	if err := set.Parse(args[1:]); err != nil {
+		return nil, err
+	}
+	if set.NArg() != 2 {
+		return nil, fmt.Errorf("%s needs the source and the destination directories", command.name)
+	}
+	command.from, command.to = set.Arg(0), set.Arg(1)
+	return command, nil
+}
+
+func (s *syncCommand) run(c *ftp.ServerConn) error {
+	if s.name == "mirror" {
+		return mirror(c, s.from, s.to, s.deleteExtra, s.dryRun)
+	}
+	return syncDir(c, s.from, s.to, s.deleteExtra, s.dryRun)
+}
+
+// mirror downloads the changed files of the remote directory into the local one
+func mirror(c *ftp.ServerConn, remoteRoot, localRoot string, deleteExtra, dryRun bool) error {
+	src, tolerance, err := remoteTree(c, remoteRoot)
+	if err != nil {
+		return err
+	}
+	dst, err := localTree(localRoot)
+	if err != nil {
+		return err
+	}
+	if !dryRun {
+		if err := os.MkdirAll(localRoot, 0o755); err != nil {
+			return err
+		}
+	}
+
+	return apply(plan(src, dst, tolerance, deleteExtra), dryRun, func(a action) error {
+		local := filepath.Join(localRoot, filepath.FromSlash(a.path))
+		switch a.kind {
+		case mkdirAction:
+			return os.MkdirAll(local, 0o755)
+		case copyAction:
+			if err := transfer.Download(c, local, path.Join(remoteRoot, a.path), nil); err != nil {
+				return err
+			}
+			return os.Chtimes(local, a.info.modTime, a.info.modTime)
+		default:
+			return os.RemoveAll(local)
+		}
+	})
+}
+
+// syncDir uploads the changed files of the local directory into the remote one
+func syncDir(c *ftp.ServerConn, localRoot, remoteRoot string, deleteExtra, dryRun bool) error {
+	src, err := localTree(localRoot)
+	if err != nil {
+		return err
+	}
+	if len(src) == 0 {
+		if _, err := os.Stat(localRoot); err != nil {
+			return err
+		}
+	}
+	dst, tolerance, err := remoteTree(c, remoteRoot)
+	var replyErr *textproto.Error
+	if dst == nil && errors.As(err, &replyErr) && replyErr.Code == ftp.StatusFileUnavailable {
+		// The directory does not exist yet
+		if !dryRun {
+			if err := c.MakeDir(remoteRoot); err != nil {
+				return err
+			}
+		}
+		dst, tolerance, err = tree{}, time.Second, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return apply(plan(src, dst, tolerance, deleteExtra), dryRun, func(a action) error {
+		remote := path.Join(remoteRoot, a.path)
+		switch a.kind {
+		case mkdirAction:
+			return c.MakeDir(remote)
+		case copyAction:
+			if err := transfer.Upload(c, filepath.Join(localRoot, filepath.FromSlash(a.path)), remote, nil); err != nil {
+				return err
+			}
+			if c.IsSetTimeSupported() {
+				return c.SetTime(remote, a.info.modTime)
+			}
+			return nil
+		default:
+			if dst[a.path].dir {
+				return c.RemoveDirRecur(remote)
+			}
+			return c.Delete(remote)
+		}
+	})
+}
+
+// apply prints and does the actions. A failed action does not stop the others
+func apply(actions []action, dryRun bool, do func(action) error) error {
+	failed := 0
+	for _, a := range actions {
+		var line string
+		switch a.kind {
+		case mkdirAction:
+			line = "mkdir " + a.path
+		case copyAction:
+			line = fmt.Sprintf("copy %s (%d bytes)", a.path, a.info.size)
+		case deleteAction:
+			line = "delete " + a.path
+		case conflictAction:
+			fmt.Println("skip", a.path+": a file on one side and a directory on the other")
+			continue
+		}
+		if dryRun {
+			fmt.Println("would", line)
+			continue
+		}
+		fmt.Println(line)
+		if err := do(a); err != nil {
+			fmt.Println("Error:", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d actions failed", failed, len(actions))
+	}
+	if len(actions) == 0 {
+		fmt.Println("Everything is up to date")
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"example.com/ftpClient/transfer"
+)
+
+var base = time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+
+func file(size int64, modTime time.Time) fileInfo {
+	return fileInfo{size: size, modTime: modTime}
+}
+
+var dir = fileInfo{dir: true}
+
+var planCases = []struct {
+	name        string
+	src, dst    tree
+	deleteExtra bool
+	want        []string
+}{
+	{
+		name: "empty destination",
+		src:  tree{"a": dir, "a/b.txt": file(3, base), "c.txt": file(1, base)},
+		dst:  tree{},
+		want: []string{"mkdir a", "copy a/b.txt", "copy c.txt"},
+	},
+	{
+		name: "up to date",
+		src:  tree{"a": dir, "a/b.txt": file(3, base)},
+		// Times within the tolerance are the same
+		dst:  tree{"a": dir, "a/b.txt": file(3, base.Add(-time.Second))},
+		want: nil,
+	},
+	{
+		name: "changed files",
+		src:  tree{"size": file(3, base), "newer": file(3, base.Add(time.Hour)), "older": file(3, base)},
+		dst:  tree{"size": file(4, base), "newer": file(3, base), "older": file(3, base.Add(time.Hour))},
+		want: []string{"copy newer", "copy size"},
+	},
+	{
+		name: "extra files are kept",
+		src:  tree{"a.txt": file(1, base)},
+		dst:  tree{"a.txt": file(1, base), "old": dir, "old/x": file(1, base)},
+		want: nil,
+	},
+	{
+		name:        "extra files are deleted",
+		src:         tree{"a.txt": file(1, base)},
+		dst:         tree{"a.txt": file(1, base), "old": dir, "old/x": file(1, base), "old/y": dir, "z": file(1, base)},
+		deleteExtra: true,
+		want:        []string{"delete z", "delete old/y", "delete old/x", "delete old"},
+	},
+	{
+		name:        "file and directory",
+		src:         tree{"a": file(1, base)},
+		dst:         tree{"a": dir, "a/b": file(1, base)},
+		deleteExtra: true,
+		want:        []string{"conflict a", "delete a/b"},
+	},
+}
+
+func TestPlan(t *testing.T) {
+	names := map[actionKind]string{mkdirAction: "mkdir", copyAction: "copy", deleteAction: "delete", conflictAction: "conflict"}
+	for _, tt := range planCases {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, a := range plan(tt.src, tt.dst, time.Second, tt.deleteExtra) {
+				got = append(got, names[a.kind]+" "+a.path)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalTree(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "a", "b"), 0o755)
+	os.WriteFile(filepath.Join(root, "a", "b", "c.txt"), []byte("hello"), 0o644)
+	os.WriteFile(filepath.Join(root, "d.txt"), nil, 0o644)
+	// Unfinished downloads are not part of the tree
+	os.WriteFile(filepath.Join(root, "e.txt"+transfer.PartSuffix), []byte("part"), 0o644)
+	os.Chtimes(filepath.Join(root, "d.txt"), base, base)
+
+	got, err := localTree(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 4 || !got["a"].dir || !got["a/b"].dir || got["a/b/c.txt"].size != 5 || !got["d.txt"].modTime.Equal(base) {
+		t.Errorf("got %+v", got)
+	}
+
+	if got, err := localTree(filepath.Join(root, "missing")); err != nil || len(got) != 0 {
+		t.Errorf("missing directory: got %v, %v", got, err)
+	}
+}
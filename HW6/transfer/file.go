@@ -0,0 +1,137 @@
+// Package transfer moves files between the local disk and an FTP server: streaming
+// downloads and uploads that go on after an interruption, and a queue that runs them
+// one after another with progress
+package transfer
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// PartSuffix marks unfinished transfers, they go on from where they stopped next time
+const PartSuffix = ".part"
+
+// Progress is called as the data goes. done counts from the beginning of the file, the part
+// left by an interrupted transfer included, total is -1 if unknown. An error stops the transfer
+type Progress func(done, total int64) error
+
+// counter reports the bytes that pass through it
+type counter struct {
+	done, total int64
+	progress    Progress
+}
+
+func (c *counter) Write(p []byte) (int, error) {
+	c.done += int64(len(p))
+	if c.progress != nil {
+		if err := c.progress(c.done, c.total); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Download streams the file into a ".part" file next to local and renames it at the end.
+// If the ".part" file is left from an interrupted download of the same version of the file,
+// only the rest is requested
+func Download(c *ftp.ServerConn, local, remote string, progress Progress) error {
+	total, err := c.FileSize(remote)
+	if err != nil {
+		total = -1
+	}
+	modTime, timeErr := time.Time{}, errors.New("MDTM is not supported")
+	if c.IsGetTimeSupported() {
+		modTime, timeErr = c.GetTime(remote)
+	}
+	part := local + PartSuffix
+	var offset int64
+	// The part keeps the modification time of the file it was taken from. A file that has
+	// changed since then is downloaded again
+	if info, err := os.Stat(part); err == nil && timeErr == nil && total >= 0 &&
+		info.Size() < total && info.ModTime().Equal(modTime) {
+		offset = info.Size()
+	}
+
+	reader, err := c.RetrFrom(remote, uint64(offset))
+	if err != nil && offset > 0 {
+		// The server may not support REST
+		offset = 0
+		reader, err = c.Retr(remote)
+	}
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(part, flags, 0o644)
+	if err != nil {
+		return err
+	}
+	count := &counter{done: offset, total: total, progress: progress}
+	_, err = io.Copy(file, io.TeeReader(reader, count))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	// Stamped only after the writes, which change the modification time
+	if timeErr == nil {
+		os.Chtimes(part, modTime, modTime)
+	}
+	if err != nil {
+		return err
+	}
+	if err := reader.Close(); err != nil {
+		return err
+	}
+	return os.Rename(part, local)
+}
+
+// Upload streams the file into a ".part" file on the server and renames it at the end.
+// If the ".part" file is left from an interrupted upload of the same version of the file,
+// only the rest is sent
+func Upload(c *ftp.ServerConn, local, remote string, progress Progress) error {
+	file, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	part := remote + PartSuffix
+	var offset int64
+	// As with downloads, the part keeps the modification time of the file, to a second as MDTM has it
+	if size, err := c.FileSize(part); err == nil && size < info.Size() && c.IsGetTimeSupported() {
+		if modTime, err := c.GetTime(part); err == nil && modTime.Equal(info.ModTime().Truncate(time.Second)) {
+			offset = size
+		}
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	count := &counter{done: offset, total: info.Size(), progress: progress}
+	err = c.StorFrom(part, io.TeeReader(file, count), uint64(offset))
+	if c.IsSetTimeSupported() {
+		c.SetTime(part, info.ModTime())
+	}
+	if err != nil {
+		return err
+	}
+
+	// Not every server renames over an existing file
+	if _, err := c.FileSize(remote); err == nil {
+		if err := c.Delete(remote); err != nil {
+			return err
+		}
+	}
+	return c.Rename(part, remote)
+}
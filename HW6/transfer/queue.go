@@ -0,0 +1,417 @@
+package transfer
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// Kind is what a job does
+type Kind int
+
+const (
+	DownloadJob Kind = iota
+	UploadJob
+	DeleteRemoteJob
+	DeleteLocalJob
+)
+
+func (k Kind) String() string {
+	switch k {
+	case DownloadJob:
+		return "download"
+	case UploadJob:
+		return "upload"
+	case DeleteRemoteJob:
+		return "delete remote"
+	case DeleteLocalJob:
+		return "delete local"
+	}
+	return "unknown"
+}
+
+// State is where a job is in the queue
+type State int
+
+const (
+	Queued State = iota
+	Running
+	Done
+	Failed
+	Canceled
+)
+
+func (s State) String() string {
+	switch s {
+	case Queued:
+		return "queued"
+	case Running:
+		return "running"
+	case Done:
+		return "done"
+	case Failed:
+		return "failed"
+	case Canceled:
+		return "canceled"
+	}
+	return "unknown"
+}
+
+// Finished tells if the job will not run again unless retried
+func (s State) Finished() bool {
+	return s == Done || s == Failed || s == Canceled
+}
+
+// Job is one transfer or deletion. A directory is downloaded or uploaded by adding
+// a job for each of its entries, and deleted with everything in it
+type Job struct {
+	ID     int
+	Kind   Kind
+	Local  string
+	Remote string
+	Dir    bool
+
+	State State
+	Done  int64
+	// Total is -1 if unknown
+	Total int64
+	Err   error
+}
+
+// ErrCanceled is the error of a running job stopped by Cancel
+var ErrCanceled = errors.New("transfer: canceled")
+
+// progressInterval is how often the progress of a running job is reported
+const progressInterval = 100 * time.Millisecond
+
+// Queue runs jobs one after another on its own connection, so that browsing the server
+// goes on with another one meanwhile
+type Queue struct {
+	dial     func() (*ftp.ServerConn, error)
+	onChange func(Job)
+
+	mu     sync.Mutex
+	wake   *sync.Cond
+	jobs   []*Job
+	nextID int
+	cancel map[int]bool
+	closed bool
+	done   chan struct{}
+}
+
+// NewQueue starts the worker. dial opens the connection when the first job comes and
+// again after the old one breaks. onChange is called from the worker with a copy of
+// the job whenever it changes
+func NewQueue(dial func() (*ftp.ServerConn, error), onChange func(Job)) *Queue {
+	q := &Queue{dial: dial, onChange: onChange, cancel: map[int]bool{}, done: make(chan struct{})}
+	q.wake = sync.NewCond(&q.mu)
+	go q.work()
+	return q
+}
+
+// Add puts the job at the end of the queue and returns its ID
+func (q *Queue) Add(job Job) int {
+	q.mu.Lock()
+	id := q.insert(len(q.jobs), job)
+	added := *q.jobs[len(q.jobs)-1]
+	q.mu.Unlock()
+	q.changed(added)
+	return id
+}
+
+// insert puts the job at i, q.mu is held
+func (q *Queue) insert(i int, job Job) int {
+	q.nextID++
+	job.ID = q.nextID
+	job.State = Queued
+	job.Done, job.Total, job.Err = 0, -1, nil
+	q.jobs = append(q.jobs, nil)
+	copy(q.jobs[i+1:], q.jobs[i:])
+	q.jobs[i] = &job
+	q.wake.Signal()
+	return job.ID
+}
+
+// Jobs returns copies of all jobs in the order they run
+func (q *Queue) Jobs() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := make([]Job, len(q.jobs))
+	for i, job := range q.jobs {
+		jobs[i] = *job
+	}
+	return jobs
+}
+
+// Cancel stops the job if it runs or takes it off the queue if it waits. An interrupted
+// transfer goes on from where it stopped when retried
+func (q *Queue) Cancel(id int) {
+	q.mu.Lock()
+	job := q.find(id)
+	if job == nil || job.State.Finished() {
+		q.mu.Unlock()
+		return
+	}
+	if job.State == Running {
+		q.cancel[id] = true
+		q.mu.Unlock()
+		return
+	}
+	job.State = Canceled
+	canceled := *job
+	q.mu.Unlock()
+	q.changed(canceled)
+}
+
+// Retry queues a failed or canceled job again
+func (q *Queue) Retry(id int) {
+	q.mu.Lock()
+	job := q.find(id)
+	if job == nil || (job.State != Failed && job.State != Canceled) {
+		q.mu.Unlock()
+		return
+	}
+	job.State, job.Err = Queued, nil
+	retried := *job
+	q.wake.Signal()
+	q.mu.Unlock()
+	q.changed(retried)
+}
+
+// ClearFinished forgets the jobs that are done, failed or canceled
+func (q *Queue) ClearFinished() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := q.jobs[:0]
+	for _, job := range q.jobs {
+		if !job.State.Finished() {
+			jobs = append(jobs, job)
+		}
+	}
+	q.jobs = jobs
+}
+
+// Close cancels the running job, stops the worker and closes its connection
+func (q *Queue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	for _, job := range q.jobs {
+		if job.State == Running {
+			q.cancel[job.ID] = true
+		}
+	}
+	q.wake.Signal()
+	q.mu.Unlock()
+	<-q.done
+}
+
+func (q *Queue) find(id int) *Job {
+	for _, job := range q.jobs {
+		if job.ID == id {
+			return job
+		}
+	}
+	return nil
+}
+
+func (q *Queue) changed(job Job) {
+	if q.onChange != nil {
+		q.onChange(job)
+	}
+}
+
+// next waits for a queued job and marks it running, nil means the queue is closed
+func (q *Queue) next() *Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		if q.closed {
+			return nil
+		}
+		for _, job := range q.jobs {
+			if job.State == Queued {
+				job.State = Running
+				return job
+			}
+		}
+		q.wake.Wait()
+	}
+}
+
+func (q *Queue) work() {
+	defer close(q.done)
+	var c *ftp.ServerConn
+	defer func() {
+		if c != nil {
+			c.Quit()
+		}
+	}()
+
+	for {
+		job := q.next()
+		if job == nil {
+			return
+		}
+		q.mu.Lock()
+		started := *job
+		q.mu.Unlock()
+		q.changed(started)
+
+		var err error
+		if job.Kind != DeleteLocalJob && c == nil {
+			c, err = q.dial()
+		}
+		if err == nil {
+			err = q.run(c, job)
+		}
+		// The connection may be broken by the error, a new one is dialed for the next job
+		if err != nil && c != nil && c.NoOp() != nil {
+			c.Quit()
+			c = nil
+		}
+
+		q.mu.Lock()
+		switch {
+		case q.cancel[job.ID]:
+			job.State, job.Err = Canceled, ErrCanceled
+		case err != nil:
+			job.State, job.Err = Failed, err
+		default:
+			job.State = Done
+		}
+		delete(q.cancel, job.ID)
+		finished := *job
+		q.mu.Unlock()
+		q.changed(finished)
+	}
+}
+
+// run does the job, c is nil for local deletions
+func (q *Queue) run(c *ftp.ServerConn, job *Job) error {
+	switch job.Kind {
+	case DownloadJob:
+		if job.Dir {
+			return q.downloadDir(c, job)
+		}
+		return Download(c, job.Local, job.Remote, q.progress(job))
+	case UploadJob:
+		if job.Dir {
+			return q.uploadDir(c, job)
+		}
+		return Upload(c, job.Local, job.Remote, q.progress(job))
+	case DeleteRemoteJob:
+		if job.Dir {
+			return c.RemoveDirRecur(job.Remote)
+		}
+		return c.Delete(job.Remote)
+	case DeleteLocalJob:
+		if job.Dir {
+			return os.RemoveAll(job.Local)
+		}
+		return os.Remove(job.Local)
+	}
+	return errors.New("transfer: unknown job kind")
+}
+
+// progress updates the job as the data goes, at most every progressInterval,
+// and stops it once canceled
+func (q *Queue) progress(job *Job) Progress {
+	var last time.Time
+	return func(done, total int64) error {
+		q.mu.Lock()
+		job.Done, job.Total = done, total
+		canceled := q.cancel[job.ID]
+		report := *job
+		q.mu.Unlock()
+		if canceled {
+			return ErrCanceled
+		}
+		if now := time.Now(); now.Sub(last) >= progressInterval || done == total {
+			last = now
+			q.changed(report)
+		}
+		return nil
+	}
+}
+
+// downloadDir creates the local directory and queues its entries right after it
+func (q *Queue) downloadDir(c *ftp.ServerConn, job *Job) error {
+	if err := os.MkdirAll(job.Local, 0o755); err != nil {
+		return err
+	}
+	entries, err := c.List(job.Remote)
+	if err != nil {
+		return err
+	}
+	var children []Job
+	for _, entry := range entries {
+		if entry.Name == "." || entry.Name == ".." || entry.Type == ftp.EntryTypeLink {
+			continue
+		}
+		children = append(children, Job{
+			Kind:   DownloadJob,
+			Local:  filepath.Join(job.Local, entry.Name),
+			Remote: path.Join(job.Remote, entry.Name),
+			Dir:    entry.Type == ftp.EntryTypeFolder,
+		})
+	}
+	return q.addAfter(job, children)
+}
+
+// uploadDir creates the remote directory and queues its entries right after it
+func (q *Queue) uploadDir(c *ftp.ServerConn, job *Job) error {
+	entries, err := os.ReadDir(job.Local)
+	if err != nil {
+		return err
+	}
+	if err := c.MakeDir(job.Remote); err != nil {
+		// It may be there already
+		if _, listErr := c.List(job.Remote); listErr != nil {
+			return err
+		}
+	}
+	var children []Job
+	for _, entry := range entries {
+		if !entry.IsDir() && !entry.Type().IsRegular() {
+			continue
+		}
+		children = append(children, Job{
+			Kind:   UploadJob,
+			Local:  filepath.Join(job.Local, entry.Name()),
+			Remote: path.Join(job.Remote, entry.Name()),
+			Dir:    entry.IsDir(),
+		})
+	}
+	return q.addAfter(job, children)
+}
+
+// addAfter queues the entries of a directory right after it, unless the directory job is canceled
+func (q *Queue) addAfter(parent *Job, children []Job) error {
+	q.mu.Lock()
+	if q.cancel[parent.ID] {
+		q.mu.Unlock()
+		return ErrCanceled
+	}
+	i := len(q.jobs)
+	for j, job := range q.jobs {
+		if job == parent {
+			i = j + 1
+		}
+	}
+	var added []Job
+	for _, child := range children {
+		q.insert(i, child)
+		added = append(added, *q.jobs[i])
+		i++
+	}
+	q.mu.Unlock()
+	for _, job := range added {
+		q.changed(job)
+	}
+	return nil
+}
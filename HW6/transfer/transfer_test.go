@@ -0,0 +1,406 @@
+package transfer
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/ftpClient/ftpserver"
+	"example.com/ftpClient/profile"
+	"github.com/jlaffaye/ftp"
+)
+
+// startServer starts a local server on a temporary root and returns the way to log in to it
+func startServer(t *testing.T) (func() (*ftp.ServerConn, error), string) {
+	t.Helper()
+	s := &ftpserver.Server{Root: t.TempDir(), Users: map[string]string{"San": "123"}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ln) }()
+	t.Cleanup(func() {
+		s.Close()
+		if err := <-done; !errors.Is(err, ftpserver.ErrServerClosed) {
+			t.Errorf("Serve: got %v, want ErrServerClosed", err)
+		}
+	})
+
+	p := profile.Profile{Addr: ln.Addr().String(), User: "San"}
+	return func() (*ftp.ServerConn, error) { return p.Dial("123", 5*time.Second) }, s.Root
+}
+
+func connect(t *testing.T) (*ftp.ServerConn, string) {
+	t.Helper()
+	dial, root := startServer(t)
+	c, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cleanups run last first, so the connection is closed before the server
+	t.Cleanup(func() { c.Quit() })
+	return c, root
+}
+
+func writeFile(t *testing.T, name, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkFile(t *testing.T, name, want string) {
+	t.Helper()
+	got, err := os.ReadFile(name)
+	if err != nil || string(got) != want {
+		t.Errorf("%s: got %q (%v), want %q", name, got, err, want)
+	}
+}
+
+func TestUploadAndDownload(t *testing.T) {
+	c, root := connect(t)
+	local := t.TempDir()
+	writeFile(t, filepath.Join(local, "a.txt"), "hello world")
+
+	if err := Upload(c, filepath.Join(local, "a.txt"), "/a.txt", nil); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(root, "a.txt"), "hello world")
+	if _, err := os.Stat(filepath.Join(root, "a.txt"+PartSuffix)); !os.IsNotExist(err) {
+		t.Errorf("the part file is left: %v", err)
+	}
+
+	// An existing file is replaced
+	writeFile(t, filepath.Join(local, "a.txt"), "bye")
+	if err := Upload(c, filepath.Join(local, "a.txt"), "/a.txt", nil); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(root, "a.txt"), "bye")
+
+	if err := Download(c, filepath.Join(local, "b.txt"), "/a.txt", nil); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(local, "b.txt"), "bye")
+
+	if err := Download(c, filepath.Join(local, "c.txt"), "/missing", nil); err == nil {
+		t.Error("downloaded a missing file")
+	}
+	if err := Upload(c, filepath.Join(local, "missing"), "/missing", nil); err == nil {
+		t.Error("uploaded a missing file")
+	}
+}
+
+func TestResume(t *testing.T) {
+	c, root := connect(t)
+	local := t.TempDir()
+	modTime := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	writeStamped := func(name, data string) {
+		writeFile(t, name, data)
+		os.Chtimes(name, modTime, modTime)
+	}
+
+	// The part files are left from interrupted transfers of the same files, only the rest is sent.
+	// Their beginnings differ from the sources to show that they are kept
+	writeStamped(filepath.Join(root, "a.txt"), "hello world")
+	writeStamped(filepath.Join(local, "a.txt"+PartSuffix), "HELLO")
+	if err := Download(c, filepath.Join(local, "a.txt"), "/a.txt", nil); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(local, "a.txt"), "HELLO world")
+
+	writeStamped(filepath.Join(local, "b.txt"), "hello world")
+	writeStamped(filepath.Join(root, "b.txt"+PartSuffix), "HELLO")
+	if err := Upload(c, filepath.Join(local, "b.txt"), "/b.txt", nil); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(root, "b.txt"), "HELLO world")
+
+	// A part file that is not shorter than the source or has another modification time
+	// is from another version of it
+	writeStamped(filepath.Join(local, "a.txt"+PartSuffix), "something longer")
+	if err := Download(c, filepath.Join(local, "a.txt"), "/a.txt", nil); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(local, "a.txt"), "hello world")
+
+	writeFile(t, filepath.Join(local, "a.txt"+PartSuffix), "HELLO")
+	if err := Download(c, filepath.Join(local, "a.txt"), "/a.txt", nil); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(local, "a.txt"), "hello world")
+
+	writeFile(t, filepath.Join(root, "b.txt"+PartSuffix), "HELLO")
+	if err := Upload(c, filepath.Join(local, "b.txt"), "/b.txt", nil); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(root, "b.txt"), "hello world")
+}
+
+func TestResumeStopped(t *testing.T) {
+	c, root := connect(t)
+	local := t.TempDir()
+	data := strings.Repeat("hello world\n", 10000)
+	writeFile(t, filepath.Join(root, "a.txt"), data)
+	writeFile(t, filepath.Join(local, "b.txt"), data)
+	modTime := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(filepath.Join(local, "b.txt"), modTime, modTime)
+
+	// The transfers stop after the first bytes and go on from there next time
+	stop := errors.New("stop")
+	progress := func(done, total int64) error {
+		if done > 0 && done < total/2 {
+			return nil
+		}
+		return stop
+	}
+	if err := Download(c, filepath.Join(local, "a.txt"), "/a.txt", progress); !errors.Is(err, stop) {
+		t.Fatalf("stopped download: got %v, want %v", err, stop)
+	}
+	if err := Upload(c, filepath.Join(local, "b.txt"), "/b.txt", progress); !errors.Is(err, stop) {
+		t.Fatalf("stopped upload: got %v, want %v", err, stop)
+	}
+
+	for _, transfer := range []struct {
+		name string
+		do   func(progress Progress) error
+		part string
+	}{
+		{"download", func(p Progress) error { return Download(c, filepath.Join(local, "a.txt"), "/a.txt", p) },
+			filepath.Join(local, "a.txt"+PartSuffix)},
+		{"upload", func(p Progress) error { return Upload(c, filepath.Join(local, "b.txt"), "/b.txt", p) },
+			filepath.Join(root, "b.txt"+PartSuffix)},
+	} {
+		info, err := os.Stat(transfer.part)
+		if err != nil {
+			t.Fatalf("%s: %v", transfer.name, err)
+		}
+		var first int64 = -1
+		err = transfer.do(func(done, total int64) error {
+			if first < 0 {
+				first = done
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", transfer.name, err)
+		}
+		if info.Size() == 0 || first <= info.Size() {
+			t.Errorf("%s: started from %d, want after the part of %d bytes", transfer.name, first, info.Size())
+		}
+	}
+	checkFile(t, filepath.Join(local, "a.txt"), data)
+	checkFile(t, filepath.Join(root, "b.txt"), data)
+}
+
+func TestProgress(t *testing.T) {
+	c, root := connect(t)
+	local := t.TempDir()
+	writeFile(t, filepath.Join(root, "a.txt"), "hello world")
+
+	var last, total int64
+	progress := func(done, size int64) error {
+		if done < last {
+			t.Errorf("progress went back from %d to %d", last, done)
+		}
+		last, total = done, size
+		return nil
+	}
+	if err := Download(c, filepath.Join(local, "a.txt"), "/a.txt", progress); err != nil {
+		t.Fatal(err)
+	}
+	if last != 11 || total != 11 {
+		t.Errorf("download: got %d of %d, want 11 of 11", last, total)
+	}
+
+	last = 0
+	if err := Upload(c, filepath.Join(local, "a.txt"), "/b.txt", progress); err != nil {
+		t.Fatal(err)
+	}
+	if last != 11 || total != 11 {
+		t.Errorf("upload: got %d of %d, want 11 of 11", last, total)
+	}
+
+	// An error from the progress stops the transfer and leaves the part file
+	stop := errors.New("stop")
+	err := Download(c, filepath.Join(local, "c.txt"), "/a.txt", func(done, total int64) error { return stop })
+	if !errors.Is(err, stop) {
+		t.Errorf("stopped download: got %v, want %v", err, stop)
+	}
+	if _, err := os.Stat(filepath.Join(local, "c.txt")); !os.IsNotExist(err) {
+		t.Errorf("stopped download is renamed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(local, "c.txt"+PartSuffix)); err != nil {
+		t.Errorf("stopped download left no part file: %v", err)
+	}
+	if err := c.NoOp(); err != nil {
+		t.Errorf("connection after the stopped download: %v", err)
+	}
+}
+
+// recorder passes the jobs the queue has finished
+type recorder struct {
+	finished chan Job
+}
+
+func newRecorder() *recorder {
+	return &recorder{finished: make(chan Job, 100)}
+}
+
+func (r *recorder) onChange(job Job) {
+	if job.State.Finished() {
+		r.finished <- job
+	}
+}
+
+func (r *recorder) wait(t *testing.T) Job {
+	t.Helper()
+	select {
+	case job := <-r.finished:
+		return job
+	case <-time.After(5 * time.Second):
+		t.Fatal("no job finished")
+	}
+	return Job{}
+}
+
+func TestQueue(t *testing.T) {
+	dial, root := startServer(t)
+	local := t.TempDir()
+	writeFile(t, filepath.Join(local, "up", "a.txt"), "a")
+	writeFile(t, filepath.Join(local, "up", "sub", "b.txt"), "b")
+	writeFile(t, filepath.Join(root, "down", "c.txt"), "c")
+	writeFile(t, filepath.Join(root, "gone", "d.txt"), "d")
+	writeFile(t, filepath.Join(local, "gone.txt"), "e")
+
+	r := newRecorder()
+	q := NewQueue(dial, r.onChange)
+	defer q.Close()
+
+	jobs := []Job{
+		{Kind: UploadJob, Local: filepath.Join(local, "up"), Remote: "/up", Dir: true},
+		{Kind: DownloadJob, Local: filepath.Join(local, "down"), Remote: "/down", Dir: true},
+		{Kind: DeleteRemoteJob, Remote: "/gone", Dir: true},
+		{Kind: DeleteLocalJob, Local: filepath.Join(local, "gone.txt")},
+		{Kind: DownloadJob, Local: filepath.Join(local, "missing"), Remote: "/missing"},
+	}
+	for _, job := range jobs {
+		q.Add(job)
+	}
+	// The directories add a job for each of their entries
+	for i := 0; i < len(jobs)+4; i++ {
+		r.wait(t)
+	}
+
+	checkFile(t, filepath.Join(root, "up", "a.txt"), "a")
+	checkFile(t, filepath.Join(root, "up", "sub", "b.txt"), "b")
+	checkFile(t, filepath.Join(local, "down", "c.txt"), "c")
+	if _, err := os.Stat(filepath.Join(root, "gone")); !os.IsNotExist(err) {
+		t.Errorf("remote directory is not deleted: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(local, "gone.txt")); !os.IsNotExist(err) {
+		t.Errorf("local file is not deleted: %v", err)
+	}
+
+	var failed []Job
+	for _, job := range q.Jobs() {
+		if job.State == Failed {
+			failed = append(failed, job)
+		} else if job.State != Done {
+			t.Errorf("%s %s: got %v, want done", job.Kind, job.Remote, job.State)
+		}
+	}
+	if len(failed) != 1 || failed[0].Remote != "/missing" || failed[0].Err == nil {
+		t.Fatalf("failed jobs: got %+v, want the missing file", failed)
+	}
+
+	// The failed job goes on once the file is there
+	writeFile(t, filepath.Join(root, "missing"), "found")
+	q.Retry(failed[0].ID)
+	if job := r.wait(t); job.State != Done {
+		t.Errorf("retried job: got %v (%v), want done", job.State, job.Err)
+	}
+	checkFile(t, filepath.Join(local, "missing"), "found")
+
+	q.ClearFinished()
+	if jobs := q.Jobs(); len(jobs) != 0 {
+		t.Errorf("cleared queue: got %+v", jobs)
+	}
+}
+
+func TestQueueCancel(t *testing.T) {
+	dial, root := startServer(t)
+	local := t.TempDir()
+	writeFile(t, filepath.Join(root, "a.txt"), "hello world")
+
+	// The first job waits until the second one is canceled
+	block := make(chan struct{})
+	r := newRecorder()
+	q := NewQueue(func() (*ftp.ServerConn, error) {
+		<-block
+		return dial()
+	}, r.onChange)
+	defer q.Close()
+
+	first := q.Add(Job{Kind: DownloadJob, Local: filepath.Join(local, "a.txt"), Remote: "/a.txt"})
+	second := q.Add(Job{Kind: DownloadJob, Local: filepath.Join(local, "b.txt"), Remote: "/a.txt"})
+	q.Cancel(second)
+	close(block)
+	if job := r.wait(t); job.ID != second || job.State != Canceled {
+		t.Errorf("got job %d %v, want %d canceled", job.ID, job.State, second)
+	}
+	if job := r.wait(t); job.ID != first || job.State != Done {
+		t.Errorf("got job %d %v (%v), want %d done", job.ID, job.State, job.Err, first)
+	}
+	if _, err := os.Stat(filepath.Join(local, "b.txt")); !os.IsNotExist(err) {
+		t.Errorf("canceled job has run: %v", err)
+	}
+
+	q.Retry(second)
+	if job := r.wait(t); job.ID != second || job.State != Done {
+		t.Errorf("got job %d %v (%v), want %d done", job.ID, job.State, job.Err, second)
+	}
+	checkFile(t, filepath.Join(local, "b.txt"), "hello world")
+
+	// A directory canceled while it runs queues none of its entries
+	writeFile(t, filepath.Join(root, "dir", "c.txt"), "c")
+	block = make(chan struct{})
+	q = NewQueue(func() (*ftp.ServerConn, error) {
+		<-block
+		return dial()
+	}, r.onChange)
+	defer q.Close()
+	dir := q.Add(Job{Kind: DownloadJob, Local: filepath.Join(local, "dir"), Remote: "/dir", Dir: true})
+	waitRunning(t, q, dir)
+	q.Cancel(dir)
+	close(block)
+	if job := r.wait(t); job.ID != dir || job.State != Canceled {
+		t.Errorf("got job %d %v (%v), want %d canceled", job.ID, job.State, job.Err, dir)
+	}
+	if jobs := q.Jobs(); len(jobs) != 1 {
+		t.Errorf("canceled directory queued its entries: %+v", jobs)
+	}
+	if _, err := os.Stat(filepath.Join(local, "dir", "c.txt")); !os.IsNotExist(err) {
+		t.Errorf("entry of the canceled directory is downloaded: %v", err)
+	}
+}
+
+func waitRunning(t *testing.T, q *Queue, id int) {
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		for _, job := range q.Jobs() {
+			if job.ID == id && job.State == Running {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %d is not running", id)
+}